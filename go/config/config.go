@@ -16,12 +16,37 @@ package config
 
 import (
 	"fmt"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
 	"github.com/hashicorp/go-multierror"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ElasticsearchConfig struct {
 	Refresh                 RefreshOption
 	URL, Username, Password string
+	Layout                  LayoutOption
+	Indices                 IndicesConfig
+	DynamicMapping          DynamicMappingOption `json:"dynamic_mapping"`
+	// DisableAutoMigration skips migrating outdated indices when Grafeas starts, so that migrations can be run separately
+	DisableAutoMigration bool `json:"disable_auto_migration"`
+	// ValidateNoteReferences rejects occurrences that reference a note that doesn't exist, or a note of a different kind
+	ValidateNoteReferences bool `json:"validate_note_references"`
+	// VerifyIndices checks that the indices for every project exist when Grafeas starts
+	VerifyIndices VerifyIndicesOption `json:"verify_indices"`
+	// DeduplicateOccurrences names occurrences after a fingerprint of their resource, note, kind, and key details, so that
+	// an occurrence that's reported again updates the existing occurrence instead of creating a duplicate
+	DeduplicateOccurrences bool `json:"deduplicate_occurrences"`
+	// RevisionHistory records every write to a note or occurrence as a revision, which can be listed and fetched later
+	RevisionHistory bool `json:"revision_history"`
+	Rollover        RolloverConfig
+	Retention       RetentionConfig
+	Bulk            BulkConfig
+	SoftDelete      SoftDeleteConfig `json:"soft_delete"`
+	Audit           AuditConfig
+	Import          ImportConfig
 }
 
 func (c ElasticsearchConfig) IsValid() (e error) {
@@ -32,9 +57,385 @@ func (c ElasticsearchConfig) IsValid() (e error) {
 		e = multierror.Append(e, fmt.Errorf("invalid refresh value: %s", c.Refresh))
 	}
 
+	switch c.Layout {
+	case "", LayoutPerProject, LayoutShared:
+		break
+	default:
+		e = multierror.Append(e, fmt.Errorf("invalid layout value: %s", c.Layout))
+	}
+
+	switch c.VerifyIndices {
+	case "", VerifyIndicesFalse, VerifyIndicesTrue, VerifyIndicesRepair:
+		break
+	default:
+		e = multierror.Append(e, fmt.Errorf("invalid verify_indices value: %s", c.VerifyIndices))
+	}
+
+	switch c.DynamicMapping {
+	case "", DynamicMappingTrue, DynamicMappingFalse, DynamicMappingStrict:
+		break
+	default:
+		e = multierror.Append(e, fmt.Errorf("invalid dynamic_mapping value: %s", c.DynamicMapping))
+	}
+
+	if err := c.Indices.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.Rollover.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.Retention.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.Bulk.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.SoftDelete.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.Audit.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	if err := c.Import.IsValid(); err != nil {
+		e = multierror.Append(e, err)
+	}
+
+	return
+}
+
+// IndicesConfig holds the index settings used for each type of index created by the storage backend
+type IndicesConfig struct {
+	Projects    IndexSettings
+	Notes       IndexSettings
+	Occurrences IndexSettings
+	Revisions   IndexSettings
+	Audit       IndexSettings
+}
+
+func (c IndicesConfig) IsValid() (e error) {
+	for name, s := range map[string]IndexSettings{
+		"projects":    c.Projects,
+		"notes":       c.Notes,
+		"occurrences": c.Occurrences,
+		"revisions":   c.Revisions,
+		"audit":       c.Audit,
+	} {
+		if err := s.IsValid(); err != nil {
+			e = multierror.Append(e, fmt.Errorf("invalid %s index settings: %s", name, err))
+		}
+	}
+
+	return
+}
+
+// IndexSettings are applied to indices when they are created. Any values that are left unset will use the cluster defaults.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/index-modules.html#index-modules-settings
+type IndexSettings struct {
+	NumberOfShards   int    `json:"number_of_shards"`
+	NumberOfReplicas *int   `json:"number_of_replicas"`
+	RefreshInterval  string `json:"refresh_interval"`
+	Codec            string `json:"codec"`
+}
+
+var timeUnitPattern = regexp.MustCompile(`^\d+(d|h|m|s|ms|micros|nanos)$`)
+
+func (s IndexSettings) IsValid() (e error) {
+	if s.NumberOfShards < 0 {
+		e = multierror.Append(e, fmt.Errorf("invalid number_of_shards value: %d", s.NumberOfShards))
+	}
+
+	if s.NumberOfReplicas != nil && *s.NumberOfReplicas < 0 {
+		e = multierror.Append(e, fmt.Errorf("invalid number_of_replicas value: %d", *s.NumberOfReplicas))
+	}
+
+	if s.RefreshInterval != "" && s.RefreshInterval != "-1" && !timeUnitPattern.MatchString(s.RefreshInterval) {
+		e = multierror.Append(e, fmt.Errorf("invalid refresh_interval value: %s", s.RefreshInterval))
+	}
+
+	switch s.Codec {
+	case "", CodecDefault, CodecBestCompression:
+		break
+	default:
+		e = multierror.Append(e, fmt.Errorf("invalid codec value: %s", s.Codec))
+	}
+
 	return
 }
 
+// RolloverConfig enables rolling over the occurrences indices, so that new occurrences are written to a new index
+// once any of the conditions are met. Occurrences in the previous indices can still be read.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-rollover-index.html#rollover-index-api-request-body
+type RolloverConfig struct {
+	Enabled bool
+	MaxAge  string `json:"max_age"`
+	MaxSize string `json:"max_size"`
+	MaxDocs int    `json:"max_docs"`
+	// CheckInterval is how often the conditions are checked, as a Go duration. Defaults to DefaultRolloverCheckInterval.
+	CheckInterval string `json:"check_interval"`
+}
+
+const DefaultRolloverCheckInterval = 5 * time.Minute
+
+var byteSizePattern = regexp.MustCompile(`^\d+(b|kb|mb|gb|tb|pb)$`)
+
+func (r RolloverConfig) IsValid() (e error) {
+	if !r.Enabled {
+		return
+	}
+
+	if r.MaxAge == "" && r.MaxSize == "" && r.MaxDocs == 0 {
+		e = multierror.Append(e, fmt.Errorf("rollover requires at least one of max_age, max_size, or max_docs"))
+	}
+
+	if r.MaxAge != "" && !timeUnitPattern.MatchString(r.MaxAge) {
+		e = multierror.Append(e, fmt.Errorf("invalid rollover max_age value: %s", r.MaxAge))
+	}
+
+	if r.MaxSize != "" && !byteSizePattern.MatchString(r.MaxSize) {
+		e = multierror.Append(e, fmt.Errorf("invalid rollover max_size value: %s", r.MaxSize))
+	}
+
+	if r.MaxDocs < 0 {
+		e = multierror.Append(e, fmt.Errorf("invalid rollover max_docs value: %d", r.MaxDocs))
+	}
+
+	if r.CheckInterval != "" {
+		if d, err := time.ParseDuration(r.CheckInterval); err != nil || d <= 0 {
+			e = multierror.Append(e, fmt.Errorf("invalid rollover check_interval value: %s", r.CheckInterval))
+		}
+	}
+
+	return
+}
+
+// Interval returns the configured check interval, or the default when it isn't set
+func (r RolloverConfig) Interval() time.Duration {
+	d, err := time.ParseDuration(r.CheckInterval)
+	if err != nil || d <= 0 {
+		return DefaultRolloverCheckInterval
+	}
+
+	return d
+}
+
+// RetentionConfig defines how long occurrences are kept for each kind of occurrence, e.g. DISCOVERY or VULNERABILITY.
+// Occurrences with a createTime older than the retention period are periodically deleted. Kinds without a retention
+// period are kept forever.
+type RetentionConfig struct {
+	// Occurrences maps an occurrence kind to its retention period, using Elasticsearch time units, e.g. 30d.
+	// Kinds are case-insensitive, as configuration keys are lowercased when the configuration is loaded.
+	Occurrences map[string]string
+	// DryRun counts the occurrences that would be deleted without deleting them
+	DryRun bool `json:"dry_run"`
+	// CheckInterval is how often expired occurrences are deleted, as a Go duration. Defaults to DefaultRetentionCheckInterval.
+	CheckInterval string `json:"check_interval"`
+}
+
+const DefaultRetentionCheckInterval = time.Hour
+
+var retentionPeriodPattern = regexp.MustCompile(`^\d+(d|h|m|s)$`)
+
+func (r RetentionConfig) IsValid() (e error) {
+	for kind, period := range r.Occurrences {
+		if _, ok := common_go_proto.NoteKind_value[strings.ToUpper(kind)]; !ok {
+			e = multierror.Append(e, fmt.Errorf("invalid retention occurrence kind: %s", kind))
+		}
+
+		if !retentionPeriodPattern.MatchString(period) {
+			e = multierror.Append(e, fmt.Errorf("invalid retention period for %s: %s", kind, period))
+		}
+	}
+
+	if r.CheckInterval != "" {
+		if d, err := time.ParseDuration(r.CheckInterval); err != nil || d <= 0 {
+			e = multierror.Append(e, fmt.Errorf("invalid retention check_interval value: %s", r.CheckInterval))
+		}
+	}
+
+	return
+}
+
+// Enabled returns true when a retention period is configured for any kind of occurrence
+func (r RetentionConfig) Enabled() bool {
+	return len(r.Occurrences) != 0
+}
+
+// Interval returns the configured check interval, or the default when it isn't set
+func (r RetentionConfig) Interval() time.Duration {
+	d, err := time.ParseDuration(r.CheckInterval)
+	if err != nil || d <= 0 {
+		return DefaultRetentionCheckInterval
+	}
+
+	return d
+}
+
+// SoftDeleteConfig keeps deleted notes and occurrences as tombstones, which are hidden from reads but can be restored
+// until they are purged once the grace period has passed.
+type SoftDeleteConfig struct {
+	Enabled bool
+	// GracePeriod is how long tombstones can be restored for, e.g. 7d. Defaults to DefaultSoftDeleteGracePeriod.
+	GracePeriod string `json:"grace_period"`
+	// CheckInterval is how often expired tombstones are purged, as a Go duration. Defaults to DefaultSoftDeleteCheckInterval.
+	CheckInterval string `json:"check_interval"`
+}
+
+const (
+	DefaultSoftDeleteGracePeriod   = 7 * 24 * time.Hour
+	DefaultSoftDeleteCheckInterval = time.Hour
+)
+
+func (s SoftDeleteConfig) IsValid() (e error) {
+	if s.GracePeriod != "" && !retentionPeriodPattern.MatchString(s.GracePeriod) {
+		e = multierror.Append(e, fmt.Errorf("invalid soft_delete grace_period value: %s", s.GracePeriod))
+	}
+
+	if s.CheckInterval != "" {
+		if d, err := time.ParseDuration(s.CheckInterval); err != nil || d <= 0 {
+			e = multierror.Append(e, fmt.Errorf("invalid soft_delete check_interval value: %s", s.CheckInterval))
+		}
+	}
+
+	return
+}
+
+// Period returns the configured grace period, or the default when it isn't set
+func (s SoftDeleteConfig) Period() time.Duration {
+	match := retentionPeriodPattern.FindStringSubmatch(s.GracePeriod)
+	if match == nil {
+		return DefaultSoftDeleteGracePeriod
+	}
+
+	// days aren't supported by time.ParseDuration
+	if match[1] == "d" {
+		days, _ := strconv.Atoi(strings.TrimSuffix(s.GracePeriod, "d"))
+		return time.Duration(days) * 24 * time.Hour
+	}
+
+	d, _ := time.ParseDuration(s.GracePeriod)
+	return d
+}
+
+// Interval returns the configured check interval, or the default when it isn't set
+func (s SoftDeleteConfig) Interval() time.Duration {
+	d, err := time.ParseDuration(s.CheckInterval)
+	if err != nil || d <= 0 {
+		return DefaultSoftDeleteCheckInterval
+	}
+
+	return d
+}
+
+// AuditConfig records an audit event for every write to a project, note, or occurrence. Events older than the retention
+// period are periodically deleted, and are kept forever when no retention period is set.
+type AuditConfig struct {
+	Enabled bool
+	// Retention is how long audit events are kept, using Elasticsearch time units, e.g. 365d
+	Retention string
+	// CheckInterval is how often expired audit events are deleted, as a Go duration. Defaults to DefaultAuditCheckInterval.
+	CheckInterval string `json:"check_interval"`
+	// UserHeader is the gRPC metadata key that identifies the user for writes that Grafeas doesn't pass a user ID to,
+	// such as updates and deletes
+	UserHeader string `json:"user_header"`
+}
+
+const DefaultAuditCheckInterval = time.Hour
+
+func (a AuditConfig) IsValid() (e error) {
+	if a.Retention != "" && !retentionPeriodPattern.MatchString(a.Retention) {
+		e = multierror.Append(e, fmt.Errorf("invalid audit retention value: %s", a.Retention))
+	}
+
+	if a.CheckInterval != "" {
+		if d, err := time.ParseDuration(a.CheckInterval); err != nil || d <= 0 {
+			e = multierror.Append(e, fmt.Errorf("invalid audit check_interval value: %s", a.CheckInterval))
+		}
+	}
+
+	return
+}
+
+// Interval returns the configured check interval, or the default when it isn't set
+func (a AuditConfig) Interval() time.Duration {
+	d, err := time.ParseDuration(a.CheckInterval)
+	if err != nil || d <= 0 {
+		return DefaultAuditCheckInterval
+	}
+
+	return d
+}
+
+// ImportConfig configures the import-vulnerabilities command, which writes the vulnerabilities in OSV and NVD feeds as notes
+type ImportConfig struct {
+	// ProviderProject is the project that imported notes are written to, unless another project is given to the command
+	ProviderProject string `json:"provider_project"`
+}
+
+func (i ImportConfig) IsValid() (e error) {
+	if strings.Contains(i.ProviderProject, "/") {
+		e = multierror.Append(e, fmt.Errorf("invalid import provider_project value: %s", i.ProviderProject))
+	}
+
+	return
+}
+
+// BulkConfig controls how batches of notes and occurrences are written with the bulk API. Large batches are split into
+// chunks by number of documents and size, so that requests stay below the maximum request size of the cluster.
+// Any values that are left unset will use the defaults.
+type BulkConfig struct {
+	MaxDocs     int `json:"max_docs"`
+	MaxBytes    int `json:"max_bytes"`
+	Concurrency int
+	// MaxRetries is how many times documents that were rejected because the cluster is overloaded are retried
+	MaxRetries int `json:"max_retries"`
+}
+
+const (
+	DefaultBulkMaxDocs     = 1000
+	DefaultBulkMaxBytes    = 5 * 1024 * 1024
+	DefaultBulkConcurrency = 4
+	DefaultBulkMaxRetries  = 3
+)
+
+func (b BulkConfig) IsValid() (e error) {
+	for name, value := range map[string]int{
+		"max_docs":    b.MaxDocs,
+		"max_bytes":   b.MaxBytes,
+		"concurrency": b.Concurrency,
+		"max_retries": b.MaxRetries,
+	} {
+		if value < 0 {
+			e = multierror.Append(e, fmt.Errorf("invalid bulk %s value: %d", name, value))
+		}
+	}
+
+	return
+}
+
+// WithDefaults returns a copy of the bulk configuration where every value that isn't set uses the default
+func (b BulkConfig) WithDefaults() BulkConfig {
+	if b.MaxDocs == 0 {
+		b.MaxDocs = DefaultBulkMaxDocs
+	}
+	if b.MaxBytes == 0 {
+		b.MaxBytes = DefaultBulkMaxBytes
+	}
+	if b.Concurrency == 0 {
+		b.Concurrency = DefaultBulkConcurrency
+	}
+	if b.MaxRetries == 0 {
+		b.MaxRetries = DefaultBulkMaxRetries
+	}
+
+	return b
+}
+
 // RefreshOption is based on https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-refresh.html
 type RefreshOption string
 
@@ -47,3 +448,51 @@ const (
 	RefreshWaitFor = "wait_for"
 	RefreshFalse   = "false"
 )
+
+// LayoutOption determines how notes and occurrences are distributed across indices.
+// The per-project layout creates a notes and an occurrences index for every project, while the shared layout stores
+// the notes and occurrences for all projects in two indices, using a project field for routing and filtering.
+type LayoutOption string
+
+func (l LayoutOption) String() string {
+	return string(l)
+}
+
+const (
+	LayoutPerProject = "per_project"
+	LayoutShared     = "shared"
+)
+
+// DynamicMappingOption controls how fields that aren't part of the explicit mappings are handled.
+// When unset, unknown fields are stored but not indexed.
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/dynamic.html
+type DynamicMappingOption string
+
+func (d DynamicMappingOption) String() string {
+	return string(d)
+}
+
+const (
+	DynamicMappingTrue   = "true"
+	DynamicMappingFalse  = "false"
+	DynamicMappingStrict = "strict"
+)
+
+// VerifyIndicesOption controls whether the indices for every project are checked when Grafeas starts.
+// Inconsistencies are logged, and are also fixed when set to repair.
+type VerifyIndicesOption string
+
+func (v VerifyIndicesOption) String() string {
+	return string(v)
+}
+
+const (
+	VerifyIndicesTrue   = "true"
+	VerifyIndicesFalse  = "false"
+	VerifyIndicesRepair = "repair"
+)
+
+const (
+	CodecDefault         = "default"
+	CodecBestCompression = "best_compression"
+)
@@ -18,6 +18,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"time"
 )
 
 var _ = Describe("ElasticsearchConfig", func() {
@@ -46,5 +47,278 @@ var _ = Describe("ElasticsearchConfig", func() {
 			URL:     fake.URL(),
 			Refresh: "somethingInvalid",
 		}, true),
+		Entry("per project layout", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Layout:  LayoutPerProject,
+		}, false),
+		Entry("shared layout", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Layout:  LayoutShared,
+		}, false),
+		Entry("invalid layout", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Layout:  "somethingInvalid",
+		}, true),
+		Entry("strict dynamic mapping", ElasticsearchConfig{
+			URL:            fake.URL(),
+			Refresh:        RefreshTrue,
+			DynamicMapping: DynamicMappingStrict,
+		}, false),
+		Entry("disabled dynamic mapping", ElasticsearchConfig{
+			URL:            fake.URL(),
+			Refresh:        RefreshTrue,
+			DynamicMapping: DynamicMappingFalse,
+		}, false),
+		Entry("invalid dynamic mapping", ElasticsearchConfig{
+			URL:            fake.URL(),
+			Refresh:        RefreshTrue,
+			DynamicMapping: "sometimes",
+		}, true),
+		Entry("verify indices", ElasticsearchConfig{
+			URL:           fake.URL(),
+			Refresh:       RefreshTrue,
+			VerifyIndices: VerifyIndicesRepair,
+		}, false),
+		Entry("invalid verify indices", ElasticsearchConfig{
+			URL:           fake.URL(),
+			Refresh:       RefreshTrue,
+			VerifyIndices: "always",
+		}, true),
+		Entry("valid soft delete", ElasticsearchConfig{
+			URL:        fake.URL(),
+			Refresh:    RefreshTrue,
+			SoftDelete: SoftDeleteConfig{Enabled: true, GracePeriod: "30d", CheckInterval: "1h"},
+		}, false),
+		Entry("invalid soft delete grace period", ElasticsearchConfig{
+			URL:        fake.URL(),
+			Refresh:    RefreshTrue,
+			SoftDelete: SoftDeleteConfig{Enabled: true, GracePeriod: "a month"},
+		}, true),
+		Entry("invalid soft delete check interval", ElasticsearchConfig{
+			URL:        fake.URL(),
+			Refresh:    RefreshTrue,
+			SoftDelete: SoftDeleteConfig{Enabled: true, CheckInterval: "often"},
+		}, true),
+		Entry("valid audit", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Audit:   AuditConfig{Enabled: true, Retention: "365d", CheckInterval: "1h", UserHeader: "x-user"},
+		}, false),
+		Entry("invalid audit retention", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Audit:   AuditConfig{Enabled: true, Retention: "a year"},
+		}, true),
+		Entry("invalid audit check interval", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Audit:   AuditConfig{Enabled: true, CheckInterval: "often"},
+		}, true),
+		Entry("valid import provider project", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Import:  ImportConfig{ProviderProject: "vulnerabilities"},
+		}, false),
+		Entry("invalid import provider project", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Import:  ImportConfig{ProviderProject: "projects/vulnerabilities"},
+		}, true),
+		Entry("rollover disabled without conditions", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{},
+		}, false),
+		Entry("valid rollover", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Rollover: RolloverConfig{
+				Enabled:       true,
+				MaxAge:        "7d",
+				MaxSize:       "50gb",
+				MaxDocs:       1000000,
+				CheckInterval: "10m",
+			},
+		}, false),
+		Entry("rollover enabled without conditions", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{Enabled: true},
+		}, true),
+		Entry("invalid rollover max age", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{Enabled: true, MaxAge: "a week"},
+		}, true),
+		Entry("invalid rollover max size", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{Enabled: true, MaxSize: "50 gigs"},
+		}, true),
+		Entry("negative rollover max docs", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{Enabled: true, MaxDocs: -1},
+		}, true),
+		Entry("invalid rollover check interval", ElasticsearchConfig{
+			URL:      fake.URL(),
+			Refresh:  RefreshTrue,
+			Rollover: RolloverConfig{Enabled: true, MaxDocs: 10, CheckInterval: "often"},
+		}, true),
+		Entry("valid retention", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Retention: RetentionConfig{
+				Occurrences: map[string]string{
+					"discovery":     "30d",
+					"VULNERABILITY": "365d",
+				},
+				DryRun:        true,
+				CheckInterval: "6h",
+			},
+		}, false),
+		Entry("invalid retention occurrence kind", ElasticsearchConfig{
+			URL:       fake.URL(),
+			Refresh:   RefreshTrue,
+			Retention: RetentionConfig{Occurrences: map[string]string{"scan": "30d"}},
+		}, true),
+		Entry("invalid retention period", ElasticsearchConfig{
+			URL:       fake.URL(),
+			Refresh:   RefreshTrue,
+			Retention: RetentionConfig{Occurrences: map[string]string{"discovery": "a month"}},
+		}, true),
+		Entry("invalid retention check interval", ElasticsearchConfig{
+			URL:       fake.URL(),
+			Refresh:   RefreshTrue,
+			Retention: RetentionConfig{Occurrences: map[string]string{"discovery": "30d"}, CheckInterval: "hourly"},
+		}, true),
+		Entry("valid bulk settings", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Bulk: BulkConfig{
+				MaxDocs:     500,
+				MaxBytes:    1024 * 1024,
+				Concurrency: 2,
+				MaxRetries:  5,
+			},
+		}, false),
+		Entry("negative bulk concurrency", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Bulk:    BulkConfig{Concurrency: -1},
+		}, true),
+		Entry("valid index settings", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Indices: IndicesConfig{
+				Projects: IndexSettings{
+					NumberOfShards:   1,
+					NumberOfReplicas: intPtr(0),
+				},
+				Occurrences: IndexSettings{
+					RefreshInterval: "30s",
+					Codec:           CodecBestCompression,
+				},
+				Notes: IndexSettings{
+					RefreshInterval: "-1",
+					Codec:           CodecDefault,
+				},
+			},
+		}, false),
+		Entry("negative number of shards", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Indices: IndicesConfig{
+				Notes: IndexSettings{NumberOfShards: -1},
+			},
+		}, true),
+		Entry("negative number of replicas", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Indices: IndicesConfig{
+				Occurrences: IndexSettings{NumberOfReplicas: intPtr(-1)},
+			},
+		}, true),
+		Entry("invalid refresh interval", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Indices: IndicesConfig{
+				Projects: IndexSettings{RefreshInterval: "soon"},
+			},
+		}, true),
+		Entry("invalid codec", ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: RefreshTrue,
+			Indices: IndicesConfig{
+				Projects: IndexSettings{Codec: "zstd"},
+			},
+		}, true),
 	)
 })
+
+var _ = Describe("RolloverConfig", func() {
+	DescribeTable("check interval", func(c RolloverConfig, expected time.Duration) {
+		Expect(c.Interval()).To(Equal(expected))
+	},
+		Entry("default", RolloverConfig{}, DefaultRolloverCheckInterval),
+		Entry("configured", RolloverConfig{CheckInterval: "30s"}, 30*time.Second),
+	)
+})
+
+var _ = Describe("RetentionConfig", func() {
+	DescribeTable("check interval", func(c RetentionConfig, expected time.Duration) {
+		Expect(c.Interval()).To(Equal(expected))
+	},
+		Entry("default", RetentionConfig{}, DefaultRetentionCheckInterval),
+		Entry("configured", RetentionConfig{CheckInterval: "15m"}, 15*time.Minute),
+	)
+
+	It("should only be enabled when a retention period is configured", func() {
+		Expect(RetentionConfig{}.Enabled()).To(BeFalse())
+		Expect(RetentionConfig{Occurrences: map[string]string{"discovery": "30d"}}.Enabled()).To(BeTrue())
+	})
+})
+
+var _ = Describe("SoftDeleteConfig", func() {
+	DescribeTable("grace period", func(c SoftDeleteConfig, expected time.Duration) {
+		Expect(c.Period()).To(Equal(expected))
+	},
+		Entry("default", SoftDeleteConfig{}, DefaultSoftDeleteGracePeriod),
+		Entry("days", SoftDeleteConfig{GracePeriod: "30d"}, 30*24*time.Hour),
+		Entry("hours", SoftDeleteConfig{GracePeriod: "12h"}, 12*time.Hour),
+	)
+
+	DescribeTable("check interval", func(c SoftDeleteConfig, expected time.Duration) {
+		Expect(c.Interval()).To(Equal(expected))
+	},
+		Entry("default", SoftDeleteConfig{}, DefaultSoftDeleteCheckInterval),
+		Entry("configured", SoftDeleteConfig{CheckInterval: "15m"}, 15*time.Minute),
+	)
+})
+
+var _ = Describe("AuditConfig", func() {
+	DescribeTable("check interval", func(c AuditConfig, expected time.Duration) {
+		Expect(c.Interval()).To(Equal(expected))
+	},
+		Entry("default", AuditConfig{}, DefaultAuditCheckInterval),
+		Entry("configured", AuditConfig{CheckInterval: "15m"}, 15*time.Minute),
+	)
+})
+
+var _ = Describe("BulkConfig", func() {
+	It("should use the defaults for values that aren't set", func() {
+		Expect(BulkConfig{MaxDocs: 10}.WithDefaults()).To(Equal(BulkConfig{
+			MaxDocs:     10,
+			MaxBytes:    DefaultBulkMaxBytes,
+			Concurrency: DefaultBulkConcurrency,
+			MaxRetries:  DefaultBulkMaxRetries,
+		}))
+	})
+})
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage"
+	"io/ioutil"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// Format is the schema of a vulnerability feed file
+type Format string
+
+const (
+	// FormatAuto detects the format from the contents of each file
+	FormatAuto Format = ""
+	// FormatOSV is a single OSV vulnerability, or an array of them. https://ossf.github.io/osv-schema/
+	FormatOSV Format = "osv"
+	// FormatNVD is a yearly or modified feed in the NVD JSON 1.1 schema
+	FormatNVD Format = "nvd"
+)
+
+// NoteWriter creates or updates notes in a project, and is implemented by storage.ElasticsearchStorage
+type NoteWriter interface {
+	UpsertNotes(ctx context.Context, projectId, uID string, notesWithNoteIds map[string]*pb.Note) (*storage.NoteUpsertReport, []error)
+}
+
+// Importer writes the vulnerabilities in feed files to a provider project as vulnerability notes, named after the ID of
+// each vulnerability. Notes are upserted, so importing a newer version of a feed only writes the notes that changed.
+type Importer struct {
+	writer    NoteWriter
+	projectId string
+}
+
+func NewImporter(writer NoteWriter, projectId string) *Importer {
+	return &Importer{
+		writer:    writer,
+		projectId: projectId,
+	}
+}
+
+// ImportFiles reads and writes each file in turn, so that only one feed is held in memory at a time. Files that can't be
+// read or written don't stop the rest from being imported, and their errors are returned along with the combined counts.
+func (i *Importer) ImportFiles(ctx context.Context, uID string, format Format, paths ...string) (*storage.NoteUpsertReport, error) {
+	var (
+		total = &storage.NoteUpsertReport{}
+		e     error
+	)
+	for _, path := range paths {
+		notes, err := ReadNotes(path, format)
+		if err != nil {
+			e = multierror.Append(e, err)
+			continue
+		}
+
+		report, errs := i.writer.UpsertNotes(ctx, i.projectId, uID, notes)
+		if report != nil {
+			total.Created += report.Created
+			total.Updated += report.Updated
+			total.Unchanged += report.Unchanged
+		}
+		for _, err := range errs {
+			e = multierror.Append(e, fmt.Errorf("error importing %s: %s", path, err))
+		}
+	}
+
+	return total, e
+}
+
+// ReadNotes converts the vulnerabilities in a feed file into notes, keyed by note ID. Files compressed with gzip, like
+// the NVD feeds, are decompressed first.
+func ReadNotes(path string, format Format) (map[string]*pb.Note, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing %s: %s", path, err)
+		}
+
+		data, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing %s: %s", path, err)
+		}
+	}
+
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+
+	var notes map[string]*pb.Note
+	switch format {
+	case FormatOSV:
+		notes, err = osvNotes(data)
+	case FormatNVD:
+		notes, err = nvdNotes(data)
+	default:
+		return nil, fmt.Errorf("unable to determine the format of %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	return notes, nil
+}
+
+// detectFormat recognizes NVD feeds by their list of CVE items, and OSV files by the ID of the vulnerability
+func detectFormat(data []byte) Format {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return FormatOSV
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return FormatAuto
+	}
+
+	if _, ok := fields["CVE_Items"]; ok {
+		return FormatNVD
+	}
+	if _, ok := fields["id"]; ok {
+		return FormatOSV
+	}
+
+	return FormatAuto
+}
+
+// timestampOrNil converts a time that may be unset
+func timestampOrNil(t time.Time) *timestamp.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+
+	return ts
+}
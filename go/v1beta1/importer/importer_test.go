@@ -0,0 +1,153 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("importer", func() {
+	var (
+		writer    *fakeNoteWriter
+		importer  *Importer
+		projectId string
+		userId    string
+	)
+
+	BeforeEach(func() {
+		writer = &fakeNoteWriter{}
+		projectId = fake.LetterN(10)
+		userId = fake.LetterN(10)
+		importer = NewImporter(writer, projectId)
+	})
+
+	Context("importing files", func() {
+		var (
+			paths        []string
+			actualReport *storage.NoteUpsertReport
+			actualErr    error
+		)
+
+		BeforeEach(func() {
+			paths = []string{"testdata/osv.json", "testdata/nvd.json"}
+			writer.reports = []*storage.NoteUpsertReport{
+				{Created: 1},
+				{Updated: 1, Unchanged: 1},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualReport, actualErr = importer.ImportFiles(context.Background(), userId, FormatAuto, paths...)
+		})
+
+		It("should write the notes from each file to the provider project", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(writer.calls).To(HaveLen(2))
+
+			Expect(writer.calls[0].projectId).To(Equal(projectId))
+			Expect(writer.calls[0].userId).To(Equal(userId))
+			Expect(writer.calls[0].notes).To(HaveKey("GHSA-jfh8-c2jp-5v3q"))
+			Expect(writer.calls[1].notes).To(HaveLen(2))
+			Expect(writer.calls[1].notes).To(HaveKey("CVE-2021-44228"))
+		})
+
+		It("should combine the counts of every file", func() {
+			Expect(actualReport).To(Equal(&storage.NoteUpsertReport{Created: 1, Updated: 1, Unchanged: 1}))
+		})
+
+		When("a file can't be read", func() {
+			BeforeEach(func() {
+				paths = []string{"testdata/missing.json", "testdata/nvd.json"}
+			})
+
+			It("should import the rest of the files", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErr.Error()).To(ContainSubstring("missing.json"))
+				Expect(writer.calls).To(HaveLen(1))
+				Expect(actualReport).To(Equal(&storage.NoteUpsertReport{Created: 1}))
+			})
+		})
+
+		When("some notes can't be written", func() {
+			BeforeEach(func() {
+				writer.errs = []error{errors.New(fake.LetterN(10))}
+			})
+
+			It("should return an error that names the file", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(actualErr.Error()).To(ContainSubstring("testdata/osv.json"))
+				Expect(actualErr.Error()).To(ContainSubstring(writer.errs[0].Error()))
+			})
+		})
+	})
+
+	Context("reading notes", func() {
+		DescribeTable("detecting the format", func(path string, expectedNoteIds ...string) {
+			notes, err := ReadNotes(path, FormatAuto)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(notes).To(HaveLen(len(expectedNoteIds)))
+			for _, noteId := range expectedNoteIds {
+				Expect(notes).To(HaveKey(noteId))
+			}
+		},
+			Entry("single OSV vulnerability", "testdata/osv.json", "GHSA-jfh8-c2jp-5v3q"),
+			Entry("list of OSV vulnerabilities", "testdata/osv-list.json", "GHSA-xxxx-1111-aaaa", "GHSA-xxxx-2222-bbbb"),
+			Entry("NVD feed", "testdata/nvd.json", "CVE-2021-44228", "CVE-2014-0160"),
+			Entry("compressed NVD feed", "testdata/nvd.json.gz", "CVE-2021-44228", "CVE-2014-0160"),
+		)
+
+		It("should reject files in an unknown format", func() {
+			_, err := ReadNotes("testdata/unknown.json", FormatAuto)
+
+			Expect(err).To(MatchError(ContainSubstring("unable to determine the format")))
+		})
+
+		It("should reject files that don't match the given format", func() {
+			_, err := ReadNotes("testdata/nvd.json", FormatOSV)
+
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+type upsertNotesCall struct {
+	projectId string
+	userId    string
+	notes     map[string]*pb.Note
+}
+
+// fakeNoteWriter records the notes it's given, and returns the prepared reports in order
+type fakeNoteWriter struct {
+	calls   []*upsertNotesCall
+	reports []*storage.NoteUpsertReport
+	errs    []error
+}
+
+func (f *fakeNoteWriter) UpsertNotes(_ context.Context, projectId, uID string, notes map[string]*pb.Note) (*storage.NoteUpsertReport, []error) {
+	f.calls = append(f.calls, &upsertNotesCall{projectId: projectId, userId: uID, notes: notes})
+
+	report := f.reports[0]
+	f.reports = f.reports[1:]
+
+	return report, f.errs
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"strings"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// NVD JSON 1.1 feeds, as described in https://csrc.nist.gov/schema/nvd/feed/1.1/nvd_cve_feed_json_1.1.schema
+
+type nvdFeed struct {
+	Items []*nvdItem `json:"CVE_Items"`
+}
+
+type nvdItem struct {
+	Cve              *nvdCve            `json:"cve"`
+	Configurations   *nvdConfigurations `json:"configurations"`
+	Impact           *nvdImpact         `json:"impact"`
+	LastModifiedDate string             `json:"lastModifiedDate"`
+}
+
+type nvdCve struct {
+	Meta struct {
+		Id string `json:"ID"`
+	} `json:"CVE_data_meta"`
+	Description struct {
+		Data []*nvdLangString `json:"description_data"`
+	} `json:"description"`
+	References struct {
+		Data []*nvdReference `json:"reference_data"`
+	} `json:"references"`
+}
+
+type nvdLangString struct {
+	Lang  string `json:"lang"`
+	Value string `json:"value"`
+}
+
+type nvdReference struct {
+	Url       string `json:"url"`
+	Refsource string `json:"refsource"`
+}
+
+type nvdConfigurations struct {
+	Nodes []*nvdNode `json:"nodes"`
+}
+
+type nvdNode struct {
+	Operator string         `json:"operator"`
+	Children []*nvdNode     `json:"children"`
+	CpeMatch []*nvdCpeMatch `json:"cpe_match"`
+}
+
+type nvdCpeMatch struct {
+	Vulnerable            bool   `json:"vulnerable"`
+	Cpe23Uri              string `json:"cpe23Uri"`
+	VersionStartIncluding string `json:"versionStartIncluding"`
+	VersionStartExcluding string `json:"versionStartExcluding"`
+	VersionEndIncluding   string `json:"versionEndIncluding"`
+	VersionEndExcluding   string `json:"versionEndExcluding"`
+}
+
+type nvdImpact struct {
+	BaseMetricV3 *struct {
+		CvssV3 struct {
+			BaseScore    float32 `json:"baseScore"`
+			BaseSeverity string  `json:"baseSeverity"`
+		} `json:"cvssV3"`
+	} `json:"baseMetricV3"`
+	BaseMetricV2 *struct {
+		CvssV2 struct {
+			BaseScore float32 `json:"baseScore"`
+		} `json:"cvssV2"`
+		Severity string `json:"severity"`
+	} `json:"baseMetricV2"`
+}
+
+// nvdTimeLayout is the format of the dates in NVD feeds, which don't include seconds
+const nvdTimeLayout = "2006-01-02T15:04Z"
+
+// nvdNotes converts the CVEs in an NVD feed into notes
+func nvdNotes(data []byte) (map[string]*pb.Note, error) {
+	feed := &nvdFeed{}
+	if err := json.Unmarshal(data, feed); err != nil {
+		return nil, err
+	}
+
+	notes := map[string]*pb.Note{}
+	for _, item := range feed.Items {
+		if item.Cve == nil || item.Cve.Meta.Id == "" {
+			return nil, fmt.Errorf("found an NVD item without a CVE ID")
+		}
+
+		notes[item.Cve.Meta.Id] = nvdNote(item)
+	}
+
+	return notes, nil
+}
+
+func nvdNote(item *nvdItem) *pb.Note {
+	var sourceUpdateTime *timestamp.Timestamp
+	if modified, err := time.Parse(nvdTimeLayout, item.LastModifiedDate); err == nil {
+		sourceUpdateTime = timestampOrNil(modified)
+	}
+
+	// CVSS v3 metrics are preferred, since older CVEs only have v2 metrics
+	var (
+		cvssScore float32
+		severity  vulnerability_go_proto.Severity
+	)
+	if impact := item.Impact; impact != nil && impact.BaseMetricV3 != nil {
+		cvssScore = impact.BaseMetricV3.CvssV3.BaseScore
+		severity = namedSeverity(impact.BaseMetricV3.CvssV3.BaseSeverity)
+	} else if impact != nil && impact.BaseMetricV2 != nil {
+		cvssScore = impact.BaseMetricV2.CvssV2.BaseScore
+		severity = namedSeverity(impact.BaseMetricV2.Severity)
+	}
+
+	var details []*vulnerability_go_proto.Vulnerability_Detail
+	if item.Configurations != nil {
+		for _, match := range nvdVulnerableMatches(item.Configurations.Nodes) {
+			detail := nvdMatchDetail(match)
+			detail.SeverityName = severityName(severity)
+			detail.SourceUpdateTime = sourceUpdateTime
+			details = append(details, detail)
+		}
+	}
+
+	var description string
+	for _, d := range item.Cve.Description.Data {
+		if d.Lang == "en" {
+			description = d.Value
+			break
+		}
+	}
+
+	var relatedUrls []*common_go_proto.RelatedUrl
+	for _, reference := range item.Cve.References.Data {
+		relatedUrls = append(relatedUrls, &common_go_proto.RelatedUrl{
+			Url:   reference.Url,
+			Label: reference.Refsource,
+		})
+	}
+
+	return &pb.Note{
+		ShortDescription: item.Cve.Meta.Id,
+		LongDescription:  description,
+		Kind:             common_go_proto.NoteKind_VULNERABILITY,
+		RelatedUrl:       relatedUrls,
+		Type: &pb.Note_Vulnerability{
+			Vulnerability: &vulnerability_go_proto.Vulnerability{
+				CvssScore:        cvssScore,
+				Severity:         severity,
+				Details:          details,
+				SourceUpdateTime: sourceUpdateTime,
+			},
+		},
+	}
+}
+
+// nvdVulnerableMatches collects the vulnerable CPE matches from a configuration, including its children. Matches that
+// aren't vulnerable only describe the platform that a vulnerable product has to run on.
+func nvdVulnerableMatches(nodes []*nvdNode) []*nvdCpeMatch {
+	var matches []*nvdCpeMatch
+	for _, node := range nodes {
+		for _, match := range node.CpeMatch {
+			if match.Vulnerable {
+				matches = append(matches, match)
+			}
+		}
+
+		matches = append(matches, nvdVulnerableMatches(node.Children)...)
+	}
+
+	return matches
+}
+
+// nvdMatchDetail converts a CPE match into the range of affected versions of a product. A match either names a single
+// version in its CPE, or a range of versions with its start and end. An excluded end version is the first version that
+// isn't affected, so it becomes the fixed location. Ranges without an end affect every later version.
+func nvdMatchDetail(match *nvdCpeMatch) *vulnerability_go_proto.Vulnerability_Detail {
+	// cpe:2.3:part:vendor:product:version:update:...
+	fields := strings.Split(match.Cpe23Uri, ":")
+	var product, version string
+	if len(fields) > 5 {
+		product = fields[4]
+		if fields[5] != "*" && fields[5] != "-" {
+			version = fields[5]
+		}
+	}
+
+	detail := &vulnerability_go_proto.Vulnerability_Detail{
+		CpeUri:  match.Cpe23Uri,
+		Package: product,
+	}
+
+	switch {
+	case version != "":
+		detail.MinAffectedVersion = packageVersion(version, package_go_proto.Version_MINIMUM)
+		detail.MaxAffectedVersion = packageVersion(version, package_go_proto.Version_MAXIMUM)
+		return detail
+	case match.VersionStartIncluding != "":
+		detail.MinAffectedVersion = packageVersion(match.VersionStartIncluding, package_go_proto.Version_MINIMUM)
+	default:
+		// the minimum affected version is inclusive, so an excluded start version is included in the range to err on the
+		// side of reporting the vulnerability
+		detail.MinAffectedVersion = packageVersion(match.VersionStartExcluding, package_go_proto.Version_MINIMUM)
+	}
+
+	switch {
+	case match.VersionEndIncluding != "":
+		detail.MaxAffectedVersion = packageVersion(match.VersionEndIncluding, package_go_proto.Version_MAXIMUM)
+	case match.VersionEndExcluding != "":
+		detail.FixedLocation = &vulnerability_go_proto.VulnerabilityLocation{
+			CpeUri:  match.Cpe23Uri,
+			Package: product,
+			Version: packageVersion(match.VersionEndExcluding, package_go_proto.Version_MAXIMUM),
+		}
+	default:
+		detail.MaxAffectedVersion = packageVersion("", package_go_proto.Version_MAXIMUM)
+	}
+
+	return detail
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"github.com/golang/protobuf/ptypes"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("NVD feeds", func() {
+	var notes map[string]*pb.Note
+
+	BeforeEach(func() {
+		var err error
+		notes, err = ReadNotes("testdata/nvd.json", FormatNVD)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("a CVE with CVSS v3 metrics", func() {
+		var note *pb.Note
+
+		BeforeEach(func() {
+			note = notes["CVE-2021-44228"]
+		})
+
+		It("should describe the CVE", func() {
+			Expect(note.Kind).To(Equal(common_go_proto.NoteKind_VULNERABILITY))
+			Expect(note.ShortDescription).To(Equal("CVE-2021-44228"))
+			Expect(note.LongDescription).To(HavePrefix("Apache Log4j2 2.0-beta9 through 2.15.0"))
+			Expect(note.RelatedUrl).To(ConsistOf(
+				&common_go_proto.RelatedUrl{Url: "https://logging.apache.org/log4j/2.x/security.html", Label: "MISC"},
+			))
+		})
+
+		It("should prefer the CVSS v3 score and severity", func() {
+			vulnerability := note.GetVulnerability()
+
+			Expect(vulnerability.CvssScore).To(BeEquivalentTo(10))
+			Expect(vulnerability.Severity).To(Equal(vulnerability_go_proto.Severity_CRITICAL))
+
+			modified, err := ptypes.Timestamp(vulnerability.SourceUpdateTime)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(modified).To(Equal(time.Date(2021, 12, 20, 15, 15, 0, 0, time.UTC)))
+		})
+
+		It("should only add the vulnerable products, including those in child configurations", func() {
+			details := note.GetVulnerability().Details
+
+			Expect(details).To(HaveLen(2))
+			for _, detail := range details {
+				Expect(detail.CpeUri).To(Equal("cpe:2.3:a:apache:log4j:*:*:*:*:*:*:*:*"))
+				Expect(detail.Package).To(Equal("log4j"))
+				Expect(detail.SeverityName).To(Equal("CRITICAL"))
+			}
+		})
+
+		It("should use an excluded end version as the fixed version", func() {
+			detail := note.GetVulnerability().Details[0]
+
+			Expect(detail.MinAffectedVersion).To(Equal(&package_go_proto.Version{Name: "2.0.1", Kind: package_go_proto.Version_NORMAL}))
+			Expect(detail.MaxAffectedVersion).To(BeNil())
+			Expect(detail.FixedLocation.Version).To(Equal(&package_go_proto.Version{Name: "2.12.2", Kind: package_go_proto.Version_NORMAL}))
+		})
+
+		It("should use an included end version as the maximum affected version", func() {
+			detail := note.GetVulnerability().Details[1]
+
+			Expect(detail.MinAffectedVersion.Name).To(Equal("2.13.0"))
+			Expect(detail.MaxAffectedVersion).To(Equal(&package_go_proto.Version{Name: "2.15.0", Kind: package_go_proto.Version_NORMAL}))
+			Expect(detail.FixedLocation).To(BeNil())
+		})
+	})
+
+	Context("a CVE with only CVSS v2 metrics", func() {
+		var note *pb.Note
+
+		BeforeEach(func() {
+			note = notes["CVE-2014-0160"]
+		})
+
+		It("should use the CVSS v2 score and severity", func() {
+			Expect(note.GetVulnerability().CvssScore).To(BeEquivalentTo(5))
+			Expect(note.GetVulnerability().Severity).To(Equal(vulnerability_go_proto.Severity_MEDIUM))
+			Expect(note.RelatedUrl).To(BeEmpty())
+		})
+
+		It("should only affect the version named in the CPE", func() {
+			detail := note.GetVulnerability().Details[0]
+
+			Expect(detail.Package).To(Equal("openssl"))
+			Expect(detail.MinAffectedVersion).To(Equal(&package_go_proto.Version{Name: "1.0.1f", Kind: package_go_proto.Version_NORMAL}))
+			Expect(detail.MaxAffectedVersion).To(Equal(&package_go_proto.Version{Name: "1.0.1f", Kind: package_go_proto.Version_NORMAL}))
+		})
+	})
+
+	It("should reject items without a CVE ID", func() {
+		_, err := nvdNotes([]byte(`{"CVE_Items": [{"cve": {}}]}`))
+
+		Expect(err).To(HaveOccurred())
+	})
+})
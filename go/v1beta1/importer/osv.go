@@ -0,0 +1,244 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// OSV vulnerabilities, as described in https://ossf.github.io/osv-schema/
+
+type osvVulnerability struct {
+	Id               string               `json:"id"`
+	Modified         time.Time            `json:"modified"`
+	Withdrawn        *time.Time           `json:"withdrawn,omitempty"`
+	Summary          string               `json:"summary"`
+	Details          string               `json:"details"`
+	Severity         []*osvSeverity       `json:"severity"`
+	Affected         []*osvAffected       `json:"affected"`
+	References       []*osvReference      `json:"references"`
+	DatabaseSpecific *osvDatabaseSpecific `json:"database_specific,omitempty"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvAffected struct {
+	Package *osvPackage `json:"package"`
+	Ranges  []*osvRange `json:"ranges"`
+}
+
+type osvPackage struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	Purl      string `json:"purl"`
+}
+
+type osvRange struct {
+	Type   string      `json:"type"`
+	Events []*osvEvent `json:"events"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+}
+
+type osvReference struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
+// osvDatabaseSpecific holds the severity that GitHub advisories include for vulnerabilities without a CVSS vector
+type osvDatabaseSpecific struct {
+	Severity string `json:"severity"`
+}
+
+// osvIntroducedAtStart is the introduced version of a range that affects every version before the fix
+const osvIntroducedAtStart = "0"
+
+// osvNotes converts a single OSV vulnerability, or an array of them, into notes
+func osvNotes(data []byte) (map[string]*pb.Note, error) {
+	var vulnerabilities []*osvVulnerability
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &vulnerabilities); err != nil {
+			return nil, err
+		}
+	} else {
+		vulnerability := &osvVulnerability{}
+		if err := json.Unmarshal(data, vulnerability); err != nil {
+			return nil, err
+		}
+		vulnerabilities = append(vulnerabilities, vulnerability)
+	}
+
+	notes := map[string]*pb.Note{}
+	for _, vulnerability := range vulnerabilities {
+		if vulnerability.Id == "" {
+			return nil, fmt.Errorf("found an OSV vulnerability without an id")
+		}
+
+		note, err := osvNote(vulnerability)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s: %s", vulnerability.Id, err)
+		}
+		notes[vulnerability.Id] = note
+	}
+
+	return notes, nil
+}
+
+func osvNote(v *osvVulnerability) (*pb.Note, error) {
+	var (
+		sourceUpdateTime = timestampOrNil(v.Modified)
+		cvssScore        float32
+		err              error
+	)
+	for _, severity := range v.Severity {
+		if severity.Type != "CVSS_V3" {
+			continue
+		}
+
+		cvssScore, err = cvssV3BaseScore(severity.Score)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	severity := scoreSeverity(cvssScore)
+	if severity == vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED && v.DatabaseSpecific != nil {
+		severity = namedSeverity(v.DatabaseSpecific.Severity)
+	}
+
+	var details []*vulnerability_go_proto.Vulnerability_Detail
+	for _, affected := range v.Affected {
+		if affected.Package == nil {
+			continue
+		}
+
+		for _, r := range affected.Ranges {
+			// git ranges are made of commit hashes, which can't be compared with package versions
+			if r.Type != "SEMVER" && r.Type != "ECOSYSTEM" {
+				continue
+			}
+
+			for _, detail := range osvRangeDetails(affected.Package, r) {
+				detail.SeverityName = severityName(severity)
+				detail.SourceUpdateTime = sourceUpdateTime
+				detail.IsObsolete = v.Withdrawn != nil
+				details = append(details, detail)
+			}
+		}
+	}
+
+	var relatedUrls []*common_go_proto.RelatedUrl
+	for _, reference := range v.References {
+		relatedUrls = append(relatedUrls, &common_go_proto.RelatedUrl{
+			Url:   reference.Url,
+			Label: reference.Type,
+		})
+	}
+
+	shortDescription := v.Summary
+	if shortDescription == "" {
+		shortDescription = v.Id
+	}
+
+	return &pb.Note{
+		ShortDescription: shortDescription,
+		LongDescription:  v.Details,
+		Kind:             common_go_proto.NoteKind_VULNERABILITY,
+		RelatedUrl:       relatedUrls,
+		Type: &pb.Note_Vulnerability{
+			Vulnerability: &vulnerability_go_proto.Vulnerability{
+				CvssScore:        cvssScore,
+				Severity:         severity,
+				Details:          details,
+				SourceUpdateTime: sourceUpdateTime,
+			},
+		},
+	}, nil
+}
+
+// osvRangeDetails splits the events of a range into the intervals of affected versions. Each interval starts at an
+// introduced version and ends at a fixed version, which becomes the fixed location, or at the last affected version.
+// An interval that's still open at the end of the range affects every later version.
+func osvRangeDetails(p *osvPackage, r *osvRange) []*vulnerability_go_proto.Vulnerability_Detail {
+	cpeUri := p.Purl
+	if cpeUri == "" {
+		cpeUri = p.Ecosystem
+	}
+
+	var (
+		details    []*vulnerability_go_proto.Vulnerability_Detail
+		introduced *string
+	)
+	closeInterval := func(max *package_go_proto.Version, fixed string) {
+		detail := &vulnerability_go_proto.Vulnerability_Detail{
+			CpeUri:             cpeUri,
+			Package:            p.Name,
+			PackageType:        p.Ecosystem,
+			MinAffectedVersion: osvIntroducedVersion(*introduced),
+			MaxAffectedVersion: max,
+		}
+		if fixed != "" {
+			detail.FixedLocation = &vulnerability_go_proto.VulnerabilityLocation{
+				CpeUri:  cpeUri,
+				Package: p.Name,
+				Version: packageVersion(fixed, package_go_proto.Version_MAXIMUM),
+			}
+		}
+
+		details = append(details, detail)
+		introduced = nil
+	}
+
+	for _, event := range r.Events {
+		switch {
+		case event.Introduced != "":
+			introduced = &event.Introduced
+		case introduced == nil:
+			continue
+		case event.Fixed != "":
+			closeInterval(nil, event.Fixed)
+		case event.LastAffected != "":
+			closeInterval(packageVersion(event.LastAffected, package_go_proto.Version_MAXIMUM), "")
+		}
+	}
+	if introduced != nil {
+		closeInterval(packageVersion("", package_go_proto.Version_MAXIMUM), "")
+	}
+
+	return details
+}
+
+func osvIntroducedVersion(introduced string) *package_go_proto.Version {
+	if introduced == osvIntroducedAtStart {
+		introduced = ""
+	}
+
+	return packageVersion(introduced, package_go_proto.Version_MINIMUM)
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"github.com/golang/protobuf/ptypes"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("OSV feeds", func() {
+	var notes map[string]*pb.Note
+
+	Context("a vulnerability with a CVSS vector", func() {
+		var note *pb.Note
+
+		BeforeEach(func() {
+			var err error
+			notes, err = ReadNotes("testdata/osv.json", FormatOSV)
+			Expect(err).ToNot(HaveOccurred())
+
+			note = notes["GHSA-jfh8-c2jp-5v3q"]
+		})
+
+		It("should describe the vulnerability", func() {
+			Expect(note.Kind).To(Equal(common_go_proto.NoteKind_VULNERABILITY))
+			Expect(note.ShortDescription).To(Equal("Remote code injection in Log4j"))
+			Expect(note.LongDescription).To(HavePrefix("Log4j versions prior to 2.16.0"))
+			Expect(note.RelatedUrl).To(ConsistOf(
+				&common_go_proto.RelatedUrl{Url: "https://nvd.nist.gov/vuln/detail/CVE-2021-44228", Label: "ADVISORY"},
+				&common_go_proto.RelatedUrl{Url: "https://logging.apache.org/log4j/2.x/security.html", Label: "WEB"},
+			))
+		})
+
+		It("should score the vulnerability from its CVSS vector", func() {
+			vulnerability := note.GetVulnerability()
+
+			Expect(vulnerability.CvssScore).To(BeEquivalentTo(10))
+			Expect(vulnerability.Severity).To(Equal(vulnerability_go_proto.Severity_CRITICAL))
+
+			modified, err := ptypes.Timestamp(vulnerability.SourceUpdateTime)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(modified).To(Equal(time.Date(2021, 12, 20, 18, 5, 11, 0, time.UTC)))
+		})
+
+		It("should add the affected versions between each introduced and fixed version", func() {
+			details := note.GetVulnerability().Details
+			Expect(details).To(HaveLen(3))
+
+			Expect(details[0].CpeUri).To(Equal("pkg:maven/org.apache.logging.log4j/log4j-core"))
+			Expect(details[0].Package).To(Equal("org.apache.logging.log4j:log4j-core"))
+			Expect(details[0].PackageType).To(Equal("Maven"))
+			Expect(details[0].SeverityName).To(Equal("CRITICAL"))
+			Expect(details[0].MinAffectedVersion).To(Equal(&package_go_proto.Version{Name: "2.13.0", Kind: package_go_proto.Version_NORMAL}))
+			Expect(details[0].MaxAffectedVersion).To(BeNil())
+			Expect(details[0].FixedLocation.Version).To(Equal(&package_go_proto.Version{Name: "2.15.0", Kind: package_go_proto.Version_NORMAL}))
+		})
+
+		It("should end a range at the last affected version", func() {
+			detail := note.GetVulnerability().Details[1]
+
+			Expect(detail.MinAffectedVersion.Name).To(Equal("2.0-beta9"))
+			Expect(detail.MaxAffectedVersion).To(Equal(&package_go_proto.Version{Name: "2.12.1", Kind: package_go_proto.Version_NORMAL}))
+			Expect(detail.FixedLocation).To(BeNil())
+		})
+
+		It("should affect every version of a package without a fix", func() {
+			detail := note.GetVulnerability().Details[2]
+
+			Expect(detail.CpeUri).To(Equal("Maven"))
+			Expect(detail.Package).To(Equal("org.apache.logging.log4j:log4j-api"))
+			Expect(detail.MinAffectedVersion).To(Equal(&package_go_proto.Version{Kind: package_go_proto.Version_MINIMUM}))
+			Expect(detail.MaxAffectedVersion).To(Equal(&package_go_proto.Version{Kind: package_go_proto.Version_MAXIMUM}))
+		})
+	})
+
+	Context("a list of vulnerabilities", func() {
+		BeforeEach(func() {
+			var err error
+			notes, err = ReadNotes("testdata/osv-list.json", FormatOSV)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should use the severity of the advisory when there's no CVSS vector", func() {
+			vulnerability := notes["GHSA-xxxx-1111-aaaa"].GetVulnerability()
+
+			Expect(vulnerability.CvssScore).To(BeZero())
+			Expect(vulnerability.Severity).To(Equal(vulnerability_go_proto.Severity_MEDIUM))
+			Expect(vulnerability.Details[0].MinAffectedVersion.Kind).To(Equal(package_go_proto.Version_MINIMUM))
+			Expect(vulnerability.Details[0].IsObsolete).To(BeFalse())
+		})
+
+		It("should mark the affected versions of withdrawn vulnerabilities as obsolete", func() {
+			note := notes["GHSA-xxxx-2222-bbbb"]
+
+			Expect(note.ShortDescription).To(Equal("GHSA-xxxx-2222-bbbb"))
+			Expect(note.GetVulnerability().Severity).To(Equal(vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED))
+			Expect(note.GetVulnerability().Details[0].IsObsolete).To(BeTrue())
+			Expect(note.GetVulnerability().Details[0].SeverityName).To(BeEmpty())
+		})
+	})
+
+	It("should reject vulnerabilities without an id", func() {
+		_, err := osvNotes([]byte(`[{"summary": "missing id"}]`))
+
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject invalid CVSS vectors", func() {
+		_, err := osvNotes([]byte(`{"id": "GHSA-1", "severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:X"}]}`))
+
+		Expect(err).To(MatchError(ContainSubstring("GHSA-1")))
+	})
+})
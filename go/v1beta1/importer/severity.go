@@ -0,0 +1,152 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"fmt"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"math"
+	"strings"
+)
+
+// cvssV3Weights are the numeric values of each metric in a CVSS v3 base vector.
+// https://www.first.org/cvss/v3.1/specification-document#7-4-Metric-Values
+var cvssV3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvssV3BaseScore calculates the base score of a CVSS v3.0 or v3.1 vector, e.g. CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H
+func cvssV3BaseScore(vector string) (float32, error) {
+	parts := strings.Split(vector, "/")
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "CVSS:3") {
+		return 0, fmt.Errorf("unsupported CVSS vector %q", vector)
+	}
+
+	metrics := map[string]string{}
+	for _, part := range parts[1:] {
+		metric := strings.SplitN(part, ":", 2)
+		if len(metric) != 2 {
+			return 0, fmt.Errorf("invalid CVSS vector %q", vector)
+		}
+		metrics[metric[0]] = metric[1]
+	}
+
+	scopeChanged := metrics["S"] == "C"
+	if !scopeChanged && metrics["S"] != "U" {
+		return 0, fmt.Errorf("invalid CVSS vector %q", vector)
+	}
+
+	weights := map[string]float64{}
+	for metric, values := range cvssV3Weights {
+		weight, ok := values[metrics[metric]]
+		if !ok {
+			return 0, fmt.Errorf("invalid CVSS vector %q", vector)
+		}
+		weights[metric] = weight
+	}
+
+	// privileges matter more when the vulnerable component can affect others
+	if scopeChanged && metrics["PR"] == "L" {
+		weights["PR"] = 0.68
+	} else if scopeChanged && metrics["PR"] == "H" {
+		weights["PR"] = 0.5
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+	impact := 6.42 * iss
+	if scopeChanged {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * weights["PR"] * weights["UI"]
+	score := impact + exploitability
+	if scopeChanged {
+		score *= 1.08
+	}
+
+	return float32(roundUp(math.Min(score, 10))), nil
+}
+
+// roundUp rounds up to one decimal place, avoiding floating point errors as described in the CVSS v3.1 specification
+func roundUp(value float64) float64 {
+	i := int64(math.Round(value * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+
+	return float64(i/10000+1) / 10
+}
+
+// scoreSeverity returns the qualitative severity of a CVSS score
+func scoreSeverity(score float32) vulnerability_go_proto.Severity {
+	switch {
+	case score <= 0:
+		return vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED
+	case score < 4:
+		return vulnerability_go_proto.Severity_LOW
+	case score < 7:
+		return vulnerability_go_proto.Severity_MEDIUM
+	case score < 9:
+		return vulnerability_go_proto.Severity_HIGH
+	default:
+		return vulnerability_go_proto.Severity_CRITICAL
+	}
+}
+
+// namedSeverity returns the severity with the given name, accepting the names used by GitHub advisories
+func namedSeverity(name string) vulnerability_go_proto.Severity {
+	switch strings.ToUpper(name) {
+	case "MINIMAL", "NONE":
+		return vulnerability_go_proto.Severity_MINIMAL
+	case "LOW":
+		return vulnerability_go_proto.Severity_LOW
+	case "MEDIUM", "MODERATE":
+		return vulnerability_go_proto.Severity_MEDIUM
+	case "HIGH":
+		return vulnerability_go_proto.Severity_HIGH
+	case "CRITICAL":
+		return vulnerability_go_proto.Severity_CRITICAL
+	default:
+		return vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED
+	}
+}
+
+// severityName is the name stored alongside each affected package, which is left empty when the severity isn't known
+func severityName(severity vulnerability_go_proto.Severity) string {
+	if severity == vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED {
+		return ""
+	}
+
+	return severity.String()
+}
+
+// packageVersion returns a version with the given name, or the sentinel version of the given kind when there's no name
+func packageVersion(name string, sentinel package_go_proto.Version_VersionKind) *package_go_proto.Version {
+	if name == "" {
+		return &package_go_proto.Version{Kind: sentinel}
+	}
+
+	return &package_go_proto.Version{Name: name, Kind: package_go_proto.Version_NORMAL}
+}
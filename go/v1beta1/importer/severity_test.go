@@ -0,0 +1,67 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package importer
+
+import (
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("severity", func() {
+	DescribeTable("CVSS v3 base score", func(vector string, expected float64) {
+		score, err := cvssV3BaseScore(vector)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(score).To(BeNumerically("~", expected, 0.001))
+	},
+		Entry("critical", "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8),
+		Entry("scope changed", "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0),
+		Entry("scope changed with privileges", "CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:C/C:L/I:L/A:N", 6.4),
+		Entry("user interaction", "CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N", 6.1),
+		Entry("local", "CVSS:3.0/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H", 7.8),
+		Entry("no impact", "CVSS:3.1/AV:N/AC:H/PR:N/UI:R/S:U/C:N/I:N/A:N", 0.0),
+	)
+
+	DescribeTable("invalid CVSS v3 vectors", func(vector string) {
+		_, err := cvssV3BaseScore(vector)
+
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("CVSS v2", "AV:N/AC:L/Au:N/C:P/I:N/A:N"),
+		Entry("missing metric", "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H"),
+		Entry("unknown value", "CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"),
+		Entry("unknown scope", "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:X/C:H/I:H/A:H"),
+	)
+
+	DescribeTable("score severity", func(score float32, expected vulnerability_go_proto.Severity) {
+		Expect(scoreSeverity(score)).To(Equal(expected))
+	},
+		Entry("none", float32(0), vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED),
+		Entry("low", float32(3.9), vulnerability_go_proto.Severity_LOW),
+		Entry("medium", float32(4), vulnerability_go_proto.Severity_MEDIUM),
+		Entry("high", float32(8.9), vulnerability_go_proto.Severity_HIGH),
+		Entry("critical", float32(9), vulnerability_go_proto.Severity_CRITICAL),
+	)
+
+	DescribeTable("named severity", func(name string, expected vulnerability_go_proto.Severity) {
+		Expect(namedSeverity(name)).To(Equal(expected))
+	},
+		Entry("GitHub moderate", "MODERATE", vulnerability_go_proto.Severity_MEDIUM),
+		Entry("lowercase", "high", vulnerability_go_proto.Severity_HIGH),
+		Entry("unknown", "severe", vulnerability_go_proto.Severity_SEVERITY_UNSPECIFIED),
+	)
+})
@@ -0,0 +1,294 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	grafeasConfig "github.com/grafeas/grafeas/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/importer"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+// adminCommand registers any flags that it accepts, and returns a function that runs the command against the storage
+// backend described by the Grafeas config file, which is also passed to the command.
+type adminCommand func(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error
+
+// adminCommands can be run instead of starting the Grafeas server, e.g. `grafeas-elasticsearch migrate --config config.yaml`
+var adminCommands = map[string]adminCommand{
+	"migrate":                migrateCommand,
+	"delete-project":         deleteProjectCommand,
+	"verify-indices":         verifyIndicesCommand,
+	"restore":                restoreCommand,
+	"audit-events":           auditEventsCommand,
+	"upsert-notes":           upsertNotesCommand,
+	"import-vulnerabilities": importVulnerabilitiesCommand,
+}
+
+func runAdminCommand(logger *zap.Logger, name string, command adminCommand, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := flags.String("config", "", "Path to a config file")
+	run := command(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := grafeasConfig.LoadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	if cfg.StorageType != "elasticsearch" || cfg.StorageConfig == nil {
+		return fmt.Errorf("the config file does not contain an elasticsearch storage configuration")
+	}
+
+	var c *config.ElasticsearchConfig
+	if err := grafeasConfig.ConvertGenericConfigToSpecificType(cfg.StorageConfig, &c); err != nil {
+		return fmt.Errorf("unable to convert config for Elasticsearch: %s", err)
+	}
+
+	if err := c.IsValid(); err != nil {
+		return err
+	}
+
+	es, err := newElasticsearchStorage(logger)(c)
+	if err != nil {
+		return err
+	}
+
+	return run(context.Background(), es, c)
+}
+
+// migrateCommand migrates any indices created with an older schema version, which is useful when automatic migrations
+// are disabled so that they can be run ahead of a deployment.
+func migrateCommand(_ *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		return es.Migrate(ctx)
+	}
+}
+
+// deleteProjectCommand deletes a single project, or finishes deleting any projects whose deletion was interrupted when no
+// project is given. Projects with notes that are referenced from other projects are only deleted with -force.
+func deleteProjectCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	projectId := flags.String("project", "", "ID of the project to delete")
+	force := flags.Bool("force", false, "Delete the project even if its notes are referenced by occurrences in other projects")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		if *projectId == "" {
+			return es.ResumeProjectDeletions(ctx)
+		}
+		if *force {
+			return es.ForceDeleteProject(ctx, *projectId)
+		}
+
+		return es.DeleteProject(ctx, *projectId)
+	}
+}
+
+// verifyIndicesCommand checks that the indices for every project exist, and fails if any problems are found that weren't repaired
+func verifyIndicesCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	repair := flags.Bool("repair", false, "Create missing indices, and restore the project documents for orphaned indices")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		report, err := es.VerifyIndices(ctx, *repair)
+		if err != nil {
+			return err
+		}
+
+		if len(report.InvalidIndices) > 0 {
+			return fmt.Errorf("found indices that were not created by grafeas: %s", strings.Join(report.InvalidIndices, ", "))
+		}
+		if !*repair && !report.Consistent() {
+			return fmt.Errorf("found %d missing indices and %d projects with orphaned indices", len(report.MissingIndices), len(report.OrphanedProjects))
+		}
+
+		return nil
+	}
+}
+
+// restoreCommand restores a note or occurrence that was soft deleted, using its full name, e.g. `projects/rode/notes/abc`
+func restoreCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	noteName := flags.String("note", "", "Name of the note to restore")
+	occurrenceName := flags.String("occurrence", "", "Name of the occurrence to restore")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		if (*noteName == "") == (*occurrenceName == "") {
+			return fmt.Errorf("exactly one of -note or -occurrence must be set")
+		}
+
+		if *noteName != "" {
+			projectId, noteId, err := parseResourceName(*noteName, "notes")
+			if err != nil {
+				return err
+			}
+
+			_, err = es.RestoreNote(ctx, projectId, noteId)
+			return err
+		}
+
+		projectId, occurrenceId, err := parseResourceName(*occurrenceName, "occurrences")
+		if err != nil {
+			return err
+		}
+
+		_, err = es.RestoreOccurrence(ctx, projectId, occurrenceId)
+		return err
+	}
+}
+
+// auditEventsCommand prints the audit events that match the given filters as JSON, one event per line, starting with the most recent
+func auditEventsCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	query := &storage.AuditQuery{}
+	flags.StringVar(&query.User, "user", "", "Only show events for writes made by this user")
+	flags.StringVar(&query.Name, "name", "", "Only show events for this resource, e.g. projects/rode/notes/abc")
+	flags.StringVar(&query.Project, "project", "", "Only show events for resources in this project")
+	operation := flags.String("operation", "", "Only show events for this operation: CREATE, UPDATE, DELETE, or RESTORE")
+	since := flags.Duration("since", 0, "Only show events that happened within this duration, e.g. 24h")
+	flags.IntVar(&query.Limit, "limit", 0, "Maximum number of events to show")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		query.Operation = storage.Operation(strings.ToUpper(*operation))
+		if *since > 0 {
+			query.Since = time.Now().Add(-*since)
+		}
+
+		events, err := es.ListAuditEvents(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// upsertNotesCommand creates or updates the notes in a file that holds a BatchCreateNotesRequest as JSON, and prints
+// the number of notes that were created, updated, or unchanged. The project must already exist, as writing notes to a
+// project without indices would create a notes index without aliases in their place.
+func upsertNotesCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	projectId := flags.String("project", "", "ID of the project to write the notes to")
+	file := flags.String("file", "", "Path to a JSON file with the notes to write, in the format of a BatchCreateNotesRequest")
+	user := flags.String("user", "", "ID of the user recorded in the audit trail for the notes that are written")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, _ *config.ElasticsearchConfig) error {
+		if *projectId == "" || *file == "" {
+			return fmt.Errorf("both -project and -file must be set")
+		}
+
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+
+		request := &pb.BatchCreateNotesRequest{}
+		if err := protojson.Unmarshal(data, proto.MessageV2(request)); err != nil {
+			return fmt.Errorf("unable to parse notes from %s: %s", *file, err)
+		}
+
+		if err := es.InitializeIndices(ctx); err != nil {
+			return err
+		}
+
+		if _, err := es.GetProject(ctx, *projectId); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return fmt.Errorf("project %s doesn't exist, it must be created before notes can be written to it", *projectId)
+			}
+
+			return err
+		}
+
+		report, errs := es.UpsertNotes(ctx, *projectId, *user, request.Notes)
+		if report != nil {
+			if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+				return err
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("unable to write %d notes, the first error was: %s", len(errs), errs[0])
+		}
+
+		return nil
+	}
+}
+
+// importVulnerabilitiesCommand writes the vulnerabilities in OSV and NVD feed files to the provider project as notes,
+// creating the project if it doesn't exist, and prints the number of notes that were created, updated, or unchanged.
+// The indices are initialized first, since the import may run before the server has ever been started.
+func importVulnerabilitiesCommand(flags *flag.FlagSet) func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+	projectId := flags.String("project", "", "ID of the project to write the notes to, instead of the configured provider project")
+	format := flags.String("format", "", "Format of the feed files, either osv or nvd. Detected from each file when not set")
+	user := flags.String("user", "", "ID of the user recorded in the audit trail for the notes that are written")
+
+	return func(ctx context.Context, es *storage.ElasticsearchStorage, c *config.ElasticsearchConfig) error {
+		if *projectId == "" {
+			*projectId = c.Import.ProviderProject
+		}
+		if *projectId == "" {
+			return fmt.Errorf("either -project or import.provider_project must be set")
+		}
+		if flags.NArg() == 0 {
+			return fmt.Errorf("at least one feed file must be given")
+		}
+
+		if err := es.InitializeIndices(ctx); err != nil {
+			return err
+		}
+
+		_, err := es.CreateProject(ctx, *projectId, &prpb.Project{})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			return err
+		}
+
+		report, err := importer.NewImporter(es, *projectId).
+			ImportFiles(ctx, *user, importer.Format(strings.ToLower(*format)), flags.Args()...)
+		if encodeErr := json.NewEncoder(os.Stdout).Encode(report); encodeErr != nil {
+			return encodeErr
+		}
+
+		return err
+	}
+}
+
+// parseResourceName splits a name like `projects/{projectId}/{collection}/{id}` into the project and resource IDs
+func parseResourceName(name, collection string) (string, string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != collection || parts[1] == "" || parts[3] == "" {
+		return "", "", fmt.Errorf("invalid name %q, expected projects/{project}/%s/{id}", name, collection)
+	}
+
+	return parts[1], parts[3], nil
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/grafeas/grafeas/go/v1beta1/server"
@@ -25,6 +26,7 @@ import (
 	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage/filtering"
 	"go.uber.org/zap"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -35,14 +37,26 @@ func main() {
 		log.Fatalf("failed to create logger: %v", err)
 	}
 
-	registerStorageTypeProvider := storage.ElasticsearchStorageTypeProviderCreator(func(c *config.ElasticsearchConfig) (*storage.ElasticsearchStorage, error) {
-		esClient, err := createESClient(logger, c.URL, c.Username, c.Password)
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect to Elasticsearch")
+	if len(os.Args) > 1 {
+		if command, ok := adminCommands[os.Args[1]]; ok {
+			if err := runAdminCommand(logger, os.Args[1], command, os.Args[2:]); err != nil {
+				logger.Fatal("admin command failed", zap.String("command", os.Args[1]), zap.NamedError("error", err))
+			}
+
+			return
 		}
+	}
 
-		return storage.NewElasticsearchStorage(logger.Named("ElasticsearchStore"), esClient, filtering.NewFilterer(), c), nil
-	}, logger)
+	// metrics, such as the results of deleting expired occurrences, are published with expvar
+	if address, ok := os.LookupEnv("METRICS_ADDRESS"); ok {
+		go func() {
+			if err := http.ListenAndServe(address, expvar.Handler()); err != nil {
+				logger.Error("metrics server stopped", zap.NamedError("error", err))
+			}
+		}()
+	}
+
+	registerStorageTypeProvider := storage.ElasticsearchStorageTypeProviderCreator(newElasticsearchStorage(logger), logger)
 
 	err = grafeasStorage.RegisterStorageTypeProvider("elasticsearch", registerStorageTypeProvider)
 	if err != nil {
@@ -55,6 +69,17 @@ func main() {
 	}
 }
 
+func newElasticsearchStorage(logger *zap.Logger) func(c *config.ElasticsearchConfig) (*storage.ElasticsearchStorage, error) {
+	return func(c *config.ElasticsearchConfig) (*storage.ElasticsearchStorage, error) {
+		esClient, err := createESClient(logger, c.URL, c.Username, c.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Elasticsearch")
+		}
+
+		return storage.NewElasticsearchStorage(logger.Named("ElasticsearchStore"), esClient, filtering.NewFilterer(), c), nil
+	}
+}
+
 func createESClient(logger *zap.Logger, elasticsearchEndpoint, username, password string) (*elasticsearch.Client, error) {
 	c, err := elasticsearch.NewClient(elasticsearch.Config{
 		Addresses: []string{
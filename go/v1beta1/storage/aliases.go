@@ -0,0 +1,173 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// Indices are never accessed directly. Every index has a read alias, which is the name returned by projectsIndex,
+// occurrencesIndex, and notesIndex, and a write alias. The index behind the aliases is named after the read alias
+// and the schema version it was created with, so that it can be replaced with a new index without any downtime.
+
+// writeAlias returns the alias used to write documents to the index behind a read alias
+func writeAlias(alias string) string {
+	return alias + "-write"
+}
+
+// backingIndex returns the name of the index created for a read alias with the current schema version
+func backingIndex(alias string) string {
+	return fmt.Sprintf("%s-v%d", alias, schemaVersion)
+}
+
+// createAliasedIndex creates a backing index for the current schema version along with its read and write aliases
+func (es *ElasticsearchStorage) createAliasedIndex(ctx context.Context, log *zap.Logger, alias string) error {
+	index := backingIndex(alias)
+	log = log.With(zap.String("index", index), zap.String("alias", alias))
+
+	body := &esIndexCreateRequest{
+		Aliases: map[string]*esIndexAlias{
+			alias: {},
+			writeAlias(alias): {
+				IsWriteIndex: true,
+			},
+		},
+	}
+	encodedBody, requestJson := encodeRequest(body)
+	log.Debug("creating index", zap.String("request", requestJson))
+
+	res, err := es.client.Indices.Create(
+		index,
+		es.client.Indices.Create.WithContext(ctx),
+		es.client.Indices.Create.WithBody(encodedBody),
+	)
+	if err != nil {
+		return createError(log, "error sending index creation request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error creating index in elasticsearch", res)
+	}
+
+	log.Info("index created")
+
+	return nil
+}
+
+// createAliasedIndexIfNotExists creates a backing index and its aliases, unless the read alias already exists, and
+// returns whether the index was created. An index that predates aliases is also accepted, as it will be replaced with
+// an aliased index when migrated.
+func (es *ElasticsearchStorage) createAliasedIndexIfNotExists(ctx context.Context, log *zap.Logger, alias string) (bool, error) {
+	log = log.With(zap.String("alias", alias))
+
+	res, err := es.client.Indices.Exists([]string{alias}, es.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return false, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return false, createResponseError(log, "error checking if index already exists", res)
+	}
+
+	log.Info("index not found, creating...")
+
+	err = es.createAliasedIndex(ctx, log, alias)
+	// the index may have been created since checking whether it exists
+	if status.Code(err) == codes.AlreadyExists {
+		log.Info("index was created concurrently")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// backingIndexSwap describes replacing the index behind the aliases of an index
+type backingIndexSwap struct {
+	alias  string
+	source string
+	target string
+	// deleteSource removes the source index in the same operation, which also allows an index that predates aliases
+	// to be replaced by an alias with its name
+	deleteSource bool
+	// readOnly only moves the read alias, for source indices that are not the write index, e.g. rolled over indices
+	readOnly bool
+}
+
+// swapBackingIndex atomically moves the aliases from the source index to the target index
+func (es *ElasticsearchStorage) swapBackingIndex(ctx context.Context, log *zap.Logger, swap *backingIndexSwap) error {
+	log = log.With(zap.String("alias", swap.alias), zap.String("source", swap.source), zap.String("target", swap.target))
+
+	aliases := []string{swap.alias}
+	actions := []*esAliasAction{
+		{
+			Add: &esAliasActionTarget{
+				Index: swap.target,
+				Alias: swap.alias,
+			},
+		},
+	}
+	if !swap.readOnly {
+		aliases = append(aliases, writeAlias(swap.alias))
+		actions = append(actions, &esAliasAction{
+			Add: &esAliasActionTarget{
+				Index:        swap.target,
+				Alias:        writeAlias(swap.alias),
+				IsWriteIndex: true,
+			},
+		})
+	}
+
+	if swap.deleteSource {
+		actions = append(actions, &esAliasAction{
+			RemoveIndex: &esAliasActionTarget{
+				Index: swap.source,
+			},
+		})
+	} else {
+		actions = append(actions, &esAliasAction{
+			Remove: &esAliasActionTarget{
+				Index:   swap.source,
+				Aliases: aliases,
+			},
+		})
+	}
+
+	encodedBody, requestJson := encodeRequest(&esAliasActionsRequest{Actions: actions})
+	log.Debug("swapping backing index", zap.String("request", requestJson))
+
+	res, err := es.client.Indices.UpdateAliases(
+		encodedBody,
+		es.client.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error swapping backing index", res)
+	}
+
+	log.Info("backing index swapped")
+
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"net/http"
+)
+
+var _ = Describe("index aliases", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		ctx                  context.Context
+		alias                string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		alias = fmt.Sprintf("%s-%s-occurrences", indexPrefix, fake.LetterN(10))
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), &config.ElasticsearchConfig{})
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("creating an aliased index if it does not exist", func() {
+		var (
+			actualCreated bool
+			actualErr     error
+		)
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualCreated, actualErr = elasticsearchStorage.createAliasedIndexIfNotExists(ctx, logger, alias)
+		})
+
+		It("should check if the read alias exists", func() {
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodHead))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s", alias)))
+		})
+
+		It("should create a backing index for the current schema version with the read and write aliases", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", alias, schemaVersion)))
+
+			body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+			Expect(body.Exists("aliases", alias)).To(BeTrue())
+			Expect(body.Exists("aliases", alias, "is_write_index")).To(BeFalse())
+			Expect(body.Search("aliases", writeAlias(alias), "is_write_index").Data()).To(BeTrue())
+		})
+
+		It("should report that the index was created", func() {
+			Expect(actualCreated).To(BeTrue())
+		})
+
+		When("the read alias already exists", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusOK
+			})
+
+			It("should not create an index", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualCreated).To(BeFalse())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("checking if the read alias exists fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without creating an index", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the index is created concurrently", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1] = &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Body: structToJsonBody(&esErrorResponse{
+						Error:  &esIndexDocError{Type: "resource_already_exists_exception", Reason: fake.LetterN(10)},
+						Status: http.StatusBadRequest,
+					}),
+				}
+			})
+
+			It("should use the existing index", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualCreated).To(BeFalse())
+			})
+		})
+
+		When("creating the index fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			})
+		})
+	})
+
+	Context("swapping the backing index", func() {
+		var (
+			actualErr error
+			swap      *backingIndexSwap
+			source    string
+			target    string
+		)
+
+		BeforeEach(func() {
+			source = fmt.Sprintf("%s-v%d", alias, schemaVersion)
+			target = fmt.Sprintf("%s-v%d", alias, schemaVersion+1)
+			swap = &backingIndexSwap{
+				alias:  alias,
+				source: source,
+				target: target,
+			}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{StatusCode: http.StatusOK},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.swapBackingIndex(ctx, logger, swap)
+		})
+
+		It("should atomically move the read and write aliases to the target index", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal("/_aliases"))
+
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("actions.0.add.index").Data()).To(Equal(target))
+			Expect(body.Path("actions.0.add.alias").Data()).To(Equal(alias))
+			Expect(body.Path("actions.1.add.index").Data()).To(Equal(target))
+			Expect(body.Path("actions.1.add.alias").Data()).To(Equal(writeAlias(alias)))
+			Expect(body.Path("actions.1.add.is_write_index").Data()).To(BeTrue())
+			Expect(body.Path("actions.2.remove.index").Data()).To(Equal(source))
+			Expect(body.Path("actions.2.remove.aliases").Data()).To(ConsistOf(alias, writeAlias(alias)))
+		})
+
+		When("the source index should be deleted", func() {
+			BeforeEach(func() {
+				swap.deleteSource = true
+			})
+
+			It("should remove the source index in the same request", func() {
+				body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+
+				Expect(body.Path("actions.2.remove_index.index").Data()).To(Equal(source))
+				Expect(body.Exists("actions", "2", "remove")).To(BeFalse())
+			})
+		})
+
+		When("the source index is not the write index", func() {
+			BeforeEach(func() {
+				swap.readOnly = true
+			})
+
+			It("should only move the read alias", func() {
+				body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+
+				Expect(body.Path("actions.0.add.alias").Data()).To(Equal(alias))
+				Expect(body.Path("actions.1.remove.index").Data()).To(Equal(source))
+				Expect(body.Path("actions.1.remove.aliases").Data()).To(ConsistOf(alias))
+				Expect(body.Path("actions").Children()).To(HaveLen(2))
+			})
+		})
+
+		When("swapping the aliases fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			})
+		})
+	})
+})
@@ -0,0 +1,444 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	auditResourceProject    = "project"
+	auditResourceNote       = "note"
+	auditResourceOccurrence = "occurrence"
+)
+
+// auditMetrics are published through expvar. The recorded and failures counters track the audit events that were
+// written, and the ones that couldn't be. The runs and deleted counters track the purges of expired events.
+var auditMetrics = expvar.NewMap("grafeas_audit")
+
+// AuditEvent records who made a write to a project, note, or occurrence, and when
+type AuditEvent struct {
+	// Id identifies the event in the audit index
+	Id string `json:"-"`
+	// User is the ID of the user that made the write, if known
+	User      string    `json:"user"`
+	Operation Operation `json:"operation"`
+	// ResourceType is one of project, note, or occurrence
+	ResourceType string    `json:"resourceType"`
+	Name         string    `json:"name"`
+	Project      string    `json:"project"`
+	EventTime    time.Time `json:"eventTime"`
+	// ChangedFields are the JSON paths of the fields that were set by a create, or changed by an update
+	ChangedFields []string `json:"changedFields,omitempty"`
+}
+
+// AuditQuery filters the audit events returned by ListAuditEvents. Fields that aren't set match every event.
+type AuditQuery struct {
+	User      string
+	Name      string
+	Project   string
+	Operation Operation
+	// Since and Until limit the events to a time range, which is inclusive of Since and exclusive of Until
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of events to return, which defaults to and can't exceed the maximum page size
+	Limit int
+}
+
+// auditMappingProperties maps the fields of an audit event
+func auditMappingProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"user":          map[string]interface{}{"type": "keyword"},
+		"operation":     map[string]interface{}{"type": "keyword"},
+		"resourceType":  map[string]interface{}{"type": "keyword"},
+		"name":          map[string]interface{}{"type": "keyword"},
+		"project":       map[string]interface{}{"type": "keyword"},
+		"eventTime":     map[string]interface{}{"type": "date_nanos"},
+		"changedFields": map[string]interface{}{"type": "keyword"},
+	}
+}
+
+// ListAuditEvents returns the audit events that match the query, starting with the most recent
+func (es *ElasticsearchStorage) ListAuditEvents(ctx context.Context, query *AuditQuery) ([]*AuditEvent, error) {
+	log := es.logger.Named("ListAuditEvents")
+
+	if !es.config.Audit.Enabled {
+		return nil, status.Error(codes.FailedPrecondition, "audit events are not enabled")
+	}
+
+	var filters []interface{}
+	for field, value := range map[string]string{
+		"user":      query.User,
+		"name":      query.Name,
+		"project":   query.Project,
+		"operation": string(query.Operation),
+	} {
+		if value != "" {
+			filters = append(filters, map[string]interface{}{
+				"term": map[string]interface{}{field: value},
+			})
+		}
+	}
+
+	timeRange := map[string]interface{}{}
+	if !query.Since.IsZero() {
+		timeRange["gte"] = query.Since.UTC().Format(time.RFC3339Nano)
+	}
+	if !query.Until.IsZero() {
+		timeRange["lt"] = query.Until.UTC().Format(time.RFC3339Nano)
+	}
+	if len(timeRange) > 0 {
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{"eventTime": timeRange},
+		})
+	}
+
+	size := query.Limit
+	if size <= 0 || size > grafeasMaxPageSize {
+		size = grafeasMaxPageSize
+	}
+
+	encodedBody, requestJson := encodeRequest(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filters,
+			},
+		},
+		"sort": map[string]interface{}{
+			"eventTime": esSortOrderDecending,
+		},
+	})
+	log = log.With(zap.String("request", requestJson))
+	log.Debug("listing audit events")
+
+	res, err := es.client.Search(
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithIndex(auditIndex()),
+		es.client.Search.WithBody(encodedBody),
+		es.client.Search.WithSize(size),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error listing audit events", res)
+	}
+
+	var searchResults esSearchResponse
+	if err := decodeResponse(res.Body, &searchResults); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	var events []*AuditEvent
+	for _, hit := range searchResults.Hits.Hits {
+		event := &AuditEvent{}
+		if err := json.Unmarshal(hit.Source, event); err != nil {
+			return nil, createError(log, "error unmarshalling audit event", err)
+		}
+		event.Id = hit.ID
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// newAuditEvent creates the audit event for a write to a resource. The state of the resource before and after the write
+// is used to find the fields that changed, and either may be nil, e.g. for creates and deletes.
+func (es *ElasticsearchStorage) newAuditEvent(ctx context.Context, userId string, operation Operation, name string, before, after interface{}) (*AuditEvent, error) {
+	fields, err := changedFields(before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceType, projectId := parseAuditName(name)
+
+	return &AuditEvent{
+		User:          es.auditUser(ctx, userId),
+		Operation:     operation,
+		ResourceType:  resourceType,
+		Name:          name,
+		Project:       projectId,
+		EventTime:     time.Now().UTC(),
+		ChangedFields: fields,
+	}, nil
+}
+
+// recordAuditEvent records a single write when auditing is enabled
+func (es *ElasticsearchStorage) recordAuditEvent(ctx context.Context, log *zap.Logger, userId string, operation Operation, name string, before, after interface{}) {
+	if !es.config.Audit.Enabled {
+		return
+	}
+
+	event, err := es.newAuditEvent(ctx, userId, operation, name, before, after)
+	if err != nil {
+		auditMetrics.Add("failures", 1)
+		log.Error("error creating audit event", zap.Error(err))
+		return
+	}
+
+	es.recordAuditEvents(ctx, log, []*AuditEvent{event})
+}
+
+// appendAuditEvent adds the audit event for a resource that was written by a bulk request
+func (es *ElasticsearchStorage) appendAuditEvent(ctx context.Context, log *zap.Logger, events []*AuditEvent, userId string, operation Operation, name string, before, after interface{}) []*AuditEvent {
+	event, err := es.newAuditEvent(ctx, userId, operation, name, before, after)
+	if err != nil {
+		auditMetrics.Add("failures", 1)
+		log.Error("error creating audit event", zap.String("name", name), zap.Error(err))
+		return events
+	}
+
+	return append(events, event)
+}
+
+// recordAuditEvents writes audit events to the audit index. Like revisions, the write has already succeeded by the time
+// it's audited, so an event that can't be written is logged instead of failing the request.
+func (es *ElasticsearchStorage) recordAuditEvents(ctx context.Context, log *zap.Logger, events []*AuditEvent) {
+	if !es.config.Audit.Enabled || len(events) == 0 {
+		return
+	}
+
+	var items []*bulkItem
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			auditMetrics.Add("failures", 1)
+			log.Error("error marshalling audit event", zap.String("name", event.Name), zap.Error(err))
+			continue
+		}
+
+		items = append(items, &bulkItem{
+			metadata: &esBulkQueryFragment{
+				Create: &esBulkQueryIndexFragment{
+					Index: writeAlias(auditIndex()),
+					Id:    uuid.New().String(),
+				},
+			},
+			document: data,
+		})
+	}
+
+	responses, requestErrs := es.bulkWrite(ctx, log, items)
+	for i, item := range responses {
+		if item == nil {
+			auditMetrics.Add("failures", 1)
+			log.Error("error recording audit event", zap.Error(requestErrs[i]))
+		} else if item.Error != nil {
+			auditMetrics.Add("failures", 1)
+			log.Error("error recording audit event", zap.String("type", item.Error.Type), zap.String("reason", item.Error.Reason))
+		} else {
+			auditMetrics.Add("recorded", 1)
+		}
+	}
+}
+
+// auditUser returns the user ID passed by Grafeas, or the user ID from the configured request header for writes that
+// Grafeas doesn't pass a user ID to
+func (es *ElasticsearchStorage) auditUser(ctx context.Context, userId string) string {
+	if userId != "" || es.config.Audit.UserHeader == "" {
+		return userId
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get(es.config.Audit.UserHeader)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// parseAuditName returns the type of resource and the project ID for a resource name
+func parseAuditName(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 {
+		return "", ""
+	}
+
+	if len(parts) == 4 && parts[2] == "notes" {
+		return auditResourceNote, parts[1]
+	}
+	if len(parts) == 4 && parts[2] == "occurrences" {
+		return auditResourceOccurrence, parts[1]
+	}
+
+	return auditResourceProject, parts[1]
+}
+
+// changedFields compares the JSON representation of two messages, and returns the paths of the fields that differ.
+// Nested messages are compared field by field, while repeated fields are compared as a whole.
+func changedFields(before, after interface{}) ([]string, error) {
+	beforeFields, err := messageFields(before)
+	if err != nil {
+		return nil, err
+	}
+
+	afterFields, err := messageFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	diffFields("", beforeFields, afterFields, &fields)
+	sort.Strings(fields)
+
+	return fields, nil
+}
+
+// contentChanges returns the JSON paths of the fields that differ between two messages, other than the fields that are
+// set by the server when a resource is written
+func contentChanges(before, after interface{}) ([]string, error) {
+	fields, err := changedFields(before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	for _, field := range fields {
+		if !serverSetFields[strings.SplitN(field, ".", 2)[0]] {
+			changes = append(changes, field)
+		}
+	}
+
+	return changes, nil
+}
+
+func messageFields(protoMessage interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if protoMessage == nil {
+		return fields, nil
+	}
+
+	data, err := protojson.Marshal(proto.MessageV2(protoMessage))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+func diffFields(prefix string, before, after map[string]interface{}, fields *[]string) {
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		path := prefix + key
+		beforeValue, afterValue := before[key], after[key]
+
+		beforeObject, beforeIsObject := beforeValue.(map[string]interface{})
+		afterObject, afterIsObject := afterValue.(map[string]interface{})
+		if (beforeIsObject || beforeValue == nil) && (afterIsObject || afterValue == nil) {
+			diffFields(path+".", beforeObject, afterObject, fields)
+			continue
+		}
+
+		if !reflect.DeepEqual(beforeValue, afterValue) {
+			*fields = append(*fields, path)
+		}
+	}
+}
+
+// startAuditRetention periodically deletes audit events older than the retention period until the context is cancelled
+func (es *ElasticsearchStorage) startAuditRetention(ctx context.Context, log *zap.Logger) {
+	interval := es.config.Audit.Interval()
+	log = log.Named("AuditRetention")
+	log.Info("starting audit event retention", zap.Duration("interval", interval), zap.String("retention", es.config.Audit.Retention))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			// errors are logged when they're created, and the next attempt may succeed
+			_ = es.purgeExpiredAuditEvents(ctx, log)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpiredAuditEvents deletes the audit events that happened before the start of the retention period
+func (es *ElasticsearchStorage) purgeExpiredAuditEvents(ctx context.Context, log *zap.Logger) error {
+	auditMetrics.Add("runs", 1)
+
+	encodedBody, requestJson := encodeRequest(map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"eventTime": map[string]interface{}{
+					"lt": fmt.Sprintf("now-%s", es.config.Audit.Retention),
+				},
+			},
+		},
+	})
+	log.Debug("purging expired audit events", zap.String("request", requestJson))
+
+	res, err := es.client.DeleteByQuery(
+		[]string{auditIndex()},
+		encodedBody,
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
+		es.client.DeleteByQuery.WithRefresh(withRefreshBool(es.config.Refresh)),
+	)
+	if err != nil {
+		auditMetrics.Add("failures", 1)
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		auditMetrics.Add("failures", 1)
+		return createResponseError(log, "error purging expired audit events", res)
+	}
+
+	var deletedResults esDeleteResponse
+	if err := decodeResponse(res.Body, &deletedResults); err != nil {
+		auditMetrics.Add("failures", 1)
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	auditMetrics.Add("deleted", int64(deletedResults.Deleted))
+	log.Info("expired audit events purged", zap.Int("deleted", deletedResults.Deleted))
+
+	return nil
+}
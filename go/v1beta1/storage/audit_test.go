@@ -0,0 +1,478 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("audit events", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+		noteId               string
+		noteName             string
+		userId               string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			Audit: config.AuditConfig{
+				Enabled:    true,
+				Retention:  "30d",
+				UserHeader: "x-user-id",
+			},
+		}
+		projectId = fake.LetterN(10)
+		noteId = fake.LetterN(10)
+		noteName = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+		userId = fake.LetterN(10)
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("creating a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusCreated,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: fake.LetterN(10), SeqNo: 1, PrimaryTerm: 1}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.CreateNote(ctx, projectId, noteId, userId, &pb.Note{ShortDescription: fake.Word()})
+		})
+
+		It("should record who created the note, and which fields were set", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+			metadata, event := bulkRequestRevision(transport.receivedHttpRequests[2])
+			Expect(metadata.Path("create._index").Data()).To(Equal(writeAlias(auditIndex())))
+			Expect(metadata.Path("create._id").Data()).ToNot(BeEmpty())
+			Expect(event.Path("user").Data()).To(Equal(userId))
+			Expect(event.Path("operation").Data()).To(BeEquivalentTo(OperationCreate))
+			Expect(event.Path("resourceType").Data()).To(Equal("note"))
+			Expect(event.Path("name").Data()).To(Equal(noteName))
+			Expect(event.Path("project").Data()).To(Equal(projectId))
+			Expect(event.Path("eventTime").Data()).ToNot(BeEmpty())
+			Expect(event.Path("changedFields").Data()).To(ConsistOf("createTime", "name", "shortDescription"))
+		})
+
+		When("the audit event can't be recorded", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = createEsBulkNoteCreateResponse([]int{http.StatusInternalServerError})
+			})
+
+			It("should still create the note", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+			})
+		})
+
+		When("audit events are disabled", func() {
+			BeforeEach(func() {
+				esConfig.Audit.Enabled = false
+			})
+
+			It("should not record an audit event", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+
+	Context("updating a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			existingNote := &pb.Note{
+				Name:             noteName,
+				ShortDescription: fake.Word(),
+				LongDescription:  fake.Sentence(5),
+			}
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(existingNote, &documentVersion{index: fake.LetterN(10), seqNo: 1, primaryTerm: 1}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Id: documentId(noteName)}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-user-id", userId))
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.UpdateNote(ctx, projectId, noteId, &pb.Note{ShortDescription: fake.LetterN(12)}, &fieldmaskpb.FieldMask{Paths: []string{"short_description"}})
+		})
+
+		It("should record the user from the request metadata, and the fields that changed", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+			_, event := bulkRequestRevision(transport.receivedHttpRequests[2])
+			Expect(event.Path("user").Data()).To(Equal(userId))
+			Expect(event.Path("operation").Data()).To(BeEquivalentTo(OperationUpdate))
+			Expect(event.Path("changedFields").Data()).To(ConsistOf("shortDescription", "updateTime"))
+		})
+	})
+
+	Context("deleting a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.DeleteNote(ctx, projectId, noteId)
+		})
+
+		It("should record the delete without any changed fields", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			_, event := bulkRequestRevision(transport.receivedHttpRequests[1])
+			Expect(event.Path("operation").Data()).To(BeEquivalentTo(OperationDelete))
+			Expect(event.Path("user").Data()).To(BeEmpty())
+			Expect(event.Exists("changedFields")).To(BeFalse())
+		})
+
+		When("the delete fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusNotFound
+			})
+
+			It("should not record an audit event", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("batch creating notes", func() {
+		var actualErrs []error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusConflict, http.StatusCreated}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErrs = elasticsearchStorage.BatchCreateNotes(ctx, projectId, userId, map[string]*pb.Note{
+				"a": {},
+				"b": {},
+			})
+		})
+
+		It("should only record audit events for the notes that were created", func() {
+			Expect(actualErrs).To(HaveLen(1))
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "name")).To(Equal([]string{
+				fmt.Sprintf("projects/%s/notes/b", projectId),
+			}))
+		})
+
+		When("the response for a note isn't the result of a create", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].Body = createEsBulkUnexpectedItemResponse(http.StatusCreated)
+			})
+
+			It("should return an error for the note without recording an audit event for it", func() {
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "name")).To(Equal([]string{
+					fmt.Sprintf("projects/%s/notes/a", projectId),
+				}))
+			})
+		})
+	})
+
+	Context("listing audit events", func() {
+		var (
+			query        *AuditQuery
+			events       []*AuditEvent
+			actualEvents []*AuditEvent
+			actualErr    error
+		)
+
+		BeforeEach(func() {
+			query = &AuditQuery{
+				User:  userId,
+				Name:  noteName,
+				Since: time.Now().Add(-time.Hour),
+			}
+			events = []*AuditEvent{
+				{
+					User:         userId,
+					Operation:    OperationUpdate,
+					ResourceType: "note",
+					Name:         noteName,
+					Project:      projectId,
+					EventTime:    time.Now().UTC(),
+					ChangedFields: []string{
+						"shortDescription",
+					},
+				},
+				{
+					User:         userId,
+					Operation:    OperationCreate,
+					ResourceType: "note",
+					Name:         noteName,
+					Project:      projectId,
+					EventTime:    time.Now().Add(-time.Minute).UTC(),
+				},
+			}
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsAuditSearchResponse(events...),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualEvents, actualErr = elasticsearchStorage.ListAuditEvents(ctx, query)
+		})
+
+		It("should search for the matching events, starting with the most recent", func() {
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", auditIndex())))
+			Expect(transport.receivedHttpRequests[0].URL.Query().Get("size")).To(Equal(fmt.Sprint(grafeasMaxPageSize)))
+
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("sort.eventTime").Data()).To(Equal("desc"))
+
+			filters := body.Path("query.bool.filter").Children()
+			Expect(filters).To(HaveLen(3))
+
+			terms := map[string]interface{}{}
+			for _, filter := range filters {
+				for field, value := range filter.Path("term").ChildrenMap() {
+					terms[field] = value.Data()
+				}
+				if filter.Exists("range") {
+					Expect(filter.Path("range.eventTime.gte").Data()).To(Equal(query.Since.UTC().Format(time.RFC3339Nano)))
+					Expect(filter.Exists("range", "eventTime", "lt")).To(BeFalse())
+				}
+			}
+			Expect(terms).To(Equal(map[string]interface{}{
+				"user": userId,
+				"name": noteName,
+			}))
+		})
+
+		It("should return the events", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualEvents).To(HaveLen(2))
+
+			Expect(actualEvents[0].Id).To(Equal("event-0"))
+			Expect(actualEvents[0].Operation).To(Equal(OperationUpdate))
+			Expect(actualEvents[0].ChangedFields).To(Equal(events[0].ChangedFields))
+			Expect(actualEvents[1].EventTime).To(BeTemporally("==", events[1].EventTime))
+		})
+
+		When("a smaller limit is requested", func() {
+			BeforeEach(func() {
+				query.Limit = 10
+			})
+
+			It("should limit the number of events", func() {
+				Expect(transport.receivedHttpRequests[0].URL.Query().Get("size")).To(Equal("10"))
+			})
+		})
+
+		When("audit events are disabled", func() {
+			BeforeEach(func() {
+				esConfig.Audit.Enabled = false
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(BeEmpty())
+			})
+		})
+
+		When("the search fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			})
+		})
+	})
+
+	Context("purging expired audit events", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esDeleteResponse{Deleted: fake.Number(1, 100)}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.purgeExpiredAuditEvents(ctx, logger)
+		})
+
+		It("should delete the events that happened before the retention period", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_delete_by_query", auditIndex())))
+
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("query.range.eventTime.lt").Data()).To(Equal("now-30d"))
+		})
+
+		When("the delete fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			})
+		})
+	})
+
+	Context("finding the fields that changed", func() {
+		It("should return the paths of nested fields that changed", func() {
+			before := &pb.Note{
+				Name:             noteName,
+				ShortDescription: fake.Word(),
+				RelatedUrl:       []*common_go_proto.RelatedUrl{{Url: fake.URL()}},
+				Type: &pb.Note_Vulnerability{
+					Vulnerability: &vulnerability_go_proto.Vulnerability{CvssScore: 1},
+				},
+			}
+			after := &pb.Note{
+				Name:             noteName,
+				ShortDescription: before.ShortDescription,
+				RelatedUrl:       []*common_go_proto.RelatedUrl{{Url: fake.URL()}},
+				Type: &pb.Note_Vulnerability{
+					Vulnerability: &vulnerability_go_proto.Vulnerability{CvssScore: 2},
+				},
+			}
+
+			fields, err := changedFields(before, after)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fields).To(Equal([]string{"relatedUrl", "vulnerability.cvssScore"}))
+		})
+
+		It("should return nothing when neither message is set", func() {
+			fields, err := changedFields(nil, nil)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fields).To(BeEmpty())
+		})
+	})
+})
+
+func createEsAuditSearchResponse(events ...*AuditEvent) io.ReadCloser {
+	var hits []*esSearchResponseHit
+	for i, event := range events {
+		source, err := json.Marshal(event)
+		Expect(err).ToNot(HaveOccurred())
+
+		hits = append(hits, &esSearchResponseHit{
+			ID:     fmt.Sprintf("event-%d", i),
+			Source: source,
+		})
+	}
+
+	return structToJsonBody(&esSearchResponse{
+		Hits: &esSearchResponseHits{
+			Total: &esSearchResponseTotal{Value: len(hits)},
+			Hits:  hits,
+		},
+	})
+}
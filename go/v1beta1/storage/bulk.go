@@ -0,0 +1,204 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bulkRetryBackoff is how long to wait before retrying documents that were rejected by ES, doubled on every retry
+var bulkRetryBackoff = 100 * time.Millisecond
+
+// bulkItem is a single operation in a bulk request, along with the document it applies to
+type bulkItem struct {
+	metadata *esBulkQueryFragment
+	document []byte
+}
+
+// size is the number of bytes the item takes up in the ndjson body of a bulk request
+func (b *bulkItem) size() int {
+	metadata, _ := json.Marshal(b.metadata)
+
+	return len(metadata) + len(b.document) + 2
+}
+
+// result returns the response for the operation, whether it was an index or a create
+func (i *esBulkResponseItem) result() *esIndexDocResponse {
+	if i.Create != nil {
+		return i.Create
+	}
+
+	return i.Index
+}
+
+// bulkWrite sends the items to ES using the bulk API. The items are split into chunks based on the configured number of
+// documents and size, which are sent concurrently. Items that are rejected because the cluster is overloaded are retried.
+// The returned responses and errors are in the same order as the items. When the request for a chunk fails entirely,
+// the response for each item in that chunk is nil and the error for the chunk is returned for each of them instead.
+// Items that ES doesn't report a create or index result for also have a nil response, along with an error of their own.
+func (es *ElasticsearchStorage) bulkWrite(ctx context.Context, log *zap.Logger, items []*bulkItem) ([]*esIndexDocResponse, []error) {
+	bulkConfig := es.config.Bulk.WithDefaults()
+	chunks := bulkChunks(items, bulkConfig.MaxDocs, bulkConfig.MaxBytes)
+	log.Debug("writing documents in chunks", zap.Int("documents", len(items)), zap.Int("chunks", len(chunks)))
+
+	var (
+		responses = make([]*esIndexDocResponse, len(items))
+		errs      = make([]error, len(items))
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, bulkConfig.Concurrency)
+	)
+	for _, chunk := range chunks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(start, end int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			// each chunk writes to its own range of the responses and errors, so no synchronization is needed
+			err := es.sendBulkChunk(ctx, log, items[start:end], responses[start:end], errs[start:end], bulkConfig.MaxRetries)
+			if err != nil {
+				for i := start; i < end; i++ {
+					errs[i] = err
+				}
+			}
+		}(chunk[0], chunk[1])
+	}
+	wg.Wait()
+
+	return responses, errs
+}
+
+// bulkChunks splits the items into ranges of at most maxDocs items and roughly maxBytes in size.
+// An item that is larger than maxBytes is sent in a chunk of its own.
+func bulkChunks(items []*bulkItem, maxDocs, maxBytes int) [][2]int {
+	var (
+		chunks     [][2]int
+		start      int
+		chunkBytes int
+	)
+	for i, item := range items {
+		size := item.size()
+		if i > start && (i-start >= maxDocs || chunkBytes+size > maxBytes) {
+			chunks = append(chunks, [2]int{start, i})
+			start = i
+			chunkBytes = 0
+		}
+
+		chunkBytes += size
+	}
+
+	if start < len(items) {
+		chunks = append(chunks, [2]int{start, len(items)})
+	}
+
+	return chunks
+}
+
+// sendBulkChunk sends a single bulk request for the items, storing the response for each item in responses, or an error
+// in errs when the response for an item isn't the result of a create or index operation.
+// Items rejected with a 429 are resent, with backoff, until they succeed or maxRetries is reached.
+func (es *ElasticsearchStorage) sendBulkChunk(ctx context.Context, log *zap.Logger, items []*bulkItem, responses []*esIndexDocResponse, errs []error, maxRetries int) error {
+	pending := make([]int, len(items))
+	for i := range items {
+		pending[i] = i
+	}
+
+	backoff := bulkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		canRetry := attempt < maxRetries
+
+		// build the request body using newline delimited JSON (ndjson)
+		// each item is represented by two JSON structures:
+		// the first is the metadata that represents the ES operation
+		// the second is the source payload
+		var body bytes.Buffer
+		for _, i := range pending {
+			metadata, _ := json.Marshal(items[i].metadata)
+			body.Write(metadata)
+			body.WriteString("\n")
+			body.Write(items[i].document)
+			body.WriteString("\n")
+		}
+
+		log.Debug("attempting ES bulk request", zap.String("payload", body.String()), zap.Int("attempt", attempt))
+
+		res, err := es.client.Bulk(
+			bytes.NewReader(body.Bytes()),
+			es.client.Bulk.WithContext(ctx),
+			es.client.Bulk.WithRefresh(es.config.Refresh.String()),
+		)
+		if err != nil {
+			return createError(log, "failed while sending request to ES", err)
+		}
+
+		var retry []int
+		if res.StatusCode == http.StatusTooManyRequests && canRetry {
+			res.Body.Close()
+			retry = pending
+		} else {
+			if res.IsError() {
+				return createResponseError(log, "unexpected response from ES", res)
+			}
+
+			response := &esBulkResponse{}
+			if err := decodeResponse(res.Body, response); err != nil {
+				return createError(log, "error decoding ES response", err)
+			}
+			if len(response.Items) != len(pending) {
+				return createError(log, "unexpected number of items in ES response", fmt.Errorf("expected %d items, got %d", len(pending), len(response.Items)))
+			}
+
+			// each operation in the bulk request has its own status
+			for j, i := range pending {
+				result := response.Items[j].result()
+				if result == nil {
+					// without a result, callers would have no way to tell that the item wasn't written
+					errs[i] = createError(log, "unexpected item in ES bulk response", fmt.Errorf("expected a create or index result for item %d", i))
+					continue
+				}
+				if result.Status == http.StatusTooManyRequests && canRetry {
+					retry = append(retry, i)
+					continue
+				}
+
+				responses[i] = result
+			}
+		}
+
+		if len(retry) == 0 {
+			return nil
+		}
+
+		log.Info("retrying documents rejected by ES", zap.Int("documents", len(retry)), zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return createError(log, "bulk request cancelled while retrying rejected documents", ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		pending = retry
+		backoff *= 2
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var _ = Describe("bulk writes", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		originalBackoff      time.Duration
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		originalBackoff = bulkRetryBackoff
+		bulkRetryBackoff = 0
+		// a single concurrent request keeps the order of the requests to the mock transport predictable
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			Bulk: config.BulkConfig{
+				MaxDocs:     2,
+				Concurrency: 1,
+				MaxRetries:  2,
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		bulkRetryBackoff = originalBackoff
+		mockCtrl.Finish()
+	})
+
+	Context("writing documents", func() {
+		var (
+			items        []*bulkItem
+			actualResult []*esIndexDocResponse
+			actualErrs   []error
+		)
+
+		BeforeEach(func() {
+			items = generateTestBulkItems(5)
+		})
+
+		JustBeforeEach(func() {
+			actualResult, actualErrs = elasticsearchStorage.bulkWrite(ctx, logger, items)
+		})
+
+		When("every document is written successfully", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated})},
+				}
+			})
+
+			It("should split the documents into chunks of the configured size", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[0], "document")).To(Equal([]string{"0", "1"}))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[1], "document")).To(Equal([]string{"2", "3"}))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "document")).To(Equal([]string{"4"}))
+			})
+
+			It("should send each chunk to the bulk API with the configured refresh", func() {
+				for _, request := range transport.receivedHttpRequests {
+					Expect(request.URL.Path).To(Equal("/_bulk"))
+					Expect(request.URL.Query().Get("refresh")).To(Equal(esConfig.Refresh.String()))
+				}
+			})
+
+			It("should return a response for each document", func() {
+				Expect(actualErrs).To(Equal(make([]error, len(items))))
+				Expect(actualResult).To(HaveLen(len(items)))
+				for _, result := range actualResult {
+					Expect(result.Status).To(Equal(http.StatusCreated))
+				}
+			})
+		})
+
+		When("the documents exceed the maximum request size", func() {
+			BeforeEach(func() {
+				esConfig.Bulk.MaxDocs = 10
+				esConfig.Bulk.MaxBytes = items[0].size()*2 + 1
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated})},
+				}
+			})
+
+			It("should split the documents into chunks below that size", func() {
+				Expect(actualErrs).To(Equal(make([]error, len(items))))
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[0], "document")).To(Equal([]string{"0", "1"}))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "document")).To(Equal([]string{"4"}))
+			})
+		})
+
+		When("some documents are rejected because the cluster is overloaded", func() {
+			BeforeEach(func() {
+				items = generateTestBulkItems(2)
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusTooManyRequests})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated})},
+				}
+			})
+
+			It("should only retry the rejected documents", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[1], "document")).To(Equal([]string{"1"}))
+			})
+
+			It("should return the response from the retry", func() {
+				Expect(actualErrs).To(Equal(make([]error, len(items))))
+				Expect(actualResult[0].Status).To(Equal(http.StatusCreated))
+				Expect(actualResult[1].Status).To(Equal(http.StatusCreated))
+			})
+		})
+
+		When("the whole request is rejected because the cluster is overloaded", func() {
+			BeforeEach(func() {
+				items = generateTestBulkItems(2)
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusTooManyRequests, Body: createGenericEsSearchResponse()},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+				}
+			})
+
+			It("should retry every document", func() {
+				Expect(actualErrs).To(Equal(make([]error, len(items))))
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[1], "document")).To(Equal([]string{"0", "1"}))
+			})
+		})
+
+		When("documents are still rejected after the maximum number of retries", func() {
+			BeforeEach(func() {
+				items = generateTestBulkItems(2)
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusTooManyRequests})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusTooManyRequests})},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusTooManyRequests})},
+				}
+			})
+
+			It("should stop retrying", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			})
+
+			It("should return the rejection as the response for the document", func() {
+				Expect(actualErrs).To(Equal(make([]error, len(items))))
+				Expect(actualResult[0].Status).To(Equal(http.StatusCreated))
+				Expect(actualResult[1].Status).To(Equal(http.StatusTooManyRequests))
+				Expect(actualResult[1].Error).ToNot(BeNil())
+			})
+		})
+
+		When("the request for a chunk fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated})},
+					{StatusCode: http.StatusInternalServerError, Body: createGenericEsSearchResponse()},
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated})},
+				}
+			})
+
+			It("should still write the other chunks", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				Expect(actualResult[0]).ToNot(BeNil())
+				Expect(actualResult[4]).ToNot(BeNil())
+			})
+
+			It("should return the error for the failed chunk instead of responses for its documents", func() {
+				Expect(actualErrs[0]).ToNot(HaveOccurred())
+				Expect(actualErrs[2]).To(HaveOccurred())
+				Expect(actualErrs[3]).To(Equal(actualErrs[2]))
+				Expect(actualErrs[4]).ToNot(HaveOccurred())
+				Expect(actualResult[2]).To(BeNil())
+				Expect(actualResult[3]).To(BeNil())
+			})
+		})
+
+		When("the response contains an item that isn't for a create or index", func() {
+			BeforeEach(func() {
+				items = generateTestBulkItems(2)
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkUnexpectedItemResponse(http.StatusCreated)},
+				}
+			})
+
+			It("should return an error for that document", func() {
+				Expect(actualErrs[0]).ToNot(HaveOccurred())
+				Expect(actualResult[0].Status).To(Equal(http.StatusCreated))
+				assertErrorHasGrpcStatusCode(actualErrs[1], codes.Internal)
+				Expect(actualResult[1]).To(BeNil())
+			})
+		})
+
+		When("the response doesn't contain an item for every document", func() {
+			BeforeEach(func() {
+				items = generateTestBulkItems(2)
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK, Body: createEsBulkNoteCreateResponse([]int{http.StatusCreated})},
+				}
+			})
+
+			It("should return an error for each document", func() {
+				Expect(actualErrs[0]).To(HaveOccurred())
+				Expect(actualErrs[1]).To(HaveOccurred())
+				Expect(actualResult).To(Equal([]*esIndexDocResponse{nil, nil}))
+			})
+		})
+	})
+})
+
+func generateTestBulkItems(count int) []*bulkItem {
+	var items []*bulkItem
+	for i := 0; i < count; i++ {
+		items = append(items, &bulkItem{
+			metadata: &esBulkQueryFragment{
+				Create: &esBulkQueryIndexFragment{
+					Index: fake.LetterN(10),
+					Id:    fake.LetterN(10),
+				},
+			},
+			document: []byte(fmt.Sprintf(`{"document":"%d"}`, i)),
+		})
+	}
+
+	return items
+}
+
+// bulkRequestDocuments returns the value of a field for each document in a bulk request
+func bulkRequestDocuments(request *http.Request, field string) []string {
+	lines := strings.Split(strings.TrimSuffix(string(ioReadCloserToByteSlice(request.Body)), "\n"), "\n")
+
+	var documents []string
+	for i := 1; i < len(lines); i += 2 {
+		document, err := gabs.ParseJSON([]byte(lines[i]))
+		Expect(err).ToNot(HaveOccurred())
+
+		documents = append(documents, document.Path(field).Data().(string))
+	}
+
+	return documents
+}
+
+// createEsBulkUnexpectedItemResponse creates a bulk response with a create result for the given status, followed by an
+// item for an update, which isn't an operation that's sent by bulkWrite
+func createEsBulkUnexpectedItemResponse(status int) io.ReadCloser {
+	return structToJsonBody(map[string]interface{}{
+		"errors": false,
+		"items": []map[string]interface{}{
+			{"create": &esIndexDocResponse{Id: fake.LetterN(10), Status: status}},
+			{"update": &esIndexDocResponse{Id: fake.LetterN(10), Status: http.StatusOK}},
+		},
+	})
+}
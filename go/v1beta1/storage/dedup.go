@@ -0,0 +1,336 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// When occurrences are deduplicated, whether each occurrence was created or updated is returned to the client in the
+// occurrenceResultMetadataKey header, with one value per occurrence in the same order as the response.
+const (
+	occurrenceResultMetadataKey = "occurrence-result"
+	occurrenceResultCreated     = "created"
+	occurrenceResultUpdated     = "updated"
+)
+
+// occurrenceFingerprintNamespace is the namespace of the name-based UUIDs generated from occurrence fingerprints.
+// Changing it would change the name of every deduplicated occurrence.
+var occurrenceFingerprintNamespace = uuid.MustParse("5b0c4d0e-8a9e-4f3c-9a4d-6f1e2c7b8d90")
+
+// occurrenceFingerprintFields are the JSON paths of the details that identify an occurrence of each kind, in addition to
+// its resource, note, and kind. Details that are expected to change between reports, such as severities, fixed versions,
+// and descriptions, are left out so that they're updated instead. Discoveries only have one occurrence per resource and note.
+var occurrenceFingerprintFields = map[common_go_proto.NoteKind][]string{
+	common_go_proto.NoteKind_VULNERABILITY: {"vulnerability.type", "vulnerability.packageIssue[].affectedLocation"},
+	common_go_proto.NoteKind_BUILD:         {"build.provenance.id"},
+	common_go_proto.NoteKind_IMAGE:         {"derivedImage.derivedImage.fingerprint.v2Name"},
+	common_go_proto.NoteKind_PACKAGE:       {"installation.installation.name", "installation.installation.location"},
+	common_go_proto.NoteKind_DEPLOYMENT: {
+		"deployment.deployment.resourceUri",
+		"deployment.deployment.platform",
+		"deployment.deployment.address",
+		"deployment.deployment.deployTime",
+	},
+	common_go_proto.NoteKind_ATTESTATION: {"attestation.attestation"},
+	common_go_proto.NoteKind_INTOTO:      {"intoto.signed"},
+}
+
+// storedOccurrence is an occurrence that was read along with the version of its document
+type storedOccurrence struct {
+	occurrence *pb.Occurrence
+	version    *documentVersion
+}
+
+// exists returns true if the occurrence is stored and isn't a tombstone
+func (s *storedOccurrence) exists() bool {
+	return s != nil && s.version.deleteTime == nil
+}
+
+// occurrenceFingerprint returns a UUID derived from the resource, note, kind, and key details of an occurrence, which is
+// used as the occurrence ID so that the same occurrence always has the same name
+func occurrenceFingerprint(o *pb.Occurrence) (string, error) {
+	fields, err := messageFields(o)
+	if err != nil {
+		return "", err
+	}
+
+	details := map[string]interface{}{}
+	for _, path := range occurrenceFingerprintFields[o.Kind] {
+		if value, ok := fieldValue(fields, path); ok {
+			details[path] = value
+		}
+	}
+
+	// maps are encoded with sorted keys, so the same details always produce the same fingerprint
+	encodedDetails, err := json.Marshal(details)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := strings.Join([]string{o.Resource.GetUri(), o.NoteName, o.Kind.String(), string(encodedDetails)}, "\n")
+
+	return uuid.NewSHA1(occurrenceFingerprintNamespace, []byte(fingerprint)).String(), nil
+}
+
+// fieldValue returns the value at a dotted JSON path. A key ending in [] refers to an array, in which case the rest of
+// the path is followed for each of its elements, and their values are returned in order.
+func fieldValue(value interface{}, path string) (interface{}, bool) {
+	key, rest := path, ""
+	if i := strings.Index(path, "."); i >= 0 {
+		key, rest = path[:i], path[i+1:]
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	arrayKey := strings.TrimSuffix(key, "[]")
+	value, ok = object[arrayKey]
+	if !ok {
+		return nil, false
+	}
+
+	if arrayKey != key {
+		elements, ok := value.([]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		var values []interface{}
+		for _, element := range elements {
+			if rest == "" {
+				values = append(values, element)
+			} else if elementValue, ok := fieldValue(element, rest); ok {
+				values = append(values, elementValue)
+			}
+		}
+
+		return values, true
+	}
+
+	if rest == "" {
+		return value, true
+	}
+
+	return fieldValue(value, rest)
+}
+
+// nameDeduplicatedOccurrence names an occurrence after its fingerprint, and returns the occurrence ID
+func nameDeduplicatedOccurrence(projectId string, o *pb.Occurrence) (string, error) {
+	fingerprint, err := occurrenceFingerprint(o)
+	if err != nil {
+		return "", err
+	}
+
+	o.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, fingerprint)
+
+	return fingerprint, nil
+}
+
+// duplicateOccurrences finds the occurrences in a batch that share a name with a later occurrence in the same batch.
+// Only the last of them is written, and the positions of the others are mapped to its position.
+func duplicateOccurrences(occurrences []*pb.Occurrence) map[int]int {
+	last := map[string]int{}
+	for i, occurrence := range occurrences {
+		last[occurrence.Name] = i
+	}
+
+	duplicates := map[int]int{}
+	for i, occurrence := range occurrences {
+		if j := last[occurrence.Name]; j != i {
+			duplicates[i] = j
+		}
+	}
+
+	return duplicates
+}
+
+// findStoredOccurrences fetches the occurrences with the given names, including tombstones, keyed by name.
+// Occurrences that haven't been stored are left out.
+func (es *ElasticsearchStorage) findStoredOccurrences(ctx context.Context, log *zap.Logger, projectId string, names []string) (map[string]*storedOccurrence, error) {
+	stored := map[string]*storedOccurrence{}
+	err := es.findStoredDocuments(ctx, log, es.occurrencesIndex(projectId), projectId, names, func(hit *esSearchResponseHit, version *documentVersion) error {
+		occurrence := &pb.Occurrence{}
+		version, err := unmarshalDocument(log, hit.Source, occurrence, version)
+		if err != nil {
+			return err
+		}
+
+		stored[occurrence.Name] = &storedOccurrence{occurrence: occurrence, version: version}
+
+		return nil
+	})
+
+	return stored, err
+}
+
+// findStoredDocuments searches an index for the documents with the given names, including tombstones, and calls found
+// with each hit and its version. Names are looked up a page at a time, so that large batches stay within the result window.
+func (es *ElasticsearchStorage) findStoredDocuments(ctx context.Context, log *zap.Logger, index, projectId string, names []string, found func(hit *esSearchResponseHit, version *documentVersion) error) error {
+	for start := 0; start < len(names); start += grafeasMaxPageSize {
+		end := start + grafeasMaxPageSize
+		if end > len(names) {
+			end = len(names)
+		}
+
+		var ids []string
+		for _, name := range names[start:end] {
+			ids = append(ids, documentId(name))
+		}
+
+		search := &esSearch{
+			Query:            es.projectQuery(projectId, idsQuery(ids...)),
+			SeqNoPrimaryTerm: true,
+		}
+		encodedBody, requestJson := encodeRequest(search)
+		log := log.With(zap.String("request", requestJson))
+		log.Debug("searching for stored documents")
+
+		res, err := es.client.Search(
+			es.client.Search.WithContext(ctx),
+			es.client.Search.WithIndex(index),
+			es.client.Search.WithBody(encodedBody),
+			es.client.Search.WithRouting(es.routing(projectId)),
+			es.client.Search.WithSize(len(ids)),
+		)
+		if err != nil {
+			return createError(log, "error sending request to elasticsearch", err)
+		}
+		if res.IsError() {
+			return createResponseError(log, "error searching elasticsearch for stored documents", res)
+		}
+
+		var searchResults esSearchResponse
+		if err := decodeResponse(res.Body, &searchResults); err != nil {
+			return createError(log, "error unmarshalling elasticsearch response", err)
+		}
+
+		for _, hit := range searchResults.Hits.Hits {
+			version := &documentVersion{
+				index:       hit.Index,
+				seqNo:       hit.SeqNo,
+				primaryTerm: hit.PrimaryTerm,
+			}
+			if err := found(hit, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeStoredOccurrence prepares an occurrence that was reported again to replace the stored occurrence, keeping the time
+// the occurrence was first created. Tombstones are replaced as if the occurrence was new.
+func mergeStoredOccurrence(o *pb.Occurrence, stored *storedOccurrence) {
+	if !stored.exists() {
+		return
+	}
+
+	o.CreateTime = stored.occurrence.CreateTime
+	o.UpdateTime = ptypes.TimestampNow()
+}
+
+// operation returns the operation that's recorded for writing an occurrence over the stored occurrence, along with the
+// stored occurrence when it's updated
+func (s *storedOccurrence) operation() (Operation, interface{}) {
+	if s.exists() {
+		return OperationUpdate, s.occurrence
+	}
+
+	return OperationCreate, nil
+}
+
+// upsertOccurrence writes an occurrence that's named after its fingerprint, replacing the stored occurrence if there is
+// one, and returns the new version along with the occurrence that was replaced
+func (es *ElasticsearchStorage) upsertOccurrence(ctx context.Context, log *zap.Logger, projectId string, o *pb.Occurrence) (*documentVersion, *storedOccurrence, error) {
+	stored, err := es.findStoredOccurrences(ctx, log, projectId, []string{o.Name})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := stored[o.Name]
+	if existing == nil {
+		version, err := es.genericCreate(ctx, log, es.occurrencesIndex(projectId), projectId, o.Name, o)
+		if status.Code(err) != codes.AlreadyExists {
+			return version, nil, err
+		}
+
+		// searches only see occurrences once the index is refreshed, so an occurrence that's reported again soon after
+		// it was first written is read by its ID instead
+		log.Debug("occurrence was written since it was looked up")
+		existing, err = es.getStoredOccurrence(ctx, log, projectId, o.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	log.Debug("replacing stored occurrence", zap.Bool("tombstone", !existing.exists()))
+	mergeStoredOccurrence(o, existing)
+	version, err := es.genericUpdate(ctx, log, projectId, o.Name, o, existing.version)
+
+	return version, existing, err
+}
+
+// getStoredOccurrence reads the stored occurrence with the given name, including tombstones. An occurrence that has
+// been removed since it conflicted with a create was modified concurrently.
+func (es *ElasticsearchStorage) getStoredOccurrence(ctx context.Context, log *zap.Logger, projectId, name string) (*storedOccurrence, error) {
+	occurrence := &pb.Occurrence{}
+	version, err := es.getDocument(ctx, log, es.occurrencesIndex(projectId), projectId, name, occurrence)
+	if status.Code(err) == codes.NotFound {
+		return nil, status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &storedOccurrence{occurrence: occurrence, version: version}, nil
+}
+
+// occurrenceResult returns whether writing an occurrence over the stored occurrence creates or updates it
+func occurrenceResult(stored *storedOccurrence) string {
+	if stored.exists() {
+		return occurrenceResultUpdated
+	}
+
+	return occurrenceResultCreated
+}
+
+// setOccurrenceResults returns whether each deduplicated occurrence was created or updated in the response headers.
+// Like the etag, this has no effect outside of a gRPC request.
+func setOccurrenceResults(ctx context.Context, log *zap.Logger, results []string) {
+	if len(results) == 0 {
+		return
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.MD{occurrenceResultMetadataKey: results}); err != nil {
+		log.Debug("unable to set occurrence result header", zap.Error(err))
+	}
+}
@@ -0,0 +1,485 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("occurrence deduplication", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		stream               *fakeServerTransportStream
+		projectId            string
+	)
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:                    fake.URL(),
+			Refresh:                config.RefreshTrue,
+			DeduplicateOccurrences: true,
+		}
+		stream = &fakeServerTransportStream{}
+		ctx = grpc.NewContextWithServerTransportStream(context.Background(), stream)
+		projectId = fake.LetterN(10)
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("reading the value at a path", func() {
+		fields := map[string]interface{}{
+			"a": map[string]interface{}{
+				"b": []interface{}{
+					map[string]interface{}{"c": "first", "d": "ignored"},
+					map[string]interface{}{"d": "ignored"},
+					map[string]interface{}{"c": "second"},
+				},
+			},
+		}
+
+		It("should follow the rest of the path for each element of an array", func() {
+			value, ok := fieldValue(fields, "a.b[].c")
+
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]interface{}{"first", "second"}))
+		})
+
+		It("should not find a path through a value that isn't an array", func() {
+			_, ok := fieldValue(fields, "a[].b")
+
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("fingerprinting an occurrence", func() {
+		var occurrence *pb.Occurrence
+
+		BeforeEach(func() {
+			occurrence = createVulnerabilityOccurrence()
+		})
+
+		It("should return the same fingerprint for the same occurrence", func() {
+			reported := proto.Clone(occurrence).(*pb.Occurrence)
+			reported.CreateTime = ptypes.TimestampNow()
+			reported.Remediation = fake.Sentence(5)
+			reported.GetVulnerability().Severity = vulnerability_go_proto.Severity_CRITICAL
+
+			Expect(occurrenceFingerprint(occurrence)).To(Equal(mustFingerprint(reported)))
+		})
+
+		It("should return a different fingerprint for a different resource", func() {
+			reported := proto.Clone(occurrence).(*pb.Occurrence)
+			reported.Resource.Uri = fake.URL()
+
+			Expect(occurrenceFingerprint(occurrence)).ToNot(Equal(mustFingerprint(reported)))
+		})
+
+		It("should return a different fingerprint for a different note", func() {
+			reported := proto.Clone(occurrence).(*pb.Occurrence)
+			reported.NoteName = fmt.Sprintf("projects/%s/notes/%s", fake.LetterN(10), fake.LetterN(10))
+
+			Expect(occurrenceFingerprint(occurrence)).ToNot(Equal(mustFingerprint(reported)))
+		})
+
+		It("should return the same fingerprint when a fix is published or the package is rescored", func() {
+			reported := proto.Clone(occurrence).(*pb.Occurrence)
+			packageIssue := reported.GetVulnerability().PackageIssue[0]
+			packageIssue.SeverityName = "CRITICAL"
+			packageIssue.FixedLocation = &vulnerability_go_proto.VulnerabilityLocation{
+				CpeUri:  packageIssue.AffectedLocation.CpeUri,
+				Package: packageIssue.AffectedLocation.Package,
+				Version: &package_go_proto.Version{Name: fake.LetterN(5)},
+			}
+
+			Expect(occurrenceFingerprint(occurrence)).To(Equal(mustFingerprint(reported)))
+		})
+
+		It("should return a different fingerprint for a different package", func() {
+			reported := proto.Clone(occurrence).(*pb.Occurrence)
+			reported.GetVulnerability().PackageIssue[0].AffectedLocation.Version.Name = fake.LetterN(5)
+
+			Expect(occurrenceFingerprint(occurrence)).ToNot(Equal(mustFingerprint(reported)))
+		})
+
+		It("should only use the key details of the occurrence's kind", func() {
+			installation := &pb.Occurrence{
+				Resource: occurrence.Resource,
+				NoteName: occurrence.NoteName,
+				Kind:     common_go_proto.NoteKind_PACKAGE,
+				Details: &pb.Occurrence_Installation{
+					Installation: &package_go_proto.Details{
+						Installation: &package_go_proto.Installation{Name: fake.LetterN(10)},
+					},
+				},
+			}
+			renamed := proto.Clone(installation).(*pb.Occurrence)
+			renamed.GetInstallation().Installation.Name = fake.LetterN(11)
+
+			Expect(occurrenceFingerprint(installation)).ToNot(Equal(mustFingerprint(renamed)))
+		})
+	})
+
+	Context("creating an occurrence", func() {
+		var (
+			occurrence       *pb.Occurrence
+			stored           []*pb.Occurrence
+			writeResponses   []*http.Response
+			actualOccurrence *pb.Occurrence
+			actualErr        error
+		)
+
+		BeforeEach(func() {
+			occurrence = createVulnerabilityOccurrence()
+			stored = nil
+			writeResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: fake.LetterN(10), SeqNo: 3, PrimaryTerm: 1}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			transport.preparedHttpResponses = append([]*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsStoredOccurrencesResponse(stored...),
+				},
+			}, writeResponses...)
+
+			actualOccurrence, actualErr = elasticsearchStorage.CreateOccurrence(ctx, projectId, "", proto.Clone(occurrence).(*pb.Occurrence))
+		})
+
+		It("should name the occurrence after its fingerprint", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualOccurrence.Name).To(Equal(fmt.Sprintf("projects/%s/occurrences/%s", projectId, mustFingerprint(occurrence))))
+		})
+
+		It("should create the occurrence if it isn't stored", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", elasticsearchStorage.occurrencesIndex(projectId))))
+			Expect(transport.receivedHttpRequests[2].URL.Query().Get("op_type")).To(Equal("create"))
+			Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultCreated}))
+		})
+
+		When("the occurrence is already stored", func() {
+			var storedVersion *documentVersion
+
+			BeforeEach(func() {
+				storedOccurrence := proto.Clone(occurrence).(*pb.Occurrence)
+				storedOccurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, mustFingerprint(occurrence))
+				storedOccurrence.CreateTime = ptypes.TimestampNow()
+				storedOccurrence.CreateTime.Seconds -= 3600
+				stored = []*pb.Occurrence{storedOccurrence}
+				storedVersion = &documentVersion{index: storedOccurrencesIndex, seqNo: 2, primaryTerm: 1}
+			})
+
+			It("should replace the stored occurrence, keeping its create time", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+				request := transport.receivedHttpRequests[2]
+				Expect(request.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", storedVersion.index, documentId(actualOccurrence.Name))))
+				Expect(request.URL.Query().Get("if_seq_no")).To(Equal(fmt.Sprint(storedVersion.seqNo)))
+				Expect(request.URL.Query().Get("if_primary_term")).To(Equal(fmt.Sprint(storedVersion.primaryTerm)))
+
+				Expect(actualOccurrence.CreateTime).To(Equal(stored[0].CreateTime))
+				Expect(actualOccurrence.UpdateTime.AsTime()).To(BeTemporally("~", time.Now(), time.Minute))
+			})
+
+			It("should say that the occurrence was updated", func() {
+				Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultUpdated}))
+			})
+		})
+
+		When("the occurrence is reported again before the first report is visible to searches", func() {
+			var (
+				storedOccurrence *pb.Occurrence
+				storedVersion    *documentVersion
+			)
+
+			BeforeEach(func() {
+				storedOccurrence = proto.Clone(occurrence).(*pb.Occurrence)
+				storedOccurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, mustFingerprint(occurrence))
+				storedOccurrence.CreateTime = ptypes.TimestampNow()
+				storedOccurrence.CreateTime.Seconds -= 60
+				storedVersion = &documentVersion{index: storedOccurrencesIndex, seqNo: 2, primaryTerm: 1}
+
+				writeResponses = []*http.Response{
+					{
+						StatusCode: http.StatusConflict,
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsBackingIndicesResponse(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId), 1),
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsVersionedGetResponse(storedOccurrence, storedVersion),
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       structToJsonBody(&esIndexDocResponse{Index: storedVersion.index, SeqNo: 3, PrimaryTerm: 1}),
+					},
+				}
+			})
+
+			It("should read the stored occurrence by its ID", func() {
+				Expect(transport.receivedHttpRequests[4].Method).To(Equal(http.MethodGet))
+				Expect(transport.receivedHttpRequests[4].URL.Path).To(HaveSuffix(fmt.Sprintf("/_doc/%s", documentId(storedOccurrence.Name))))
+			})
+
+			It("should replace the stored occurrence, keeping its create time", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(6))
+
+				request := transport.receivedHttpRequests[5]
+				Expect(request.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", storedVersion.index, documentId(storedOccurrence.Name))))
+				Expect(request.URL.Query().Get("if_seq_no")).To(Equal(fmt.Sprint(storedVersion.seqNo)))
+				Expect(request.URL.Query().Get("if_primary_term")).To(Equal(fmt.Sprint(storedVersion.primaryTerm)))
+				Expect(actualOccurrence.CreateTime).To(Equal(storedOccurrence.CreateTime))
+			})
+
+			It("should say that the occurrence was updated", func() {
+				Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultUpdated}))
+			})
+		})
+
+		When("deduplication is disabled", func() {
+			BeforeEach(func() {
+				esConfig.DeduplicateOccurrences = false
+			})
+
+			It("should create the occurrence with a random name", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualOccurrence.Name).ToNot(HaveSuffix(mustFingerprint(occurrence)))
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(stream.header.Get(occurrenceResultMetadataKey)).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("batch creating occurrences", func() {
+		var (
+			occurrences       []*pb.Occurrence
+			actualOccurrences []*pb.Occurrence
+			actualErrs        []error
+		)
+
+		BeforeEach(func() {
+			occurrences = []*pb.Occurrence{
+				createVulnerabilityOccurrence(),
+				createVulnerabilityOccurrence(),
+			}
+			duplicate := proto.Clone(occurrences[0]).(*pb.Occurrence)
+			duplicate.Remediation = fake.Sentence(5)
+			occurrences = append(occurrences, duplicate)
+
+			storedOccurrence := proto.Clone(occurrences[1]).(*pb.Occurrence)
+			storedOccurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, mustFingerprint(occurrences[1]))
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsStoredOccurrencesResponse(storedOccurrence),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkOccurrenceStatusResponse([]int{http.StatusOK, http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualOccurrences, actualErrs = elasticsearchStorage.BatchCreateOccurrences(ctx, projectId, "", occurrences)
+		})
+
+		It("should only write occurrences with the same fingerprint once", func() {
+			Expect(actualErrs).To(BeEmpty())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+			body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+			Expect(body.Path("query.ids.values").Children()).To(HaveLen(2))
+
+			Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "remediation")).To(Equal([]string{
+				occurrences[1].Remediation,
+				occurrences[2].Remediation,
+			}))
+		})
+
+		It("should replace the stored occurrence in the index that holds it", func() {
+			metadata, _ := bulkRequestRevision(transport.receivedHttpRequests[2])
+			Expect(metadata.Path("index._index").Data()).To(Equal(storedOccurrencesIndex))
+			Expect(metadata.Path("index.if_seq_no").Data()).To(BeEquivalentTo(2))
+			Expect(metadata.Path("index.if_primary_term").Data()).To(BeEquivalentTo(1))
+		})
+
+		It("should return every occurrence, and whether it was created or updated", func() {
+			Expect(actualOccurrences).To(HaveLen(3))
+			Expect(actualOccurrences[0]).To(BeIdenticalTo(actualOccurrences[2]))
+			Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{
+				occurrenceResultCreated,
+				occurrenceResultUpdated,
+				occurrenceResultCreated,
+			}))
+		})
+
+		When("a stored occurrence changes before it's replaced", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = createEsBulkOccurrenceStatusResponse([]int{http.StatusConflict, http.StatusCreated})
+			})
+
+			It("should return an error for that occurrence", func() {
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Aborted)
+				Expect(actualOccurrences).To(HaveLen(2))
+			})
+		})
+
+		When("the stored occurrences can't be found", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = transport.preparedHttpResponses[:2]
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error for every occurrence", func() {
+				Expect(actualErrs).To(HaveLen(3))
+				Expect(actualOccurrences).To(BeEmpty())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+})
+
+// storedOccurrencesIndex is the backing index that holds the occurrences returned by createEsStoredOccurrencesResponse
+const storedOccurrencesIndex = "grafeas-v1beta1-occurrences-v7-000001"
+
+func createVulnerabilityOccurrence() *pb.Occurrence {
+	return &pb.Occurrence{
+		Resource: &pb.Resource{Uri: fake.URL()},
+		NoteName: fmt.Sprintf("projects/%s/notes/%s", fake.LetterN(10), fake.LetterN(10)),
+		Kind:     common_go_proto.NoteKind_VULNERABILITY,
+		Details: &pb.Occurrence_Vulnerability{
+			Vulnerability: &vulnerability_go_proto.Details{
+				Severity: vulnerability_go_proto.Severity_HIGH,
+				PackageIssue: []*vulnerability_go_proto.PackageIssue{
+					{
+						AffectedLocation: &vulnerability_go_proto.VulnerabilityLocation{
+							CpeUri:  fake.LetterN(10),
+							Package: fake.LetterN(10),
+							Version: &package_go_proto.Version{Name: fake.LetterN(5)},
+						},
+					},
+				},
+			},
+		},
+		Remediation: fake.Sentence(5),
+	}
+}
+
+func mustFingerprint(o *pb.Occurrence) string {
+	fingerprint, err := occurrenceFingerprint(o)
+	Expect(err).ToNot(HaveOccurred())
+
+	return fingerprint
+}
+
+func createEsStoredOccurrencesResponse(occurrences ...*pb.Occurrence) io.ReadCloser {
+	var hits []*esSearchResponseHit
+	for _, occurrence := range occurrences {
+		raw, err := protojson.Marshal(proto.MessageV2(occurrence))
+		Expect(err).ToNot(HaveOccurred())
+
+		hits = append(hits, &esSearchResponseHit{
+			ID:          documentId(occurrence.Name),
+			Index:       storedOccurrencesIndex,
+			SeqNo:       2,
+			PrimaryTerm: 1,
+			Source:      raw,
+		})
+	}
+
+	return structToJsonBody(&esSearchResponse{
+		Hits: &esSearchResponseHits{
+			Total: &esSearchResponseTotal{Value: len(hits)},
+			Hits:  hits,
+		},
+	})
+}
+
+func createEsBulkOccurrenceStatusResponse(statuses []int) io.ReadCloser {
+	var items []*esBulkResponseItem
+	for _, status := range statuses {
+		var responseErr *esIndexDocError
+		if status >= http.StatusBadRequest {
+			responseErr = &esIndexDocError{
+				Type:   fake.LetterN(10),
+				Reason: fake.LetterN(10),
+			}
+		}
+
+		items = append(items, &esBulkResponseItem{
+			Index: &esIndexDocResponse{
+				Id:     fake.LetterN(10),
+				Status: status,
+				Error:  responseErr,
+			},
+		})
+	}
+
+	return structToJsonBody(&esBulkResponse{Items: items})
+}
@@ -17,10 +17,11 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
-	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
@@ -31,6 +32,9 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"io"
+	"net/http"
+	"sort"
+	"strings"
 
 	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
 	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
@@ -42,6 +46,11 @@ const apiVersion = "v1beta1"
 const indexPrefix = "grafeas-" + apiVersion
 const grafeasMaxPageSize = 1000
 const sortField = "createTime"
+const projectField = "project"
+
+// protojsonUnmarshaler is used to convert documents into protobuf messages.
+// Unknown fields are discarded, since documents may contain fields that are only used for storage (e.g., the project field).
+var protojsonUnmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
 
 type ElasticsearchStorage struct {
 	client   *elasticsearch.Client
@@ -61,87 +70,73 @@ func NewElasticsearchStorage(logger *zap.Logger, client *elasticsearch.Client, f
 
 // CreateProject creates a project document within the project index, along with two indices that can be used
 // to store notes and occurrences.
-// Additional metadata is attached to the newly created indices to help identify them as part of a Grafeas project
+// Additional metadata is attached to the newly created indices to help identify them as part of a Grafeas project.
+// If the project can't be created, any indices created along with it are removed, unless the project already exists.
+// Indices left behind by an earlier attempt are reused.
 func (es *ElasticsearchStorage) CreateProject(ctx context.Context, projectId string, p *prpb.Project) (*prpb.Project, error) {
 	projectName := fmt.Sprintf("projects/%s", projectId)
 	log := es.logger.Named("CreateProject").With(zap.String("project", projectName))
 
-	// check if project already exists
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": projectName,
-			},
-		},
-	}
-	err := es.genericGet(ctx, log, search, projectsIndex(), &prpb.Project{})
-	if err == nil { // project exists
-		log.Debug("project already exists")
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("project with name %s already exists", projectName))
-	} else if status.Code(err) != codes.NotFound { // unexpected error (we expect a not found error here)
-		return nil, err
-	}
-
 	p.Name = projectName
 
-	// create project document
-	err = es.genericCreate(ctx, log, projectsIndex(), p)
-	if err != nil {
+	if err := es.validateProjectId(projectId); err != nil {
+		log.Debug("invalid project ID", zap.Error(err))
 		return nil, err
 	}
 
-	// create indices for occurrences and notes
-	for _, index := range []string{
-		occurrencesIndex(projectId),
-		notesIndex(projectId),
-	} {
-		res, err := es.client.Indices.Create(
-			index,
-			es.client.Indices.Create.WithContext(ctx),
-			withIndexMetadataAndStringMapping(),
-		)
+	// the indices are created before the project document, so that a project is never visible without them.
+	// notes and occurrences for every project are stored in the same indices when using the shared layout
+	var createdIndices []string
+	if !es.sharedLayout() {
+		var err error
+		createdIndices, err = es.createProjectIndices(ctx, log, projectId)
 		if err != nil {
-			return nil, createError(log, "error sending request to elasticsearch", err)
+			return nil, err
 		}
-		if res.IsError() {
-			return nil, createError(log, "error creating index in elasticsearch", err)
+	}
+
+	// create project document, which fails if the project already exists. In that case the indices belong to the
+	// existing project, which may have adopted them from this call while being created at the same time, so they're kept
+	_, err := es.genericCreate(ctx, log, projectsIndex(), "", projectName, p)
+	if err != nil {
+		if status.Code(err) != codes.AlreadyExists {
+			es.deleteCreatedIndices(ctx, log, createdIndices)
 		}
+
+		return nil, err
 	}
 
 	log.Debug("created project")
+	es.recordAuditEvent(ctx, log, "", OperationCreate, projectName, nil, p)
 
 	return p, nil
 }
 
-// GetProject returns the project with the given projectId from Elasticsearch
+// GetProject returns the project with the given projectId from Elasticsearch. Projects that are being deleted are
+// treated as missing.
 func (es *ElasticsearchStorage) GetProject(ctx context.Context, projectId string) (*prpb.Project, error) {
 	projectName := fmt.Sprintf("projects/%s", projectId)
 	log := es.logger.Named("GetProject").With(zap.String("project", projectName))
 
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": projectName,
-			},
-		},
-	}
-	project := &prpb.Project{}
-
-	err := es.genericGet(ctx, log, search, projectsIndex(), project)
+	project, state, err := es.getProject(ctx, log, projectId)
 	if err != nil {
 		return nil, err
 	}
+	if state == projectStateDeleting {
+		log.Debug("project is being deleted")
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%T not found", project))
+	}
 
 	return project, nil
 }
 
 // ListProjects returns up to pageSize number of projects beginning at pageToken (or from
-// start if pageToken is the empty string).
+// start if pageToken is the empty string). Projects that are being deleted are left out.
 func (es *ElasticsearchStorage) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
 	var projects []*prpb.Project
 	log := es.logger.Named("ListProjects")
 
-	res, err := es.genericList(ctx, log, projectsIndex(), filter, false)
+	res, err := es.genericList(ctx, log, projectsIndex(), "", filter, false)
 	if err != nil {
 		return nil, "", err
 	}
@@ -150,12 +145,21 @@ func (es *ElasticsearchStorage) ListProjects(ctx context.Context, filter string,
 		hitLogger := log.With(zap.String("project raw", string(hit.Source)))
 
 		project := &prpb.Project{}
-		err := protojson.Unmarshal(hit.Source, proto.MessageV2(project))
+		err := protojsonUnmarshaler.Unmarshal(hit.Source, proto.MessageV2(project))
 		if err != nil {
 			log.Error("failed to convert _doc to project", zap.Error(err))
 			return nil, "", createError(hitLogger, "error converting _doc to project", err)
 		}
 
+		state, err := projectState(hit.Source)
+		if err != nil {
+			return nil, "", createError(hitLogger, "error converting _doc to project", err)
+		}
+		if state == projectStateDeleting {
+			hitLogger.Debug("skipping project that is being deleted")
+			continue
+		}
+
 		hitLogger.Debug("project hit", zap.Any("project", project))
 
 		projects = append(projects, project)
@@ -164,40 +168,19 @@ func (es *ElasticsearchStorage) ListProjects(ctx context.Context, filter string,
 	return projects, "", nil
 }
 
-// DeleteProject deletes the project with the given projectId from Elasticsearch
+// DeleteProject deletes the project with the given projectId from Elasticsearch, along with its notes and occurrences.
+// Projects with notes that are referenced by occurrences in other projects can only be deleted with ForceDeleteProject.
 // Note that this will always return a 500 due to a bug in Grafeas
 func (es *ElasticsearchStorage) DeleteProject(ctx context.Context, projectId string) error {
 	projectName := fmt.Sprintf("projects/%s", projectId)
 	log := es.logger.Named("DeleteProject").With(zap.String("project", projectName))
 	log.Debug("deleting project")
 
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": projectName,
-			},
-		},
-	}
-
-	err := es.genericDelete(ctx, log, search, projectsIndex())
-	if err != nil {
+	if err := es.deleteProject(ctx, log, projectId, false); err != nil {
 		return err
 	}
 
-	log.Debug("project document deleted")
-
-	res, err := es.client.Indices.Delete(
-		[]string{
-			occurrencesIndex(projectId),
-			notesIndex(projectId),
-		},
-		es.client.Indices.Delete.WithContext(ctx),
-	)
-	if err != nil || res.IsError() {
-		return createError(log, "error deleting elasticsearch indices", err)
-	}
-
-	log.Debug("project indices for notes / occurrences deleted")
+	es.recordAuditEvent(ctx, log, "", OperationDelete, projectName, nil, nil)
 
 	return nil
 }
@@ -207,20 +190,15 @@ func (es *ElasticsearchStorage) GetOccurrence(ctx context.Context, projectId, oc
 	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
 	log := es.logger.Named("GetOccurrence").With(zap.String("occurrence", occurrenceName))
 
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": occurrenceName,
-			},
-		},
-	}
 	occurrence := &pb.Occurrence{}
 
-	err := es.genericGet(ctx, log, search, occurrencesIndex(projectId), occurrence)
+	version, err := es.genericGet(ctx, log, es.occurrencesIndex(projectId), projectId, occurrenceName, occurrence)
 	if err != nil {
 		return nil, err
 	}
 
+	setEtag(ctx, log, version)
+
 	return occurrence, nil
 }
 
@@ -230,7 +208,7 @@ func (es *ElasticsearchStorage) ListOccurrences(ctx context.Context, projectId,
 	projectName := fmt.Sprintf("projects/%s", projectId)
 	log := es.logger.Named("ListOccurrences").With(zap.String("project", projectName))
 
-	res, err := es.genericList(ctx, log, occurrencesIndex(projectId), filter, true)
+	res, err := es.genericList(ctx, log, es.occurrencesIndex(projectId), projectId, filter, true)
 	if err != nil {
 		return nil, "", err
 	}
@@ -240,7 +218,7 @@ func (es *ElasticsearchStorage) ListOccurrences(ctx context.Context, projectId,
 		hitLogger := log.With(zap.String("occurrence raw", string(hit.Source)))
 
 		occurrence := &pb.Occurrence{}
-		err := protojson.Unmarshal(hit.Source, proto.MessageV2(occurrence))
+		err := protojsonUnmarshaler.Unmarshal(hit.Source, proto.MessageV2(occurrence))
 		if err != nil {
 			log.Error("failed to convert _doc to occurrence", zap.Error(err))
 			return nil, "", createError(hitLogger, "error converting _doc to occurrence", err)
@@ -254,19 +232,73 @@ func (es *ElasticsearchStorage) ListOccurrences(ctx context.Context, projectId,
 	return occurrences, "", nil
 }
 
-// CreateOccurrence adds the specified occurrence to Elasticsearch
+// CreateOccurrence adds the specified occurrence to Elasticsearch.
+// When the client chooses the occurrence ID, using the occurrence name or an idempotency key, retrying a create that
+// already completed returns the stored occurrence instead of creating another one.
 func (es *ElasticsearchStorage) CreateOccurrence(ctx context.Context, projectId, userID string, o *pb.Occurrence) (*pb.Occurrence, error) {
 	log := es.logger.Named("CreateOccurrence")
 
 	if o.CreateTime == nil {
 		o.CreateTime = ptypes.TimestampNow()
 	}
-	o.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, uuid.New().String())
 
-	err := es.genericCreate(ctx, log, occurrencesIndex(projectId), o)
+	occurrenceId, idempotent, err := requestedOccurrenceId(projectId, o, requestIdempotencyKey(ctx))
 	if err != nil {
 		return nil, err
 	}
+	if idempotent {
+		o.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+	} else if es.config.DeduplicateOccurrences {
+		if _, err := nameDeduplicatedOccurrence(projectId, o); err != nil {
+			return nil, createError(log, "error creating occurrence fingerprint", err)
+		}
+	} else {
+		o.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, uuid.New().String())
+	}
+
+	if err := es.checkProjectWritable(ctx, log, projectId); err != nil {
+		return nil, err
+	}
+
+	if es.config.ValidateNoteReferences {
+		errs, err := es.validateNoteReferences(ctx, log, []*pb.Occurrence{o})
+		if err != nil {
+			return nil, err
+		}
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+	}
+
+	var (
+		version  *documentVersion
+		stored   *storedOccurrence
+		replayed *pb.Occurrence
+	)
+	switch {
+	case idempotent:
+		version, replayed, err = es.createIdempotentOccurrence(ctx, log, projectId, o)
+	case es.config.DeduplicateOccurrences:
+		version, stored, err = es.upsertOccurrence(ctx, log, projectId, o)
+	default:
+		version, err = es.genericCreate(ctx, log, es.occurrencesIndex(projectId), projectId, o.Name, o)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	setEtag(ctx, log, version)
+	if replayed != nil {
+		setOccurrenceResults(ctx, log, []string{occurrenceResultReplayed})
+		return replayed, nil
+	}
+
+	operation, before := stored.operation()
+	es.recordRevision(ctx, log, o.Name, operation, o, version)
+	es.recordAuditEvent(ctx, log, userID, operation, o.Name, before, o)
+	if idempotent || es.config.DeduplicateOccurrences {
+		setOccurrenceResults(ctx, log, []string{occurrenceResult(stored)})
+	}
 
 	return o, nil
 }
@@ -274,84 +306,234 @@ func (es *ElasticsearchStorage) CreateOccurrence(ctx context.Context, projectId,
 // BatchCreateOccurrences batch creates the specified occurrences in Elasticsearch.
 // This method uses the ES "_bulk" API: https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
 // This method will return all of the occurrences that were successfully created, and all of the errors that were encountered (if any)
+// When occurrences are deduplicated, occurrences that were already stored are replaced instead, and occurrences in the
+// batch with the same fingerprint are only written once. Occurrences with an ID chosen by the client, using the occurrence
+// name or an idempotency key for the batch, are returned as they were stored when the batch is retried.
 func (es *ElasticsearchStorage) BatchCreateOccurrences(ctx context.Context, projectId string, uID string, occurrences []*pb.Occurrence) ([]*pb.Occurrence, []error) {
 	log := es.logger.Named("BatchCreateOccurrences")
 	log.Debug("creating occurrences")
 
-	indexMetadata := &esBulkQueryFragment{
-		Index: &esBulkQueryIndexFragment{
-			Index: occurrencesIndex(projectId),
-		},
+	if err := es.checkProjectWritable(ctx, log, projectId); err != nil {
+		return nil, []error{err}
 	}
 
-	metadata, _ := json.Marshal(indexMetadata)
-	metadata = append(metadata, "\n"...)
-
-	// build the request body using newline delimited JSON (ndjson)
-	// each occurrence is represented by two JSON structures:
-	// the first is the metadata that represents the ES operation, in this case "index"
-	// the second is the source payload to index
-	// in total, this body will consist of (len(occurrences) * 2) JSON structures, separated by newlines, with a trailing newline at the end
-	var body bytes.Buffer
-	for _, occurrence := range occurrences {
-		occurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, uuid.New().String())
+	var (
+		occurrenceIds  = make([]string, len(occurrences))
+		itemErrs       = make([]error, len(occurrences))
+		idempotent     = make([]bool, len(occurrences))
+		anyIdempotent  bool
+		idempotencyKey = requestIdempotencyKey(ctx)
+	)
+	for i, occurrence := range occurrences {
+		id, ok, err := requestedOccurrenceId(projectId, occurrence, batchIdempotencyKey(idempotencyKey, i))
+		switch {
+		case err != nil:
+			itemErrs[i] = err
+		case ok:
+			occurrenceIds[i] = id
+			idempotent[i] = true
+			anyIdempotent = true
+			occurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, id)
+		case es.config.DeduplicateOccurrences:
+			id, err := nameDeduplicatedOccurrence(projectId, occurrence)
+			if err != nil {
+				return nil, []error{
+					withBatchItemDetails(createError(log, "error creating occurrence fingerprint", err), occurrenceResourceType, occurrence.Name, "", i),
+				}
+			}
+			occurrenceIds[i] = id
+		default:
+			occurrenceIds[i] = uuid.New().String()
+			occurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceIds[i])
+		}
 		if occurrence.CreateTime == nil {
 			occurrence.CreateTime = ptypes.TimestampNow()
 		}
+	}
+
+	// occurrences that reference an invalid note are rejected, while the rest of the batch is still created
+	if es.config.ValidateNoteReferences {
+		validationErrs, err := es.validateNoteReferences(ctx, log, occurrences)
+		for i := range itemErrs {
+			if err != nil {
+				itemErrs[i] = err
+			} else if itemErrs[i] == nil {
+				itemErrs[i] = validationErrs[i]
+			}
+		}
+	}
+
+	var (
+		stored     = map[string]*storedOccurrence{}
+		duplicates = map[int]int{}
+	)
+	if es.config.DeduplicateOccurrences {
+		duplicates = duplicateOccurrences(occurrences)
+	}
+
+	// occurrences with an ID chosen by the client are looked up before they're written, since the write alias may have
+	// rolled over to a new backing index since an earlier attempt of the batch stored them
+	var names []string
+	for i, occurrence := range occurrences {
+		if _, ok := duplicates[i]; !ok && itemErrs[i] == nil && (idempotent[i] || es.config.DeduplicateOccurrences) {
+			names = append(names, occurrence.Name)
+		}
+	}
+
+	if len(names) > 0 {
+		var err error
+		stored, err = es.findStoredOccurrences(ctx, log, projectId, names)
+		if err != nil {
+			for i := range itemErrs {
+				itemErrs[i] = err
+			}
+		}
+	}
+
+	var (
+		items     []*bulkItem
+		positions []int
+		retried   []int
+	)
+	for i, occurrence := range occurrences {
+		if _, ok := duplicates[i]; ok || itemErrs[i] != nil {
+			continue
+		}
+
+		existing := stored[occurrence.Name]
+		if idempotent[i] && existing.exists() {
+			replayed, err := replayedOccurrence(log, existing, occurrence)
+			if err != nil {
+				itemErrs[i] = err
+			} else {
+				occurrences[i] = replayed
+			}
+
+			retried = append(retried, i)
+			continue
+		}
+
+		// occurrences that were already stored, and tombstones, are replaced in the backing index that holds them, as long
+		// as they haven't changed since they were read
+		action := &esBulkQueryIndexFragment{
+			Index:   writeAlias(es.occurrencesIndex(projectId)),
+			Id:      documentId(occurrence.Name),
+			Routing: es.routing(projectId),
+		}
+		if existing != nil {
+			if !idempotent[i] {
+				mergeStoredOccurrence(occurrence, existing)
+			}
+			action.Index = existing.version.index
+			action.IfSeqNo = &existing.version.seqNo
+			action.IfPrimaryTerm = &existing.version.primaryTerm
+		}
 
 		data, err := protojson.Marshal(proto.MessageV2(occurrence))
+		if err == nil {
+			data, err = es.withProjectField(projectId, data)
+		}
 		if err != nil {
 			return nil, []error{
-				createError(log, "error marshaling occurrence", err),
+				withBatchItemDetails(createError(log, "error marshaling occurrence", err), occurrenceResourceType, occurrence.Name, occurrenceIds[i], i),
 			}
 		}
 
-		dataBytes := append(data, "\n"...)
-		body.Grow(len(metadata) + len(dataBytes))
-		body.Write(metadata)
-		body.Write(dataBytes)
+		// occurrences with an ID chosen by the client are only created if they still don't exist
+		metadata := &esBulkQueryFragment{Index: action}
+		if idempotent[i] && existing == nil {
+			metadata = &esBulkQueryFragment{Create: action}
+		}
+
+		positions = append(positions, i)
+		items = append(items, &bulkItem{
+			metadata: metadata,
+			document: data,
+		})
 	}
 
-	log.Debug("attempting ES bulk index", zap.String("payload", string(body.Bytes())))
+	var conflicts []int
+	if len(items) > 0 {
+		responses, requestErrs := es.bulkWrite(ctx, log, items)
 
-	res, err := es.client.Bulk(
-		bytes.NewReader(body.Bytes()),
-		es.client.Bulk.WithContext(ctx),
-		es.client.Bulk.WithRefresh(es.config.Refresh.String()),
-	)
-	if err != nil {
-		return nil, []error{
-			createError(log, "failed while sending request to ES", err),
+		// each indexing operation has its own status
+		// we need to iterate over each of the responses to know whether or not that particular occurrence was created successfully
+		var (
+			revisions   []*esRevision
+			auditEvents []*AuditEvent
+		)
+		for j, indexItem := range responses {
+			i := positions[j]
+			if indexItem == nil {
+				itemErrs[i] = requestErrs[j]
+				continue
+			}
+			if indexItem.Status == http.StatusConflict && idempotent[i] && stored[occurrences[i].Name] == nil {
+				conflicts = append(conflicts, i)
+				continue
+			}
+			if indexItem.Status == http.StatusConflict {
+				itemErrs[i] = status.Errorf(codes.Aborted, "%s was modified concurrently", occurrences[i].Name)
+				continue
+			}
+			if indexItem.Error != nil {
+				itemErrs[i] = createItemError(log, "error creating occurrence in ES", indexItem, zap.Any("occurrence", occurrences[i]))
+				continue
+			}
+
+			operation, before := stored[occurrences[i].Name].operation()
+			if es.config.RevisionHistory {
+				revisions = appendRevision(log, revisions, occurrences[i].Name, operation, occurrences[i], indexItem)
+			}
+			if es.config.Audit.Enabled {
+				auditEvents = es.appendAuditEvent(ctx, log, auditEvents, uID, operation, occurrences[i].Name, before, occurrences[i])
+			}
 		}
+
+		es.recordRevisions(ctx, log, revisions)
+		es.recordAuditEvents(ctx, log, auditEvents)
 	}
-	if res.IsError() {
-		return nil, []error{
-			createError(log, "unexpected response from ES", nil),
-		}
+
+	// creates that conflict with an occurrence stored concurrently are retries too, which return the stored occurrence
+	if len(conflicts) > 0 {
+		es.replayOccurrences(ctx, log, projectId, occurrences, conflicts, itemErrs)
+		retried = append(retried, conflicts...)
 	}
 
-	response := &esBulkResponse{}
-	err = decodeResponse(res.Body, response)
-	if err != nil {
-		return nil, []error{
-			createError(log, "error decoding ES response", nil),
+	// duplicates in the batch share the outcome of the occurrence that was written in their place
+	for i, j := range duplicates {
+		if itemErrs[i] == nil {
+			occurrences[i] = occurrences[j]
+			itemErrs[i] = itemErrs[j]
 		}
 	}
 
-	// each indexing operation in this bulk request has its own status
-	// we need to iterate over each of the items in the response to know whether or not that particular occurrence was created successfully
+	// the created occurrences and errors are returned in the same order as the input
 	var (
 		createdOccurrences []*pb.Occurrence
 		errs               []error
+		results            []string
+		replayed           = map[int]bool{}
 	)
+	for _, i := range retried {
+		replayed[i] = true
+	}
 	for i, occurrence := range occurrences {
-		indexItem := response.Items[i].Index
-		if occErr := indexItem.Error; occErr != nil {
-			errs = append(errs, createError(log, "error creating occurrence in ES", fmt.Errorf("[%d] %s: %s", indexItem.Status, occErr.Type, occErr.Reason), zap.Any("occurrence", occurrence)))
+		if err := itemErrs[i]; err != nil {
+			errs = append(errs, withBatchItemDetails(err, occurrenceResourceType, occurrence.Name, occurrenceIds[i], i))
 			continue
 		}
 
 		createdOccurrences = append(createdOccurrences, occurrence)
+		if replayed[i] {
+			results = append(results, occurrenceResultReplayed)
+		} else {
+			results = append(results, occurrenceResult(stored[occurrence.Name]))
+		}
+	}
+
+	if es.config.DeduplicateOccurrences || anyIdempotent {
+		setOccurrenceResults(ctx, log, results)
 	}
 
 	if len(errs) > 0 {
@@ -365,9 +547,38 @@ func (es *ElasticsearchStorage) BatchCreateOccurrences(ctx context.Context, proj
 	return createdOccurrences, nil
 }
 
-// UpdateOccurrence updates the existing occurrence with the given projectId and occurrenceId
+// UpdateOccurrence updates the fields in the mask of the existing occurrence with the given projectId and occurrenceId,
+// or replaces the occurrence when the mask is empty. The update is rejected if the occurrence changes before it's written,
+// or if the etag sent by the client doesn't match the current version of the occurrence.
 func (es *ElasticsearchStorage) UpdateOccurrence(ctx context.Context, projectId, occurrenceId string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (*pb.Occurrence, error) {
-	return nil, nil
+	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+	log := es.logger.Named("UpdateOccurrence").With(zap.String("occurrence", occurrenceName))
+
+	occurrence := &pb.Occurrence{}
+	version, err := es.genericGet(ctx, log, es.occurrencesIndex(projectId), projectId, occurrenceName, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEtag(ctx, log, occurrenceName, version); err != nil {
+		return nil, err
+	}
+
+	before := proto.Clone(occurrence)
+	if err := applyFieldMask(occurrence, o, mask); err != nil {
+		return nil, err
+	}
+	occurrence.UpdateTime = ptypes.TimestampNow()
+
+	version, err = es.genericUpdate(ctx, log, projectId, occurrenceName, occurrence, version)
+	if err != nil {
+		return nil, err
+	}
+
+	es.recordRevision(ctx, log, occurrenceName, OperationUpdate, occurrence, version)
+	es.recordAuditEvent(ctx, log, "", OperationUpdate, occurrenceName, before, occurrence)
+	setEtag(ctx, log, version)
+
+	return occurrence, nil
 }
 
 // DeleteOccurrence deletes the occurrence with the given projectId and occurrenceId
@@ -375,17 +586,22 @@ func (es *ElasticsearchStorage) DeleteOccurrence(ctx context.Context, projectId,
 	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
 	log := es.logger.Named("DeleteOccurrence").With(zap.String("occurrence", occurrenceName))
 
-	log.Debug("deleting occurrence")
-
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": occurrenceName,
-			},
-		},
+	var err error
+	if es.config.SoftDelete.Enabled {
+		log.Debug("soft deleting occurrence")
+		err = es.softDelete(ctx, log, es.occurrencesIndex(projectId), projectId, occurrenceName, &pb.Occurrence{})
+	} else {
+		log.Debug("deleting occurrence")
+		err = es.conditionalDelete(ctx, log, es.occurrencesIndex(projectId), projectId, occurrenceName, &pb.Occurrence{})
 	}
+	if err != nil {
+		return err
+	}
+
+	es.recordRevision(ctx, log, occurrenceName, OperationDelete, nil, nil)
+	es.recordAuditEvent(ctx, log, "", OperationDelete, occurrenceName, nil, nil)
 
-	return es.genericDelete(ctx, log, search, occurrencesIndex(projectId))
+	return nil
 }
 
 // GetNote returns the note with project (pID) and note ID (nID)
@@ -393,20 +609,15 @@ func (es *ElasticsearchStorage) GetNote(ctx context.Context, projectId, noteId s
 	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
 	log := es.logger.Named("GetNote").With(zap.String("note", noteName))
 
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": noteName,
-			},
-		},
-	}
 	note := &pb.Note{}
 
-	err := es.genericGet(ctx, log, search, notesIndex(projectId), note)
+	version, err := es.genericGet(ctx, log, es.notesIndex(projectId), projectId, noteName, note)
 	if err != nil {
 		return nil, err
 	}
 
+	setEtag(ctx, log, version)
+
 	return note, nil
 }
 
@@ -416,7 +627,7 @@ func (es *ElasticsearchStorage) ListNotes(ctx context.Context, projectId, filter
 	projectName := fmt.Sprintf("projects/%s", projectId)
 	log := es.logger.Named("ListNotes").With(zap.String("project", projectName))
 
-	res, err := es.genericList(ctx, log, notesIndex(projectId), filter, true)
+	res, err := es.genericList(ctx, log, es.notesIndex(projectId), projectId, filter, true)
 	if err != nil {
 		return nil, "", err
 	}
@@ -426,7 +637,7 @@ func (es *ElasticsearchStorage) ListNotes(ctx context.Context, projectId, filter
 		hitLogger := log.With(zap.String("note raw", string(hit.Source)))
 
 		note := &pb.Note{}
-		err := protojson.Unmarshal(hit.Source, proto.MessageV2(note))
+		err := protojsonUnmarshaler.Unmarshal(hit.Source, proto.MessageV2(note))
 		if err != nil {
 			log.Error("failed to convert _doc to note", zap.Error(err))
 			return nil, "", createError(hitLogger, "error converting _doc to note", err)
@@ -445,171 +656,124 @@ func (es *ElasticsearchStorage) CreateNote(ctx context.Context, projectId, noteI
 	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
 	log := es.logger.Named("CreateNote").With(zap.String("note", noteName))
 
-	// since note IDs are provided up front by the client, we need to search ES to see if this note already exists before creating it
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": noteName,
-			},
-		},
-	}
-	err := es.genericGet(ctx, log, search, notesIndex(projectId), &pb.Note{})
-	if err == nil { // note exists
-		log.Debug("note already exists")
-		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("note with name %s already exists", noteName))
-	} else if status.Code(err) != codes.NotFound { // unexpected error (we expect a not found error here)
-		return nil, err
-	}
-
 	if n.CreateTime == nil {
 		n.CreateTime = ptypes.TimestampNow()
 	}
 	n.Name = noteName
 
-	err = es.genericCreate(ctx, log, notesIndex(projectId), n)
+	if err := es.checkProjectWritable(ctx, log, projectId); err != nil {
+		return nil, err
+	}
+
+	// since note IDs are provided up front by the client, the note is only created if one with the same name doesn't exist
+	version, err := es.genericCreate(ctx, log, es.notesIndex(projectId), projectId, noteName, n)
 	if err != nil {
 		return nil, err
 	}
 
+	es.recordRevision(ctx, log, noteName, OperationCreate, n, version)
+	es.recordAuditEvent(ctx, log, uID, OperationCreate, noteName, nil, n)
+	setEtag(ctx, log, version)
+
 	return n, nil
 }
 
-// BatchCreateNotes batch creates the specified notes in memstore.
+// BatchCreateNotes batch creates the specified notes in Elasticsearch.
+// Each note is created with a bulk "create" action using an ID derived from its name, so Elasticsearch rejects any note
+// that already exists, even when the same note is created concurrently. Notes that were soft deleted are created again
+// by replacing their tombstones.
+// This method will return all of the notes that were successfully created, and all of the errors that were encountered (if any)
 func (es *ElasticsearchStorage) BatchCreateNotes(ctx context.Context, projectId, uID string, notesWithNoteIds map[string]*pb.Note) ([]*pb.Note, []error) {
 	log := es.logger.Named("BatchCreateNotes").With(zap.String("projectId", projectId))
 	log.Debug("creating notes")
 
-	searchMetadata, _ := json.Marshal(&esMultiSearchQueryFragment{
-		Index: notesIndex(projectId),
-	})
-	searchMetadata = append(searchMetadata, "\n"...)
+	if err := es.checkProjectWritable(ctx, log, projectId); err != nil {
+		return nil, []error{err}
+	}
+
+	// notes are created in order of their IDs, so that the created notes and errors are returned in a predictable order
+	var noteIds []string
+	for noteId := range notesWithNoteIds {
+		noteIds = append(noteIds, noteId)
+	}
+	sort.Strings(noteIds)
 
 	var (
-		notes             []*pb.Note
-		searchRequestBody bytes.Buffer
+		notes []*pb.Note
+		items []*bulkItem
 	)
-	for noteId, note := range notesWithNoteIds {
+	for i, noteId := range noteIds {
+		note := notesWithNoteIds[noteId]
 		note.Name = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
 		if note.CreateTime == nil {
 			note.CreateTime = ptypes.TimestampNow()
 		}
 
-		notes = append(notes, note)
+		data, err := protojson.Marshal(proto.MessageV2(note))
+		if err == nil {
+			data, err = es.withProjectField(projectId, data)
+		}
+		if err != nil {
+			return nil, []error{
+				withBatchItemDetails(createError(log, "error marshaling note", err), noteResourceType, note.Name, noteId, i),
+			}
+		}
 
-		searchBody := &esSearch{
-			Query: &filtering.Query{
-				Term: &filtering.Term{
-					"name": note.Name,
+		notes = append(notes, note)
+		items = append(items, &bulkItem{
+			metadata: &esBulkQueryFragment{
+				Create: &esBulkQueryIndexFragment{
+					Index:   writeAlias(es.notesIndex(projectId)),
+					Id:      documentId(note.Name),
+					Routing: es.routing(projectId),
 				},
 			},
-		}
-		data, _ := json.Marshal(searchBody)
-		dataBytes := append(data, "\n"...)
-
-		searchRequestBody.Grow(len(searchMetadata) + len(dataBytes))
-		searchRequestBody.Write(searchMetadata)
-		searchRequestBody.Write(dataBytes)
-	}
-
-	log.Debug("attempting ES multisearch", zap.String("payload", string(searchRequestBody.Bytes())))
-
-	res, err := es.client.Msearch(
-		bytes.NewReader(searchRequestBody.Bytes()),
-		es.client.Msearch.WithContext(ctx),
-	)
-
-	if err != nil {
-		return nil, []error{
-			createError(log, "failed while sending request to ES", err),
-		}
-	}
-	if res.IsError() {
-		return nil, []error{
-			createError(log, "unexpected response from ES", nil, zap.Any("response", res.String()), zap.Int("status", res.StatusCode)),
-		}
+			document: data,
+		})
 	}
 
-	searchResponse := &esMultiSearchResponse{}
-	err = decodeResponse(res.Body, searchResponse)
-	if err != nil {
-		return nil, []error{
-			createError(log, "error decoding ES response", nil),
-		}
-	}
+	responses, requestErrs := es.bulkWrite(ctx, log, items)
+	replaced := es.replaceNoteTombstones(ctx, log, projectId, notes, items, responses, requestErrs)
 
+	// each create operation has its own status
+	// we need to iterate over each of the responses to know whether or not that particular note was created successfully
 	var (
-		notesToCreate []*pb.Note
-		errs          []error
+		createdNotes []*pb.Note
+		errs         []error
+		revisions    []*esRevision
+		auditEvents  []*AuditEvent
 	)
-	for i, res := range searchResponse.Responses {
-		if res.Hits.Total.Value != 0 {
-			errs = append(errs, status.Errorf(codes.AlreadyExists, "note with the name %s already exists", notes[i].Name))
-		} else {
-			notesToCreate = append(notesToCreate, notes[i])
+	for i, note := range notes {
+		var err error
+		if createItem := responses[i]; createItem == nil {
+			err = requestErrs[i]
+		} else if createItem.Status == http.StatusConflict && replaced[i] {
+			err = status.Errorf(codes.Aborted, "%s was modified concurrently", note.Name)
+		} else if createItem.Status == http.StatusConflict {
+			err = status.Errorf(codes.AlreadyExists, "note with the name %s already exists", note.Name)
+		} else if createItem.Error != nil {
+			err = createItemError(log, "error creating note in ES", createItem, zap.Any("note", note))
 		}
-	}
-
-	if len(notesToCreate) == 0 {
-		log.Error("all notes already exist")
-		return nil, errs
-	}
-
-	indexMetadata, _ := json.Marshal(&esBulkQueryFragment{
-		Index: &esBulkQueryIndexFragment{
-			Index: notesIndex(projectId),
-		},
-	})
-	indexMetadata = append(indexMetadata, "\n"...)
-
-	// build the request body using newline delimited JSON (ndjson)
-	// each note is represented by two JSON structures:
-	// the first is the metadata that represents the ES operation, in this case "index"
-	// the second is the source payload to index
-	// in total, this body will consist of (len(notes) * 2) JSON structures, separated by newlines, with a trailing newline at the end
-	var indexBody bytes.Buffer
-	for _, note := range notesToCreate {
-		data, _ := protojson.Marshal(proto.MessageV2(note))
-
-		dataBytes := append(data, "\n"...)
-		indexBody.Grow(len(indexMetadata) + len(dataBytes))
-		indexBody.Write(indexMetadata)
-		indexBody.Write(dataBytes)
-	}
-
-	log.Debug("attempting ES bulk index", zap.String("payload", string(indexBody.Bytes())))
-
-	res, err = es.client.Bulk(
-		bytes.NewReader(indexBody.Bytes()),
-		es.client.Bulk.WithContext(ctx),
-		es.client.Bulk.WithRefresh(es.config.Refresh.String()),
-	)
-	if err != nil {
-		return nil, append(errs, createError(log, "failed while sending request to ES", err))
-	}
-	if res.IsError() {
-		return nil, append(errs, createError(log, "unexpected response from ES", nil, zap.Any("response", res.String()), zap.Int("status", res.StatusCode)))
-	}
 
-	bulkResponse := &esBulkResponse{}
-	err = decodeResponse(res.Body, bulkResponse)
-	if err != nil {
-		return nil, append(errs, createError(log, "error decoding ES response", nil))
-	}
-
-	// each indexing operation in this bulk request has its own status
-	// we need to iterate over each of the items in the response to know whether or not that particular note was created successfully
-	var createdNotes []*pb.Note
-	for i, note := range notesToCreate {
-		indexItem := bulkResponse.Items[i].Index
-		if indexDocError := indexItem.Error; indexDocError != nil {
-			errs = append(errs, createError(log, "error creating note in ES", fmt.Errorf("[%d] %s: %s", indexItem.Status, indexDocError.Type, indexDocError.Reason), zap.Any("note", note)))
+		if err != nil {
+			errs = append(errs, withBatchItemDetails(err, noteResourceType, note.Name, noteIds[i], i))
 			continue
 		}
 
 		createdNotes = append(createdNotes, note)
 		log.Debug(fmt.Sprintf("note %s created", note.Name))
+
+		if es.config.RevisionHistory {
+			revisions = appendRevision(log, revisions, note.Name, OperationCreate, note, responses[i])
+		}
+		if es.config.Audit.Enabled {
+			auditEvents = es.appendAuditEvent(ctx, log, auditEvents, uID, OperationCreate, note.Name, nil, note)
+		}
 	}
 
+	es.recordRevisions(ctx, log, revisions)
+	es.recordAuditEvents(ctx, log, auditEvents)
+
 	if len(errs) > 0 {
 		log.Info("errors while creating notes", zap.Any("errors", errs))
 
@@ -621,9 +785,38 @@ func (es *ElasticsearchStorage) BatchCreateNotes(ctx context.Context, projectId,
 	return createdNotes, nil
 }
 
-// UpdateNote updates the existing note with the given pID and nID
-func (es *ElasticsearchStorage) UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error) {
-	return nil, nil
+// UpdateNote updates the fields in the mask of the existing note with the given projectId and noteId, or replaces the note
+// when the mask is empty. The update is rejected if the note changes before it's written, or if the etag sent by the client
+// doesn't match the current version of the note.
+func (es *ElasticsearchStorage) UpdateNote(ctx context.Context, projectId, noteId string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error) {
+	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+	log := es.logger.Named("UpdateNote").With(zap.String("note", noteName))
+
+	note := &pb.Note{}
+	version, err := es.genericGet(ctx, log, es.notesIndex(projectId), projectId, noteName, note)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEtag(ctx, log, noteName, version); err != nil {
+		return nil, err
+	}
+
+	before := proto.Clone(note)
+	if err := applyFieldMask(note, n, mask); err != nil {
+		return nil, err
+	}
+	note.UpdateTime = ptypes.TimestampNow()
+
+	version, err = es.genericUpdate(ctx, log, projectId, noteName, note, version)
+	if err != nil {
+		return nil, err
+	}
+
+	es.recordRevision(ctx, log, noteName, OperationUpdate, note, version)
+	es.recordAuditEvent(ctx, log, "", OperationUpdate, noteName, before, note)
+	setEtag(ctx, log, version)
+
+	return note, nil
 }
 
 // DeleteNote deletes the note with the given pID and nID
@@ -631,17 +824,22 @@ func (es *ElasticsearchStorage) DeleteNote(ctx context.Context, projectId, noteI
 	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
 	log := es.logger.Named("DeleteNote").With(zap.String("note", noteName))
 
-	log.Debug("deleting note")
-
-	search := &esSearch{
-		Query: &filtering.Query{
-			Term: &filtering.Term{
-				"name": noteName,
-			},
-		},
+	var err error
+	if es.config.SoftDelete.Enabled {
+		log.Debug("soft deleting note")
+		err = es.softDelete(ctx, log, es.notesIndex(projectId), projectId, noteName, &pb.Note{})
+	} else {
+		log.Debug("deleting note")
+		err = es.conditionalDelete(ctx, log, es.notesIndex(projectId), projectId, noteName, &pb.Note{})
+	}
+	if err != nil {
+		return err
 	}
 
-	return es.genericDelete(ctx, log, search, notesIndex(projectId))
+	es.recordRevision(ctx, log, noteName, OperationDelete, nil, nil)
+	es.recordAuditEvent(ctx, log, "", OperationDelete, noteName, nil, nil)
+
+	return nil
 }
 
 // GetOccurrenceNote gets the note for the specified occurrence from PostgreSQL.
@@ -659,7 +857,71 @@ func (es *ElasticsearchStorage) GetVulnerabilityOccurrencesSummary(ctx context.C
 	return &pb.VulnerabilityOccurrencesSummary{}, nil
 }
 
-func (es *ElasticsearchStorage) genericGet(ctx context.Context, log *zap.Logger, search *esSearch, index string, protoMessage interface{}) error {
+// genericGet fetches the document for a resource name, and returns the version of the document that was read.
+// Tombstones left by a soft delete are treated as missing.
+func (es *ElasticsearchStorage) genericGet(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) (*documentVersion, error) {
+	version, err := es.getDocument(ctx, log, index, projectId, name, protoMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	if es.config.SoftDelete.Enabled && version.deleteTime != nil {
+		log.Debug("document was deleted", zap.Time("deleteTime", *version.deleteTime))
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%T not found", protoMessage))
+	}
+
+	return version, nil
+}
+
+// getDocument fetches the document for a resource name, including tombstones. When an index has more than one backing
+// index, such as a rolled over occurrences index, the document is found using a search instead, since it could be in
+// any of them.
+func (es *ElasticsearchStorage) getDocument(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) (*documentVersion, error) {
+	id := documentId(name)
+	log = log.With(zap.String("id", id))
+
+	multipleBackingIndices, err := es.hasMultipleBackingIndices(ctx, log, index)
+	if err != nil {
+		return nil, err
+	}
+	if multipleBackingIndices {
+		return es.searchById(ctx, log, index, projectId, id, protoMessage)
+	}
+
+	res, err := es.client.Get(
+		index,
+		id,
+		es.client.Get.WithContext(ctx),
+		es.client.Get.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("document not found")
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%T not found", protoMessage))
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error retrieving document from elasticsearch", res)
+	}
+
+	var document esGetResponse
+	if err := decodeResponse(res.Body, &document); err != nil {
+		return nil, createError(log, "error unmarshalling elasticsearch response", err)
+	}
+
+	return unmarshalDocument(log, document.Source, protoMessage, &documentVersion{
+		index:       document.Index,
+		seqNo:       document.SeqNo,
+		primaryTerm: document.PrimaryTerm,
+	})
+}
+
+func (es *ElasticsearchStorage) searchById(ctx context.Context, log *zap.Logger, index, projectId, id string, protoMessage interface{}) (*documentVersion, error) {
+	search := &esSearch{
+		Query:            es.projectQuery(projectId, idsQuery(id)),
+		SeqNoPrimaryTerm: true,
+	}
 	encodedBody, requestJson := encodeRequest(search)
 	log = log.With(zap.String("request", requestJson))
 
@@ -667,59 +929,148 @@ func (es *ElasticsearchStorage) genericGet(ctx context.Context, log *zap.Logger,
 		es.client.Search.WithContext(ctx),
 		es.client.Search.WithIndex(index),
 		es.client.Search.WithBody(encodedBody),
+		es.client.Search.WithRouting(es.routing(projectId)),
 	)
 	if err != nil {
-		return createError(log, "error sending request to elasticsearch", err)
+		return nil, createError(log, "error sending request to elasticsearch", err)
 	}
 	if res.IsError() {
-		return createError(log, "error searching elasticsearch for document", nil, zap.String("response", res.String()), zap.Int("status", res.StatusCode))
+		return nil, createResponseError(log, "error searching elasticsearch for document", res)
 	}
 
 	var searchResults esSearchResponse
 	if err := decodeResponse(res.Body, &searchResults); err != nil {
-		return createError(log, "error unmarshalling elasticsearch response", err)
+		return nil, createError(log, "error unmarshalling elasticsearch response", err)
 	}
 
 	if searchResults.Hits.Total.Value == 0 {
 		log.Debug("document not found", zap.Any("search", search))
-		return status.Error(codes.NotFound, fmt.Sprintf("%T not found", protoMessage))
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%T not found", protoMessage))
 	}
 
-	return protojson.Unmarshal(searchResults.Hits.Hits[0].Source, proto.MessageV2(protoMessage))
+	hit := searchResults.Hits.Hits[0]
+
+	return unmarshalDocument(log, hit.Source, protoMessage, &documentVersion{
+		index:       hit.Index,
+		seqNo:       hit.SeqNo,
+		primaryTerm: hit.PrimaryTerm,
+	})
 }
 
-func (es *ElasticsearchStorage) genericCreate(ctx context.Context, log *zap.Logger, index string, protoMessage interface{}) error {
-	str, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(proto.MessageV2(protoMessage))
+// unmarshalDocument converts a document into a protobuf message, and adds the time the document was deleted to its
+// version when it's a tombstone
+func unmarshalDocument(log *zap.Logger, source json.RawMessage, protoMessage interface{}, version *documentVersion) (*documentVersion, error) {
+	if err := protojsonUnmarshaler.Unmarshal(source, proto.MessageV2(protoMessage)); err != nil {
+		return nil, createError(log, "error unmarshalling document", err)
+	}
+
+	deleteTime, err := documentDeleteTime(source)
+	if err != nil {
+		return nil, createError(log, "error unmarshalling document", err)
+	}
+	version.deleteTime = deleteTime
+
+	return version, nil
+}
+
+// genericCreate writes a document through the write alias of the given index, using an ID derived from the resource name.
+// Elasticsearch rejects the document if one with the same ID already exists, which is returned as an AlreadyExists error,
+// unless the existing document is a tombstone that can be replaced.
+func (es *ElasticsearchStorage) genericCreate(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) (*documentVersion, error) {
+	str, err := es.documentBody(projectId, protoMessage)
 	if err != nil {
-		return createError(log, fmt.Sprintf("error marshalling %T to json", protoMessage), err)
+		return nil, createError(log, fmt.Sprintf("error marshalling %T to json", protoMessage), err)
 	}
 
 	res, err := es.client.Index(
-		index,
+		writeAlias(index),
 		bytes.NewReader(str),
 		es.client.Index.WithContext(ctx),
+		es.client.Index.WithDocumentID(documentId(name)),
+		es.client.Index.WithOpType("create"),
 		es.client.Index.WithRefresh(es.config.Refresh.String()),
+		es.client.Index.WithRouting(es.routing(projectId)),
 	)
 	if err != nil {
-		return createError(log, "error sending request to elasticsearch", err)
+		return nil, createError(log, "error sending request to elasticsearch", err)
 	}
 
+	if res.StatusCode == http.StatusConflict {
+		if es.config.SoftDelete.Enabled && index != projectsIndex() {
+			return es.replaceTombstone(ctx, log, index, projectId, name, protoMessage, str)
+		}
+
+		log.Debug("document already exists")
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", name)
+	}
 	if res.IsError() {
-		return createError(log, "error indexing document in elasticsearch", nil, zap.String("response", res.String()), zap.Int("status", res.StatusCode))
+		return nil, createResponseError(log, "error indexing document in elasticsearch", res)
 	}
 
 	esResponse := &esIndexDocResponse{}
 	err = decodeResponse(res.Body, esResponse)
 	if err != nil {
-		return createError(log, "error decoding elasticsearch response", err)
+		return nil, createError(log, "error decoding elasticsearch response", err)
 	}
 
 	log.Debug("elasticsearch response", zap.Any("response", esResponse))
 
+	return &documentVersion{
+		index:       esResponse.Index,
+		seqNo:       esResponse.SeqNo,
+		primaryTerm: esResponse.PrimaryTerm,
+	}, nil
+}
+
+// documentBody converts a protobuf message into the document stored in Elasticsearch
+func (es *ElasticsearchStorage) documentBody(projectId string, protoMessage interface{}) ([]byte, error) {
+	str, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(proto.MessageV2(protoMessage))
+	if err != nil {
+		return nil, err
+	}
+
+	return es.withProjectField(projectId, str)
+}
+
+// genericDelete deletes the document for a resource name, using a delete by query when the document could be in more
+// than one backing index
+func (es *ElasticsearchStorage) genericDelete(ctx context.Context, log *zap.Logger, index, projectId, name string) error {
+	id := documentId(name)
+	log = log.With(zap.String("id", id))
+
+	multipleBackingIndices, err := es.hasMultipleBackingIndices(ctx, log, index)
+	if err != nil {
+		return err
+	}
+	if multipleBackingIndices {
+		return es.deleteById(ctx, log, index, projectId, name)
+	}
+
+	res, err := es.client.Delete(
+		index,
+		id,
+		es.client.Delete.WithContext(ctx),
+		es.client.Delete.WithRefresh(es.config.Refresh.String()),
+		es.client.Delete.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("document not found")
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error deleting document from elasticsearch", res)
+	}
+
 	return nil
 }
 
-func (es *ElasticsearchStorage) genericDelete(ctx context.Context, log *zap.Logger, search *esSearch, index string) error {
+func (es *ElasticsearchStorage) deleteById(ctx context.Context, log *zap.Logger, index, projectId, name string) error {
+	search := &esSearch{
+		Query: es.projectQuery(projectId, idsQuery(documentId(name))),
+	}
 	encodedBody, requestJson := encodeRequest(search)
 	log = log.With(zap.String("request", requestJson))
 
@@ -728,12 +1079,13 @@ func (es *ElasticsearchStorage) genericDelete(ctx context.Context, log *zap.Logg
 		encodedBody,
 		es.client.DeleteByQuery.WithContext(ctx),
 		es.client.DeleteByQuery.WithRefresh(withRefreshBool(es.config.Refresh)),
+		es.client.DeleteByQuery.WithRouting(es.routing(projectId)),
 	)
 	if err != nil {
 		return createError(log, "error sending request to elasticsearch", err)
 	}
 	if res.IsError() {
-		return createError(log, "received unexpected response from elasticsearch", nil)
+		return createResponseError(log, "received unexpected response from elasticsearch", res)
 	}
 
 	var deletedResults esDeleteResponse
@@ -742,23 +1094,26 @@ func (es *ElasticsearchStorage) genericDelete(ctx context.Context, log *zap.Logg
 	}
 
 	if deletedResults.Deleted == 0 {
-		return createError(log, "elasticsearch returned zero deleted documents", nil, zap.Any("response", deletedResults))
+		log.Debug("document not found")
+		return status.Errorf(codes.NotFound, "%s not found", name)
 	}
 
 	return nil
 }
 
-func (es *ElasticsearchStorage) genericList(ctx context.Context, log *zap.Logger, index, filter string, sort bool) (*esSearchResponseHits, error) {
+func (es *ElasticsearchStorage) genericList(ctx context.Context, log *zap.Logger, index, projectId, filter string, sort bool) (*esSearchResponseHits, error) {
 	body := &esSearch{}
 	if filter != "" {
 		log = log.With(zap.String("filter", filter))
 		filterQuery, err := es.filterer.ParseExpression(filter)
 		if err != nil {
-			return nil, createError(log, "error while parsing filter expression", err)
+			log.Debug("invalid filter expression", zap.Error(err))
+			return nil, status.Errorf(codes.InvalidArgument, "error while parsing filter expression: %s", err)
 		}
 
 		body.Query = filterQuery
 	}
+	body.Query = es.projectQuery(projectId, es.withoutTombstones(body.Query))
 
 	if sort {
 		body.Sort = map[string]esSortOrder{
@@ -775,12 +1130,13 @@ func (es *ElasticsearchStorage) genericList(ctx context.Context, log *zap.Logger
 		es.client.Search.WithIndex(index),
 		es.client.Search.WithBody(encodedBody),
 		es.client.Search.WithSize(grafeasMaxPageSize),
+		es.client.Search.WithRouting(es.routing(projectId)),
 	)
 	if err != nil {
 		return nil, createError(log, "error sending request to elasticsearch", err)
 	}
 	if res.IsError() {
-		return nil, createError(log, "unexpected response from elasticsearch", nil, zap.String("response", res.String()), zap.Int("status", res.StatusCode))
+		return nil, createResponseError(log, "unexpected response from elasticsearch", res)
 	}
 
 	var searchResults esSearchResponse
@@ -791,6 +1147,98 @@ func (es *ElasticsearchStorage) genericList(ctx context.Context, log *zap.Logger
 	return searchResults.Hits, nil
 }
 
+// deleteProjectDocuments removes all notes and occurrences that belong to the given project from the shared indices
+func (es *ElasticsearchStorage) deleteProjectDocuments(ctx context.Context, log *zap.Logger, projectId string) error {
+	encodedBody, requestJson := encodeRequest(&esSearch{
+		Query: es.projectQuery(projectId, nil),
+	})
+	log = log.With(zap.String("request", requestJson))
+
+	res, err := es.client.DeleteByQuery(
+		es.projectIndices(projectId),
+		encodedBody,
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithRefresh(withRefreshBool(es.config.Refresh)),
+		es.client.DeleteByQuery.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error deleting project notes / occurrences", res)
+	}
+
+	var deletedResults esDeleteResponse
+	if err = decodeResponse(res.Body, &deletedResults); err != nil {
+		return createError(log, "error unmarshalling elasticsearch response", err)
+	}
+
+	log.Debug("project notes / occurrences deleted", zap.Int("deleted", deletedResults.Deleted))
+
+	return nil
+}
+
+// createIndexIfNotExists creates the given index unless it already exists
+func (es *ElasticsearchStorage) createIndexIfNotExists(ctx context.Context, log *zap.Logger, index string) error {
+	log = log.With(zap.String("index", index))
+
+	res, err := es.client.Indices.Exists([]string{index}, es.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return createResponseError(log, "error checking if index already exists", res)
+	}
+
+	// the response is an error if the index was not found, so we need to create it
+	if !res.IsError() {
+		return nil
+	}
+
+	log.Info("index not found, creating...")
+	res, err = es.client.Indices.Create(
+		index,
+		es.client.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return createError(log, "error sending index creation request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error creating index in elasticsearch", res)
+	}
+	log.Info("index created")
+
+	return nil
+}
+
+// resolveIndices returns the names of the concrete indices behind a list of index names or aliases, skipping any that don't exist
+func (es *ElasticsearchStorage) resolveIndices(ctx context.Context, log *zap.Logger, names []string) ([]string, error) {
+	res, err := es.client.Indices.GetAlias(
+		es.client.Indices.GetAlias.WithContext(ctx),
+		es.client.Indices.GetAlias.WithIndex(names...),
+		es.client.Indices.GetAlias.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error resolving indices", res)
+	}
+
+	indices := esIndicesResponse{}
+	if err := decodeResponse(res.Body, &indices); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	var resolved []string
+	for name := range indices {
+		resolved = append(resolved, name)
+	}
+	sort.Strings(resolved)
+
+	return resolved, nil
+}
+
 // createError is a helper function that allows you to easily log an error and return a gRPC formatted error.
 func createError(log *zap.Logger, message string, err error, fields ...zap.Field) error {
 	if err == nil {
@@ -802,34 +1250,6 @@ func createError(log *zap.Logger, message string, err error, fields ...zap.Field
 	return status.Errorf(codes.Internal, "%s: %s", message, err)
 }
 
-// withIndexMetadataAndStringMapping adds an index mapping to add metadata that can be used to help identify an index as
-// a part of the Grafeas storage backend, and a dynamic template to map all strings to keywords.
-func withIndexMetadataAndStringMapping() func(*esapi.IndicesCreateRequest) {
-	var indexCreateBuffer bytes.Buffer
-	indexCreateBody := map[string]interface{}{
-		"mappings": map[string]interface{}{
-			"_meta": map[string]string{
-				"type": "grafeas",
-			},
-			"dynamic_templates": []map[string]interface{}{
-				{
-					"strings_as_keywords": map[string]interface{}{
-						"match_mapping_type": "string",
-						"mapping": map[string]interface{}{
-							"type":  "keyword",
-							"norms": false,
-						},
-					},
-				},
-			},
-		},
-	}
-
-	_ = json.NewEncoder(&indexCreateBuffer).Encode(indexCreateBody)
-
-	return esapi.Indices{}.Create.WithBody(&indexCreateBuffer)
-}
-
 func decodeResponse(r io.ReadCloser, i interface{}) error {
 	return json.NewDecoder(r).Decode(i)
 }
@@ -844,18 +1264,159 @@ func encodeRequest(body interface{}) (io.Reader, string) {
 	return bytes.NewReader(b), string(b)
 }
 
+// documentId returns the ID of the document for a Grafeas resource name. Names are hashed, since they can contain
+// characters that aren't allowed in a URL path. The same ID is computed by the script used to reindex documents during
+// a migration, see documentIdScript.
+func documentId(name string) string {
+	hash := sha256.Sum256([]byte(name))
+
+	return hex.EncodeToString(hash[:])
+}
+
+func idsQuery(ids ...string) *filtering.Query {
+	return &filtering.Query{
+		Ids: &filtering.Ids{
+			Values: ids,
+		},
+	}
+}
+
+// hasMultipleBackingIndices returns true when the documents for an index are spread across more than one backing index,
+// which happens once an occurrences index is rolled over. The backing indices of occurrences indices are looked up every
+// time rather than relying on whether rollover is enabled, since indices that were rolled over before rollover was
+// disabled still have several backing indices, and another instance of the server may roll an index over at any time.
+// Until then, documents are read and deleted by ID, which sees documents as soon as they're written.
+func (es *ElasticsearchStorage) hasMultipleBackingIndices(ctx context.Context, log *zap.Logger, index string) (bool, error) {
+	if !strings.HasSuffix(index, "-occurrences") {
+		return false, nil
+	}
+
+	res, err := es.client.Indices.GetAlias(
+		es.client.Indices.GetAlias.WithContext(ctx),
+		es.client.Indices.GetAlias.WithIndex(index),
+	)
+	if err != nil {
+		return false, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.IsError() {
+		return false, createResponseError(log, "error retrieving backing indices", res)
+	}
+
+	indices := esIndicesResponse{}
+	if err := decodeResponse(res.Body, &indices); err != nil {
+		return false, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return len(indices) > 1, nil
+}
+
 func projectsIndex() string {
 	return fmt.Sprintf("%s-projects", indexPrefix)
 }
 
-func occurrencesIndex(projectId string) string {
+// revisionsIndex holds the revisions of every note and occurrence, regardless of the layout
+func revisionsIndex() string {
+	return fmt.Sprintf("%s-revisions", indexPrefix)
+}
+
+// auditIndex holds the audit events for writes to every project, note, and occurrence
+func auditIndex() string {
+	return fmt.Sprintf("%s-audit", indexPrefix)
+}
+
+// occurrencesIndexPattern matches the read alias of every occurrences index, regardless of the layout
+func occurrencesIndexPattern() string {
+	return fmt.Sprintf("%s-*occurrences", indexPrefix)
+}
+
+// notesIndexPattern matches the read alias of every notes index, regardless of the layout
+func notesIndexPattern() string {
+	return fmt.Sprintf("%s-*notes", indexPrefix)
+}
+
+func (es *ElasticsearchStorage) occurrencesIndex(projectId string) string {
+	if es.sharedLayout() {
+		return fmt.Sprintf("%s-occurrences", indexPrefix)
+	}
+
 	return fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId)
 }
 
-func notesIndex(projectId string) string {
+func (es *ElasticsearchStorage) notesIndex(projectId string) string {
+	if es.sharedLayout() {
+		return fmt.Sprintf("%s-notes", indexPrefix)
+	}
+
 	return fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)
 }
 
+// projectIndices returns the indices used to store the occurrences and notes for a project
+func (es *ElasticsearchStorage) projectIndices(projectId string) []string {
+	return []string{
+		es.occurrencesIndex(projectId),
+		es.notesIndex(projectId),
+	}
+}
+
+func (es *ElasticsearchStorage) sharedLayout() bool {
+	return es.config.Layout == config.LayoutShared
+}
+
+// routing returns the custom routing value for documents that belong to the given project.
+// When using the shared layout, documents are routed by project, so that requests for a project only hit a single shard.
+func (es *ElasticsearchStorage) routing(projectId string) string {
+	if es.sharedLayout() {
+		return projectId
+	}
+
+	return ""
+}
+
+// projectQuery restricts query to the documents that belong to the given project when using the shared layout.
+// A nil query will match all of the project's documents.
+func (es *ElasticsearchStorage) projectQuery(projectId string, query *filtering.Query) *filtering.Query {
+	if !es.sharedLayout() || projectId == "" {
+		return query
+	}
+
+	projectTerm := &filtering.Query{
+		Term: &filtering.Term{
+			projectField: projectId,
+		},
+	}
+	if query == nil {
+		return projectTerm
+	}
+
+	return &filtering.Query{
+		Bool: &filtering.Bool{
+			Must: &filtering.Must{
+				projectTerm,
+				query,
+			},
+		},
+	}
+}
+
+// withProjectField adds the project field to a JSON document when using the shared layout
+func (es *ElasticsearchStorage) withProjectField(projectId string, document []byte) ([]byte, error) {
+	if !es.sharedLayout() || projectId == "" {
+		return document, nil
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(document, &fields); err != nil {
+		return nil, err
+	}
+
+	fields[projectField], _ = json.Marshal(projectId)
+
+	return json.Marshal(fields)
+}
+
 // DeleteByQuery does not support `wait_for` value, although API docs say it is available.
 // Immediately refresh on `wait_for` config, assuming that is likely closer to the desired Grafeas user functionality.
 // https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-delete-by-query.html#docs-delete-by-query-api-query-params
@@ -26,12 +26,14 @@ import (
 	"github.com/rode/grafeas-elasticsearch/go/config"
 	"github.com/rode/grafeas-elasticsearch/go/mocks"
 	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage/filtering"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -95,12 +97,20 @@ var _ = Describe("elasticsearch storage", func() {
 		// Variables configured here may be overridden in nested BeforeEach blocks
 		BeforeEach(func() {
 			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusNotFound,
+				},
 				{
 					StatusCode: http.StatusOK,
-					Body:       createEsSearchResponse("project"),
+				},
+				{
+					StatusCode: http.StatusNotFound,
 				},
 				{
 					StatusCode: http.StatusOK,
+				},
+				{
+					StatusCode: http.StatusCreated,
 					Body: structToJsonBody(&esIndexDocResponse{
 						Id: fake.LetterN(10),
 					}),
@@ -108,9 +118,6 @@ var _ = Describe("elasticsearch storage", func() {
 				{
 					StatusCode: http.StatusOK,
 				},
-				{
-					StatusCode: http.StatusOK,
-				},
 			}
 			expectedProjectIndex = fmt.Sprintf("%s-%s", indexPrefix, "projects")
 			expectedOccurrencesIndex = fmt.Sprintf("%s-%s-%s", indexPrefix, expectedProjectId, "occurrences")
@@ -122,20 +129,67 @@ var _ = Describe("elasticsearch storage", func() {
 			expectedProject, createProjectErr = elasticsearchStorage.CreateProject(context.Background(), expectedProjectId, &prpb.Project{})
 		})
 
-		It("should check if the project document already exists", func() {
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedProjectIndex)))
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+		It("should check whether the indices for storing occurrences/notes already exist", func() {
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodHead))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedOccurrencesIndex)))
 
-			assertJsonHasValues(transport.receivedHttpRequests[0].Body, map[string]interface{}{
-				"query.term.name": fmt.Sprintf("projects/%s", expectedProjectId),
-			})
+			Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodHead))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedNotesIndex)))
+		})
+
+		It("should create indices for storing occurrences/notes for the project", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", expectedOccurrencesIndex, schemaVersion)))
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+
+			Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", expectedNotesIndex, schemaVersion)))
+			Expect(transport.receivedHttpRequests[3].Method).To(Equal(http.MethodPut))
+		})
+
+		It("should create read and write aliases for the indices", func() {
+			for i, alias := range []string{expectedOccurrencesIndex, expectedNotesIndex} {
+				body := parseJsonBody(transport.receivedHttpRequests[i*2+1].Body)
+
+				Expect(body.Exists("aliases", alias)).To(BeTrue())
+				Expect(body.Path("aliases").Search(writeAlias(alias), "is_write_index").Data()).To(BeTrue())
+			}
+		})
+
+		It("should rely on the index templates for the mappings and settings of the indices", func() {
+			for _, i := range []int{1, 3} {
+				body := parseJsonBody(transport.receivedHttpRequests[i].Body)
+
+				Expect(body.Exists("mappings")).To(BeFalse())
+				Expect(body.Exists("settings")).To(BeFalse())
+			}
+		})
+
+		It("should create a new document for the project after the indices, using an ID derived from the project name", func() {
+			expectedId := documentId(fmt.Sprintf("projects/%s", expectedProjectId))
+
+			Expect(transport.receivedHttpRequests).To(HaveLen(5))
+			Expect(transport.receivedHttpRequests[4].URL.Path).To(Equal(fmt.Sprintf("/%s-write/_doc/%s", expectedProjectIndex, expectedId)))
+			Expect(transport.receivedHttpRequests[4].Method).To(Equal(http.MethodPut))
+			Expect(transport.receivedHttpRequests[4].URL.Query().Get("op_type")).To(Equal("create"))
+
+			projectBody := &prpb.Project{}
+			err := protojson.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[4].Body), proto.MessageV2(projectBody))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(projectBody.Name).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
+		})
+
+		It("should return the project", func() {
+			Expect(createProjectErr).ToNot(HaveOccurred())
+			Expect(expectedProject).ToNot(BeNil())
+			Expect(expectedProject.Name).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
 		})
 
 		When("the project already exists", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0] = &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       createEsSearchResponse("project", fake.LetterN(10)),
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusOK},
+					{StatusCode: http.StatusOK},
+					{StatusCode: http.StatusConflict},
 				}
 			})
 
@@ -144,109 +198,164 @@ var _ = Describe("elasticsearch storage", func() {
 				Expect(expectedProject).To(BeNil())
 			})
 
-			It("should not create any documents or indices for the project", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			It("should not create or delete any indices", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
 			})
 		})
 
-		When("checking if the project exists returns an error", func() {
+		When("the same project is created at the same time, and the other create wins", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0] = &http.Response{StatusCode: http.StatusBadRequest}
+				transport.preparedHttpResponses[4] = &http.Response{StatusCode: http.StatusConflict}
 			})
 
 			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(createProjectErr, codes.Internal)
-				Expect(expectedProject).To(BeNil())
+				assertErrorHasGrpcStatusCode(createProjectErr, codes.AlreadyExists)
 			})
 
-			It("should not create a document or indices", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			It("should keep the indices it created, since they now belong to the other project", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(5))
+				for _, request := range transport.receivedHttpRequests {
+					Expect(request.Method).ToNot(Equal(http.MethodDelete))
+				}
 			})
 		})
 
-		When("the project does not exist", func() {
-			It("should create a new document for the project", func() {
-				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc", expectedProjectIndex)))
-				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPost))
+		When("the project ID would make its indices match another index template", func() {
+			BeforeEach(func() {
+				expectedProjectId = fmt.Sprintf("%s-notes-v1", fake.LetterN(10))
+			})
 
-				projectBody := &prpb.Project{}
-				err := protojson.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body), proto.MessageV2(projectBody))
-				Expect(err).ToNot(HaveOccurred())
+			It("should return an error without creating the project", func() {
+				assertErrorHasGrpcStatusCode(createProjectErr, codes.InvalidArgument)
+				Expect(transport.receivedHttpRequests).To(BeEmpty())
+			})
 
-				Expect(projectBody.Name).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
+			When("the shared layout is configured", func() {
+				BeforeEach(func() {
+					esConfig.Layout = config.LayoutShared
+					transport.preparedHttpResponses = transport.preparedHttpResponses[4:]
+				})
+
+				It("should create the project", func() {
+					Expect(createProjectErr).ToNot(HaveOccurred())
+				})
 			})
+		})
 
-			It("should create indices for storing occurrences/notes for the project", func() {
-				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedOccurrencesIndex)))
-				Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodPut))
-				assertIndexCreateBodyHasMetadataAndStringMapping(transport.receivedHttpRequests[2].Body)
+		When("indices were left behind by an earlier attempt", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = append([]*http.Response{{StatusCode: http.StatusOK}}, transport.preparedHttpResponses[2:]...)
+			})
 
-				Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedNotesIndex)))
-				Expect(transport.receivedHttpRequests[3].Method).To(Equal(http.MethodPut))
-				assertIndexCreateBodyHasMetadataAndStringMapping(transport.receivedHttpRequests[3].Body)
+			It("should use the existing index and create the missing one", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
+				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", expectedNotesIndex, schemaVersion)))
 			})
 
 			It("should return the project", func() {
-				Expect(expectedProject).ToNot(BeNil())
+				Expect(createProjectErr).ToNot(HaveOccurred())
 				Expect(expectedProject.Name).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
 			})
+		})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshTrue
-				})
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+				transport.preparedHttpResponses = transport.preparedHttpResponses[4:]
+			})
 
-				It("should immediately refresh the index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
-				})
+			It("should not create indices for the project", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(transport.receivedHttpRequests[0].URL.Path).To(HavePrefix(fmt.Sprintf("/%s-write/_doc/", expectedProjectIndex)))
 			})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshWaitFor
-				})
+			It("should return the project", func() {
+				Expect(createProjectErr).ToNot(HaveOccurred())
+				Expect(expectedProject.Name).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
+			})
+		})
 
-				It("should wait for refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshTrue
 			})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshFalse
-				})
+			It("should immediately refresh the index", func() {
+				Expect(transport.receivedHttpRequests[4].URL.Query().Get("refresh")).To(Equal("true"))
+			})
+		})
 
-				It("should not wait or force refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshWaitFor
 			})
 
-			When("creating a new document fails", func() {
-				BeforeEach(func() {
-					transport.preparedHttpResponses[1] = &http.Response{StatusCode: http.StatusBadRequest}
-				})
+			It("should wait for refresh of index", func() {
+				Expect(transport.receivedHttpRequests[4].URL.Query().Get("refresh")).To(Equal("wait_for"))
+			})
+		})
 
-				It("should return an error", func() {
-					assertErrorHasGrpcStatusCode(createProjectErr, codes.Internal)
-					Expect(expectedProject).To(BeNil())
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshFalse
+			})
 
-				It("should not attempt to create indices", func() {
-					Expect(transport.receivedHttpRequests).To(HaveLen(2))
-				})
+			It("should not wait or force refresh of index", func() {
+				Expect(transport.receivedHttpRequests[4].URL.Query().Get("refresh")).To(Equal("false"))
+			})
+		})
+
+		When("creating a new document fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[4] = &http.Response{StatusCode: http.StatusInternalServerError}
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(createProjectErr, codes.Internal)
+				Expect(expectedProject).To(BeNil())
+			})
+
+			It("should delete the indices that were created for the project", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(6))
+				Expect(transport.receivedHttpRequests[5].Method).To(Equal(http.MethodDelete))
+				Expect(transport.receivedHttpRequests[5].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d,%s-v%d", expectedOccurrencesIndex, schemaVersion, expectedNotesIndex, schemaVersion)))
 			})
 
-			When("creating the indices fails", func() {
+			When("deleting the indices fails", func() {
 				BeforeEach(func() {
-					transport.preparedHttpResponses[2] = &http.Response{StatusCode: http.StatusBadRequest}
+					transport.preparedHttpResponses[5].StatusCode = http.StatusInternalServerError
 				})
 
-				It("should return an error", func() {
+				It("should return the original error", func() {
 					assertErrorHasGrpcStatusCode(createProjectErr, codes.Internal)
-					Expect(expectedProject).To(BeNil())
+					Expect(status.Convert(createProjectErr).Message()).To(ContainSubstring("indexing document"))
 				})
 			})
 		})
+
+		When("creating the indices fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[3] = &http.Response{
+					StatusCode: http.StatusBadRequest,
+					Body: structToJsonBody(&esErrorResponse{
+						Error:  &esIndexDocError{Type: "illegal_argument_exception", Reason: fake.LetterN(10)},
+						Status: http.StatusBadRequest,
+					}),
+				}
+				transport.preparedHttpResponses[4] = &http.Response{StatusCode: http.StatusOK}
+			})
+
+			It("should return an error with the code for the elasticsearch error", func() {
+				assertErrorHasGrpcStatusCode(createProjectErr, codes.InvalidArgument)
+				Expect(expectedProject).To(BeNil())
+			})
+
+			It("should delete the index that was created and not create the project document", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(5))
+				Expect(transport.receivedHttpRequests[4].Method).To(Equal(http.MethodDelete))
+				Expect(transport.receivedHttpRequests[4].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", expectedOccurrencesIndex, schemaVersion)))
+			})
+		})
 	})
 
 	Context("listing Grafeas projects", func() {
@@ -336,7 +445,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
 			})
 		})
 
@@ -412,7 +521,7 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body: createGenericEsSearchResponse(&prpb.Project{
+					Body: createEsGetResponse(&prpb.Project{
 						Name: fmt.Sprintf("projects/%s", expectedProjectId),
 					}),
 				},
@@ -423,20 +532,12 @@ var _ = Describe("elasticsearch storage", func() {
 			actualProject, actualErr = elasticsearchStorage.GetProject(ctx, expectedProjectId)
 		})
 
-		It("should query elasticsearch for the specified project", func() {
+		It("should retrieve the project document by its ID", func() {
 			Expect(transport.receivedHttpRequests).To(HaveLen(1))
 
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedProjectIndex)))
+			expectedId := documentId(fmt.Sprintf("projects/%s", expectedProjectId))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedProjectIndex, expectedId)))
 			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
-
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
-
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
-
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
 		})
 
 		When("elasticsearch successfully returns a project document", func() {
@@ -454,8 +555,8 @@ var _ = Describe("elasticsearch storage", func() {
 			BeforeEach(func() {
 				transport.preparedHttpResponses = []*http.Response{
 					{
-						StatusCode: http.StatusOK,
-						Body:       createGenericEsSearchResponse(),
+						StatusCode: http.StatusNotFound,
+						Body:       structToJsonBody(&esGetResponse{Found: false}),
 					},
 				}
 			})
@@ -511,13 +612,24 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body: structToJsonBody(&esDeleteResponse{
-						Deleted: 1,
+					Body:       structToJsonBody(&esCountResponse{Count: 0}),
+				},
+				{
+					StatusCode: http.StatusOK,
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body: structToJsonBody(esIndicesResponse{
+						expectedOccurrencesIndex: {},
+						expectedNotesIndex:       {},
 					}),
 				},
 				{
 					StatusCode: http.StatusOK,
 				},
+				{
+					StatusCode: http.StatusOK,
+				},
 			}
 		})
 
@@ -525,106 +637,227 @@ var _ = Describe("elasticsearch storage", func() {
 			actualErr = elasticsearchStorage.DeleteProject(ctx, expectedProjectId)
 		})
 
-		It("should have sent a request to delete the project document", func() {
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodPost))
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_delete_by_query", expectedProjectIndex)))
+		It("should check for occurrences in other projects that reference the project's notes", func() {
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s-*occurrences/_count", indexPrefix)))
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
+			assertJsonHasValues(transport.receivedHttpRequests[0].Body, map[string]interface{}{
+				"query.bool.must.0.prefix.noteName": fmt.Sprintf("projects/%s/notes/", expectedProjectId),
+				"query.bool.must_not.0.prefix.name": fmt.Sprintf("projects/%s/", expectedProjectId),
+			})
+		})
 
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
+		It("should mark the project as deleting before deleting anything", func() {
+			expectedId := documentId(fmt.Sprintf("projects/%s", expectedProjectId))
 
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(fmt.Sprintf("projects/%s", expectedProjectId)))
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s/_update", writeAlias(expectedProjectIndex), expectedId)))
+			assertJsonHasValues(transport.receivedHttpRequests[1].Body, map[string]interface{}{
+				"doc.state": projectStateDeleting,
+			})
 		})
 
-		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
+		It("should resolve the indices for notes / occurrences, ignoring any that were already deleted", func() {
+			Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s,%s/_alias", expectedOccurrencesIndex, expectedNotesIndex)))
+			Expect(transport.receivedHttpRequests[2].URL.Query().Get("ignore_unavailable")).To(Equal("true"))
+		})
+
+		It("should delete the indices for notes / occurrences", func() {
+			Expect(transport.receivedHttpRequests[3].Method).To(Equal(http.MethodDelete))
+			Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s,%s", expectedNotesIndex, expectedOccurrencesIndex)))
+		})
+
+		It("should delete the project document last", func() {
+			expectedId := documentId(fmt.Sprintf("projects/%s", expectedProjectId))
+
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(5))
+			Expect(transport.receivedHttpRequests[4].Method).To(Equal(http.MethodDelete))
+			Expect(transport.receivedHttpRequests[4].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedProjectIndex, expectedId)))
+		})
+
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
 			BeforeEach(func() {
-				esConfig.Refresh = config.RefreshTrue
+				esConfig.Refresh = config.RefreshWaitFor
 			})
 
-			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+			It("should wait for refresh of the project index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
+				Expect(transport.receivedHttpRequests[4].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
 		})
 
-		When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
+		When("soft deletes are enabled", func() {
 			BeforeEach(func() {
-				esConfig.Refresh = config.RefreshWaitFor
+				esConfig.SoftDelete = config.SoftDeleteConfig{Enabled: true}
 			})
 
-			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+			It("should not count deleted occurrences as references to the project's notes", func() {
+				assertJsonHasValues(transport.receivedHttpRequests[0].Body, map[string]interface{}{
+					"query.bool.must.0.bool.must.0.prefix.noteName": fmt.Sprintf("projects/%s/notes/", expectedProjectId),
+					"query.bool.must_not.0.exists.field":            deleteTimeField,
+				})
 			})
 		})
 
-		When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
+		When("occurrences in other projects reference the project's notes", func() {
 			BeforeEach(func() {
-				esConfig.Refresh = config.RefreshFalse
+				transport.preparedHttpResponses[0].Body = structToJsonBody(&esCountResponse{Count: fake.Number(1, 100)})
 			})
 
-			It("should not wait for or force refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("false"))
+			It("should refuse to delete the project", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
 			})
 		})
 
-		When("elasticsearch successfully deletes the project document", func() {
+		When("checking for references to the project's notes fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 1,
-				})
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
 			})
 
-			It("should attempt to delete the indices for notes / occurrences", func() {
-				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodDelete))
-				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s,%s", expectedOccurrencesIndex, expectedNotesIndex)))
+			It("should return an error without deleting anything", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
 			})
+		})
 
-			When("elasticsearch successfully deletes the indices for notes / occurrences", func() {
-				It("should not return an error", func() {
-					Expect(actualErr).ToNot(HaveOccurred())
-				})
+		When("project does not exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusNotFound
 			})
 
-			When("elasticsearch fails to delete the indices for notes / occurrences", func() {
-				BeforeEach(func() {
-					transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
-				})
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+			})
 
-				It("should return an error", func() {
-					assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
-				})
+			It("should not attempt to delete the indices for notes / occurrences", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
 			})
 		})
 
-		When("project does not exist", func() {
+		When("marking the project as deleting fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without deleting anything", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("the indices have been migrated", func() {
+			var (
+				migratedOccurrencesIndex string
+				migratedNotesIndex       string
+			)
+
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 0,
+				migratedOccurrencesIndex = fmt.Sprintf("%s-v%d", expectedOccurrencesIndex, schemaVersion)
+				migratedNotesIndex = fmt.Sprintf("%s-v%d", expectedNotesIndex, schemaVersion)
+
+				transport.preparedHttpResponses[2].Body = structToJsonBody(esIndicesResponse{
+					migratedOccurrencesIndex: {
+						Aliases: map[string]*esIndexAlias{expectedOccurrencesIndex: {}},
+					},
+					migratedNotesIndex: {
+						Aliases: map[string]*esIndexAlias{expectedNotesIndex: {}},
+					},
 				})
 			})
 
-			It("should return an error", func() {
+			It("should delete the indices behind the aliases", func() {
+				Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s,%s", migratedNotesIndex, migratedOccurrencesIndex)))
+			})
+		})
+
+		When("the indices were already deleted by a previous attempt", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = structToJsonBody(esIndicesResponse{})
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses[:3], transport.preparedHttpResponses[4])
+			})
+
+			It("should delete the project document", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
+				Expect(transport.receivedHttpRequests[3].URL.Path).To(HavePrefix(fmt.Sprintf("/%s/_doc/", expectedProjectIndex)))
+			})
+		})
+
+		When("resolving the indices for notes / occurrences fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without deleting any indices or the project document", func() {
 				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
 			})
+		})
 
-			It("should not attempt to delete the indices for notes / occurrences", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		When("elasticsearch fails to delete the indices for notes / occurrences", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[3].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without deleting the project document", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
 			})
 		})
 
 		When("deleting the project document fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				transport.preparedHttpResponses[4].StatusCode = http.StatusInternalServerError
 			})
 
 			It("should return an error", func() {
 				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
 			})
+		})
 
-			It("should not attempt to delete the indices for notes / occurrences", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+				transport.preparedHttpResponses = []*http.Response{
+					transport.preparedHttpResponses[0],
+					transport.preparedHttpResponses[1],
+					{
+						StatusCode: http.StatusOK,
+						Body: structToJsonBody(&esDeleteResponse{
+							Deleted: fake.Number(0, 100),
+						}),
+					},
+					transport.preparedHttpResponses[4],
+				}
+			})
+
+			It("should delete the project's documents from the shared indices", func() {
+				Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodPost))
+				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%[1]s-occurrences,%[1]s-notes/_delete_by_query", indexPrefix)))
+				Expect(transport.receivedHttpRequests[2].URL.Query().Get("routing")).To(Equal(expectedProjectId))
+
+				assertJsonHasValues(transport.receivedHttpRequests[2].Body, map[string]interface{}{
+					"query.term.project": expectedProjectId,
+				})
+			})
+
+			It("should delete the project document without deleting any indices", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
+				Expect(transport.receivedHttpRequests[3].URL.Path).To(HavePrefix(fmt.Sprintf("/%s/_doc/", expectedProjectIndex)))
+			})
+
+			When("deleting the project's documents fails", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[2].StatusCode = http.StatusInternalServerError
+				})
+
+				It("should return an error without deleting the project document", func() {
+					assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+					Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				})
 			})
 		})
 	})
@@ -645,7 +878,11 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body: createGenericEsSearchResponse(&pb.Occurrence{
+					Body:       createEsBackingIndicesResponse(expectedOccurrenceIndex, 1),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body: createEsGetResponse(&pb.Occurrence{
 						Name: expectedOccurrenceName,
 					}),
 				},
@@ -656,20 +893,76 @@ var _ = Describe("elasticsearch storage", func() {
 			actualOccurrence, actualErr = elasticsearchStorage.GetOccurrence(ctx, expectedProjectId, expectedOccurrenceId)
 		})
 
-		It("should query elasticsearch for the specified occurrence", func() {
-			Expect(transport.receivedHttpRequests).To(HaveLen(1))
-
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedOccurrenceIndex)))
+		It("should look up the backing indices of the occurrences index", func() {
 			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_alias", expectedOccurrenceIndex)))
+		})
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
+		It("should retrieve the occurrence document by its ID when there's only one backing index", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedOccurrenceIndex, documentId(expectedOccurrenceName))))
+		})
 
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+				transport.preparedHttpResponses[0].Body = createEsBackingIndicesResponse(fmt.Sprintf("%s-occurrences", indexPrefix), 1)
+			})
+
+			It("should retrieve the occurrence from the shared occurrences index, routed by project", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-occurrences/_doc/%s", indexPrefix, documentId(expectedOccurrenceName))))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("routing")).To(Equal(expectedProjectId))
+			})
+
+			It("should return the Grafeas occurrence", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualOccurrence.Name).To(Equal(expectedOccurrenceName))
+			})
+		})
+
+		When("the occurrences index has been rolled over", func() {
+			BeforeEach(func() {
+				esConfig.Rollover = config.RolloverConfig{Enabled: true, MaxDocs: fake.Number(1, 1000)}
+				transport.preparedHttpResponses[0].Body = createEsBackingIndicesResponse(expectedOccurrenceIndex, 2)
+				transport.preparedHttpResponses[1].Body = createGenericEsSearchResponse(&pb.Occurrence{
+					Name: expectedOccurrenceName,
+				})
+			})
+
+			It("should search every backing index for the occurrence ID", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedOccurrenceIndex)))
+
+				body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+				Expect(body.Path("query.ids.values").Data()).To(ConsistOf(documentId(expectedOccurrenceName)))
+			})
+
+			It("should return the Grafeas occurrence", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualOccurrence.Name).To(Equal(expectedOccurrenceName))
+			})
+
+			When("rollover has since been disabled", func() {
+				BeforeEach(func() {
+					esConfig.Rollover = config.RolloverConfig{}
+				})
 
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(expectedOccurrenceName))
+				It("should still search every backing index for the occurrence ID", func() {
+					Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedOccurrenceIndex)))
+				})
+			})
+		})
+
+		When("looking up the backing indices fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without retrieving the occurrence", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
 		})
 
 		When("elasticsearch successfully returns an occurrence document", func() {
@@ -685,12 +978,18 @@ var _ = Describe("elasticsearch storage", func() {
 
 		When("elasticsearch can not find the specified occurrence document", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses = []*http.Response{
-					{
-						StatusCode: http.StatusOK,
-						Body:       createGenericEsSearchResponse(),
-					},
-				}
+				transport.preparedHttpResponses[1].StatusCode = http.StatusNotFound
+			})
+
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+			})
+		})
+
+		When("the occurrences index doesn't exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusNotFound
+				transport.preparedHttpResponses[1].StatusCode = http.StatusNotFound
 			})
 
 			It("should return a not found error", func() {
@@ -700,12 +999,7 @@ var _ = Describe("elasticsearch storage", func() {
 
 		When("elasticsearch returns a bad object", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses = []*http.Response{
-					{
-						StatusCode: http.StatusOK,
-						Body:       ioutil.NopCloser(strings.NewReader(fake.LetterN(10))),
-					},
-				}
+				transport.preparedHttpResponses[1].Body = ioutil.NopCloser(strings.NewReader(fake.LetterN(10)))
 			})
 
 			It("should return an error", func() {
@@ -715,11 +1009,7 @@ var _ = Describe("elasticsearch storage", func() {
 
 		When("elasticsearch returns an error", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses = []*http.Response{
-					{
-						StatusCode: http.StatusInternalServerError,
-					},
-				}
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
 			})
 
 			It("should return an error", func() {
@@ -745,6 +1035,10 @@ var _ = Describe("elasticsearch storage", func() {
 			expectedOccurrence = generateTestOccurrence("")
 
 			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(expectedProjectId, ""),
+				},
 				{
 					StatusCode: http.StatusCreated,
 					Body: structToJsonBody(&esIndexDocResponse{
@@ -758,16 +1052,17 @@ var _ = Describe("elasticsearch storage", func() {
 		JustBeforeEach(func() {
 			occurrence := deepCopyOccurrence(expectedOccurrence)
 
-			transport.preparedHttpResponses[0].Body = structToJsonBody(&esIndexDocResponse{
+			transport.preparedHttpResponses[1].Body = structToJsonBody(&esIndexDocResponse{
 				Id: expectedOccurrenceESId,
 			})
 			actualOccurrence, actualErr = elasticsearchStorage.CreateOccurrence(context.Background(), expectedProjectId, "", occurrence)
 		})
 
-		It("should attempt to index the occurrence as a document", func() {
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc", expectedOccurrencesIndex)))
+		It("should attempt to index the occurrence as a document, using an ID derived from the occurrence name", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-write/_doc/%s", expectedOccurrencesIndex, documentId(actualOccurrence.Name))))
+			Expect(transport.receivedHttpRequests[1].URL.Query().Get("op_type")).To(Equal("create"))
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
+			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[1].Body)
 			Expect(err).ToNot(HaveOccurred())
 
 			indexedOccurrence := &pb.Occurrence{}
@@ -784,7 +1079,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
 			})
 		})
 
@@ -794,7 +1089,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should wait for refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("wait_for"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
 		})
 
@@ -804,13 +1099,13 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should not wait or force refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("false"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
 			})
 		})
 
 		When("indexing the document fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0] = &http.Response{
+				transport.preparedHttpResponses[1] = &http.Response{
 					StatusCode: http.StatusInternalServerError,
 					Body: structToJsonBody(&esIndexDocResponse{
 						Error: &esIndexDocError{
@@ -835,6 +1130,23 @@ var _ = Describe("elasticsearch storage", func() {
 				Expect(actualOccurrence).To(Equal(expectedOccurrence))
 			})
 		})
+
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+			})
+
+			It("should index the occurrence in the shared occurrences index, routed by project", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-occurrences-write/_doc/%s", indexPrefix, documentId(actualOccurrence.Name))))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("routing")).To(Equal(expectedProjectId))
+			})
+
+			It("should add the project field to the document", func() {
+				assertJsonHasValues(transport.receivedHttpRequests[1].Body, map[string]interface{}{
+					"project": expectedProjectId,
+				})
+			})
+		})
 	})
 
 	Context("creating a batch of Grafeas occurrences", func() {
@@ -856,6 +1168,10 @@ var _ = Describe("elasticsearch storage", func() {
 			}
 
 			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(expectedProjectId, ""),
+				},
 				{
 					StatusCode: http.StatusOK,
 					Body:       createEsBulkOccurrenceIndexResponse(expectedOccurrences, expectedErrs),
@@ -867,7 +1183,7 @@ var _ = Describe("elasticsearch storage", func() {
 		JustBeforeEach(func() {
 			occurrences := deepCopyOccurrences(expectedOccurrences)
 
-			transport.preparedHttpResponses[0].Body = createEsBulkOccurrenceIndexResponse(occurrences, expectedErrs)
+			transport.preparedHttpResponses[1].Body = createEsBulkOccurrenceIndexResponse(occurrences, expectedErrs)
 			actualOccurrences, actualErrs = elasticsearchStorage.BatchCreateOccurrences(context.Background(), expectedProjectId, "", occurrences)
 		})
 
@@ -879,18 +1195,19 @@ var _ = Describe("elasticsearch storage", func() {
 				expectedPayloads = append(expectedPayloads, &esBulkQueryFragment{}, &pb.Occurrence{})
 			}
 
-			parseEsBulkIndexRequest(transport.receivedHttpRequests[0].Body, expectedPayloads)
+			parseEsBulkIndexRequest(transport.receivedHttpRequests[1].Body, expectedPayloads)
 
 			for i, payload := range expectedPayloads {
 				if i%2 == 0 { // index metadata
 					metadata := payload.(*esBulkQueryFragment)
-					Expect(metadata.Index.Index).To(Equal(expectedOccurrencesIndex))
+					Expect(metadata.Index.Index).To(Equal(writeAlias(expectedOccurrencesIndex)))
 				} else { // occurrence
 					occurrence := payload.(*pb.Occurrence)
 					expectedOccurrence := expectedOccurrences[(i-1)/2]
 					expectedOccurrence.Name = occurrence.Name
 
 					Expect(occurrence).To(Equal(expectedOccurrence))
+					Expect(expectedPayloads[i-1].(*esBulkQueryFragment).Index.Id).To(Equal(documentId(occurrence.Name)))
 				}
 			}
 		})
@@ -901,7 +1218,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
 			})
 		})
 
@@ -911,7 +1228,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should wait for refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("wait_for"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
 		})
 
@@ -921,7 +1238,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should not wait or force refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("false"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
 			})
 		})
 
@@ -937,15 +1254,39 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 		})
 
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+			})
+
+			It("should index each occurrence in the shared occurrences index, routed by project", func() {
+				requestBody := strings.Split(strings.TrimSuffix(string(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body)), "\n"), "\n")
+				Expect(requestBody).To(HaveLen(len(expectedOccurrences) * 2))
+
+				for i := 0; i < len(requestBody); i += 2 {
+					metadata := &esBulkQueryFragment{}
+					Expect(json.Unmarshal([]byte(requestBody[i]), metadata)).To(Succeed())
+					Expect(metadata.Index.Index).To(Equal(fmt.Sprintf("%s-occurrences-write", indexPrefix)))
+					Expect(metadata.Index.Routing).To(Equal(expectedProjectId))
+
+					document := map[string]interface{}{}
+					Expect(json.Unmarshal([]byte(requestBody[i+1]), &document)).To(Succeed())
+					Expect(document[projectField]).To(Equal(expectedProjectId))
+				}
+			})
+		})
+
 		When("the bulk request completely fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
 			})
 
-			It("should return a single error and no occurrences", func() {
+			It("should return an error for each occurrence and no occurrences", func() {
 				Expect(actualOccurrences).To(BeNil())
-				Expect(actualErrs).To(HaveLen(1))
-				Expect(actualErrs[0]).To(HaveOccurred())
+				Expect(actualErrs).To(HaveLen(len(expectedOccurrences)))
+				for i, err := range actualErrs {
+					assertErrorHasBatchItemDetails(err, occurrenceResourceType, i)
+				}
 			})
 		})
 
@@ -981,6 +1322,11 @@ var _ = Describe("elasticsearch storage", func() {
 				Expect(actualErrs).To(HaveLen(1))
 				Expect(actualErrs[0]).To(HaveOccurred())
 			})
+
+			It("should identify the occurrence that failed", func() {
+				resource := assertErrorHasBatchItemDetails(actualErrs[0], occurrenceResourceType, randomErrorIndex)
+				Expect(resource.ResourceName).To(MatchRegexp("^projects/%s/occurrences/.+$", expectedProjectId))
+			})
 		})
 	})
 
@@ -1000,9 +1346,7 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body: structToJsonBody(&esDeleteResponse{
-						Deleted: 1,
-					}),
+					Body:       createEsBackingIndicesResponse(expectedOccurrencesIndex, 1),
 				},
 				{
 					StatusCode: http.StatusOK,
@@ -1014,19 +1358,49 @@ var _ = Describe("elasticsearch storage", func() {
 			actualErr = elasticsearchStorage.DeleteOccurrence(ctx, expectedProjectId, expectedOccurrenceId)
 		})
 
-		It("should have sent a request to elasticsearch to delete the occurrence document", func() {
-			Expect(transport.receivedHttpRequests).To(HaveLen(1))
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodPost))
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_delete_by_query", expectedOccurrencesIndex)))
+		It("should delete the occurrence document by its ID when there's only one backing index", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_alias", expectedOccurrencesIndex)))
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodDelete))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedOccurrencesIndex, documentId(expectedOccurrenceName))))
+		})
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
+		When("the occurrences index has been rolled over", func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshWaitFor
+				transport.preparedHttpResponses[0].Body = createEsBackingIndicesResponse(expectedOccurrencesIndex, 2)
+				transport.preparedHttpResponses[1].Body = structToJsonBody(&esDeleteResponse{
+					Deleted: 1,
+				})
+			})
 
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
+			It("should delete the occurrence from every backing index by its ID", func() {
+				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPost))
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_delete_by_query", expectedOccurrencesIndex)))
+
+				body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+				Expect(body.Path("query.ids.values").Data()).To(ConsistOf(documentId(expectedOccurrenceName)))
+			})
+
+			It("should refresh the index, since a delete by query can't wait for a refresh", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
+			})
+
+			It("should not return an error", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+			})
+
+			When("the occurrence does not exist", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[1].Body = structToJsonBody(&esDeleteResponse{
+						Deleted: 0,
+					})
+				})
 
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(expectedOccurrenceName))
+				It("should return a not found error", func() {
+					assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				})
+			})
 		})
 
 		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
@@ -1035,7 +1409,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
 			})
 		})
 
@@ -1044,8 +1418,8 @@ var _ = Describe("elasticsearch storage", func() {
 				esConfig.Refresh = config.RefreshWaitFor
 			})
 
-			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+			It("should wait for refresh of index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal(config.RefreshWaitFor))
 			})
 		})
 
@@ -1055,17 +1429,11 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should not wait or force refresh of index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("false"))
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
 			})
 		})
 
 		When("elasticsearch successfully deletes the occurrence document", func() {
-			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 1,
-				})
-			})
-
 			It("should not return an error", func() {
 				Expect(actualErr).ToNot(HaveOccurred())
 			})
@@ -1073,19 +1441,17 @@ var _ = Describe("elasticsearch storage", func() {
 
 		When("the occurrence does not exist", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 0,
-				})
+				transport.preparedHttpResponses[1].StatusCode = http.StatusNotFound
 			})
 
-			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
 			})
 		})
 
 		When("deleting the occurrence document fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
 			})
 
 			It("should return an error", func() {
@@ -1182,7 +1548,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
 			})
 		})
 
@@ -1271,7 +1637,7 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body:       createGenericEsSearchResponse(), // happy path: a note with this ID does not exist (0 hits), so we create one
+					Body:       createEsProjectGetResponse(expectedProjectId, ""),
 				},
 				{
 					StatusCode: http.StatusCreated,
@@ -1289,136 +1655,97 @@ var _ = Describe("elasticsearch storage", func() {
 			actualNote, actualErr = elasticsearchStorage.CreateNote(context.Background(), expectedProjectId, expectedNoteId, "", note)
 		})
 
-		It("should check elasticsearch to see if a note with the specified noteId already exists", func() {
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedNotesIndex)))
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+		It("should attempt to index the note as a document, using an ID derived from the note name", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-write/_doc/%s", expectedNotesIndex, documentId(expectedNoteName))))
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+			Expect(transport.receivedHttpRequests[1].URL.Query().Get("op_type")).To(Equal("create"))
+
+			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[1].Body)
 			Expect(err).ToNot(HaveOccurred())
 
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
+			indexedNote := &pb.Note{}
+			err = protojson.Unmarshal(requestBody, proto.MessageV2(indexedNote))
 			Expect(err).ToNot(HaveOccurred())
 
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(expectedNoteName))
+			Expect(indexedNote).To(BeEquivalentTo(expectedNote))
 		})
 
-		When("a note with the specified noteId does not exist", func() {
-			It("should attempt to index the note as a document", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(2))
-
-				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc", expectedNotesIndex)))
-
-				requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[1].Body)
-				Expect(err).ToNot(HaveOccurred())
-
-				indexedNote := &pb.Note{}
-				err = protojson.Unmarshal(requestBody, proto.MessageV2(indexedNote))
-				Expect(err).ToNot(HaveOccurred())
-
-				Expect(indexedNote).To(BeEquivalentTo(expectedNote))
-			})
-
-			When("indexing the document fails", func() {
-				BeforeEach(func() {
-					transport.preparedHttpResponses[0] = &http.Response{
-						StatusCode: http.StatusInternalServerError,
-						Body: structToJsonBody(&esIndexDocResponse{
-							Error: &esIndexDocError{
-								Type:   fake.LetterN(10),
-								Reason: fake.LetterN(10),
-							},
-						}),
-					}
-				})
-
-				It("should return an error", func() {
-					Expect(actualNote).To(BeNil())
-					Expect(actualErr).To(HaveOccurred())
-				})
-			})
-
-			When("indexing the document succeeds", func() {
-				It("should return the note that was created", func() {
-					Expect(actualErr).ToNot(HaveOccurred())
-
-					expectedNote.Name = actualNote.Name
-					Expect(actualNote).To(Equal(expectedNote))
-				})
-			})
-
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshTrue
-				})
-
-				It("should immediately refresh the index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
-				})
+		When("indexing the document fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1] = &http.Response{
+					StatusCode: http.StatusInternalServerError,
+					Body: structToJsonBody(&esIndexDocResponse{
+						Error: &esIndexDocError{
+							Type:   fake.LetterN(10),
+							Reason: fake.LetterN(10),
+						},
+					}),
+				}
 			})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshWaitFor
-				})
-
-				It("should wait for refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
-				})
+			It("should return an error", func() {
+				Expect(actualNote).To(BeNil())
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
 			})
+		})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshFalse
-				})
+		When("indexing the document succeeds", func() {
+			It("should return the note that was created", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
 
-				It("should not wait or force refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
-				})
+				expectedNote.Name = actualNote.Name
+				Expect(actualNote).To(Equal(expectedNote))
 			})
 		})
 
-		When("a note with the specified noteId exists", func() {
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = createGenericEsSearchResponse(&pb.Note{
-					Name: expectedNoteName,
-				})
-			})
-
-			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
+				esConfig.Refresh = config.RefreshTrue
 			})
 
-			It("should not attempt to index a note document", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			It("should immediately refresh the index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
 			})
 		})
 
-		When("checking for the existence of the note fails", func() {
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				esConfig.Refresh = config.RefreshWaitFor
 			})
 
-			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			It("should wait for refresh of index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
+		})
 
-			It("should not attempt to index a note document", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshFalse
+			})
+
+			It("should not wait or force refresh of index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
 			})
 		})
 
-		When("elasticsearch returns a bad response when checking if a note exists", func() {
+		When("a note with the specified noteId exists", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = ioutil.NopCloser(strings.NewReader("bad object"))
+				transport.preparedHttpResponses[1] = &http.Response{
+					StatusCode: http.StatusConflict,
+					Body: structToJsonBody(&esIndexDocResponse{
+						Error: &esIndexDocError{
+							Type:   "version_conflict_engine_exception",
+							Reason: fake.LetterN(10),
+						},
+					}),
+				}
 			})
 
 			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
-			})
-
-			It("should not attempt to index a note document", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(actualNote).To(BeNil())
+				assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
 			})
 		})
 	})
@@ -1431,6 +1758,7 @@ var _ = Describe("elasticsearch storage", func() {
 			expectedNotes            []*pb.Note
 			expectedNotesWithNoteIds map[string]*pb.Note
 			expectedNotesIndex       string
+			responseStatuses         []int
 		)
 
 		// BeforeEach configures the happy path for this context
@@ -1441,133 +1769,178 @@ var _ = Describe("elasticsearch storage", func() {
 			expectedNotesWithNoteIds = convertSliceOfNotesToMap(expectedNotes)
 
 			// happy path: none of the provided notes exist, all of the provided notes were created successfully
-			// response 1: every search result will have zero hits
-			// response 2: every index operation was successful
+			responseStatuses = []int{}
+			for range expectedNotes {
+				responseStatuses = append(responseStatuses, http.StatusCreated)
+			}
+
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body:       createEsMultiSearchNoteResponse(expectedNotesWithNoteIds),
+					Body:       createEsProjectGetResponse(expectedProjectId, ""),
 				},
 				{
 					StatusCode: http.StatusOK,
-					Body:       createEsBulkNoteIndexResponse(expectedNotesWithNoteIds),
 				},
 			}
 		})
 
 		// JustBeforeEach actually invokes the system under test
 		JustBeforeEach(func() {
+			transport.preparedHttpResponses[1].Body = createEsBulkNoteCreateResponse(responseStatuses)
 			actualNotes, actualErrs = elasticsearchStorage.BatchCreateNotes(context.Background(), expectedProjectId, "", deepCopyNotes(expectedNotesWithNoteIds))
 		})
 
 		// this test parses the ndjson request body and ensures that it was formatted correctly
-		It("should send a multisearch request to ES to check for the existence of each note", func() {
+		It("should send a single bulk request to ES to create each note, using IDs derived from the note names", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal("/_bulk"))
+
 			var expectedPayloads []interface{}
 
-			for i := 0; i < len(expectedNotesWithNoteIds); i++ {
-				expectedPayloads = append(expectedPayloads, &esMultiSearchQueryFragment{}, &esSearch{})
+			for i := 0; i < len(expectedNotes); i++ {
+				expectedPayloads = append(expectedPayloads, &esBulkQueryFragment{}, &pb.Note{})
 			}
 
-			parseEsMsearchIndexRequest(transport.receivedHttpRequests[0].Body, expectedPayloads)
+			parseEsBulkIndexRequest(transport.receivedHttpRequests[1].Body, expectedPayloads)
 
 			for i, payload := range expectedPayloads {
-				if i%2 == 0 { // index metadata
-					metadata := payload.(*esMultiSearchQueryFragment)
-					Expect(metadata.Index).To(Equal(expectedNotesIndex))
+				if i%2 == 0 { // create metadata
+					metadata := payload.(*esBulkQueryFragment)
+					Expect(metadata.Index).To(BeNil())
+					Expect(metadata.Create.Index).To(Equal(writeAlias(expectedNotesIndex)))
 				} else { // note
-					Expect(payload).To(BeAssignableToTypeOf(&esSearch{}))
-					Expect(map[string]string(*payload.(*esSearch).Query.Term)["name"]).To(MatchRegexp("projects/%s/notes/\\w+", expectedProjectId))
+					note := payload.(*pb.Note)
+					noteId := strings.Split(note.Name, "/")[3] // projects/${projectId}/notes/${noteId}
+					expectedNote := expectedNotesWithNoteIds[noteId]
+					expectedNote.Name = note.Name
+
+					Expect(note).To(Equal(expectedNote))
+					Expect(expectedPayloads[i-1].(*esBulkQueryFragment).Create.Id).To(Equal(documentId(note.Name)))
 				}
 			}
 		})
 
-		When("the multisearch request returns an error", func() {
+		When("the bulk request returns no errors", func() {
+			It("should return all created notes", func() {
+				Expect(actualErrs).To(BeEmpty())
+				for _, note := range expectedNotesWithNoteIds {
+					Expect(actualNotes).To(ContainElement(note))
+				}
+			})
+
+			It("should return the notes in order of their IDs", func() {
+				var actualNames []string
+				for _, note := range actualNotes {
+					actualNames = append(actualNames, note.Name)
+				}
+
+				Expect(sort.StringsAreSorted(actualNames)).To(BeTrue())
+			})
+		})
+
+		When("some of the notes already exist", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				responseStatuses[0] = http.StatusConflict
 			})
 
-			It("should return a single error and no notes", func() {
+			It("should return an already exists error for each existing note", func() {
 				Expect(actualErrs).To(HaveLen(1))
-				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.AlreadyExists)
 			})
 
-			It("should not attempt to index any notes", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			It("should identify the note that already exists", func() {
+				var noteIds []string
+				for noteId := range expectedNotesWithNoteIds {
+					noteIds = append(noteIds, noteId)
+				}
+				sort.Strings(noteIds)
+
+				resource := assertErrorHasBatchItemDetails(actualErrs[0], noteResourceType, 0)
+				Expect(resource.ResourceName).To(Equal(fmt.Sprintf("projects/%s/notes/%s", expectedProjectId, noteIds[0])))
 			})
-		})
 
-		When("the multisearch request returns no notes already exist", func() {
-			It("should attempt to bulk index all of the notes", func() {
-				var expectedPayloads []interface{}
+			It("should return the notes that were created", func() {
+				Expect(actualNotes).To(HaveLen(len(expectedNotes) - 1))
+			})
+		})
 
-				for i := 0; i < len(expectedNotes); i++ {
-					expectedPayloads = append(expectedPayloads, &esBulkQueryFragment{}, &pb.Note{})
-				}
+		When("creating some of the notes fails", func() {
+			BeforeEach(func() {
+				responseStatuses[0] = http.StatusInternalServerError
+			})
 
-				parseEsBulkIndexRequest(transport.receivedHttpRequests[1].Body, expectedPayloads)
+			It("should return an error for each note that was not created", func() {
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
+				Expect(actualNotes).To(HaveLen(len(expectedNotes) - 1))
+			})
+		})
 
-				for i, payload := range expectedPayloads {
-					if i%2 == 0 { // index metadata
-						metadata := payload.(*esBulkQueryFragment)
-						Expect(metadata.Index.Index).To(Equal(expectedNotesIndex))
-					} else { // note
-						note := payload.(*pb.Note)
-						noteId := strings.Split(note.Name, "/")[3] // projects/${projectId}/notes/${noteId}
-						expectedNote := expectedNotesWithNoteIds[noteId]
-						expectedNote.Name = note.Name
+		When("the bulk request completely fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			})
 
-						Expect(note).To(Equal(expectedNote))
-					}
+			It("should return an error for each note and no notes", func() {
+				Expect(actualNotes).To(BeNil())
+				Expect(actualErrs).To(HaveLen(len(expectedNotes)))
+				for i, err := range actualErrs {
+					assertErrorHasGrpcStatusCode(err, codes.Internal)
+					assertErrorHasBatchItemDetails(err, noteResourceType, i)
 				}
 			})
+		})
 
-			When("the bulk index request returns no errors", func() {
-				It("should return all created notes", func() {
-					for _, note := range expectedNotesWithNoteIds {
-						Expect(actualNotes).To(ContainElement(note))
-					}
-				})
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
 			})
 
-			When("the bulk index request completely fails", func() {
-				BeforeEach(func() {
-					transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
-				})
+			It("should create each note in the shared notes index, routed by project", func() {
+				requestBody := strings.Split(strings.TrimSuffix(string(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body)), "\n"), "\n")
+				Expect(requestBody).To(HaveLen(len(expectedNotes) * 2))
 
-				It("should return a single error and no notes", func() {
-					Expect(actualErrs).To(HaveLen(1))
-					assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
-				})
+				for i := 0; i < len(requestBody); i += 2 {
+					metadata := &esBulkQueryFragment{}
+					Expect(json.Unmarshal([]byte(requestBody[i]), metadata)).To(Succeed())
+					Expect(metadata.Create.Index).To(Equal(fmt.Sprintf("%s-notes-write", indexPrefix)))
+					Expect(metadata.Create.Routing).To(Equal(expectedProjectId))
+
+					document := map[string]interface{}{}
+					Expect(json.Unmarshal([]byte(requestBody[i+1]), &document)).To(Succeed())
+					Expect(document[projectField]).To(Equal(expectedProjectId))
+				}
 			})
+		})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshTrue
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshTrue
+			})
 
-				It("should immediately refresh the index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
-				})
+			It("should immediately refresh the index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("true"))
 			})
+		})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshWaitFor
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshWaitFor), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshWaitFor
+			})
 
-				It("should wait for refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
-				})
+			It("should wait for refresh of index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
+		})
 
-			When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
-				BeforeEach(func() {
-					esConfig.Refresh = config.RefreshFalse
-				})
+		When(fmt.Sprintf("refresh configuration is %s", config.RefreshFalse), func() {
+			BeforeEach(func() {
+				esConfig.Refresh = config.RefreshFalse
+			})
 
-				It("should not wait or force refresh of index", func() {
-					Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
-				})
+			It("should not wait or force refresh of index", func() {
+				Expect(transport.receivedHttpRequests[1].URL.Query().Get("refresh")).To(Equal("false"))
 			})
 		})
 	})
@@ -1588,7 +1961,7 @@ var _ = Describe("elasticsearch storage", func() {
 			transport.preparedHttpResponses = []*http.Response{
 				{
 					StatusCode: http.StatusOK,
-					Body: createGenericEsSearchResponse(&pb.Note{
+					Body: createEsGetResponse(&pb.Note{
 						Name: expectedNoteName,
 					}),
 				},
@@ -1599,20 +1972,21 @@ var _ = Describe("elasticsearch storage", func() {
 			actualNote, actualErr = elasticsearchStorage.GetNote(ctx, expectedProjectId, expectedNoteId)
 		})
 
-		It("should query elasticsearch for the specified note", func() {
+		It("should retrieve the note document by its ID", func() {
 			Expect(transport.receivedHttpRequests).To(HaveLen(1))
 
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedNotesIndex)))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedNotesIndex, documentId(expectedNoteName))))
 			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+		})
 
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
-
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
+		When("rollover is enabled", func() {
+			BeforeEach(func() {
+				esConfig.Rollover = config.RolloverConfig{Enabled: true, MaxDocs: fake.Number(1, 1000)}
+			})
 
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(expectedNoteName))
+			It("should still retrieve the note document by its ID, since notes indices aren't rolled over", func() {
+				Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedNotesIndex, documentId(expectedNoteName))))
+			})
 		})
 
 		When("elasticsearch successfully returns a note document", func() {
@@ -1630,8 +2004,8 @@ var _ = Describe("elasticsearch storage", func() {
 			BeforeEach(func() {
 				transport.preparedHttpResponses = []*http.Response{
 					{
-						StatusCode: http.StatusOK,
-						Body:       createGenericEsSearchResponse(),
+						StatusCode: http.StatusNotFound,
+						Body:       structToJsonBody(&esGetResponse{Found: false}),
 					},
 				}
 			})
@@ -1700,6 +2074,26 @@ var _ = Describe("elasticsearch storage", func() {
 			actualNotes, _, actualErr = elasticsearchStorage.ListNotes(ctx, expectedProjectId, expectedFilter, "", 0)
 		})
 
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+			})
+
+			It("should only query the shared notes index for the project's notes", func() {
+				Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s-notes/_search", indexPrefix)))
+				Expect(transport.receivedHttpRequests[0].URL.Query().Get("routing")).To(Equal(expectedProjectId))
+
+				assertJsonHasValues(transport.receivedHttpRequests[0].Body, map[string]interface{}{
+					"query.term.project": expectedProjectId,
+				})
+			})
+
+			It("should return the notes", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualNotes).To(HaveLen(len(expectedNotes)))
+			})
+		})
+
 		It("should query elasticsearch for notes", func() {
 			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedNotesIndex)))
 			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
@@ -1759,7 +2153,7 @@ var _ = Describe("elasticsearch storage", func() {
 			})
 
 			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
 			})
 		})
 
@@ -1837,12 +2231,6 @@ var _ = Describe("elasticsearch storage", func() {
 			expectedNoteName = fmt.Sprintf("projects/%s/notes/%s", expectedProjectId, expectedNoteId)
 
 			transport.preparedHttpResponses = []*http.Response{
-				{
-					StatusCode: http.StatusOK,
-					Body: structToJsonBody(&esDeleteResponse{
-						Deleted: 1,
-					}),
-				},
 				{
 					StatusCode: http.StatusOK,
 				},
@@ -1853,19 +2241,10 @@ var _ = Describe("elasticsearch storage", func() {
 			actualErr = elasticsearchStorage.DeleteNote(ctx, expectedProjectId, expectedNoteId)
 		})
 
-		It("should have sent a request to elasticsearch to delete the note document", func() {
+		It("should have sent a request to elasticsearch to delete the note document by its ID", func() {
 			Expect(transport.receivedHttpRequests).To(HaveLen(1))
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodPost))
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_delete_by_query", expectedNotesIndex)))
-
-			requestBody, err := ioutil.ReadAll(transport.receivedHttpRequests[0].Body)
-			Expect(err).ToNot(HaveOccurred())
-
-			searchBody := &esSearch{}
-			err = json.Unmarshal(requestBody, searchBody)
-			Expect(err).ToNot(HaveOccurred())
-
-			Expect((*searchBody.Query.Term)["name"]).To(Equal(expectedNoteName))
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodDelete))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", expectedNotesIndex, documentId(expectedNoteName))))
 		})
 
 		When(fmt.Sprintf("refresh configuration is %s", config.RefreshTrue), func() {
@@ -1883,8 +2262,8 @@ var _ = Describe("elasticsearch storage", func() {
 				esConfig.Refresh = config.RefreshWaitFor
 			})
 
-			It("should immediately refresh the index", func() {
-				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("true"))
+			It("should wait for refresh of index", func() {
+				Expect(transport.receivedHttpRequests[0].URL.Query().Get("refresh")).To(Equal("wait_for"))
 			})
 		})
 
@@ -1899,12 +2278,6 @@ var _ = Describe("elasticsearch storage", func() {
 		})
 
 		When("elasticsearch successfully deletes the note document", func() {
-			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 1,
-				})
-			})
-
 			It("should not return an error", func() {
 				Expect(actualErr).ToNot(HaveOccurred())
 			})
@@ -1912,13 +2285,11 @@ var _ = Describe("elasticsearch storage", func() {
 
 		When("the note does not exist", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].Body = structToJsonBody(&esDeleteResponse{
-					Deleted: 0,
-				})
+				transport.preparedHttpResponses[0].StatusCode = http.StatusNotFound
 			})
 
-			It("should return an error", func() {
-				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
 			})
 		})
 
@@ -1988,45 +2359,63 @@ func createGenericEsSearchResponse(messages ...proto.Message) io.ReadCloser {
 	return ioutil.NopCloser(bytes.NewReader(responseBody))
 }
 
-func createEsSearchResponse(objectType string, hitNames ...string) io.ReadCloser {
-	var occurrenceHits []*esSearchResponseHit
+// createEsSearchResponseWithProjectField returns a search response whose documents include the project field,
+// which is added to every document when using the shared layout
+func createEsSearchResponseWithProjectField(projectId string, messages ...proto.Message) io.ReadCloser {
+	var hits []*esSearchResponseHit
 
-	for _, hit := range hitNames {
-		switch objectType {
-		case "project":
-			rawGrafeasObject, err := json.Marshal(generateTestProject(hit))
-			Expect(err).ToNot(HaveOccurred())
-			occurrenceHits = append(occurrenceHits, &esSearchResponseHit{
-				Source: rawGrafeasObject,
-			})
-		case "occurrence":
-			rawGrafeasObject, err := json.Marshal(generateTestOccurrence(hit))
-			Expect(err).ToNot(HaveOccurred())
-			occurrenceHits = append(occurrenceHits, &esSearchResponseHit{
-				Source: rawGrafeasObject,
-			})
-		case "note":
-			rawGrafeasObject, err := json.Marshal(generateTestNote(hit))
-			Expect(err).ToNot(HaveOccurred())
-			occurrenceHits = append(occurrenceHits, &esSearchResponseHit{
-				Source: rawGrafeasObject,
-			})
-		}
+	for _, m := range messages {
+		raw, err := protojson.Marshal(proto.MessageV2(m))
+		Expect(err).ToNot(HaveOccurred())
+
+		document := map[string]interface{}{}
+		Expect(json.Unmarshal(raw, &document)).To(Succeed())
+		document[projectField] = projectId
+
+		raw, err = json.Marshal(document)
+		Expect(err).ToNot(HaveOccurred())
+
+		hits = append(hits, &esSearchResponseHit{
+			Source: raw,
+		})
 	}
 
-	response := &esSearchResponse{
+	return structToJsonBody(&esSearchResponse{
 		Took: fake.Number(1, 10),
 		Hits: &esSearchResponseHits{
 			Total: &esSearchResponseTotal{
-				Value: len(hitNames),
+				Value: len(hits),
 			},
-			Hits: occurrenceHits,
+			Hits: hits,
 		},
+	})
+}
+
+// createEsBackingIndicesResponse returns the given number of backing indices for an alias, the last of which is the write index
+func createEsBackingIndicesResponse(alias string, count int) io.ReadCloser {
+	indices := esIndicesResponse{}
+	for i := 1; i <= count; i++ {
+		backingIndex := fmt.Sprintf("%s-v%d-%06d", alias, schemaVersion, i)
+		indices[backingIndex] = &esIndex{
+			Aliases: map[string]*esIndexAlias{
+				alias:             {},
+				writeAlias(alias): {IsWriteIndex: i == count},
+			},
+		}
 	}
-	responseBody, err := json.Marshal(response)
+
+	return structToJsonBody(indices)
+}
+
+func createEsGetResponse(message proto.Message) io.ReadCloser {
+	raw, err := protojson.Marshal(proto.MessageV2(message))
 	Expect(err).ToNot(HaveOccurred())
 
-	return ioutil.NopCloser(bytes.NewReader(responseBody))
+	return structToJsonBody(&esGetResponse{
+		Id:     fake.LetterN(10),
+		Found:  true,
+		Source: raw,
+	})
 }
 
 func createEsBulkOccurrenceIndexResponse(occurrences []*pb.Occurrence, errs []error) io.ReadCloser {
@@ -2068,45 +2457,35 @@ func createEsBulkOccurrenceIndexResponse(occurrences []*pb.Occurrence, errs []er
 	return ioutil.NopCloser(bytes.NewReader(responseBody))
 }
 
-func createEsBulkNoteIndexResponse(notesThatCreatedSuccessfully map[string]*pb.Note) io.ReadCloser {
-	var responseItems []*esBulkResponseItem
-	for range notesThatCreatedSuccessfully {
+// createEsBulkNoteCreateResponse returns a bulk response with a create item for each of the given statuses
+func createEsBulkNoteCreateResponse(statuses []int) io.ReadCloser {
+	var (
+		responseItems     []*esBulkResponseItem
+		responseHasErrors = false
+	)
+	for _, status := range statuses {
+		var responseErr *esIndexDocError
+		if status >= http.StatusBadRequest {
+			responseErr = &esIndexDocError{
+				Type:   fake.LetterN(10),
+				Reason: fake.LetterN(10),
+			}
+			responseHasErrors = true
+		}
+
 		responseItems = append(responseItems, &esBulkResponseItem{
-			Index: &esIndexDocResponse{
+			Create: &esIndexDocResponse{
 				Id:     fake.LetterN(10),
-				Status: http.StatusCreated,
+				Status: status,
+				Error:  responseErr,
 			},
 		})
 	}
 
-	response := &esBulkResponse{
+	return structToJsonBody(&esBulkResponse{
 		Items:  responseItems,
-		Errors: false,
-	}
-
-	responseBody, err := json.Marshal(response)
-	Expect(err).ToNot(HaveOccurred())
-
-	return ioutil.NopCloser(bytes.NewReader(responseBody))
-}
-
-func createEsMultiSearchNoteResponse(notes map[string]*pb.Note) io.ReadCloser {
-	multiSearchResponse := &esMultiSearchResponse{}
-
-	for range notes {
-		multiSearchResponse.Responses = append(multiSearchResponse.Responses, &esMultiSearchResponseHitsSummary{
-			Hits: &esMultiSearchResponseHits{
-				Total: &esSearchResponseTotal{
-					Value: 0,
-				},
-			},
-		})
-	}
-
-	responseBody, err := json.Marshal(multiSearchResponse)
-	Expect(err).ToNot(HaveOccurred())
-
-	return ioutil.NopCloser(bytes.NewReader(responseBody))
+		Errors: responseHasErrors,
+	})
 }
 
 func generateTestProject(name string) *prpb.Project {
@@ -2199,19 +2578,29 @@ func assertJsonHasValues(body io.ReadCloser, values map[string]interface{}) {
 		case bool:
 			Expect(parsed.Path(k).Data().(bool)).To(Equal(v.(bool)))
 		case int:
-			Expect(parsed.Path(k).Data().(int)).To(Equal(v.(int)))
+			Expect(parsed.Path(k).Data()).To(BeEquivalentTo(v.(int)))
 		default:
 			Fail("assertJsonHasValues encountered unexpected type")
 		}
 	}
 }
 
-func assertIndexCreateBodyHasMetadataAndStringMapping(body io.ReadCloser) {
+func parseJsonBody(body io.ReadCloser) *gabs.Container {
+	requestBody, err := ioutil.ReadAll(body)
+	Expect(err).ToNot(HaveOccurred())
+
+	parsed, err := gabs.ParseJSON(requestBody)
+	Expect(err).ToNot(HaveOccurred())
+
+	return parsed
+}
+
+func assertIndexTemplateBodyHasMetadataAndStringMapping(body io.ReadCloser) {
 	assertJsonHasValues(body, map[string]interface{}{
-		"mappings._meta.type": "grafeas",
-		"mappings.dynamic_templates.0.strings_as_keywords.match_mapping_type": "string",
-		"mappings.dynamic_templates.0.strings_as_keywords.mapping.type":       "keyword",
-		"mappings.dynamic_templates.0.strings_as_keywords.mapping.norms":      false,
+		"template.mappings._meta.type": "grafeas",
+		"template.mappings.dynamic_templates.0.strings_as_keywords.match_mapping_type": "string",
+		"template.mappings.dynamic_templates.0.strings_as_keywords.mapping.type":       "keyword",
+		"template.mappings.dynamic_templates.0.strings_as_keywords.mapping.norms":      false,
 	})
 }
 
@@ -2223,6 +2612,30 @@ func assertErrorHasGrpcStatusCode(err error, code codes.Code) {
 	Expect(s.Code()).To(Equal(code))
 }
 
+// assertErrorHasBatchItemDetails checks that an error from a batch method identifies the resource and its position in the batch
+func assertErrorHasBatchItemDetails(err error, resourceType string, position int) *errdetails.ResourceInfo {
+	var (
+		resource  *errdetails.ResourceInfo
+		errorInfo *errdetails.ErrorInfo
+	)
+	for _, detail := range status.Convert(err).Details() {
+		switch d := detail.(type) {
+		case *errdetails.ResourceInfo:
+			resource = d
+		case *errdetails.ErrorInfo:
+			errorInfo = d
+		}
+	}
+
+	Expect(resource).ToNot(BeNil())
+	Expect(resource.ResourceType).To(Equal(resourceType))
+	Expect(errorInfo).ToNot(BeNil())
+	Expect(errorInfo.Metadata["position"]).To(Equal(strconv.Itoa(position)))
+	Expect(resource.ResourceName).To(HaveSuffix("/" + errorInfo.Metadata["id"]))
+
+	return resource
+}
+
 // parseEsBulkIndexRequest parses a request body in ndjson format
 // each line of the body is assumed to be properly formatted JSON
 // every odd line is assumed to be a regular JSON structure that can be unmarshalled via json.Unmarshal
@@ -2247,22 +2660,6 @@ func parseEsBulkIndexRequest(body io.ReadCloser, structs []interface{}) {
 	}
 }
 
-func parseEsMsearchIndexRequest(body io.ReadCloser, structs []interface{}) {
-	buf := new(bytes.Buffer)
-	_, err := buf.ReadFrom(body)
-	Expect(err).ToNot(HaveOccurred())
-
-	requestPayload := strings.TrimSuffix(buf.String(), "\n") // _bulk requests need to end in a newline
-	jsonPayloads := strings.Split(requestPayload, "\n")
-	Expect(jsonPayloads).To(HaveLen(len(structs)))
-
-	for i, s := range structs {
-		err = json.Unmarshal([]byte(jsonPayloads[i]), s)
-
-		Expect(err).ToNot(HaveOccurred())
-	}
-}
-
 func deepCopyOccurrences(occs []*pb.Occurrence) []*pb.Occurrence {
 	var result []*pb.Occurrence
 	for _, occ := range occs {
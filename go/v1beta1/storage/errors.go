@@ -0,0 +1,165 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	errorDomain           = "grafeas-elasticsearch"
+	batchItemFailedReason = "BATCH_ITEM_FAILED"
+
+	occurrenceResourceType = "grafeas.io/Occurrence"
+	noteResourceType       = "grafeas.io/Note"
+)
+
+// esErrorTypeCodes maps the types of errors returned by Elasticsearch to the gRPC code that best describes them
+var esErrorTypeCodes = map[string]codes.Code{
+	// the request or document is invalid
+	"action_request_validation_exception": codes.InvalidArgument,
+	"illegal_argument_exception":          codes.InvalidArgument,
+	"mapper_parsing_exception":            codes.InvalidArgument,
+	"parsing_exception":                   codes.InvalidArgument,
+	"query_shard_exception":               codes.InvalidArgument,
+	"strict_dynamic_mapping_exception":    codes.InvalidArgument,
+	"x_content_parse_exception":           codes.InvalidArgument,
+
+	// the document or index was changed by another request
+	"version_conflict_engine_exception": codes.Aborted,
+	"resource_already_exists_exception": codes.AlreadyExists,
+
+	"index_not_found_exception":    codes.NotFound,
+	"resource_not_found_exception": codes.NotFound,
+
+	// the cluster is overloaded
+	"circuit_breaking_exception":      codes.ResourceExhausted,
+	"es_rejected_execution_exception": codes.ResourceExhausted,
+
+	// the cluster can't serve the request right now, such as while an index is blocked for writes during a migration
+	"cluster_block_exception":                 codes.Unavailable,
+	"master_not_discovered_exception":         codes.Unavailable,
+	"no_shard_available_action_exception":     codes.Unavailable,
+	"node_not_connected_exception":            codes.Unavailable,
+	"unavailable_shards_exception":            codes.Unavailable,
+	"process_cluster_event_timeout_exception": codes.DeadlineExceeded,
+	"receive_timeout_transport_exception":     codes.DeadlineExceeded,
+
+	"security_exception": codes.PermissionDenied,
+}
+
+// esStatusCodes maps HTTP statuses to gRPC codes, for errors with a type that isn't in esErrorTypeCodes
+var esStatusCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.Aborted,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+	http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// esErrorCode returns the gRPC code for an error returned by Elasticsearch, based on the type of the error when it's
+// known and otherwise on the HTTP status. Any other error is Internal.
+func esErrorCode(statusCode int, errorType string) codes.Code {
+	if code, ok := esErrorTypeCodes[errorType]; ok {
+		return code
+	}
+
+	if code, ok := esStatusCodes[statusCode]; ok {
+		return code
+	}
+
+	return codes.Internal
+}
+
+// createResponseError logs an error response from Elasticsearch and returns a gRPC error with the code for that response.
+// The body of the response is consumed.
+func createResponseError(log *zap.Logger, message string, res *esapi.Response, fields ...zap.Field) error {
+	var (
+		body       []byte
+		esResponse esErrorResponse
+	)
+	if res.Body != nil {
+		body, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		_ = json.Unmarshal(body, &esResponse)
+	}
+
+	var errorType, reason string
+	if esResponse.Error != nil {
+		errorType = esResponse.Error.Type
+		reason = esResponse.Error.Reason
+	}
+
+	code := esErrorCode(res.StatusCode, errorType)
+	log.Error(message, append(fields, zap.ByteString("response", body), zap.Int("status", res.StatusCode), zap.String("code", code.String()))...)
+
+	if reason == "" {
+		return status.Errorf(code, "%s", message)
+	}
+
+	return status.Errorf(code, "%s: [%s] %s", message, errorType, reason)
+}
+
+// createItemError logs an error for a single operation in a bulk request and returns a gRPC error with the code for that error
+func createItemError(log *zap.Logger, message string, item *esIndexDocResponse, fields ...zap.Field) error {
+	var errorType, reason string
+	if item.Error != nil {
+		errorType = item.Error.Type
+		reason = item.Error.Reason
+	}
+
+	code := esErrorCode(item.Status, errorType)
+	log.Error(message, append(fields, zap.Int("status", item.Status), zap.String("type", errorType), zap.String("reason", reason), zap.String("code", code.String()))...)
+
+	return status.Errorf(code, "%s: [%d] %s: %s", message, item.Status, errorType, reason)
+}
+
+// withBatchItemDetails attaches the resource that failed and its position in the batch to an error from a batch method,
+// so that clients can tell which of their inputs the error belongs to
+func withBatchItemDetails(err error, resourceType, name, id string, position int) error {
+	st := status.Convert(err)
+	detailed, detailsErr := st.WithDetails(
+		&errdetails.ResourceInfo{
+			ResourceType: resourceType,
+			ResourceName: name,
+			Description:  st.Message(),
+		},
+		&errdetails.ErrorInfo{
+			Reason: batchItemFailedReason,
+			Domain: errorDomain,
+			Metadata: map[string]string{
+				"id":       id,
+				"position": strconv.Itoa(position),
+			},
+		},
+	)
+	if detailsErr != nil {
+		return err
+	}
+
+	return detailed.Err()
+}
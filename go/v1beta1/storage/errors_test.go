@@ -0,0 +1,102 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+var _ = Describe("elasticsearch errors", func() {
+	DescribeTable("mapping errors to gRPC codes", func(statusCode int, errorType string, expected codes.Code) {
+		Expect(esErrorCode(statusCode, errorType)).To(Equal(expected))
+	},
+		Entry("mapping conflict", http.StatusBadRequest, "mapper_parsing_exception", codes.InvalidArgument),
+		Entry("unknown field with strict mappings", http.StatusBadRequest, "strict_dynamic_mapping_exception", codes.InvalidArgument),
+		Entry("version conflict", http.StatusConflict, "version_conflict_engine_exception", codes.Aborted),
+		Entry("rejected execution", http.StatusTooManyRequests, "es_rejected_execution_exception", codes.ResourceExhausted),
+		Entry("circuit breaker", http.StatusTooManyRequests, "circuit_breaking_exception", codes.ResourceExhausted),
+		Entry("missing index", http.StatusNotFound, "index_not_found_exception", codes.NotFound),
+		Entry("write block", http.StatusForbidden, "cluster_block_exception", codes.Unavailable),
+		Entry("unknown type with a known status", http.StatusServiceUnavailable, fake.LetterN(10), codes.Unavailable),
+		Entry("status without a type", http.StatusTooManyRequests, "", codes.ResourceExhausted),
+		Entry("unknown type and status", http.StatusInternalServerError, fake.LetterN(10), codes.Internal),
+	)
+
+	Context("creating an error from a response", func() {
+		var (
+			response  *esapi.Response
+			errorType string
+			reason    string
+			actualErr error
+		)
+
+		BeforeEach(func() {
+			errorType = "mapper_parsing_exception"
+			reason = fake.LetterN(10)
+			response = &esapi.Response{
+				StatusCode: http.StatusBadRequest,
+				Body: structToJsonBody(&esErrorResponse{
+					Error: &esIndexDocError{
+						Type:   errorType,
+						Reason: reason,
+					},
+					Status: http.StatusBadRequest,
+				}),
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = createResponseError(logger, "error", response)
+		})
+
+		It("should use the code for the type of error", func() {
+			assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
+		})
+
+		It("should include the reason in the message", func() {
+			Expect(status.Convert(actualErr).Message()).To(ContainSubstring(reason))
+		})
+
+		When("the response doesn't have a body", func() {
+			BeforeEach(func() {
+				response = &esapi.Response{StatusCode: http.StatusServiceUnavailable}
+			})
+
+			It("should use the code for the status", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Unavailable)
+			})
+		})
+	})
+
+	Context("creating an error for a bulk item", func() {
+		It("should use the code for the type of error", func() {
+			err := createItemError(logger, "error", &esIndexDocResponse{
+				Status: http.StatusConflict,
+				Error: &esIndexDocError{
+					Type:   "version_conflict_engine_exception",
+					Reason: fake.LetterN(10),
+				},
+			})
+
+			assertErrorHasGrpcStatusCode(err, codes.Aborted)
+		})
+	})
+})
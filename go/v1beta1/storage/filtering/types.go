@@ -16,9 +16,11 @@ package filtering
 
 // Query holds a parent query that carries the entire search query
 type Query struct {
-	Bool   *Bool `json:"bool,omitempty"`
-	Term   *Term `json:"term,omitempty"`
-	Prefix *Term `json:"prefix,omitempty"`
+	Bool   *Bool   `json:"bool,omitempty"`
+	Term   *Term   `json:"term,omitempty"`
+	Prefix *Term   `json:"prefix,omitempty"`
+	Ids    *Ids    `json:"ids,omitempty"`
+	Exists *Exists `json:"exists,omitempty"`
 }
 
 // Bool holds a general query that carries any number of
@@ -39,5 +41,15 @@ type MustNot []interface{}
 // Should holds a should operator which equates to an OR operation
 type Should []interface{}
 
+// Ids holds the document IDs to match
+type Ids struct {
+	Values []string `json:"values"`
+}
+
+// Exists matches documents that have a value for the field
+type Exists struct {
+	Field string `json:"field"`
+}
+
 // Term holds a comparison for equating two strings
 type Term map[string]string
@@ -15,12 +15,12 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	grafeasConfig "github.com/grafeas/grafeas/go/config"
 	"github.com/grafeas/grafeas/go/v1beta1/storage"
 	"github.com/rode/grafeas-elasticsearch/go/config"
 	"go.uber.org/zap"
-	"net/http"
 )
 
 type newElasticsearchStorageFunc func(*config.ElasticsearchConfig) (*ElasticsearchStorage, error)
@@ -59,26 +59,37 @@ func ElasticsearchStorageTypeProviderCreator(newES newElasticsearchStorageFunc,
 			return nil, err
 		}
 
-		res, err := es.client.Indices.Exists([]string{projectsIndex()})
-		if err != nil || (res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound) {
-			return nil, createError(log, "error checking if project index already exists", err)
+		ctx := context.Background()
+		if err := es.initializeIndices(ctx, log); err != nil {
+			return nil, err
 		}
 
-		// the response is an error if the index was not found, so we need to create it
-		if res.IsError() {
-			log := log.With(zap.String("index", projectsIndex()))
-			log.Info("initial index for grafeas projects not found, creating...")
-			res, err = es.client.Indices.Create(
-				projectsIndex(),
-				withIndexMetadataAndStringMapping(),
-			)
-			if err != nil {
-				return nil, createError(log, "error sending index creation request to elasticsearch", err)
-			}
-			if res.IsError() {
-				return nil, createError(log, "error creating index in elasticsearch", fmt.Errorf(res.String()))
+		if c.DisableAutoMigration {
+			log.Info("automatic index migration is disabled")
+		} else if err := es.migrateIndices(ctx, log); err != nil {
+			return nil, err
+		}
+
+		if c.VerifyIndices == config.VerifyIndicesTrue || c.VerifyIndices == config.VerifyIndicesRepair {
+			if _, err := es.verifyIndices(ctx, log, c.VerifyIndices == config.VerifyIndicesRepair); err != nil {
+				return nil, err
 			}
-			log.Info("project index created", zap.String("index", projectsIndex()))
+		}
+
+		if c.Rollover.Enabled {
+			es.startRollover(ctx, log)
+		}
+
+		if c.Retention.Enabled() {
+			es.startRetention(ctx, log)
+		}
+
+		if c.SoftDelete.Enabled {
+			es.startTombstonePurge(ctx, log)
+		}
+
+		if c.Audit.Enabled && c.Audit.Retention != "" {
+			es.startAuditRetention(ctx, log)
 		}
 
 		return &storage.Storage{
@@ -87,3 +98,40 @@ func ElasticsearchStorageTypeProviderCreator(newES newElasticsearchStorageFunc,
 		}, nil
 	}
 }
+
+// InitializeIndices installs the current index templates, and creates the indices that the server creates when it starts,
+// so that admin commands that write notes or projects can be run before the server has ever been started.
+func (es *ElasticsearchStorage) InitializeIndices(ctx context.Context) error {
+	return es.initializeIndices(ctx, es.logger.Named("InitializeIndices"))
+}
+
+// initializeIndices installs the index templates, then creates the indices for projects, revisions, and audit events that
+// don't exist yet, along with the shared indices for notes and occurrences when using the shared layout. The indices are
+// created with their aliases before anything writes to them, as writing to a missing write alias would otherwise create
+// a concrete index in its place.
+func (es *ElasticsearchStorage) initializeIndices(ctx context.Context, log *zap.Logger) error {
+	if err := es.installIndexTemplates(ctx, log); err != nil {
+		return err
+	}
+
+	indices := []string{projectsIndex()}
+	if es.config.RevisionHistory {
+		indices = append(indices, revisionsIndex())
+	}
+	if es.config.Audit.Enabled {
+		indices = append(indices, auditIndex())
+	}
+
+	// when using the shared layout, notes and occurrences for all projects are stored in indices that are created up front
+	if es.sharedLayout() {
+		indices = append(indices, es.projectIndices("")...)
+	}
+
+	for _, index := range indices {
+		if _, err := es.createAliasedIndexIfNotExists(ctx, log, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
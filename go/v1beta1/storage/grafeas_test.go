@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
@@ -62,19 +63,32 @@ var _ = Describe("Grafeas integration", func() {
 			err                                       error
 			expectedStorageType, expectedProjectIndex string
 			storageConfig                             grafeasConfig.StorageConfiguration
+			templateRequests                          int
 		)
 
 		// BeforeEach configures the happy path for this context
 		// Variables configured here may be overridden in nested BeforeEach blocks
 		BeforeEach(func() {
-			transport.preparedHttpResponses = []*http.Response{
-				{
+			// the index templates are already installed and up to date
+			transport.preparedHttpResponses = []*http.Response{}
+			for _, template := range (&ElasticsearchStorage{config: esConfig}).indexTemplates() {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(template.name, template.body()),
+				})
+			}
+			templateRequests = len(transport.preparedHttpResponses)
+
+			transport.preparedHttpResponses = append(transport.preparedHttpResponses,
+				&http.Response{
 					StatusCode: http.StatusOK,
 				},
-				{
+				&http.Response{
 					StatusCode: http.StatusOK,
 				},
-			}
+			)
+			// automatic migrations are covered in their own context below
+			esConfig.DisableAutoMigration = true
 			storageConfig = grafeasConfig.StorageConfiguration(esConfig)
 			expectedProjectIndex = fmt.Sprintf("%s-%s", indexPrefix, "projects")
 			expectedStorageType = "elasticsearch"
@@ -90,9 +104,16 @@ var _ = Describe("Grafeas integration", func() {
 			_, err = registerStorageTypeProvider(expectedStorageType, &storageConfig)
 		})
 
+		It("should check if the index templates are installed", func() {
+			for i, template := range elasticsearchStorage.indexTemplates() {
+				Expect(transport.receivedHttpRequests[i].URL.Path).To(Equal(fmt.Sprintf("/_index_template/%s", template.name)))
+				Expect(transport.receivedHttpRequests[i].Method).To(Equal(http.MethodGet))
+			}
+		})
+
 		It("should check if an index for projects has already been created", func() {
-			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedProjectIndex)))
-			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodHead))
+			Expect(transport.receivedHttpRequests[templateRequests].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedProjectIndex)))
+			Expect(transport.receivedHttpRequests[templateRequests].Method).To(Equal(http.MethodHead))
 			Expect(err).ToNot(HaveOccurred())
 		})
 
@@ -139,22 +160,133 @@ var _ = Describe("Grafeas integration", func() {
 			})
 		})
 
+		When("installing the index templates fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0] = &http.Response{
+					StatusCode: http.StatusInternalServerError,
+				}
+			})
+
+			It("should return an error", func() {
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("should not check for the projects index", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
 		When("an index for projects does not exist", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusNotFound
+				transport.preparedHttpResponses[templateRequests].StatusCode = http.StatusNotFound
 			})
 
 			It("should create the index for projects", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(2))
-				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s", expectedProjectIndex)))
-				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+				Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 2))
+				Expect(transport.receivedHttpRequests[templateRequests+1].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", expectedProjectIndex, schemaVersion)))
+				Expect(transport.receivedHttpRequests[templateRequests+1].Method).To(Equal(http.MethodPut))
+			})
+
+			It("should access the index for projects through aliases", func() {
+				body := parseJsonBody(transport.receivedHttpRequests[templateRequests+1].Body)
 
-				assertIndexCreateBodyHasMetadataAndStringMapping(transport.receivedHttpRequests[1].Body)
+				Expect(body.Exists("aliases", expectedProjectIndex)).To(BeTrue())
+				Expect(body.Exists("aliases", writeAlias(expectedProjectIndex))).To(BeTrue())
 			})
 
 			When("creating the index for projects returns errors from elasticsearch", func() {
 				BeforeEach(func() {
-					transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+					transport.preparedHttpResponses[templateRequests+1].StatusCode = http.StatusInternalServerError
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+				storageConfig = grafeasConfig.StorageConfiguration(esConfig)
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusNotFound,
+				}, &http.Response{
+					StatusCode: http.StatusOK,
+				})
+			})
+
+			It("should check if the shared indices for occurrences and notes exist", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests[templateRequests+1].URL.Path).To(Equal(fmt.Sprintf("/%s-occurrences", indexPrefix)))
+				Expect(transport.receivedHttpRequests[templateRequests+1].Method).To(Equal(http.MethodHead))
+				Expect(transport.receivedHttpRequests[templateRequests+2].URL.Path).To(Equal(fmt.Sprintf("/%s-notes", indexPrefix)))
+				Expect(transport.receivedHttpRequests[templateRequests+2].Method).To(Equal(http.MethodHead))
+			})
+
+			It("should create the shared indices that do not exist", func() {
+				Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 4))
+				Expect(transport.receivedHttpRequests[templateRequests+3].URL.Path).To(Equal(fmt.Sprintf("/%s-notes-v%d", indexPrefix, schemaVersion)))
+				Expect(transport.receivedHttpRequests[templateRequests+3].Method).To(Equal(http.MethodPut))
+			})
+		})
+
+		When("automatic migration is enabled", func() {
+			BeforeEach(func() {
+				esConfig.DisableAutoMigration = false
+				storageConfig = grafeasConfig.StorageConfiguration(esConfig)
+				transport.preparedHttpResponses[templateRequests+1] = &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(esIndicesResponse{}),
+				}
+			})
+
+			It("should check for outdated indices", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 2))
+				Expect(transport.receivedHttpRequests[templateRequests+1].URL.Path).To(Equal(fmt.Sprintf("/%s-*", indexPrefix)))
+				Expect(transport.receivedHttpRequests[templateRequests+1].Method).To(Equal(http.MethodGet))
+			})
+
+			When("checking for outdated indices fails", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[templateRequests+1].StatusCode = http.StatusInternalServerError
+				})
+
+				It("should return an error", func() {
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		When("index verification is enabled", func() {
+			BeforeEach(func() {
+				esConfig.VerifyIndices = config.VerifyIndicesTrue
+				storageConfig = grafeasConfig.StorageConfiguration(esConfig)
+				transport.preparedHttpResponses[templateRequests+1] = &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createProjectEsSearchResponse(),
+				}
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusOK,
+					Body: structToJsonBody(esIndicesResponse{
+						backingIndex(projectsIndex()): {
+							Mappings: &esIndexMappings{Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: schemaVersion}},
+						},
+					}),
+				})
+			})
+
+			It("should verify the indices", func() {
+				Expect(err).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 3))
+				Expect(transport.receivedHttpRequests[templateRequests+1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", expectedProjectIndex)))
+				Expect(transport.receivedHttpRequests[templateRequests+2].URL.Path).To(Equal(fmt.Sprintf("/%s-*", indexPrefix)))
+			})
+
+			When("verifying the indices fails", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[templateRequests+1].StatusCode = http.StatusInternalServerError
 				})
 
 				It("should return an error", func() {
@@ -165,13 +297,13 @@ var _ = Describe("Grafeas integration", func() {
 
 		When("an index for projects already exists", func() {
 			It("should not create an index for projects", func() {
-				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 1))
 			})
 		})
 
 		When("checking for the existence of a project index fails", func() {
 			BeforeEach(func() {
-				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+				transport.preparedHttpResponses[templateRequests].StatusCode = http.StatusInternalServerError
 			})
 
 			It("should return an error", func() {
@@ -179,4 +311,63 @@ var _ = Describe("Grafeas integration", func() {
 			})
 		})
 	})
+
+	Context("initializing the indices for an admin command", func() {
+		var (
+			actualErr        error
+			templateRequests int
+		)
+
+		BeforeEach(func() {
+			esConfig.RevisionHistory = true
+
+			transport.preparedHttpResponses = []*http.Response{}
+			for _, template := range (&ElasticsearchStorage{config: esConfig}).indexTemplates() {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(template.name, template.body()),
+				})
+			}
+			templateRequests = len(transport.preparedHttpResponses)
+
+			transport.preparedHttpResponses = append(transport.preparedHttpResponses,
+				&http.Response{
+					StatusCode: http.StatusNotFound,
+				},
+				&http.Response{
+					StatusCode: http.StatusOK,
+				},
+				&http.Response{
+					StatusCode: http.StatusOK,
+				},
+			)
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.InitializeIndices(context.Background())
+		})
+
+		It("should create the missing indices with their aliases", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(templateRequests + 3))
+
+			Expect(transport.receivedHttpRequests[templateRequests+1].URL.Path).To(Equal(fmt.Sprintf("/%s-v%d", projectsIndex(), schemaVersion)))
+			Expect(transport.receivedHttpRequests[templateRequests+1].Method).To(Equal(http.MethodPut))
+			body := parseJsonBody(transport.receivedHttpRequests[templateRequests+1].Body)
+			Expect(body.Exists("aliases", writeAlias(projectsIndex()))).To(BeTrue())
+
+			Expect(transport.receivedHttpRequests[templateRequests+2].URL.Path).To(Equal(fmt.Sprintf("/%s", revisionsIndex())))
+		})
+
+		When("installing the index templates fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without creating any indices", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
 })
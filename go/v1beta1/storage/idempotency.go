@@ -0,0 +1,184 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// Clients can retry creating an occurrence without creating a duplicate by sending an idempotency key in the
+// idempotencyKeyMetadataKey header, or by choosing the name of the occurrence up front. Either way the occurrence ID is
+// known before the occurrence is written, so a retry of a create that already completed returns the stored occurrence.
+// Keys aren't stored anywhere else, since the occurrence named after the key is the record of the completed request.
+const idempotencyKeyMetadataKey = "idempotency-key"
+
+// occurrenceResultReplayed is returned in the occurrence result header when a retried create returns the stored occurrence
+const occurrenceResultReplayed = "replayed"
+
+// idempotencyKeyNamespace is the namespace of the name-based UUIDs generated from idempotency keys.
+// Changing it would cause retries of requests that completed before the change to create new occurrences.
+var idempotencyKeyNamespace = uuid.MustParse("0f6f4a3c-2d8b-4b5e-a1c7-93e0d2f4b6a8")
+
+// serverSetFields are set by the server when a note or occurrence is written, so they're expected to differ when a create
+// is retried, or when a resource is written again with the same content
+var serverSetFields = map[string]bool{
+	"name":       true,
+	"createTime": true,
+	"updateTime": true,
+}
+
+// requestIdempotencyKey returns the idempotency key sent by the client in the request headers, if any
+func requestIdempotencyKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get(idempotencyKeyMetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// requestedOccurrenceId returns the occurrence ID chosen by the client, either from the name of the occurrence or derived
+// from an idempotency key, and whether one was chosen. A name set by the client must belong to the project.
+func requestedOccurrenceId(projectId string, o *pb.Occurrence, idempotencyKey string) (string, bool, error) {
+	if o.Name != "" {
+		prefix := fmt.Sprintf("projects/%s/occurrences/", projectId)
+		occurrenceId := strings.TrimPrefix(o.Name, prefix)
+		if !strings.HasPrefix(o.Name, prefix) || occurrenceId == "" || strings.Contains(occurrenceId, "/") {
+			return "", false, status.Errorf(codes.InvalidArgument, "invalid occurrence name %q, expected %s{occurrenceId}", o.Name, prefix)
+		}
+
+		return occurrenceId, true, nil
+	}
+
+	if idempotencyKey != "" {
+		return uuid.NewSHA1(idempotencyKeyNamespace, []byte(projectId+"/"+idempotencyKey)).String(), true, nil
+	}
+
+	return "", false, nil
+}
+
+// batchIdempotencyKey derives the idempotency key for each occurrence in a batch from the key sent with the request
+func batchIdempotencyKey(idempotencyKey string, position int) string {
+	if idempotencyKey == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%d", idempotencyKey, position)
+}
+
+// createIdempotentOccurrence creates an occurrence with an ID chosen by the client. The occurrence is looked up first,
+// since the write alias may have rolled over to a new backing index since an earlier attempt stored it, in which case
+// creating it through the write alias would succeed and leave two occurrences with the same name. When the occurrence
+// already exists, the create is treated as a retry and the stored occurrence is returned instead, along with its version.
+func (es *ElasticsearchStorage) createIdempotentOccurrence(ctx context.Context, log *zap.Logger, projectId string, o *pb.Occurrence) (*documentVersion, *pb.Occurrence, error) {
+	stored, err := es.findStoredOccurrences(ctx, log, projectId, []string{o.Name})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := stored[o.Name]
+	switch {
+	case existing.exists():
+		replayed, err := replayedOccurrence(log, existing, o)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return existing.version, replayed, nil
+	case existing != nil:
+		log.Debug("replacing tombstone", zap.Time("deleteTime", *existing.version.deleteTime))
+		version, err := es.genericUpdate(ctx, log, projectId, o.Name, o, existing.version)
+
+		return version, nil, err
+	}
+
+	version, err := es.genericCreate(ctx, log, es.occurrencesIndex(projectId), projectId, o.Name, o)
+	if status.Code(err) != codes.AlreadyExists {
+		return version, nil, err
+	}
+
+	// another attempt created the occurrence after it was looked up
+	stored, err = es.findStoredOccurrences(ctx, log, projectId, []string{o.Name})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replayed, err := replayedOccurrence(log, stored[o.Name], o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return stored[o.Name].version, replayed, nil
+}
+
+// replayOccurrences handles the creates in a batch that conflicted with a stored occurrence as retries, replacing each
+// of the occurrences at the given positions with the stored occurrence, or setting an error for it
+func (es *ElasticsearchStorage) replayOccurrences(ctx context.Context, log *zap.Logger, projectId string, occurrences []*pb.Occurrence, positions []int, itemErrs []error) {
+	var names []string
+	for _, i := range positions {
+		names = append(names, occurrences[i].Name)
+	}
+
+	stored, err := es.findStoredOccurrences(ctx, log, projectId, names)
+	for _, i := range positions {
+		if err != nil {
+			itemErrs[i] = err
+			continue
+		}
+
+		replayed, err := replayedOccurrence(log, stored[occurrences[i].Name], occurrences[i])
+		if err != nil {
+			itemErrs[i] = err
+			continue
+		}
+
+		occurrences[i] = replayed
+	}
+}
+
+// replayedOccurrence returns the stored occurrence for a retried create. A create that reuses the ID of an occurrence
+// with different fields isn't a retry, so it's rejected, as is a create for an occurrence that has since been deleted.
+func replayedOccurrence(log *zap.Logger, stored *storedOccurrence, requested *pb.Occurrence) (*pb.Occurrence, error) {
+	if !stored.exists() {
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", requested.Name)
+	}
+
+	differentFields, err := contentChanges(stored.occurrence, requested)
+	if err != nil {
+		return nil, createError(log, "error comparing occurrences", err)
+	}
+	if len(differentFields) > 0 {
+		log.Debug("occurrence already exists with different fields", zap.Strings("fields", differentFields))
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists with different values for %s", requested.Name, strings.Join(differentFields, ", "))
+	}
+
+	log.Debug("returning the stored occurrence for a retried create")
+
+	return stored.occurrence, nil
+}
@@ -0,0 +1,395 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("idempotent occurrence creates", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		stream               *fakeServerTransportStream
+		projectId            string
+		idempotencyKey       string
+	)
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		}
+		stream = &fakeServerTransportStream{}
+		projectId = fake.LetterN(10)
+		idempotencyKey = fake.UUID()
+		ctx = grpc.NewContextWithServerTransportStream(context.Background(), stream)
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyMetadataKey, idempotencyKey))
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("choosing the occurrence ID", func() {
+		It("should derive the same ID from the same idempotency key", func() {
+			first, ok, err := requestedOccurrenceId(projectId, &pb.Occurrence{}, idempotencyKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			second, _, _ := requestedOccurrenceId(projectId, &pb.Occurrence{}, idempotencyKey)
+			Expect(second).To(Equal(first))
+
+			otherProject, _, _ := requestedOccurrenceId(fake.LetterN(11), &pb.Occurrence{}, idempotencyKey)
+			Expect(otherProject).ToNot(Equal(first))
+		})
+
+		It("should use the name of the occurrence when it's set", func() {
+			occurrenceId := fake.LetterN(10)
+
+			actualId, ok, err := requestedOccurrenceId(projectId, &pb.Occurrence{Name: fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)}, idempotencyKey)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(actualId).To(Equal(occurrenceId))
+		})
+
+		It("should reject a name from a different project", func() {
+			_, _, err := requestedOccurrenceId(projectId, &pb.Occurrence{Name: fmt.Sprintf("projects/%s/occurrences/%s", fake.LetterN(11), fake.LetterN(10))}, "")
+
+			assertErrorHasGrpcStatusCode(err, codes.InvalidArgument)
+		})
+
+		It("should not choose an ID without a name or an idempotency key", func() {
+			_, ok, err := requestedOccurrenceId(projectId, &pb.Occurrence{}, "")
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("creating an occurrence", func() {
+		var (
+			occurrence       *pb.Occurrence
+			expectedName     string
+			actualOccurrence *pb.Occurrence
+			actualErr        error
+		)
+
+		BeforeEach(func() {
+			occurrence = createVulnerabilityOccurrence()
+			occurrenceId, _, err := requestedOccurrenceId(projectId, &pb.Occurrence{}, idempotencyKey)
+			Expect(err).ToNot(HaveOccurred())
+			expectedName = fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsStoredOccurrencesResponse(),
+				},
+				{
+					StatusCode: http.StatusCreated,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: fake.LetterN(10), SeqNo: 1, PrimaryTerm: 1}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualOccurrence, actualErr = elasticsearchStorage.CreateOccurrence(ctx, projectId, "", proto.Clone(occurrence).(*pb.Occurrence))
+		})
+
+		It("should look for the occurrence in every backing index", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", elasticsearchStorage.occurrencesIndex(projectId))))
+
+			body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+			Expect(body.Path("query.ids.values").Data()).To(ConsistOf(documentId(expectedName)))
+		})
+
+		It("should only create the occurrence if it doesn't exist", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualOccurrence.Name).To(Equal(expectedName))
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(HaveSuffix(documentId(expectedName)))
+			Expect(transport.receivedHttpRequests[2].URL.Query().Get("op_type")).To(Equal("create"))
+			Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultCreated}))
+		})
+
+		When("the create is retried", func() {
+			var storedOccurrence *pb.Occurrence
+
+			BeforeEach(func() {
+				storedOccurrence = proto.Clone(occurrence).(*pb.Occurrence)
+				storedOccurrence.Name = expectedName
+			})
+
+			Context("with the same occurrence", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[1].Body = createEsStoredOccurrencesResponse(storedOccurrence)
+				})
+
+				It("should return the stored occurrence without writing it again", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(actualOccurrence).To(Equal(storedOccurrence))
+					Expect(transport.receivedHttpRequests).To(HaveLen(2))
+					Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultReplayed}))
+					Expect(stream.header.Get(etagMetadataKey)).ToNot(BeEmpty())
+				})
+			})
+
+			Context("with a different occurrence", func() {
+				BeforeEach(func() {
+					storedOccurrence.Remediation = fake.Sentence(3)
+					transport.preparedHttpResponses[1].Body = createEsStoredOccurrencesResponse(storedOccurrence)
+				})
+
+				It("should return an error", func() {
+					assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
+					Expect(actualErr.Error()).To(ContainSubstring("remediation"))
+					Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				})
+			})
+
+			Context("while the first attempt is still being written", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses = []*http.Response{
+						{
+							StatusCode: http.StatusOK,
+							Body:       createEsProjectGetResponse(projectId, ""),
+						},
+						{
+							StatusCode: http.StatusOK,
+							Body:       createEsStoredOccurrencesResponse(),
+						},
+						{
+							StatusCode: http.StatusConflict,
+						},
+						{
+							StatusCode: http.StatusOK,
+							Body:       createEsStoredOccurrencesResponse(storedOccurrence),
+						},
+					}
+				})
+
+				It("should return the stored occurrence", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(actualOccurrence).To(Equal(storedOccurrence))
+					Expect(transport.receivedHttpRequests).To(HaveLen(4))
+					Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultReplayed}))
+				})
+
+				When("the occurrence is deleted before it can be read", func() {
+					BeforeEach(func() {
+						transport.preparedHttpResponses[3].Body = createEsStoredOccurrencesResponse()
+					})
+
+					It("should return an error", func() {
+						assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
+					})
+				})
+			})
+
+			Context("after the occurrence was deleted", func() {
+				BeforeEach(func() {
+					esConfig.SoftDelete.Enabled = true
+					transport.preparedHttpResponses[1].Body = createEsStoredTombstonesResponse(storedOccurrence)
+					transport.preparedHttpResponses[2].StatusCode = http.StatusOK
+				})
+
+				It("should replace the tombstone in the backing index that holds it", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(transport.receivedHttpRequests).To(HaveLen(3))
+					Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", storedOccurrencesIndex, documentId(expectedName))))
+					Expect(transport.receivedHttpRequests[2].URL.Query().Get("if_seq_no")).To(Equal("2"))
+					Expect(transport.receivedHttpRequests[2].URL.Query().Get("if_primary_term")).To(Equal("1"))
+					Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{occurrenceResultCreated}))
+				})
+			})
+		})
+
+		When("the occurrence name is invalid", func() {
+			BeforeEach(func() {
+				occurrence.Name = fake.LetterN(10)
+			})
+
+			It("should return an error without creating the occurrence", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
+				Expect(transport.receivedHttpRequests).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("batch creating occurrences", func() {
+		var (
+			occurrences       []*pb.Occurrence
+			storedOccurrence  *pb.Occurrence
+			actualOccurrences []*pb.Occurrence
+			actualErrs        []error
+		)
+
+		BeforeEach(func() {
+			occurrences = []*pb.Occurrence{
+				createVulnerabilityOccurrence(),
+				createVulnerabilityOccurrence(),
+			}
+
+			occurrenceId, _, err := requestedOccurrenceId(projectId, &pb.Occurrence{}, batchIdempotencyKey(idempotencyKey, 1))
+			Expect(err).ToNot(HaveOccurred())
+			storedOccurrence = proto.Clone(occurrences[1]).(*pb.Occurrence)
+			storedOccurrence.Name = fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsStoredOccurrencesResponse(storedOccurrence),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualOccurrences, actualErrs = elasticsearchStorage.BatchCreateOccurrences(ctx, projectId, "", occurrences)
+		})
+
+		It("should only create the occurrences that don't exist", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", elasticsearchStorage.occurrencesIndex(projectId))))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal("/_bulk"))
+
+			actions := bulkRequestActions(transport.receivedHttpRequests[2])
+			Expect(actions).To(HaveLen(1))
+			Expect(actions[0].Exists("create")).To(BeTrue())
+		})
+
+		It("should return the stored occurrences for the creates that were retried", func() {
+			Expect(actualErrs).To(BeEmpty())
+			Expect(actualOccurrences).To(HaveLen(2))
+			Expect(actualOccurrences[1]).To(Equal(storedOccurrence))
+			Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{
+				occurrenceResultCreated,
+				occurrenceResultReplayed,
+			}))
+		})
+
+		When("an occurrence is stored after it was looked up", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = []*http.Response{
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsProjectGetResponse(projectId, ""),
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsStoredOccurrencesResponse(),
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusConflict}),
+					},
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsStoredOccurrencesResponse(storedOccurrence),
+					},
+				}
+			})
+
+			It("should return the stored occurrence", func() {
+				Expect(actualErrs).To(BeEmpty())
+				Expect(actualOccurrences[1]).To(Equal(storedOccurrence))
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
+				Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{
+					occurrenceResultCreated,
+					occurrenceResultReplayed,
+				}))
+			})
+		})
+
+		When("an occurrence was deleted", func() {
+			BeforeEach(func() {
+				esConfig.SoftDelete.Enabled = true
+				transport.preparedHttpResponses[1].Body = createEsStoredTombstonesResponse(storedOccurrence)
+				transport.preparedHttpResponses[2].Body = createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusOK})
+			})
+
+			It("should replace the tombstone in the backing index that holds it", func() {
+				Expect(actualErrs).To(BeEmpty())
+
+				actions := bulkRequestActions(transport.receivedHttpRequests[2])
+				Expect(actions).To(HaveLen(2))
+				Expect(actions[1].Path("index._index").Data()).To(Equal(storedOccurrencesIndex))
+				Expect(actions[1].Path("index.if_seq_no").Data()).To(BeEquivalentTo(2))
+				Expect(actions[1].Path("index.if_primary_term").Data()).To(BeEquivalentTo(1))
+				Expect(stream.header.Get(occurrenceResultMetadataKey)).To(Equal([]string{
+					occurrenceResultCreated,
+					occurrenceResultCreated,
+				}))
+			})
+		})
+	})
+})
+
+// createEsStoredTombstonesResponse returns the occurrences as tombstones when they're looked up
+func createEsStoredTombstonesResponse(occurrences ...*pb.Occurrence) io.ReadCloser {
+	response := &esSearchResponse{}
+	Expect(json.NewDecoder(createEsStoredOccurrencesResponse(occurrences...)).Decode(response)).To(Succeed())
+
+	for _, hit := range response.Hits.Hits {
+		document, err := gabs.ParseJSON(hit.Source)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = document.Set(time.Now().UTC().Format(time.RFC3339Nano), deleteTimeField)
+		Expect(err).ToNot(HaveOccurred())
+		hit.Source = document.Bytes()
+	}
+
+	return structToJsonBody(response)
+}
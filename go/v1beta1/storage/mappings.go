@@ -0,0 +1,121 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// nestedFields are the paths of repeated message fields that are mapped with the nested type, so that the fields of each
+// element can be queried together. The elements are also included in the parent document, so that regular term queries
+// on these fields continue to work.
+var nestedFields = map[string]bool{
+	"vulnerability.details":        true,
+	"vulnerability.windowsDetails": true,
+	"vulnerability.packageIssue":   true,
+}
+
+// wellKnownTypeMappings maps the protobuf well-known types to field mappings based on their JSON representation
+// https://developers.google.com/protocol-buffers/docs/proto3#json
+var wellKnownTypeMappings = map[protoreflect.FullName]map[string]interface{}{
+	"google.protobuf.Timestamp":   {"type": "date"},
+	"google.protobuf.Duration":    {"type": "keyword"},
+	"google.protobuf.FieldMask":   {"type": "keyword"},
+	"google.protobuf.BoolValue":   {"type": "boolean"},
+	"google.protobuf.Int32Value":  {"type": "integer"},
+	"google.protobuf.UInt32Value": {"type": "long"},
+	"google.protobuf.Int64Value":  {"type": "long"},
+	"google.protobuf.UInt64Value": {"type": "long"},
+	"google.protobuf.FloatValue":  {"type": "float"},
+	"google.protobuf.DoubleValue": {"type": "double"},
+	"google.protobuf.StringValue": {"type": "keyword"},
+	"google.protobuf.BytesValue":  {"type": "binary"},
+	"google.protobuf.Any":         {"type": "object", "enabled": false},
+	"google.protobuf.Struct":      {"type": "object", "enabled": false},
+	"google.protobuf.Value":       {"type": "object", "enabled": false},
+	"google.protobuf.ListValue":   {"type": "object", "enabled": false},
+	"google.protobuf.Empty":       {"type": "object", "enabled": false},
+}
+
+// protoMappingProperties generates explicit mappings for each field of a protobuf message, based on the message descriptor.
+// The field names match the JSON names used by protojson when the message is stored as a document.
+func protoMappingProperties(m proto.Message) map[string]interface{} {
+	return messageProperties(proto.MessageV2(m).ProtoReflect().Descriptor(), "", map[protoreflect.FullName]bool{})
+}
+
+func messageProperties(md protoreflect.MessageDescriptor, path string, visited map[protoreflect.FullName]bool) map[string]interface{} {
+	visited[md.FullName()] = true
+	defer delete(visited, md.FullName())
+
+	properties := map[string]interface{}{}
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		fieldPath := fd.JSONName()
+		if path != "" {
+			fieldPath = path + "." + fd.JSONName()
+		}
+
+		properties[fd.JSONName()] = fieldMapping(fd, fieldPath, visited)
+	}
+
+	return properties
+}
+
+func fieldMapping(fd protoreflect.FieldDescriptor, path string, visited map[protoreflect.FullName]bool) map[string]interface{} {
+	// map keys are arbitrary, so their contents are mapped dynamically
+	if fd.IsMap() {
+		return map[string]interface{}{"type": "object", "dynamic": true}
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return map[string]interface{}{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return map[string]interface{}{"type": "integer"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Int64Kind, protoreflect.Sint64Kind,
+		protoreflect.Sfixed64Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return map[string]interface{}{"type": "long"}
+	case protoreflect.FloatKind:
+		return map[string]interface{}{"type": "float"}
+	case protoreflect.DoubleKind:
+		return map[string]interface{}{"type": "double"}
+	case protoreflect.BytesKind:
+		return map[string]interface{}{"type": "binary"}
+	case protoreflect.StringKind, protoreflect.EnumKind:
+		return map[string]interface{}{"type": "keyword"}
+	}
+
+	md := fd.Message()
+	if mapping, ok := wellKnownTypeMappings[md.FullName()]; ok {
+		return mapping
+	}
+
+	// recursive messages can't be mapped explicitly, so they are stored without being indexed
+	if visited[md.FullName()] {
+		return map[string]interface{}{"type": "object", "enabled": false}
+	}
+
+	mapping := map[string]interface{}{
+		"properties": messageProperties(md, path, visited),
+	}
+	if fd.IsList() && nestedFields[path] {
+		mapping["type"] = "nested"
+		mapping["include_in_parent"] = true
+	}
+
+	return mapping
+}
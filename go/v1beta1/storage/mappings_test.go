@@ -0,0 +1,101 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/Jeffail/gabs/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+var _ = Describe("proto mappings", func() {
+	Context("occurrences", func() {
+		var properties *gabs.Container
+
+		BeforeEach(func() {
+			properties = gabs.Wrap(protoMappingProperties(&pb.Occurrence{}))
+		})
+
+		It("should map strings and enums to keywords", func() {
+			Expect(properties.Path("name.type").Data()).To(Equal("keyword"))
+			Expect(properties.Path("kind.type").Data()).To(Equal("keyword"))
+			Expect(properties.Path("resource.properties.uri.type").Data()).To(Equal("keyword"))
+		})
+
+		It("should map timestamps to dates", func() {
+			Expect(properties.Path("createTime.type").Data()).To(Equal("date"))
+			Expect(properties.Path("updateTime.type").Data()).To(Equal("date"))
+		})
+
+		It("should map numbers to the matching numeric type", func() {
+			Expect(properties.Path("vulnerability.properties.cvssScore.type").Data()).To(Equal("float"))
+			Expect(properties.Path("vulnerability.properties.packageIssue.properties.affectedLocation.properties.version.properties.epoch.type").Data()).To(Equal("integer"))
+		})
+
+		It("should map the package issues as nested documents that are also included in the parent", func() {
+			Expect(properties.Path("vulnerability.properties.packageIssue.type").Data()).To(Equal("nested"))
+			Expect(properties.Path("vulnerability.properties.packageIssue.include_in_parent").Data()).To(BeTrue())
+		})
+
+		It("should map other repeated messages as objects", func() {
+			Expect(properties.ExistsP("vulnerability.properties.relatedUrls.type")).To(BeFalse())
+			Expect(properties.ExistsP("vulnerability.properties.relatedUrls.properties.url")).To(BeTrue())
+		})
+
+		It("should map the contents of map fields dynamically", func() {
+			fileHashes := properties.Path("build.properties.provenance.properties.sourceProvenance.properties.fileHashes")
+
+			Expect(fileHashes.Path("type").Data()).To(Equal("object"))
+			Expect(fileHashes.Path("dynamic").Data()).To(BeTrue())
+		})
+
+		It("should store Any values without indexing them", func() {
+			details := properties.Path("discovered.properties.discovered.properties.analysisStatusError.properties.details")
+
+			Expect(details.Path("type").Data()).To(Equal("object"))
+			Expect(details.Path("enabled").Data()).To(BeFalse())
+		})
+	})
+
+	Context("notes", func() {
+		var properties *gabs.Container
+
+		BeforeEach(func() {
+			properties = gabs.Wrap(protoMappingProperties(&pb.Note{}))
+		})
+
+		It("should map the vulnerability details as nested documents", func() {
+			Expect(properties.Path("vulnerability.properties.details.type").Data()).To(Equal("nested"))
+			Expect(properties.Path("vulnerability.properties.details.include_in_parent").Data()).To(BeTrue())
+			Expect(properties.Path("vulnerability.properties.details.properties.cpeUri.type").Data()).To(Equal("keyword"))
+		})
+
+		It("should map the vulnerability severity and score", func() {
+			Expect(properties.Path("vulnerability.properties.severity.type").Data()).To(Equal("keyword"))
+			Expect(properties.Path("vulnerability.properties.cvssScore.type").Data()).To(Equal("float"))
+		})
+	})
+
+	Context("projects", func() {
+		It("should map the project name", func() {
+			properties := gabs.Wrap(protoMappingProperties(&prpb.Project{}))
+
+			Expect(properties.Path("name.type").Data()).To(Equal("keyword"))
+		})
+	})
+})
@@ -0,0 +1,290 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// schemaVersion is stored in the metadata of every index, so that indices created with older mappings can be found and migrated.
+// The mappings of new indices come from the index templates, so the schema version follows the index template version.
+const schemaVersion = indexTemplateVersion
+
+// reindexPollInterval is how often the progress of a reindex task is checked during a migration
+var reindexPollInterval = 5 * time.Second
+
+// documentIdScript sets the ID of each document to the one computed by documentId while reindexing, so that documents
+// created before IDs were derived from resource names can be fetched by their name
+const documentIdScript = "if (ctx._source.name != null) { ctx._id = ctx._source.name.sha256() }"
+
+// versionedIndexPattern matches backing indices, which are named after the read alias they are accessed through.
+// Indices created by a rollover have an additional counter.
+var versionedIndexPattern = regexp.MustCompile(`^(.+)-v\d+(-\d+)?$`)
+
+// indexMigration describes the migration of a single index to the current schema version
+type indexMigration struct {
+	source        string
+	sourceVersion int
+	target        string
+	alias         string
+	// writeIndex is set when the source index receives writes, so the write alias should be moved to the target index
+	writeIndex bool
+}
+
+// Migrate installs the current index templates, then migrates every index that was created with an older schema version.
+func (es *ElasticsearchStorage) Migrate(ctx context.Context) error {
+	log := es.logger.Named("Migrate")
+
+	if err := es.installIndexTemplates(ctx, log); err != nil {
+		return err
+	}
+
+	return es.migrateIndices(ctx, log)
+}
+
+// migrateIndices migrates every outdated index by creating a new index with the current mappings, copying the documents
+// of the outdated index into it, and then atomically replacing the outdated index with the new one behind its aliases.
+// Each step can safely be repeated, so an interrupted migration is resumed on the next run.
+func (es *ElasticsearchStorage) migrateIndices(ctx context.Context, log *zap.Logger) error {
+	migrations, err := es.findIndexMigrations(ctx, log)
+	if err != nil {
+		return err
+	}
+
+	if len(migrations) == 0 {
+		log.Info("all indices are up to date", zap.Int("schemaVersion", schemaVersion))
+		return nil
+	}
+
+	log.Info("found outdated indices", zap.Int("count", len(migrations)), zap.Int("schemaVersion", schemaVersion))
+	for i, m := range migrations {
+		if err := es.migrateIndex(ctx, log.With(zap.Int("migration", i+1), zap.Int("total", len(migrations))), m); err != nil {
+			return err
+		}
+	}
+
+	log.Info("index migrations complete")
+
+	return nil
+}
+
+// findIndexMigrations returns a migration for every Grafeas index with a schema version older than the current one.
+// Indices without a schema version were created before versioning was introduced, and are treated as version 0.
+func (es *ElasticsearchStorage) findIndexMigrations(ctx context.Context, log *zap.Logger) ([]*indexMigration, error) {
+	indices, err := es.getIndices(ctx, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// when an index has been rolled over, only the latest index for an alias is the write index
+	writeIndices := map[string]string{}
+	for _, name := range names {
+		for alias, options := range indices[name].Aliases {
+			if options != nil && options.IsWriteIndex {
+				writeIndices[alias] = name
+			}
+		}
+	}
+
+	var migrations []*indexMigration
+	for _, name := range names {
+		if !isGrafeasIndex(indices[name]) {
+			continue
+		}
+		mappings := indices[name].Mappings
+		if mappings.Meta.SchemaVersion >= schemaVersion {
+			continue
+		}
+
+		alias := name
+		if match := versionedIndexPattern.FindStringSubmatch(name); match != nil {
+			alias = match[1]
+		}
+
+		writeIndex, hasWriteIndex := writeIndices[writeAlias(alias)]
+
+		migrations = append(migrations, &indexMigration{
+			source:        name,
+			sourceVersion: mappings.Meta.SchemaVersion,
+			target:        backingIndex(alias),
+			alias:         alias,
+			writeIndex:    !hasWriteIndex || writeIndex == name,
+		})
+	}
+
+	return migrations, nil
+}
+
+func (es *ElasticsearchStorage) migrateIndex(ctx context.Context, log *zap.Logger, m *indexMigration) error {
+	log = log.With(
+		zap.String("source", m.source),
+		zap.String("target", m.target),
+		zap.Int("sourceVersion", m.sourceVersion),
+		zap.Int("targetVersion", schemaVersion),
+	)
+	log.Info("migrating index")
+
+	if m.source == m.target {
+		log.Warn("outdated index has the name of the current schema version, skipping migration")
+		return nil
+	}
+
+	// writes are blocked while migrating, so that documents written after the reindex has started are not lost
+	if err := es.blockIndexWrites(ctx, log, m.source); err != nil {
+		return err
+	}
+
+	if err := es.createIndexIfNotExists(ctx, log, m.target); err != nil {
+		return err
+	}
+
+	if err := es.reindex(ctx, log, m.source, m.target); err != nil {
+		return err
+	}
+
+	swap := &backingIndexSwap{
+		alias:        m.alias,
+		source:       m.source,
+		target:       m.target,
+		deleteSource: true,
+		readOnly:     !m.writeIndex,
+	}
+	if err := es.swapBackingIndex(ctx, log, swap); err != nil {
+		return err
+	}
+
+	log.Info("index migrated")
+
+	return nil
+}
+
+func (es *ElasticsearchStorage) blockIndexWrites(ctx context.Context, log *zap.Logger, index string) error {
+	body := map[string]interface{}{
+		"index": map[string]interface{}{
+			"blocks": map[string]interface{}{
+				"write": true,
+			},
+		},
+	}
+	encodedBody, _ := encodeRequest(body)
+
+	res, err := es.client.Indices.PutSettings(
+		encodedBody,
+		es.client.Indices.PutSettings.WithContext(ctx),
+		es.client.Indices.PutSettings.WithIndex(index),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error blocking writes to index", res)
+	}
+
+	return nil
+}
+
+// reindex copies all documents from the source index into the target index, skipping any documents that were already
+// copied by a previous attempt. The copy runs as a background task in Elasticsearch, which is polled until it completes.
+func (es *ElasticsearchStorage) reindex(ctx context.Context, log *zap.Logger, source, target string) error {
+	body := map[string]interface{}{
+		"conflicts": "proceed",
+		"source": map[string]interface{}{
+			"index": source,
+		},
+		"dest": map[string]interface{}{
+			"index":   target,
+			"op_type": "create",
+		},
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": documentIdScript,
+		},
+	}
+	encodedBody, requestJson := encodeRequest(body)
+	log.Debug("reindexing", zap.String("request", requestJson))
+
+	res, err := es.client.Reindex(
+		encodedBody,
+		es.client.Reindex.WithContext(ctx),
+		es.client.Reindex.WithWaitForCompletion(false),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error starting reindex", res)
+	}
+
+	taskCreated := &esTaskCreatedResponse{}
+	if err := decodeResponse(res.Body, taskCreated); err != nil {
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	log = log.With(zap.String("task", taskCreated.Task))
+	for {
+		res, err := es.client.Tasks.Get(
+			taskCreated.Task,
+			es.client.Tasks.Get.WithContext(ctx),
+		)
+		if err != nil {
+			return createError(log, "error sending request to elasticsearch", err)
+		}
+		if res.IsError() {
+			return createResponseError(log, "error retrieving reindex task", res)
+		}
+
+		task := &esTaskResponse{}
+		if err := decodeResponse(res.Body, task); err != nil {
+			return createError(log, "error decoding elasticsearch response", err)
+		}
+
+		progress := []zap.Field{
+			zap.Int("documents", task.Task.Status.Total),
+			zap.Int("copied", task.Task.Status.Created),
+			zap.Int("alreadyCopied", task.Task.Status.VersionConflicts),
+		}
+
+		if task.Completed {
+			if task.Error != nil {
+				return createError(log, "reindex task failed", fmt.Errorf("%s: %s", task.Error.Type, task.Error.Reason))
+			}
+			if task.Response != nil && len(task.Response.Failures) != 0 {
+				return createError(log, "reindex task failed", nil, append(progress, zap.Int("failures", len(task.Response.Failures)))...)
+			}
+
+			log.Info("reindex complete", progress...)
+			return nil
+		}
+
+		log.Info("reindexing", progress...)
+
+		select {
+		case <-ctx.Done():
+			return createError(log, "migration interrupted, it will be resumed on the next run", ctx.Err())
+		case <-time.After(reindexPollInterval):
+		}
+	}
+}
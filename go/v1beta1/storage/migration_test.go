@@ -0,0 +1,443 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("index migrations", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		}
+		reindexPollInterval = time.Millisecond
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("migrating indices", func() {
+		var (
+			actualErr         error
+			outdatedIndex     string
+			targetIndex       string
+			expectedTaskId    string
+			existingIndices   esIndicesResponse
+			getIndicesStatus  int
+			targetIndexExists bool
+			targetIndexStatus int
+			reindexResponses  []*http.Response
+		)
+
+		BeforeEach(func() {
+			projectId := fake.LetterN(10)
+			outdatedIndex = fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId)
+			targetIndex = fmt.Sprintf("%s-v%d", outdatedIndex, schemaVersion)
+			expectedTaskId = fmt.Sprintf("%s:%d", fake.LetterN(10), fake.Number(1, 1000))
+
+			existingIndices = esIndicesResponse{
+				outdatedIndex: {
+					Mappings: &esIndexMappings{
+						Meta: &esIndexMeta{Type: "grafeas"},
+					},
+				},
+			}
+			getIndicesStatus = http.StatusOK
+			targetIndexExists = false
+			targetIndexStatus = 0
+			reindexResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esTaskCreatedResponse{Task: expectedTaskId}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsTaskResponse(true, 10, 10),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: getIndicesStatus,
+					Body:       structToJsonBody(existingIndices),
+				},
+				{
+					StatusCode: http.StatusOK,
+				},
+			}
+			if targetIndexStatus != 0 {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: targetIndexStatus,
+				})
+			} else if targetIndexExists {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusOK,
+				})
+			} else {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusNotFound,
+				}, &http.Response{
+					StatusCode: http.StatusOK,
+				})
+			}
+			transport.preparedHttpResponses = append(transport.preparedHttpResponses, reindexResponses...)
+			transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+				StatusCode: http.StatusOK,
+			})
+
+			actualErr = elasticsearchStorage.migrateIndices(ctx, logger)
+		})
+
+		It("should look for outdated Grafeas indices", func() {
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s-*", indexPrefix)))
+		})
+
+		It("should block writes to the outdated index", func() {
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_settings", outdatedIndex)))
+
+			assertJsonHasValues(transport.receivedHttpRequests[1].Body, map[string]interface{}{
+				"index.blocks.write": true,
+			})
+		})
+
+		It("should create an index for the current schema version", func() {
+			Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodHead))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s", targetIndex)))
+			Expect(transport.receivedHttpRequests[3].Method).To(Equal(http.MethodPut))
+			Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s", targetIndex)))
+		})
+
+		It("should copy the documents into the new index in the background", func() {
+			Expect(transport.receivedHttpRequests[4].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[4].URL.Path).To(Equal("/_reindex"))
+			Expect(transport.receivedHttpRequests[4].URL.Query().Get("wait_for_completion")).To(Equal("false"))
+
+			assertJsonHasValues(transport.receivedHttpRequests[4].Body, map[string]interface{}{
+				"conflicts":    "proceed",
+				"source.index": outdatedIndex,
+				"dest.index":   targetIndex,
+				"dest.op_type": "create",
+			})
+		})
+
+		It("should derive the ID of each document from its resource name", func() {
+			assertJsonHasValues(transport.receivedHttpRequests[4].Body, map[string]interface{}{
+				"script.lang":   "painless",
+				"script.source": documentIdScript,
+			})
+		})
+
+		It("should wait for the reindex task to complete", func() {
+			Expect(transport.receivedHttpRequests[5].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[5].URL.Path).To(Equal(fmt.Sprintf("/_tasks/%s", expectedTaskId)))
+		})
+
+		It("should replace the outdated index with the new index behind its aliases", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(7))
+			Expect(transport.receivedHttpRequests[6].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[6].URL.Path).To(Equal("/_aliases"))
+
+			assertJsonHasValues(transport.receivedHttpRequests[6].Body, map[string]interface{}{
+				"actions.0.add.index":          targetIndex,
+				"actions.0.add.alias":          outdatedIndex,
+				"actions.1.add.index":          targetIndex,
+				"actions.1.add.alias":          writeAlias(outdatedIndex),
+				"actions.1.add.is_write_index": true,
+				"actions.2.remove_index.index": outdatedIndex,
+			})
+			Expect(actualErr).ToNot(HaveOccurred())
+		})
+
+		When("the outdated index was created by a previous migration", func() {
+			var alias string
+
+			BeforeEach(func() {
+				alias = outdatedIndex
+				outdatedIndex = fmt.Sprintf("%s-v%d", alias, schemaVersion-1)
+				existingIndices = esIndicesResponse{
+					outdatedIndex: {
+						Aliases: map[string]*esIndexAlias{alias: {}},
+						Mappings: &esIndexMappings{
+							Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: schemaVersion - 1},
+						},
+					},
+				}
+			})
+
+			It("should keep using the same alias", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				assertJsonHasValues(transport.receivedHttpRequests[6].Body, map[string]interface{}{
+					"actions.0.add.index":          targetIndex,
+					"actions.0.add.alias":          alias,
+					"actions.1.add.alias":          writeAlias(alias),
+					"actions.2.remove_index.index": outdatedIndex,
+				})
+			})
+		})
+
+		When("the outdated index has been rolled over", func() {
+			var alias string
+
+			BeforeEach(func() {
+				alias = outdatedIndex
+				outdatedIndex = fmt.Sprintf("%s-v%d-000001", alias, schemaVersion-1)
+				existingIndices = esIndicesResponse{
+					outdatedIndex: {
+						Aliases: map[string]*esIndexAlias{
+							alias:             {},
+							writeAlias(alias): {},
+						},
+						Mappings: &esIndexMappings{
+							Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: schemaVersion - 1},
+						},
+					},
+					targetIndex: {
+						Aliases: map[string]*esIndexAlias{
+							alias:             {},
+							writeAlias(alias): {IsWriteIndex: true},
+						},
+						Mappings: &esIndexMappings{
+							Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: schemaVersion},
+						},
+					},
+				}
+			})
+
+			It("should migrate the rolled over index into the index for the current schema version", func() {
+				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s", targetIndex)))
+			})
+
+			It("should leave the write alias on the latest index", func() {
+				body := parseJsonBody(transport.receivedHttpRequests[6].Body)
+
+				Expect(body.Path("actions.0.add.alias").Data()).To(Equal(alias))
+				Expect(body.Path("actions.1.remove_index.index").Data()).To(Equal(outdatedIndex))
+			})
+		})
+
+		When("all indices are up to date", func() {
+			BeforeEach(func() {
+				existingIndices = esIndicesResponse{
+					targetIndex: {
+						Mappings: &esIndexMappings{
+							Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: schemaVersion},
+						},
+					},
+					fmt.Sprintf("%s-%s", indexPrefix, fake.LetterN(10)): {
+						Mappings: &esIndexMappings{},
+					},
+				}
+			})
+
+			It("should not migrate any indices", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the new index already exists from an interrupted migration", func() {
+			BeforeEach(func() {
+				targetIndexExists = true
+			})
+
+			It("should not create the new index again", func() {
+				Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodHead))
+				Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal("/_reindex"))
+			})
+		})
+
+		When("checking if the new index exists fails", func() {
+			BeforeEach(func() {
+				targetIndexStatus = http.StatusForbidden
+			})
+
+			It("should return the error from Elasticsearch without migrating the index", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.PermissionDenied)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			})
+		})
+
+		When("the reindex task takes a while to complete", func() {
+			BeforeEach(func() {
+				reindexResponses = []*http.Response{
+					reindexResponses[0],
+					{
+						StatusCode: http.StatusOK,
+						Body:       createEsTaskResponse(false, 10, 5),
+					},
+					reindexResponses[1],
+				}
+			})
+
+			It("should poll the task until it completes", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(8))
+				Expect(transport.receivedHttpRequests[5].URL.Path).To(Equal(fmt.Sprintf("/_tasks/%s", expectedTaskId)))
+				Expect(transport.receivedHttpRequests[6].URL.Path).To(Equal(fmt.Sprintf("/_tasks/%s", expectedTaskId)))
+				Expect(transport.receivedHttpRequests[7].URL.Path).To(Equal("/_aliases"))
+			})
+		})
+
+		When("the reindex task has failures", func() {
+			BeforeEach(func() {
+				reindexResponses[1].Body = structToJsonBody(&esTaskResponse{
+					Completed: true,
+					Task: &esTask{
+						Status: &esTaskStatus{Total: 10, Created: 9},
+					},
+					Response: &esTaskResultResponse{
+						Failures: []json.RawMessage{json.RawMessage(`{"cause":{}}`)},
+					},
+				})
+			})
+
+			It("should return an error without swapping the indices", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(6))
+			})
+		})
+
+		When("the reindex task fails", func() {
+			BeforeEach(func() {
+				reindexResponses[1].Body = structToJsonBody(&esTaskResponse{
+					Completed: true,
+					Task: &esTask{
+						Status: &esTaskStatus{},
+					},
+					Error: &esIndexDocError{
+						Type:   fake.LetterN(10),
+						Reason: fake.LetterN(10),
+					},
+				})
+			})
+
+			It("should return an error without swapping the indices", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(6))
+			})
+		})
+
+		When("starting the reindex fails", func() {
+			BeforeEach(func() {
+				reindexResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(5))
+			})
+		})
+
+		When("looking for outdated indices fails", func() {
+			BeforeEach(func() {
+				getIndicesStatus = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("running migrations", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			for _, template := range (&ElasticsearchStorage{config: esConfig}).indexTemplates() {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(template.name, template.body()),
+				})
+			}
+			transport.preparedHttpResponses = append(transport.preparedHttpResponses, &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       structToJsonBody(esIndicesResponse{}),
+			})
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.Migrate(ctx)
+		})
+
+		It("should install the index templates before looking for outdated indices", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			templates := len(elasticsearchStorage.indexTemplates())
+			Expect(transport.receivedHttpRequests).To(HaveLen(templates + 1))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(HavePrefix("/_index_template/"))
+			Expect(transport.receivedHttpRequests[templates].URL.Path).To(Equal(fmt.Sprintf("/%s-*", indexPrefix)))
+		})
+
+		When("installing the index templates fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without migrating any indices", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+})
+
+func createEsTaskResponse(completed bool, total, created int) io.ReadCloser {
+	return structToJsonBody(&esTaskResponse{
+		Completed: completed,
+		Task: &esTask{
+			Status: &esTaskStatus{
+				Total:   total,
+				Created: created,
+			},
+		},
+	})
+}
@@ -0,0 +1,395 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage/filtering"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strings"
+
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+// projectStateField is stored alongside the project document to track a deletion that is in progress
+const projectStateField = "state"
+const projectStateDeleting = "DELETING"
+
+// getProject reads a project document, along with the state of a deletion that is in progress, if any
+func (es *ElasticsearchStorage) getProject(ctx context.Context, log *zap.Logger, projectId string) (*prpb.Project, string, error) {
+	project := &prpb.Project{}
+	res, err := es.client.Get(
+		projectsIndex(),
+		documentId(fmt.Sprintf("projects/%s", projectId)),
+		es.client.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, "", createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("project not found")
+		return nil, "", status.Error(codes.NotFound, fmt.Sprintf("%T not found", project))
+	}
+	if res.IsError() {
+		return nil, "", createResponseError(log, "error retrieving project from elasticsearch", res)
+	}
+
+	var document esGetResponse
+	if err := decodeResponse(res.Body, &document); err != nil {
+		return nil, "", createError(log, "error unmarshalling elasticsearch response", err)
+	}
+
+	state, err := projectState(document.Source)
+	if err != nil {
+		return nil, "", createError(log, "error unmarshalling project", err)
+	}
+	if err := protojsonUnmarshaler.Unmarshal(document.Source, proto.MessageV2(project)); err != nil {
+		return nil, "", createError(log, "error unmarshalling project", err)
+	}
+
+	return project, state, nil
+}
+
+// projectState returns the state stored alongside a project document, which is only set while it's being deleted
+func projectState(source json.RawMessage) (string, error) {
+	document := &struct {
+		State string `json:"state"`
+	}{}
+	if err := json.Unmarshal(source, document); err != nil {
+		return "", err
+	}
+
+	return document.State, nil
+}
+
+// checkProjectWritable rejects writes to a project that is being deleted. Its indices may already have been removed, in
+// which case writing to the write alias would create an index without aliases in place of the project's indices.
+// Projects without a project document are left alone, as the notes and occurrences for them were always accepted.
+func (es *ElasticsearchStorage) checkProjectWritable(ctx context.Context, log *zap.Logger, projectId string) error {
+	_, state, err := es.getProject(ctx, log, projectId)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if state == projectStateDeleting {
+		log.Debug("project is being deleted")
+		return status.Errorf(codes.FailedPrecondition, "project %s is being deleted", projectId)
+	}
+
+	return nil
+}
+
+// createProjectIndices creates the indices used to store a project's notes and occurrences, returning the backing
+// indices that were created. Existing indices are adopted rather than treated as an error, since they may have been left
+// behind by an earlier attempt to create the project. When an index can't be created, the indices created before it are
+// removed.
+func (es *ElasticsearchStorage) createProjectIndices(ctx context.Context, log *zap.Logger, projectId string) ([]string, error) {
+	var created []string
+	for _, index := range es.projectIndices(projectId) {
+		ok, err := es.createAliasedIndexIfNotExists(ctx, log, index)
+		if err != nil {
+			es.deleteCreatedIndices(ctx, log, created)
+
+			return nil, err
+		}
+		if ok {
+			created = append(created, backingIndex(index))
+		} else {
+			log.Info("using existing index", zap.String("alias", index))
+		}
+	}
+
+	return created, nil
+}
+
+// deleteCreatedIndices removes indices that were created for a project that couldn't be created. Failures are only logged,
+// as the indices will be adopted if creating the project is retried.
+func (es *ElasticsearchStorage) deleteCreatedIndices(ctx context.Context, log *zap.Logger, indices []string) {
+	if len(indices) == 0 {
+		return
+	}
+
+	log = log.With(zap.Strings("indices", indices))
+	log.Info("removing indices created for project")
+
+	res, err := es.client.Indices.Delete(
+		indices,
+		es.client.Indices.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		log.Warn("error sending request to elasticsearch", zap.Error(err))
+		return
+	}
+	if res.IsError() {
+		log.Warn("error removing indices created for project", zap.String("response", res.String()))
+	}
+}
+
+// ForceDeleteProject deletes a project even if its notes are still referenced by occurrences in other projects.
+// It can also be used to finish deleting a project when a previous deletion failed part of the way through.
+func (es *ElasticsearchStorage) ForceDeleteProject(ctx context.Context, projectId string) error {
+	projectName := fmt.Sprintf("projects/%s", projectId)
+	log := es.logger.Named("ForceDeleteProject").With(zap.String("project", projectName))
+
+	if err := es.deleteProject(ctx, log, projectId, true); err != nil {
+		return err
+	}
+
+	es.recordAuditEvent(ctx, log, "", OperationDelete, projectName, nil, nil)
+
+	return nil
+}
+
+// ResumeProjectDeletions finishes deleting any projects whose deletion was interrupted
+func (es *ElasticsearchStorage) ResumeProjectDeletions(ctx context.Context) error {
+	log := es.logger.Named("ResumeProjectDeletions")
+
+	// the projects are collected before any are deleted, so that deleting them doesn't change the pages being read
+	var (
+		projectIds []string
+		errs       error
+	)
+	query := &filtering.Query{
+		Term: &filtering.Term{
+			projectStateField: projectStateDeleting,
+		},
+	}
+	err := es.searchAllProjects(ctx, log, query, func(hit *esSearchResponseHit) error {
+		project := &prpb.Project{}
+		if err := protojsonUnmarshaler.Unmarshal(hit.Source, proto.MessageV2(project)); err != nil {
+			errs = multierror.Append(errs, createError(log, "error decoding project", err))
+			return nil
+		}
+
+		projectIds = append(projectIds, strings.TrimPrefix(project.Name, "projects/"))
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("resuming project deletions", zap.Int("projects", len(projectIds)))
+
+	for _, projectId := range projectIds {
+		projectLog := log.With(zap.String("project", fmt.Sprintf("projects/%s", projectId)))
+		if err := es.deleteProject(ctx, projectLog, projectId, true); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// searchAllProjects calls found with each project document that matches the query. A search returns at most
+// grafeasMaxPageSize hits, so the projects are sorted by name and read a page at a time using search_after.
+func (es *ElasticsearchStorage) searchAllProjects(ctx context.Context, log *zap.Logger, query *filtering.Query, found func(hit *esSearchResponseHit) error) error {
+	search := &esSearch{
+		Query: query,
+		Sort: map[string]esSortOrder{
+			"name": esSortOrderAscending,
+		},
+	}
+
+	for {
+		encodedBody, requestJson := encodeRequest(search)
+		pageLog := log.With(zap.String("request", requestJson))
+
+		res, err := es.client.Search(
+			es.client.Search.WithContext(ctx),
+			es.client.Search.WithIndex(projectsIndex()),
+			es.client.Search.WithBody(encodedBody),
+			es.client.Search.WithSize(grafeasMaxPageSize),
+		)
+		if err != nil {
+			return createError(pageLog, "error sending request to elasticsearch", err)
+		}
+		if res.IsError() {
+			return createResponseError(pageLog, "error searching for projects", res)
+		}
+
+		var searchResults esSearchResponse
+		if err := decodeResponse(res.Body, &searchResults); err != nil {
+			return createError(pageLog, "error decoding elasticsearch response", err)
+		}
+
+		hits := searchResults.Hits.Hits
+		for _, hit := range hits {
+			if err := found(hit); err != nil {
+				return err
+			}
+		}
+
+		if len(hits) < grafeasMaxPageSize {
+			return nil
+		}
+		search.SearchAfter = hits[len(hits)-1].Sort
+	}
+}
+
+// deleteProject removes a project in stages, so that a deletion that fails part of the way through can be retried:
+// the project document is marked as being deleted, then the project's notes and occurrences are removed, and finally the
+// project document itself is deleted. Unless forced, projects with notes that are referenced by occurrences in other
+// projects are not deleted.
+func (es *ElasticsearchStorage) deleteProject(ctx context.Context, log *zap.Logger, projectId string, force bool) error {
+	projectName := fmt.Sprintf("projects/%s", projectId)
+
+	if !force {
+		references, err := es.countExternalNoteReferences(ctx, log, projectId)
+		if err != nil {
+			return err
+		}
+		if references > 0 {
+			log.Info("refusing to delete project with referenced notes", zap.Int("references", references))
+			return status.Errorf(codes.FailedPrecondition, "notes in %s are referenced by %d occurrences in other projects", projectName, references)
+		}
+	}
+
+	if err := es.markProjectDeleting(ctx, log, projectName); err != nil {
+		return err
+	}
+
+	log.Debug("project marked as deleting")
+
+	if err := es.deleteProjectData(ctx, log, projectId); err != nil {
+		return err
+	}
+
+	if err := es.genericDelete(ctx, log, projectsIndex(), "", projectName); err != nil {
+		return err
+	}
+
+	log.Debug("project document deleted")
+
+	return nil
+}
+
+// countExternalNoteReferences counts the occurrences outside of a project that reference one of its notes. Soft deleted
+// occurrences are left out, since they no longer depend on the notes.
+func (es *ElasticsearchStorage) countExternalNoteReferences(ctx context.Context, log *zap.Logger, projectId string) (int, error) {
+	projectPrefix := fmt.Sprintf("projects/%s/", projectId)
+	encodedBody, requestJson := encodeRequest(&esSearch{
+		Query: es.withoutTombstones(&filtering.Query{
+			Bool: &filtering.Bool{
+				Must: &filtering.Must{
+					&filtering.Query{
+						Prefix: &filtering.Term{
+							"noteName": projectPrefix + "notes/",
+						},
+					},
+				},
+				MustNot: &filtering.MustNot{
+					&filtering.Query{
+						Prefix: &filtering.Term{
+							"name": projectPrefix,
+						},
+					},
+				},
+			},
+		}),
+	})
+	log = log.With(zap.String("request", requestJson))
+
+	res, err := es.client.Count(
+		es.client.Count.WithContext(ctx),
+		es.client.Count.WithIndex(occurrencesIndexPattern()),
+		es.client.Count.WithBody(encodedBody),
+	)
+	if err != nil {
+		return 0, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return 0, createResponseError(log, "error counting references to project notes", res)
+	}
+
+	count := &esCountResponse{}
+	if err := decodeResponse(res.Body, count); err != nil {
+		return 0, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return count.Count, nil
+}
+
+func (es *ElasticsearchStorage) markProjectDeleting(ctx context.Context, log *zap.Logger, projectName string) error {
+	encodedBody, _ := encodeRequest(map[string]interface{}{
+		"doc": map[string]interface{}{
+			projectStateField: projectStateDeleting,
+		},
+	})
+
+	res, err := es.client.Update(
+		writeAlias(projectsIndex()),
+		documentId(projectName),
+		encodedBody,
+		es.client.Update.WithContext(ctx),
+		es.client.Update.WithRefresh(es.config.Refresh.String()),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("project not found")
+		return status.Errorf(codes.NotFound, "%s not found", projectName)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error marking project as deleting", res)
+	}
+
+	return nil
+}
+
+// deleteProjectData removes the project's notes and occurrences. Indices that have already been deleted are skipped,
+// so that a previous attempt can be resumed.
+func (es *ElasticsearchStorage) deleteProjectData(ctx context.Context, log *zap.Logger, projectId string) error {
+	// the indices for notes and occurrences are shared with other projects, so only this project's documents can be removed
+	if es.sharedLayout() {
+		return es.deleteProjectDocuments(ctx, log, projectId)
+	}
+
+	// indices that have been migrated are accessed through an alias, which can't be used to delete the index
+	indices, err := es.resolveIndices(ctx, log, es.projectIndices(projectId))
+	if err != nil {
+		return err
+	}
+	if len(indices) == 0 {
+		log.Debug("project indices were already deleted")
+		return nil
+	}
+
+	res, err := es.client.Indices.Delete(
+		indices,
+		es.client.Indices.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error deleting elasticsearch indices", res)
+	}
+
+	log.Debug("project indices for notes / occurrences deleted")
+
+	return nil
+}
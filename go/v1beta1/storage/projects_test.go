@@ -0,0 +1,413 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"io"
+	"net/http"
+)
+
+var _ = Describe("project deletion", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			Layout:  config.LayoutShared,
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("forcing a project to be deleted", func() {
+		var (
+			projectId string
+			actualErr error
+		)
+
+		BeforeEach(func() {
+			projectId = fake.LetterN(10)
+			transport.preparedHttpResponses = []*http.Response{
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusOK, Body: structToJsonBody(&esDeleteResponse{})},
+				{StatusCode: http.StatusOK},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.ForceDeleteProject(ctx, projectId)
+		})
+
+		It("should delete the project without checking for references to its notes", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(HaveSuffix("/_update"))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(HaveSuffix("/_delete_by_query"))
+			Expect(transport.receivedHttpRequests[2].Method).To(Equal(http.MethodDelete))
+		})
+	})
+
+	Context("resuming project deletions", func() {
+		var (
+			projectIds []string
+			actualErr  error
+		)
+
+		BeforeEach(func() {
+			projectIds = []string{fake.LetterN(10), fake.LetterN(10)}
+
+			var hits []*esSearchResponseHit
+			for _, projectId := range projectIds {
+				source, _ := json.Marshal(map[string]string{
+					"name":            fmt.Sprintf("projects/%s", projectId),
+					projectStateField: projectStateDeleting,
+				})
+				hits = append(hits, &esSearchResponseHit{Source: source})
+			}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body: structToJsonBody(&esSearchResponse{
+						Hits: &esSearchResponseHits{
+							Total: &esSearchResponseTotal{Value: len(hits)},
+							Hits:  hits,
+						},
+					}),
+				},
+			}
+			for range projectIds {
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses,
+					&http.Response{StatusCode: http.StatusOK},
+					&http.Response{StatusCode: http.StatusOK, Body: structToJsonBody(&esDeleteResponse{})},
+					&http.Response{StatusCode: http.StatusOK},
+				)
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.ResumeProjectDeletions(ctx)
+		})
+
+		It("should search for projects that are being deleted", func() {
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", projectsIndex())))
+			assertJsonHasValues(transport.receivedHttpRequests[0].Body, map[string]interface{}{
+				"query.term.state": projectStateDeleting,
+			})
+		})
+
+		It("should finish deleting each project", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(7))
+			Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", projectsIndex(), documentId(fmt.Sprintf("projects/%s", projectIds[0])))))
+			Expect(transport.receivedHttpRequests[6].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", projectsIndex(), documentId(fmt.Sprintf("projects/%s", projectIds[1])))))
+		})
+
+		When("there is more than one page of projects being deleted", func() {
+			var lastProjectName string
+
+			BeforeEach(func() {
+				var hits []*esSearchResponseHit
+				for i := 0; i < grafeasMaxPageSize; i++ {
+					name := fmt.Sprintf("projects/%s-%04d", fake.LetterN(10), i)
+					source, _ := json.Marshal(map[string]string{
+						"name":            name,
+						projectStateField: projectStateDeleting,
+					})
+					hits = append(hits, &esSearchResponseHit{Source: source, Sort: []interface{}{name}})
+					lastProjectName = name
+				}
+
+				lastPage := transport.preparedHttpResponses[0]
+				transport.preparedHttpResponses = []*http.Response{
+					{
+						StatusCode: http.StatusOK,
+						Body: structToJsonBody(&esSearchResponse{
+							Hits: &esSearchResponseHits{
+								Total: &esSearchResponseTotal{Value: len(hits)},
+								Hits:  hits,
+							},
+						}),
+					},
+					lastPage,
+				}
+				for range hits {
+					transport.preparedHttpResponses = append(transport.preparedHttpResponses,
+						&http.Response{StatusCode: http.StatusOK},
+						&http.Response{StatusCode: http.StatusOK, Body: structToJsonBody(&esDeleteResponse{})},
+						&http.Response{StatusCode: http.StatusOK},
+					)
+				}
+				for range projectIds {
+					transport.preparedHttpResponses = append(transport.preparedHttpResponses,
+						&http.Response{StatusCode: http.StatusOK},
+						&http.Response{StatusCode: http.StatusOK, Body: structToJsonBody(&esDeleteResponse{})},
+						&http.Response{StatusCode: http.StatusOK},
+					)
+				}
+			})
+
+			It("should read the next page after the last project on the previous page", func() {
+				firstPage := parseJsonBody(transport.receivedHttpRequests[0].Body)
+				Expect(firstPage.Path("sort.name").Data()).To(Equal(string(esSortOrderAscending)))
+				Expect(firstPage.Exists("search_after")).To(BeFalse())
+
+				secondPage := parseJsonBody(transport.receivedHttpRequests[1].Body)
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", projectsIndex())))
+				Expect(secondPage.Path("search_after").Data()).To(ConsistOf(lastProjectName))
+			})
+
+			It("should finish deleting the projects on every page", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2 + (grafeasMaxPageSize+len(projectIds))*3))
+
+				lastRequest := transport.receivedHttpRequests[len(transport.receivedHttpRequests)-1]
+				Expect(lastRequest.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", projectsIndex(), documentId(fmt.Sprintf("projects/%s", projectIds[1])))))
+			})
+		})
+
+		When("deleting one of the projects fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].StatusCode = http.StatusInternalServerError
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses[:3], transport.preparedHttpResponses[4:]...)
+			})
+
+			It("should still delete the other projects", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(6))
+				Expect(transport.receivedHttpRequests[5].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", projectsIndex(), documentId(fmt.Sprintf("projects/%s", projectIds[1])))))
+			})
+		})
+	})
+
+	Context("writing to a project that is being deleted", func() {
+		var projectId string
+
+		BeforeEach(func() {
+			projectId = fake.LetterN(10)
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, projectStateDeleting),
+				},
+			}
+		})
+
+		It("should look up the project before writing", func() {
+			_, _ = elasticsearchStorage.CreateOccurrence(ctx, projectId, "", generateTestOccurrence(""))
+
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", projectsIndex(), documentId(fmt.Sprintf("projects/%s", projectId)))))
+		})
+
+		It("should reject creating an occurrence", func() {
+			occurrence, err := elasticsearchStorage.CreateOccurrence(ctx, projectId, "", generateTestOccurrence(""))
+
+			Expect(occurrence).To(BeNil())
+			assertErrorHasGrpcStatusCode(err, codes.FailedPrecondition)
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		})
+
+		It("should reject creating a note", func() {
+			note, err := elasticsearchStorage.CreateNote(ctx, projectId, fake.LetterN(10), "", generateTestNote(""))
+
+			Expect(note).To(BeNil())
+			assertErrorHasGrpcStatusCode(err, codes.FailedPrecondition)
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		})
+
+		It("should reject a batch of occurrences", func() {
+			occurrences, errs := elasticsearchStorage.BatchCreateOccurrences(ctx, projectId, "", generateTestOccurrences(2))
+
+			Expect(occurrences).To(BeEmpty())
+			Expect(errs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(errs[0], codes.FailedPrecondition)
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		})
+
+		It("should reject a batch of notes", func() {
+			notes, errs := elasticsearchStorage.BatchCreateNotes(ctx, projectId, "", map[string]*pb.Note{
+				fake.LetterN(10): generateTestNote(""),
+			})
+
+			Expect(notes).To(BeEmpty())
+			Expect(errs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(errs[0], codes.FailedPrecondition)
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		})
+
+		It("should reject upserting notes", func() {
+			report, errs := elasticsearchStorage.UpsertNotes(ctx, projectId, "", map[string]*pb.Note{
+				fake.LetterN(10): generateTestNote(""),
+			})
+
+			Expect(report).To(BeNil())
+			Expect(errs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(errs[0], codes.FailedPrecondition)
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+		})
+
+		When("the project doesn't have a project document", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusNotFound},
+					{
+						StatusCode: http.StatusCreated,
+						Body:       structToJsonBody(&esIndexDocResponse{Id: fake.LetterN(10)}),
+					},
+				}
+			})
+
+			It("should still create the occurrence", func() {
+				_, err := elasticsearchStorage.CreateOccurrence(ctx, projectId, "", generateTestOccurrence(""))
+
+				Expect(err).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("the project can't be read", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error without writing", func() {
+				_, err := elasticsearchStorage.CreateOccurrence(ctx, projectId, "", generateTestOccurrence(""))
+
+				assertErrorHasGrpcStatusCode(err, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("getting a project that is being deleted", func() {
+		var (
+			projectId     string
+			actualProject *prpb.Project
+			actualErr     error
+		)
+
+		BeforeEach(func() {
+			projectId = fake.LetterN(10)
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, projectStateDeleting),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualProject, actualErr = elasticsearchStorage.GetProject(ctx, projectId)
+		})
+
+		It("should treat the project as missing", func() {
+			Expect(actualProject).To(BeNil())
+			assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+		})
+	})
+
+	Context("listing projects while one is being deleted", func() {
+		var (
+			projectIds     []string
+			actualProjects []*prpb.Project
+			actualErr      error
+		)
+
+		BeforeEach(func() {
+			projectIds = []string{fake.LetterN(10), fake.LetterN(10)}
+
+			var hits []*esSearchResponseHit
+			for i, projectId := range projectIds {
+				source := map[string]string{"name": fmt.Sprintf("projects/%s", projectId)}
+				if i == 0 {
+					source[projectStateField] = projectStateDeleting
+				}
+				raw, _ := json.Marshal(source)
+				hits = append(hits, &esSearchResponseHit{Source: raw})
+			}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body: structToJsonBody(&esSearchResponse{
+						Hits: &esSearchResponseHits{
+							Total: &esSearchResponseTotal{Value: len(hits)},
+							Hits:  hits,
+						},
+					}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualProjects, _, actualErr = elasticsearchStorage.ListProjects(ctx, "", 0, "")
+		})
+
+		It("should leave out the project that is being deleted", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualProjects).To(HaveLen(1))
+			Expect(actualProjects[0].Name).To(Equal(fmt.Sprintf("projects/%s", projectIds[1])))
+		})
+	})
+})
+
+func createEsProjectGetResponse(projectId, state string) io.ReadCloser {
+	source := map[string]string{
+		"name": fmt.Sprintf("projects/%s", projectId),
+	}
+	if state != "" {
+		source[projectStateField] = state
+	}
+	raw, err := json.Marshal(source)
+	Expect(err).ToNot(HaveOccurred())
+
+	return structToJsonBody(&esGetResponse{
+		Id:     documentId(source["name"]),
+		Found:  true,
+		Source: raw,
+	})
+}
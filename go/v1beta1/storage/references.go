@@ -0,0 +1,140 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"regexp"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// noteNamePattern matches note names in the form projects/${projectId}/notes/${noteId}
+var noteNamePattern = regexp.MustCompile(`^projects/([^/]+)/notes/([^/]+)$`)
+
+// validateNoteReferences checks that the note referenced by each occurrence exists and is the same kind as the occurrence.
+// All of the referenced notes are fetched with a single multi-get request. The returned errors are in the same order as
+// the occurrences, and are nil for occurrences that reference a valid note.
+func (es *ElasticsearchStorage) validateNoteReferences(ctx context.Context, log *zap.Logger, occurrences []*pb.Occurrence) ([]error, error) {
+	var (
+		docs      []*esMultiGetDocument
+		noteNames = map[string]int{}
+	)
+	for _, occurrence := range occurrences {
+		matches := noteNamePattern.FindStringSubmatch(occurrence.NoteName)
+		if matches == nil {
+			continue
+		}
+		if _, ok := noteNames[occurrence.NoteName]; ok {
+			continue
+		}
+
+		noteNames[occurrence.NoteName] = len(docs)
+		docs = append(docs, &esMultiGetDocument{
+			Index:   es.notesIndex(matches[1]),
+			Id:      documentId(occurrence.NoteName),
+			Routing: es.routing(matches[1]),
+		})
+	}
+
+	var notes []*pb.Note
+	if len(docs) > 0 {
+		var err error
+		notes, err = es.multiGetNotes(ctx, log, docs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	errs := make([]error, len(occurrences))
+	for i, occurrence := range occurrences {
+		position, ok := noteNames[occurrence.NoteName]
+		if !ok {
+			errs[i] = status.Errorf(codes.InvalidArgument, "invalid note name %q", occurrence.NoteName)
+			continue
+		}
+
+		note := notes[position]
+		if note == nil {
+			errs[i] = status.Errorf(codes.FailedPrecondition, "note %s does not exist", occurrence.NoteName)
+			continue
+		}
+		if note.Kind != occurrence.Kind {
+			errs[i] = status.Errorf(codes.FailedPrecondition, "occurrence kind %s does not match the kind of note %s (%s)", occurrence.Kind, occurrence.NoteName, note.Kind)
+		}
+	}
+
+	return errs, nil
+}
+
+// multiGetNotes fetches the notes for the given documents, returning nil for any note that wasn't found or
+// was soft deleted
+func (es *ElasticsearchStorage) multiGetNotes(ctx context.Context, log *zap.Logger, docs []*esMultiGetDocument) ([]*pb.Note, error) {
+	encodedBody, requestJson := encodeRequest(&esMultiGetRequest{Docs: docs})
+	log = log.With(zap.String("request", requestJson))
+
+	res, err := es.client.Mget(
+		encodedBody,
+		es.client.Mget.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error retrieving referenced notes", res)
+	}
+
+	response := &esMultiGetResponse{}
+	if err := decodeResponse(res.Body, response); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+	if len(response.Docs) != len(docs) {
+		return nil, createError(log, "unexpected number of documents in elasticsearch response", fmt.Errorf("expected %d documents, got %d", len(docs), len(response.Docs)))
+	}
+
+	notes := make([]*pb.Note, len(docs))
+	for i, doc := range response.Docs {
+		// the notes index for a project that doesn't exist is reported as an error for that document
+		if doc.Error != nil && esErrorCode(0, doc.Error.Type) != codes.NotFound {
+			return nil, createError(log, "error retrieving referenced note", fmt.Errorf("%s: %s", doc.Error.Type, doc.Error.Reason))
+		}
+		if !doc.Found {
+			continue
+		}
+
+		note := &pb.Note{}
+		if err := protojsonUnmarshaler.Unmarshal(doc.Source, proto.MessageV2(note)); err != nil {
+			return nil, createError(log, "error unmarshalling referenced note", err)
+		}
+
+		// notes that were soft deleted can't be referenced by new occurrences
+		deleteTime, err := documentDeleteTime(doc.Source)
+		if err != nil {
+			return nil, createError(log, "error unmarshalling referenced note", err)
+		}
+		if es.config.SoftDelete.Enabled && deleteTime != nil {
+			continue
+		}
+
+		notes[i] = note
+	}
+
+	return notes, nil
+}
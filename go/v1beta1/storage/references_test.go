@@ -0,0 +1,281 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("note references", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+		note                 *pb.Note
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		projectId = fake.LetterN(10)
+		note = generateTestNote(fmt.Sprintf("projects/%s/notes/%s", fake.LetterN(10), fake.LetterN(10)))
+		note.Kind = common_go_proto.NoteKind_VULNERABILITY
+		esConfig = &config.ElasticsearchConfig{
+			URL:                    fake.URL(),
+			Refresh:                config.RefreshTrue,
+			ValidateNoteReferences: true,
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("creating an occurrence", func() {
+		var (
+			occurrence *pb.Occurrence
+			actualErr  error
+		)
+
+		BeforeEach(func() {
+			occurrence = generateTestOccurrence("")
+			occurrence.NoteName = note.Name
+			occurrence.Kind = note.Kind
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsMultiGetResponse(note),
+				},
+				{
+					StatusCode: http.StatusCreated,
+					Body:       structToJsonBody(&esIndexDocResponse{Id: fake.LetterN(10)}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.CreateOccurrence(ctx, projectId, "", occurrence)
+		})
+
+		It("should fetch the referenced note from the notes index for its project", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal("/_mget"))
+
+			request := &esMultiGetRequest{}
+			Expect(json.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body), request)).To(Succeed())
+			Expect(request.Docs).To(ConsistOf(&esMultiGetDocument{
+				Index: fmt.Sprintf("%s-%s-notes", indexPrefix, noteNamePattern.FindStringSubmatch(note.Name)[1]),
+				Id:    documentId(note.Name),
+			}))
+		})
+
+		It("should create the occurrence", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+		})
+
+		When("the referenced note doesn't exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].Body = createEsMultiGetResponse(nil)
+			})
+
+			It("should reject the occurrence", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("the project of the referenced note doesn't exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].Body = structToJsonBody(&esMultiGetResponse{
+					Docs: []*esGetResponse{
+						{
+							Error: &esIndexDocError{Type: "index_not_found_exception", Reason: fake.LetterN(10)},
+						},
+					},
+				})
+			})
+
+			It("should reject the occurrence", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+			})
+		})
+
+		When("the referenced note is a different kind", func() {
+			BeforeEach(func() {
+				occurrence.Kind = common_go_proto.NoteKind_DISCOVERY
+			})
+
+			It("should reject the occurrence", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("the note name is invalid", func() {
+			BeforeEach(func() {
+				occurrence.NoteName = fake.LetterN(10)
+			})
+
+			It("should reject the occurrence without fetching any notes", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(transport.receivedHttpRequests[0].URL.Path).ToNot(Equal("/_mget"))
+			})
+		})
+
+		When("fetching the referenced notes fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("validating note references is disabled", func() {
+			BeforeEach(func() {
+				esConfig.ValidateNoteReferences = false
+				transport.preparedHttpResponses = append(transport.preparedHttpResponses[:1], transport.preparedHttpResponses[2:]...)
+			})
+
+			It("should create the occurrence without fetching the note", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(transport.receivedHttpRequests[1].URL.Path).ToNot(Equal("/_mget"))
+			})
+		})
+	})
+
+	Context("creating a batch of occurrences", func() {
+		var (
+			occurrences       []*pb.Occurrence
+			actualOccurrences []*pb.Occurrence
+			actualErrs        []error
+		)
+
+		BeforeEach(func() {
+			occurrences = generateTestOccurrences(3)
+			for _, occurrence := range occurrences {
+				occurrence.NoteName = note.Name
+				occurrence.Kind = note.Kind
+			}
+			occurrences[1].NoteName = fmt.Sprintf("projects/%s/notes/%s", projectId, fake.LetterN(10))
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsMultiGetResponse(note, nil),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualOccurrences, actualErrs = elasticsearchStorage.BatchCreateOccurrences(ctx, projectId, "", occurrences)
+		})
+
+		It("should fetch each referenced note once", func() {
+			request := &esMultiGetRequest{}
+			Expect(json.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body), request)).To(Succeed())
+			Expect(request.Docs).To(HaveLen(2))
+		})
+
+		It("should only create the occurrences that reference an existing note", func() {
+			Expect(actualOccurrences).To(Equal([]*pb.Occurrence{occurrences[0], occurrences[2]}))
+			Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "name")).To(Equal([]string{occurrences[0].Name, occurrences[2].Name}))
+		})
+
+		It("should return an error for the occurrence that references a missing note", func() {
+			Expect(actualErrs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(actualErrs[0], codes.FailedPrecondition)
+			assertErrorHasBatchItemDetails(actualErrs[0], occurrenceResourceType, 1)
+		})
+
+		When("none of the occurrences reference an existing note", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].Body = createEsMultiGetResponse(nil, nil)
+			})
+
+			It("should not send a bulk request", func() {
+				Expect(actualOccurrences).To(BeNil())
+				Expect(actualErrs).To(HaveLen(len(occurrences)))
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+})
+
+// createEsMultiGetResponse creates a multi-get response with a document for each note, where nil is a missing note
+func createEsMultiGetResponse(notes ...*pb.Note) io.ReadCloser {
+	response := &esMultiGetResponse{}
+	for _, note := range notes {
+		if note == nil {
+			response.Docs = append(response.Docs, &esGetResponse{Id: fake.LetterN(10)})
+			continue
+		}
+
+		raw, err := protojson.Marshal(proto.MessageV2(note))
+		Expect(err).ToNot(HaveOccurred())
+
+		response.Docs = append(response.Docs, &esGetResponse{
+			Id:     documentId(note.Name),
+			Found:  true,
+			Source: raw,
+		})
+	}
+
+	return structToJsonBody(response)
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retentionMetrics are published through expvar. The runs and failures counters track each purge, while the
+// <KIND>.deleted and <KIND>.expired counters track the expired occurrences that were deleted or found during a dry run.
+var retentionMetrics = expvar.NewMap("grafeas_occurrence_retention")
+
+// startRetention periodically deletes expired occurrences until the context is cancelled
+func (es *ElasticsearchStorage) startRetention(ctx context.Context, log *zap.Logger) {
+	interval := es.config.Retention.Interval()
+	log = log.Named("Retention")
+	log.Info("starting occurrence retention", zap.Duration("interval", interval), zap.Bool("dryRun", es.config.Retention.DryRun))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			// errors are logged when they're created, and the next attempt may succeed
+			_ = es.purgeExpiredOccurrences(ctx, log)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpiredOccurrences deletes the occurrences of each kind with a retention period that were created before the
+// start of that period. During a dry run, the expired occurrences are only counted.
+func (es *ElasticsearchStorage) purgeExpiredOccurrences(ctx context.Context, log *zap.Logger) error {
+	retentionMetrics.Add("runs", 1)
+
+	var kinds []string
+	periods := map[string]string{}
+	for kind, period := range es.config.Retention.Occurrences {
+		kind = strings.ToUpper(kind)
+		kinds = append(kinds, kind)
+		periods[kind] = period
+	}
+	sort.Strings(kinds)
+
+	var result error
+	for _, kind := range kinds {
+		if err := es.purgeExpiredOccurrencesOfKind(ctx, log.With(zap.String("kind", kind), zap.String("period", periods[kind])), kind, periods[kind]); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if result != nil {
+		retentionMetrics.Add("failures", 1)
+	}
+
+	return result
+}
+
+func (es *ElasticsearchStorage) purgeExpiredOccurrencesOfKind(ctx context.Context, log *zap.Logger, kind, period string) error {
+	body := map[string]interface{}{
+		"query": expiredOccurrencesQuery(kind, period),
+	}
+	encodedBody, requestJson := encodeRequest(body)
+	log.Debug("purging expired occurrences", zap.String("request", requestJson))
+
+	if es.config.Retention.DryRun {
+		res, err := es.client.Count(
+			es.client.Count.WithContext(ctx),
+			es.client.Count.WithIndex(occurrencesIndexPattern()),
+			es.client.Count.WithBody(encodedBody),
+		)
+		if err != nil {
+			return createError(log, "error sending request to elasticsearch", err)
+		}
+		if res.IsError() {
+			return createResponseError(log, "error counting expired occurrences", res)
+		}
+
+		count := &esCountResponse{}
+		if err := decodeResponse(res.Body, count); err != nil {
+			return createError(log, "error decoding elasticsearch response", err)
+		}
+
+		retentionMetrics.Add(kind+".expired", int64(count.Count))
+		log.Info("dry run, expired occurrences were not deleted", zap.Int("expired", count.Count))
+
+		return nil
+	}
+
+	res, err := es.client.DeleteByQuery(
+		[]string{occurrencesIndexPattern()},
+		encodedBody,
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
+		es.client.DeleteByQuery.WithRefresh(withRefreshBool(es.config.Refresh)),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error deleting expired occurrences", res)
+	}
+
+	var deletedResults esDeleteResponse
+	if err := decodeResponse(res.Body, &deletedResults); err != nil {
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	retentionMetrics.Add(kind+".deleted", int64(deletedResults.Deleted))
+	log.Info("expired occurrences deleted", zap.Int("deleted", deletedResults.Deleted))
+
+	return nil
+}
+
+// expiredOccurrencesQuery matches occurrences of the given kind with a createTime before the retention period
+func expiredOccurrencesQuery(kind, period string) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{
+					"term": map[string]interface{}{
+						"kind": kind,
+					},
+				},
+				map[string]interface{}{
+					"range": map[string]interface{}{
+						"createTime": map[string]interface{}{
+							"lt": fmt.Sprintf("now-%s", period),
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"net/http"
+)
+
+var _ = Describe("occurrence retention", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		actualErr            error
+		expectedDeleted      int
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			Retention: config.RetentionConfig{
+				Occurrences: map[string]string{
+					"vulnerability": "365d",
+					"discovery":     "30d",
+				},
+			},
+		}
+		expectedDeleted = fake.Number(1, 1000)
+
+		transport.preparedHttpResponses = []*http.Response{
+			{
+				StatusCode: http.StatusOK,
+				Body:       structToJsonBody(&esDeleteResponse{Deleted: expectedDeleted}),
+			},
+			{
+				StatusCode: http.StatusOK,
+				Body:       structToJsonBody(&esDeleteResponse{Deleted: expectedDeleted}),
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+		actualErr = elasticsearchStorage.purgeExpiredOccurrences(ctx, logger)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	It("should delete expired occurrences of each kind with a retention period", func() {
+		Expect(actualErr).ToNot(HaveOccurred())
+		Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+		for i, expected := range []struct{ kind, period string }{{"DISCOVERY", "30d"}, {"VULNERABILITY", "365d"}} {
+			Expect(transport.receivedHttpRequests[i].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[i].URL.Path).To(Equal(fmt.Sprintf("/%s-*occurrences/_delete_by_query", indexPrefix)))
+			Expect(transport.receivedHttpRequests[i].URL.Query().Get("conflicts")).To(Equal("proceed"))
+
+			body := parseJsonBody(transport.receivedHttpRequests[i].Body)
+			Expect(body.Path("query.bool.filter.0.term.kind").Data()).To(Equal(expected.kind))
+			Expect(body.Path("query.bool.filter.1.range.createTime.lt").Data()).To(Equal("now-" + expected.period))
+		}
+	})
+
+	It("should record the number of deleted occurrences", func() {
+		Expect(retentionMetrics.Get("DISCOVERY.deleted").(*expvar.Int).Value()).To(BeNumerically(">=", expectedDeleted))
+	})
+
+	When("deleting the occurrences of a kind fails", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+		})
+
+		It("should still delete the occurrences of the remaining kinds", func() {
+			Expect(actualErr).To(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+		})
+	})
+
+	When("running in dry run mode", func() {
+		BeforeEach(func() {
+			esConfig.Retention.DryRun = true
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esCountResponse{Count: expectedDeleted}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esCountResponse{Count: expectedDeleted}),
+				},
+			}
+		})
+
+		It("should only count the expired occurrences", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s-*occurrences/_count", indexPrefix)))
+
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("query.bool.filter.0.term.kind").Data()).To(Equal("DISCOVERY"))
+		})
+
+		It("should record the number of expired occurrences", func() {
+			Expect(retentionMetrics.Get("DISCOVERY.expired").(*expvar.Int).Value()).To(BeNumerically(">=", expectedDeleted))
+		})
+
+		When("counting the occurrences fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusBadRequest
+			})
+
+			It("should return an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+			})
+		})
+	})
+})
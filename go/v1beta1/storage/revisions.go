@@ -0,0 +1,395 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage/filtering"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// Operation is the kind of write made to a resource, which is recorded by revisions and audit events
+type Operation string
+
+const (
+	OperationCreate  Operation = "CREATE"
+	OperationUpdate  Operation = "UPDATE"
+	OperationDelete  Operation = "DELETE"
+	OperationRestore Operation = "RESTORE"
+)
+
+// revisionMetrics are published through expvar. The recorded and failures counters track the revisions that were
+// written, and the ones that couldn't be.
+var revisionMetrics = expvar.NewMap("grafeas_revisions")
+
+// Revision describes a single write to a note or occurrence
+type Revision struct {
+	// Id identifies the revision, and can be used to fetch it
+	Id        string
+	Operation Operation
+	Time      time.Time
+	// Etag is the version of the resource that was written, and is empty for deletes
+	Etag string
+}
+
+// NoteRevision holds the state of a note after it was written. The note is nil when the revision is a delete.
+type NoteRevision struct {
+	Revision
+	Note *pb.Note
+}
+
+// OccurrenceRevision holds the state of an occurrence after it was written. The occurrence is nil when the revision is a delete.
+type OccurrenceRevision struct {
+	Revision
+	Occurrence *pb.Occurrence
+}
+
+// esRevision is the document stored in the revisions index
+type esRevision struct {
+	Name         string          `json:"name"`
+	Operation    Operation       `json:"operation"`
+	RevisionTime string          `json:"revisionTime"`
+	Etag         string          `json:"etag,omitempty"`
+	Resource     json.RawMessage `json:"resource,omitempty"`
+}
+
+// revisionMappingProperties maps the fields of a revision. The resource isn't indexed, since notes and occurrences are
+// only ever read back from a revision, and the mappings of their fields may change over time.
+func revisionMappingProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         map[string]interface{}{"type": "keyword"},
+		"operation":    map[string]interface{}{"type": "keyword"},
+		"revisionTime": map[string]interface{}{"type": "date_nanos"},
+		"etag":         map[string]interface{}{"type": "keyword"},
+		"resource":     map[string]interface{}{"type": "object", "enabled": false},
+	}
+}
+
+// ListNoteRevisions returns the revisions of a note, starting with the most recent
+func (es *ElasticsearchStorage) ListNoteRevisions(ctx context.Context, projectId, noteId string) ([]*NoteRevision, error) {
+	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+	log := es.logger.Named("ListNoteRevisions").With(zap.String("note", noteName))
+
+	hits, err := es.listRevisions(ctx, log, noteName)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*NoteRevision
+	for _, hit := range hits {
+		revision := &NoteRevision{}
+		note := &pb.Note{}
+		hasNote, err := unmarshalRevision(log, hit.ID, hit.Source, &revision.Revision, note)
+		if err != nil {
+			return nil, err
+		}
+		if hasNote {
+			revision.Note = note
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// GetNoteRevision returns a single revision of a note
+func (es *ElasticsearchStorage) GetNoteRevision(ctx context.Context, projectId, noteId, revisionId string) (*NoteRevision, error) {
+	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+	log := es.logger.Named("GetNoteRevision").With(zap.String("note", noteName), zap.String("revision", revisionId))
+
+	source, err := es.getRevision(ctx, log, noteName, revisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &NoteRevision{}
+	note := &pb.Note{}
+	hasNote, err := unmarshalRevision(log, revisionId, source, &revision.Revision, note)
+	if err != nil {
+		return nil, err
+	}
+	if hasNote {
+		revision.Note = note
+	}
+
+	return revision, nil
+}
+
+// ListOccurrenceRevisions returns the revisions of an occurrence, starting with the most recent
+func (es *ElasticsearchStorage) ListOccurrenceRevisions(ctx context.Context, projectId, occurrenceId string) ([]*OccurrenceRevision, error) {
+	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+	log := es.logger.Named("ListOccurrenceRevisions").With(zap.String("occurrence", occurrenceName))
+
+	hits, err := es.listRevisions(ctx, log, occurrenceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*OccurrenceRevision
+	for _, hit := range hits {
+		revision := &OccurrenceRevision{}
+		occurrence := &pb.Occurrence{}
+		hasOccurrence, err := unmarshalRevision(log, hit.ID, hit.Source, &revision.Revision, occurrence)
+		if err != nil {
+			return nil, err
+		}
+		if hasOccurrence {
+			revision.Occurrence = occurrence
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// GetOccurrenceRevision returns a single revision of an occurrence
+func (es *ElasticsearchStorage) GetOccurrenceRevision(ctx context.Context, projectId, occurrenceId, revisionId string) (*OccurrenceRevision, error) {
+	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+	log := es.logger.Named("GetOccurrenceRevision").With(zap.String("occurrence", occurrenceName), zap.String("revision", revisionId))
+
+	source, err := es.getRevision(ctx, log, occurrenceName, revisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &OccurrenceRevision{}
+	occurrence := &pb.Occurrence{}
+	hasOccurrence, err := unmarshalRevision(log, revisionId, source, &revision.Revision, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	if hasOccurrence {
+		revision.Occurrence = occurrence
+	}
+
+	return revision, nil
+}
+
+// newRevision creates the revision for a write to a resource. The resource is omitted for deletes, and the version is
+// only known for writes that produce a new version of the document.
+func newRevision(name string, operation Operation, protoMessage interface{}, version *documentVersion) (*esRevision, error) {
+	revision := &esRevision{
+		Name:         name,
+		Operation:    operation,
+		RevisionTime: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if version != nil {
+		revision.Etag = version.etag()
+	}
+	if protoMessage != nil {
+		resource, err := protojson.Marshal(proto.MessageV2(protoMessage))
+		if err != nil {
+			return nil, err
+		}
+		revision.Resource = resource
+	}
+
+	return revision, nil
+}
+
+// recordRevision appends a revision for a single write when revision history is enabled
+func (es *ElasticsearchStorage) recordRevision(ctx context.Context, log *zap.Logger, name string, operation Operation, protoMessage interface{}, version *documentVersion) {
+	if !es.config.RevisionHistory {
+		return
+	}
+
+	revision, err := newRevision(name, operation, protoMessage, version)
+	if err != nil {
+		revisionMetrics.Add("failures", 1)
+		log.Error("error creating revision", zap.Error(err))
+		return
+	}
+
+	es.recordRevisions(ctx, log, []*esRevision{revision})
+}
+
+// appendRevision adds the revision for a document that was written by a bulk request
+func appendRevision(log *zap.Logger, revisions []*esRevision, name string, operation Operation, protoMessage interface{}, item *esIndexDocResponse) []*esRevision {
+	revision, err := newRevision(name, operation, protoMessage, &documentVersion{
+		index:       item.Index,
+		seqNo:       item.SeqNo,
+		primaryTerm: item.PrimaryTerm,
+	})
+	if err != nil {
+		revisionMetrics.Add("failures", 1)
+		log.Error("error creating revision", zap.String("name", name), zap.Error(err))
+		return revisions
+	}
+
+	return append(revisions, revision)
+}
+
+// recordRevisions writes revisions to the revisions index, each with a new ID so that existing revisions are never
+// changed. The write to the resource has already succeeded at this point, so a revision that can't be written is logged
+// instead of failing the request.
+func (es *ElasticsearchStorage) recordRevisions(ctx context.Context, log *zap.Logger, revisions []*esRevision) {
+	if !es.config.RevisionHistory || len(revisions) == 0 {
+		return
+	}
+
+	var items []*bulkItem
+	for _, revision := range revisions {
+		data, err := json.Marshal(revision)
+		if err != nil {
+			revisionMetrics.Add("failures", 1)
+			log.Error("error marshalling revision", zap.String("name", revision.Name), zap.Error(err))
+			continue
+		}
+
+		items = append(items, &bulkItem{
+			metadata: &esBulkQueryFragment{
+				Create: &esBulkQueryIndexFragment{
+					Index: writeAlias(revisionsIndex()),
+					Id:    uuid.New().String(),
+				},
+			},
+			document: data,
+		})
+	}
+
+	responses, requestErrs := es.bulkWrite(ctx, log, items)
+	for i, item := range responses {
+		if item == nil {
+			revisionMetrics.Add("failures", 1)
+			log.Error("error recording revision", zap.Error(requestErrs[i]))
+		} else if item.Error != nil {
+			revisionMetrics.Add("failures", 1)
+			log.Error("error recording revision", zap.String("type", item.Error.Type), zap.String("reason", item.Error.Reason))
+		} else {
+			revisionMetrics.Add("recorded", 1)
+		}
+	}
+}
+
+// listRevisions searches for the revisions of a resource, starting with the most recent
+func (es *ElasticsearchStorage) listRevisions(ctx context.Context, log *zap.Logger, name string) ([]*esSearchResponseHit, error) {
+	if !es.config.RevisionHistory {
+		return nil, status.Error(codes.FailedPrecondition, "revision history is not enabled")
+	}
+
+	encodedBody, requestJson := encodeRequest(&esSearch{
+		Query: &filtering.Query{
+			Term: &filtering.Term{
+				"name": name,
+			},
+		},
+		Sort: map[string]esSortOrder{
+			"revisionTime": esSortOrderDecending,
+		},
+	})
+	log = log.With(zap.String("request", requestJson))
+	log.Debug("listing revisions")
+
+	res, err := es.client.Search(
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithIndex(revisionsIndex()),
+		es.client.Search.WithBody(encodedBody),
+		es.client.Search.WithSize(grafeasMaxPageSize),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error listing revisions", res)
+	}
+
+	var searchResults esSearchResponse
+	if err := decodeResponse(res.Body, &searchResults); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return searchResults.Hits.Hits, nil
+}
+
+// getRevision fetches a revision by its ID, as long as it belongs to the named resource
+func (es *ElasticsearchStorage) getRevision(ctx context.Context, log *zap.Logger, name, revisionId string) (json.RawMessage, error) {
+	if !es.config.RevisionHistory {
+		return nil, status.Error(codes.FailedPrecondition, "revision history is not enabled")
+	}
+
+	res, err := es.client.Get(
+		revisionsIndex(),
+		revisionId,
+		es.client.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("revision not found")
+		return nil, status.Errorf(codes.NotFound, "revision %s of %s not found", revisionId, name)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error retrieving revision", res)
+	}
+
+	var document esGetResponse
+	if err := decodeResponse(res.Body, &document); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	revision := &esRevision{}
+	if err := json.Unmarshal(document.Source, revision); err != nil {
+		return nil, createError(log, "error unmarshalling revision", err)
+	}
+	if revision.Name != name {
+		log.Debug("revision belongs to a different resource", zap.String("revisionName", revision.Name))
+		return nil, status.Errorf(codes.NotFound, "revision %s of %s not found", revisionId, name)
+	}
+
+	return document.Source, nil
+}
+
+// unmarshalRevision reads a stored revision into the given revision and resource, and returns whether the revision
+// included the resource
+func unmarshalRevision(log *zap.Logger, id string, source json.RawMessage, revision *Revision, protoMessage interface{}) (bool, error) {
+	document := &esRevision{}
+	if err := json.Unmarshal(source, document); err != nil {
+		return false, createError(log, "error unmarshalling revision", err)
+	}
+
+	revisionTime, err := time.Parse(time.RFC3339Nano, document.RevisionTime)
+	if err != nil {
+		return false, createError(log, "error parsing revision time", err)
+	}
+
+	revision.Id = id
+	revision.Operation = document.Operation
+	revision.Time = revisionTime
+	revision.Etag = document.Etag
+
+	if len(document.Resource) == 0 {
+		return false, nil
+	}
+	if err := protojsonUnmarshaler.Unmarshal(document.Resource, proto.MessageV2(protoMessage)); err != nil {
+		return false, createError(log, "error unmarshalling revision resource", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,412 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("revision history", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+		noteId               string
+		noteName             string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:             fake.URL(),
+			Refresh:         config.RefreshTrue,
+			RevisionHistory: true,
+		}
+		projectId = fake.LetterN(10)
+		noteId = fake.LetterN(10)
+		noteName = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("creating a note", func() {
+		var (
+			version   *documentVersion
+			actualErr error
+		)
+
+		BeforeEach(func() {
+			version = &documentVersion{
+				index:       fake.LetterN(10),
+				seqNo:       fake.Number(1, 100),
+				primaryTerm: fake.Number(1, 10),
+			}
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusCreated,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: version.index, SeqNo: version.seqNo, PrimaryTerm: version.primaryTerm}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.CreateNote(ctx, projectId, noteId, "", &pb.Note{ShortDescription: fake.Word()})
+		})
+
+		It("should record the created note as a new revision", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal("/_bulk"))
+
+			metadata, revision := bulkRequestRevision(transport.receivedHttpRequests[2])
+			Expect(metadata.Path("create._index").Data()).To(Equal(writeAlias(revisionsIndex())))
+			Expect(metadata.Path("create._id").Data()).ToNot(BeEmpty())
+			Expect(revision.Path("name").Data()).To(Equal(noteName))
+			Expect(revision.Path("operation").Data()).To(BeEquivalentTo(OperationCreate))
+			Expect(revision.Path("etag").Data()).To(Equal(version.etag()))
+			Expect(revision.Path("resource.name").Data()).To(Equal(noteName))
+		})
+
+		When("the revision can't be recorded", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = createEsBulkNoteCreateResponse([]int{http.StatusInternalServerError})
+			})
+
+			It("should still create the note", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+			})
+		})
+
+		When("revision history is disabled", func() {
+			BeforeEach(func() {
+				esConfig.RevisionHistory = false
+			})
+
+			It("should not record a revision", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+
+	Context("deleting a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.DeleteNote(ctx, projectId, noteId)
+		})
+
+		It("should record the delete without the note", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			_, revision := bulkRequestRevision(transport.receivedHttpRequests[1])
+			Expect(revision.Path("operation").Data()).To(BeEquivalentTo(OperationDelete))
+			Expect(revision.Exists("resource")).To(BeFalse())
+			Expect(revision.Exists("etag")).To(BeFalse())
+		})
+
+		When("the delete fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusNotFound
+			})
+
+			It("should not record a revision", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("batch creating notes", func() {
+		var actualErrs []error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusConflict}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErrs = elasticsearchStorage.BatchCreateNotes(ctx, projectId, "", map[string]*pb.Note{
+				"a": {},
+				"b": {},
+			})
+		})
+
+		It("should only record revisions for the notes that were created", func() {
+			Expect(actualErrs).To(HaveLen(1))
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "name")).To(Equal([]string{
+				fmt.Sprintf("projects/%s/notes/a", projectId),
+			}))
+		})
+
+		When("the response for a note isn't the result of a create", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].Body = createEsBulkUnexpectedItemResponse(http.StatusCreated)
+			})
+
+			It("should return an error for the note without recording a revision for it", func() {
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+				Expect(bulkRequestDocuments(transport.receivedHttpRequests[2], "name")).To(Equal([]string{
+					fmt.Sprintf("projects/%s/notes/a", projectId),
+				}))
+			})
+		})
+	})
+
+	Context("listing the revisions of a note", func() {
+		var (
+			revisions       []*esRevision
+			actualRevisions []*NoteRevision
+			actualErr       error
+		)
+
+		BeforeEach(func() {
+			created, err := newRevision(noteName, OperationCreate, &pb.Note{Name: noteName}, &documentVersion{seqNo: 1, primaryTerm: 1})
+			Expect(err).ToNot(HaveOccurred())
+			deleted, err := newRevision(noteName, OperationDelete, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			revisions = []*esRevision{deleted, created}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsRevisionSearchResponse(revisions...),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualRevisions, actualErr = elasticsearchStorage.ListNoteRevisions(ctx, projectId, noteId)
+		})
+
+		It("should search for the revisions of the note, starting with the most recent", func() {
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", revisionsIndex())))
+
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("query.term.name").Data()).To(Equal(noteName))
+			Expect(body.Path("sort.revisionTime").Data()).To(Equal("desc"))
+		})
+
+		It("should return the revisions", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualRevisions).To(HaveLen(2))
+
+			Expect(actualRevisions[0].Id).To(Equal("revision-0"))
+			Expect(actualRevisions[0].Operation).To(Equal(OperationDelete))
+			Expect(actualRevisions[0].Note).To(BeNil())
+
+			Expect(actualRevisions[1].Operation).To(Equal(OperationCreate))
+			Expect(actualRevisions[1].Etag).To(Equal(revisions[1].Etag))
+			Expect(actualRevisions[1].Time).To(BeTemporally("~", time.Now(), time.Minute))
+			Expect(actualRevisions[1].Note.Name).To(Equal(noteName))
+		})
+
+		When("revision history is disabled", func() {
+			BeforeEach(func() {
+				esConfig.RevisionHistory = false
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(BeEmpty())
+			})
+		})
+
+		When("the search fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			})
+		})
+	})
+
+	Context("getting a revision of a note", func() {
+		var (
+			revisionId     string
+			revision       *esRevision
+			actualRevision *NoteRevision
+			actualErr      error
+		)
+
+		BeforeEach(func() {
+			revisionId = fake.UUID()
+
+			var err error
+			revision, err = newRevision(noteName, OperationUpdate, &pb.Note{Name: noteName, ShortDescription: fake.Word()}, &documentVersion{seqNo: 2, primaryTerm: 1})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			source, err := json.Marshal(revision)
+			Expect(err).ToNot(HaveOccurred())
+			transport.preparedHttpResponses = append([]*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esGetResponse{Id: revisionId, Found: true, Source: source}),
+				},
+			}, transport.preparedHttpResponses...)
+
+			actualRevision, actualErr = elasticsearchStorage.GetNoteRevision(ctx, projectId, noteId, revisionId)
+		})
+
+		It("should fetch the revision by its id", func() {
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", revisionsIndex(), revisionId)))
+		})
+
+		It("should return the revision", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualRevision.Id).To(Equal(revisionId))
+			Expect(actualRevision.Operation).To(Equal(OperationUpdate))
+
+			expectedNote := &pb.Note{}
+			Expect(protojson.Unmarshal(revision.Resource, proto.MessageV2(expectedNote))).To(Succeed())
+			Expect(actualRevision.Note).To(Equal(expectedNote))
+		})
+
+		When("the revision belongs to a different resource", func() {
+			BeforeEach(func() {
+				revision.Name = fmt.Sprintf("projects/%s/notes/%s", projectId, fake.LetterN(10))
+			})
+
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				Expect(actualRevision).To(BeNil())
+			})
+		})
+	})
+
+	Context("getting a revision that doesn't exist", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusNotFound,
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.GetOccurrenceRevision(ctx, projectId, fake.LetterN(10), fake.UUID())
+		})
+
+		It("should return a not found error", func() {
+			assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+		})
+	})
+})
+
+// bulkRequestRevision returns the metadata and document of the first revision in a bulk request
+func bulkRequestRevision(request *http.Request) (*gabs.Container, *gabs.Container) {
+	lines := strings.Split(string(ioReadCloserToByteSlice(request.Body)), "\n")
+	Expect(len(lines)).To(BeNumerically(">=", 2))
+
+	metadata, err := gabs.ParseJSON([]byte(lines[0]))
+	Expect(err).ToNot(HaveOccurred())
+	revision, err := gabs.ParseJSON([]byte(lines[1]))
+	Expect(err).ToNot(HaveOccurred())
+
+	return metadata, revision
+}
+
+func createEsRevisionSearchResponse(revisions ...*esRevision) io.ReadCloser {
+	var hits []*esSearchResponseHit
+	for i, revision := range revisions {
+		source, err := json.Marshal(revision)
+		Expect(err).ToNot(HaveOccurred())
+
+		hits = append(hits, &esSearchResponseHit{
+			ID:     fmt.Sprintf("revision-%d", i),
+			Source: source,
+		})
+	}
+
+	return structToJsonBody(&esSearchResponse{
+		Hits: &esSearchResponseHits{
+			Total: &esSearchResponseTotal{Value: len(hits)},
+			Hits:  hits,
+		},
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rolloverIndexPattern splits the name of a backing index into the name it was created with and its rollover counter.
+// The first index for an alias doesn't have a counter.
+var rolloverIndexPattern = regexp.MustCompile(`^(.+-v\d+)(?:-(\d+))?$`)
+
+// startRollover periodically rolls over the occurrences indices until the context is cancelled
+func (es *ElasticsearchStorage) startRollover(ctx context.Context, log *zap.Logger) {
+	interval := es.config.Rollover.Interval()
+	log = log.Named("Rollover")
+	log.Info("starting occurrences index rollover", zap.Duration("interval", interval))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// errors are logged when they're created, and the next attempt may succeed
+				_ = es.rolloverOccurrences(ctx, log)
+			}
+		}
+	}()
+}
+
+// rolloverOccurrences rolls over the write index of every occurrences index that meets any of the configured conditions.
+// New occurrences are written to the new index, while the read alias covers both the new index and the previous ones.
+func (es *ElasticsearchStorage) rolloverOccurrences(ctx context.Context, log *zap.Logger) error {
+	res, err := es.client.Indices.GetAlias(
+		es.client.Indices.GetAlias.WithContext(ctx),
+		es.client.Indices.GetAlias.WithName(writeAlias(occurrencesIndexPattern())),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if res.IsError() {
+		return createResponseError(log, "error retrieving occurrences write aliases", res)
+	}
+
+	indices := esIndicesResponse{}
+	if err := decodeResponse(res.Body, &indices); err != nil {
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	writeIndices := map[string]string{}
+	var aliases []string
+	for index, i := range indices {
+		for alias, options := range i.Aliases {
+			if options != nil && options.IsWriteIndex {
+				writeIndices[alias] = index
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	sort.Strings(aliases)
+
+	var result error
+	for _, alias := range aliases {
+		if err := es.rolloverIndex(ctx, log, strings.TrimSuffix(alias, writeAlias("")), writeIndices[alias]); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result
+}
+
+// rolloverIndex creates the next backing index for an alias when the current write index meets any of the conditions
+func (es *ElasticsearchStorage) rolloverIndex(ctx context.Context, log *zap.Logger, alias, currentIndex string) error {
+	newIndex := nextRolloverIndex(currentIndex)
+	log = log.With(zap.String("alias", alias), zap.String("index", currentIndex), zap.String("newIndex", newIndex))
+
+	body := &esRolloverRequest{
+		Conditions: &esRolloverConditions{
+			MaxAge:  es.config.Rollover.MaxAge,
+			MaxSize: es.config.Rollover.MaxSize,
+			MaxDocs: es.config.Rollover.MaxDocs,
+		},
+		// the rollover only moves the write alias, so the read alias is added to the new index
+		Aliases: map[string]*esIndexAlias{
+			alias: {},
+		},
+	}
+	encodedBody, requestJson := encodeRequest(body)
+	log.Debug("rolling over index", zap.String("request", requestJson))
+
+	res, err := es.client.Indices.Rollover(
+		writeAlias(alias),
+		es.client.Indices.Rollover.WithContext(ctx),
+		es.client.Indices.Rollover.WithNewIndex(newIndex),
+		es.client.Indices.Rollover.WithBody(encodedBody),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error rolling over index", res)
+	}
+
+	rollover := &esRolloverResponse{}
+	if err := decodeResponse(res.Body, rollover); err != nil {
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	if rollover.RolledOver {
+		log.Info("index rolled over")
+	} else {
+		log.Debug("rollover conditions not met")
+	}
+
+	return nil
+}
+
+// nextRolloverIndex returns the name of the index that replaces the given write index when it's rolled over
+func nextRolloverIndex(index string) string {
+	counter := 1
+	name := index
+
+	if match := rolloverIndexPattern.FindStringSubmatch(index); match != nil {
+		name = match[1]
+		if match[2] != "" {
+			counter, _ = strconv.Atoi(match[2])
+		}
+	}
+
+	return fmt.Sprintf("%s-%06d", name, counter+1)
+}
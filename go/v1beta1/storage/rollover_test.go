@@ -0,0 +1,184 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"net/http"
+)
+
+var _ = Describe("occurrences rollover", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			Rollover: config.RolloverConfig{
+				Enabled: true,
+				MaxAge:  "7d",
+				MaxDocs: fake.Number(1000, 100000),
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("rolling over the occurrences indices", func() {
+		var (
+			actualErr      error
+			firstAlias     string
+			firstIndex     string
+			secondAlias    string
+			secondIndex    string
+			aliasesStatus  int
+			rolloverStatus int
+		)
+
+		BeforeEach(func() {
+			firstAlias = fmt.Sprintf("%s-a%s-occurrences", indexPrefix, fake.LetterN(10))
+			firstIndex = fmt.Sprintf("%s-v%d", firstAlias, schemaVersion)
+			secondAlias = fmt.Sprintf("%s-b%s-occurrences", indexPrefix, fake.LetterN(10))
+			secondIndex = fmt.Sprintf("%s-v%d-000003", secondAlias, schemaVersion)
+			aliasesStatus = http.StatusOK
+			rolloverStatus = http.StatusOK
+		})
+
+		JustBeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: aliasesStatus,
+					Body: structToJsonBody(esIndicesResponse{
+						firstIndex: {
+							Aliases: map[string]*esIndexAlias{
+								writeAlias(firstAlias): {IsWriteIndex: true},
+							},
+						},
+						fmt.Sprintf("%s-v%d-000002", secondAlias, schemaVersion): {
+							Aliases: map[string]*esIndexAlias{
+								writeAlias(secondAlias): {},
+							},
+						},
+						secondIndex: {
+							Aliases: map[string]*esIndexAlias{
+								writeAlias(secondAlias): {IsWriteIndex: true},
+							},
+						},
+					}),
+				},
+				{
+					StatusCode: rolloverStatus,
+					Body:       structToJsonBody(&esRolloverResponse{RolledOver: true}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esRolloverResponse{RolledOver: false}),
+				},
+			}
+
+			actualErr = elasticsearchStorage.rolloverOccurrences(ctx, logger)
+		})
+
+		It("should find the occurrences write aliases", func() {
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/_alias/%s-*occurrences-write", indexPrefix)))
+		})
+
+		It("should roll over each write alias to the next index", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPost))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_rollover/%s-000002", writeAlias(firstAlias), firstIndex)))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s/_rollover/%s-v%d-000004", writeAlias(secondAlias), secondAlias, schemaVersion)))
+		})
+
+		It("should use the configured conditions and add the read alias to the new index", func() {
+			body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+
+			Expect(body.Path("conditions.max_age").Data()).To(Equal("7d"))
+			Expect(body.Path("conditions.max_docs").Data()).To(BeEquivalentTo(esConfig.Rollover.MaxDocs))
+			Expect(body.Exists("conditions", "max_size")).To(BeFalse())
+			Expect(body.Exists("aliases", firstAlias)).To(BeTrue())
+		})
+
+		When("rolling over an index fails", func() {
+			BeforeEach(func() {
+				rolloverStatus = http.StatusBadRequest
+			})
+
+			It("should still roll over the remaining indices", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			})
+		})
+
+		When("there are no occurrences write aliases", func() {
+			BeforeEach(func() {
+				aliasesStatus = http.StatusNotFound
+			})
+
+			It("should not roll over any indices", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("retrieving the write aliases fails", func() {
+			BeforeEach(func() {
+				aliasesStatus = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	DescribeTable("naming the next index", func(index, expected string) {
+		Expect(nextRolloverIndex(index)).To(Equal(expected))
+	},
+		Entry("first rollover", "grafeas-v1beta1-foo-occurrences-v4", "grafeas-v1beta1-foo-occurrences-v4-000002"),
+		Entry("later rollover", "grafeas-v1beta1-foo-occurrences-v4-000009", "grafeas-v1beta1-foo-occurrences-v4-000010"),
+		Entry("unversioned index", "grafeas-v1beta1-foo-occurrences", "grafeas-v1beta1-foo-occurrences-000002"),
+	)
+})
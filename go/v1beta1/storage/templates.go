@@ -0,0 +1,313 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+// indexTemplateVersion should be incremented whenever the mappings within the index templates, the aliases used to
+// access indices, or the IDs of documents change, so that the updated templates are installed and existing indices are
+// migrated when the storage provider starts.
+const indexTemplateVersion = 7
+const indexTemplatePriority = 100
+
+// reservedProjectIdFragments can't appear in the IDs of projects that have their own indices. Index templates are
+// matched by wildcard patterns, so the indices of a project with one of these in its ID would also match the patterns of
+// another template, like the occurrences of a project named "a-notes-v1" matching the notes template.
+var reservedProjectIdFragments = []string{"-occurrences-v", "-notes-v", "-projects-v", "-revisions-v", "-audit-v"}
+
+// indexTemplate describes a composable index template that is applied to every index matching its patterns
+type indexTemplate struct {
+	name       string
+	patterns   []string
+	priority   int
+	settings   config.IndexSettings
+	properties map[string]interface{}
+	dynamic    config.DynamicMappingOption
+}
+
+// indexTemplates returns the templates used for the projects, occurrences, notes, revisions, and audit indices.
+// The patterns cover the indices used by both the per-project and the shared layout, including the versioned indices
+// behind the aliases. Elasticsearch rejects templates with overlapping patterns and the same priority, which the
+// versioned patterns would otherwise cause, so each template has its own priority.
+func (es *ElasticsearchStorage) indexTemplates() []indexTemplate {
+	return []indexTemplate{
+		{
+			name: projectsIndex(),
+			patterns: []string{
+				projectsIndex(),
+				fmt.Sprintf("%s-v*", projectsIndex()),
+			},
+			priority:   indexTemplatePriority,
+			settings:   es.config.Indices.Projects,
+			properties: withProjectStateProperty(protoMappingProperties(&prpb.Project{})),
+			dynamic:    es.config.DynamicMapping,
+		},
+		{
+			name: fmt.Sprintf("%s-occurrences", indexPrefix),
+			patterns: []string{
+				fmt.Sprintf("%s-*-occurrences", indexPrefix),
+				fmt.Sprintf("%s-*-occurrences-v*", indexPrefix),
+				fmt.Sprintf("%s-occurrences", indexPrefix),
+				fmt.Sprintf("%s-occurrences-v*", indexPrefix),
+			},
+			priority:   indexTemplatePriority + 1,
+			settings:   es.config.Indices.Occurrences,
+			properties: withDeleteTimeProperty(withProjectProperty(protoMappingProperties(&pb.Occurrence{}))),
+			dynamic:    es.config.DynamicMapping,
+		},
+		{
+			name: fmt.Sprintf("%s-notes", indexPrefix),
+			patterns: []string{
+				fmt.Sprintf("%s-*-notes", indexPrefix),
+				fmt.Sprintf("%s-*-notes-v*", indexPrefix),
+				fmt.Sprintf("%s-notes", indexPrefix),
+				fmt.Sprintf("%s-notes-v*", indexPrefix),
+			},
+			priority:   indexTemplatePriority + 2,
+			settings:   es.config.Indices.Notes,
+			properties: withDeleteTimeProperty(withProjectProperty(protoMappingProperties(&pb.Note{}))),
+			dynamic:    es.config.DynamicMapping,
+		},
+		{
+			name: revisionsIndex(),
+			patterns: []string{
+				revisionsIndex(),
+				fmt.Sprintf("%s-v*", revisionsIndex()),
+			},
+			priority:   indexTemplatePriority + 3,
+			settings:   es.config.Indices.Revisions,
+			properties: revisionMappingProperties(),
+			dynamic:    es.config.DynamicMapping,
+		},
+		{
+			name: auditIndex(),
+			patterns: []string{
+				auditIndex(),
+				fmt.Sprintf("%s-v*", auditIndex()),
+			},
+			priority:   indexTemplatePriority + 4,
+			settings:   es.config.Indices.Audit,
+			properties: auditMappingProperties(),
+			dynamic:    es.config.DynamicMapping,
+		},
+	}
+}
+
+// installIndexTemplates ensures that the current version of each index template is installed.
+// Templates are only updated when the installed version is older, or when the configured index settings or dynamic mapping have changed.
+// A template with a newer version than this build is left alone, as it was most likely installed by a newer deployment.
+func (es *ElasticsearchStorage) installIndexTemplates(ctx context.Context, log *zap.Logger) error {
+	for _, template := range es.indexTemplates() {
+		if err := es.installIndexTemplate(ctx, log, template); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (es *ElasticsearchStorage) installIndexTemplate(ctx context.Context, log *zap.Logger, template indexTemplate) error {
+	log = log.With(zap.String("template", template.name), zap.Int("version", indexTemplateVersion))
+	body := template.body()
+
+	res, err := es.client.Indices.GetIndexTemplate(
+		es.client.Indices.GetIndexTemplate.WithContext(ctx),
+		es.client.Indices.GetIndexTemplate.WithName(template.name),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return createResponseError(log, "error retrieving index template", res)
+	}
+
+	if res.StatusCode != http.StatusNotFound {
+		response := &esIndexTemplatesResponse{}
+		if err := decodeResponse(res.Body, response); err != nil {
+			return createError(log, "error decoding elasticsearch response", err)
+		}
+
+		for _, installed := range response.IndexTemplates {
+			if installed.Name != template.name {
+				continue
+			}
+
+			installedLog := log.With(zap.Int("installedVersion", installed.IndexTemplate.Version))
+			if installed.IndexTemplate.Version > indexTemplateVersion {
+				installedLog.Warn("a newer version of the index template is installed, skipping update")
+				return nil
+			}
+
+			if installed.IndexTemplate.Version == indexTemplateVersion &&
+				indexSettingsEqual(installed.IndexTemplate.Template.Settings, body.Template.Settings) &&
+				installed.IndexTemplate.Template.Mappings["dynamic"] == body.Template.Mappings["dynamic"] {
+				installedLog.Info("index template is up to date")
+				return nil
+			}
+		}
+	}
+
+	encodedBody, requestJson := encodeRequest(body)
+	log.Debug("installing index template", zap.String("request", requestJson))
+
+	res, err = es.client.Indices.PutIndexTemplate(
+		template.name,
+		encodedBody,
+		es.client.Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error installing index template", res)
+	}
+
+	log.Info("index template installed")
+
+	return nil
+}
+
+func (t indexTemplate) body() *esIndexTemplate {
+	return &esIndexTemplate{
+		IndexPatterns: t.patterns,
+		Priority:      t.priority,
+		Version:       indexTemplateVersion,
+		Template: &esIndexTemplateBody{
+			Settings: indexSettingsBody(t.settings),
+			Mappings: indexMappings(t.properties, t.dynamic),
+		},
+	}
+}
+
+// indexSettingsEqual compares the settings of an installed template with the configured settings,
+// treating a template without settings the same as one with an empty set of settings
+func indexSettingsEqual(installed, configured map[string]map[string]string) bool {
+	if len(installed) == 0 && len(configured) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(installed, configured)
+}
+
+// indexMappings adds metadata that can be used to help identify an index as a part of the Grafeas storage backend
+// along with the schema version of its mappings,
+// the explicit mappings for each field of the stored documents, and a dynamic template to map all strings to keywords.
+// The dynamic template only applies to fields that are mapped dynamically, such as the contents of map fields.
+func indexMappings(properties map[string]interface{}, dynamic config.DynamicMappingOption) map[string]interface{} {
+	if dynamic == "" {
+		dynamic = config.DynamicMappingFalse
+	}
+
+	return map[string]interface{}{
+		"_meta": map[string]interface{}{
+			"type":          "grafeas",
+			"schemaVersion": schemaVersion,
+		},
+		"dynamic":    dynamic.String(),
+		"properties": properties,
+		"dynamic_templates": []map[string]interface{}{
+			{
+				"strings_as_keywords": map[string]interface{}{
+					"match_mapping_type": "string",
+					"mapping": map[string]interface{}{
+						"type":  "keyword",
+						"norms": false,
+					},
+				},
+			},
+		},
+	}
+}
+
+// withProjectProperty adds a mapping for the project field, which is not a part of the Grafeas types
+// but is stored alongside notes and occurrences when using the shared layout
+func withProjectProperty(properties map[string]interface{}) map[string]interface{} {
+	properties[projectField] = map[string]interface{}{"type": "keyword"}
+
+	return properties
+}
+
+// withDeleteTimeProperty adds a mapping for the time a note or occurrence was deleted, which is not a part of the Grafeas
+// types but is stored alongside tombstones when soft deletes are enabled
+func withDeleteTimeProperty(properties map[string]interface{}) map[string]interface{} {
+	properties[deleteTimeField] = map[string]interface{}{"type": "date"}
+
+	return properties
+}
+
+// withProjectStateProperty adds a mapping for the state of a project, which is not a part of the Grafeas types
+// but is stored alongside projects that are being deleted
+func withProjectStateProperty(properties map[string]interface{}) map[string]interface{} {
+	properties[projectStateField] = map[string]interface{}{"type": "keyword"}
+
+	return properties
+}
+
+// indexSettingsBody converts the configured index settings into the format that Elasticsearch uses when returning
+// the settings of an index template, so that the installed settings can be compared to the configured ones.
+// Settings that were not configured are omitted so that the cluster defaults are used.
+func indexSettingsBody(settings config.IndexSettings) map[string]map[string]string {
+	index := map[string]string{}
+	if settings.NumberOfShards != 0 {
+		index["number_of_shards"] = strconv.Itoa(settings.NumberOfShards)
+	}
+	if settings.NumberOfReplicas != nil {
+		index["number_of_replicas"] = strconv.Itoa(*settings.NumberOfReplicas)
+	}
+	if settings.RefreshInterval != "" {
+		index["refresh_interval"] = settings.RefreshInterval
+	}
+	if settings.Codec != "" {
+		index["codec"] = settings.Codec
+	}
+
+	if len(index) == 0 {
+		return nil
+	}
+
+	return map[string]map[string]string{
+		"index": index,
+	}
+}
+
+// validateProjectId rejects project IDs that would make the names of the project's indices match the patterns of more
+// than one index template. Project IDs aren't a part of index names when using the shared layout.
+func (es *ElasticsearchStorage) validateProjectId(projectId string) error {
+	if es.sharedLayout() {
+		return nil
+	}
+
+	for _, fragment := range reservedProjectIdFragments {
+		if strings.Contains("-"+projectId, fragment) {
+			return status.Errorf(codes.InvalidArgument, "project ID %q can't contain %q", projectId, strings.TrimPrefix(fragment, "-"))
+		}
+	}
+
+	return nil
+}
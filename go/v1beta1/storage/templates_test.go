@@ -0,0 +1,389 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+var _ = Describe("index templates", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+	)
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("installing the index templates", func() {
+		var (
+			actualErr error
+		)
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.installIndexTemplates(context.Background(), logger)
+		})
+
+		It("should install a template for projects, occurrences, notes, revisions, and audit events", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(10))
+
+			for i, name := range []string{"projects", "occurrences", "notes", "revisions", "audit"} {
+				Expect(transport.receivedHttpRequests[i*2+1].Method).To(Equal(http.MethodPut))
+				Expect(transport.receivedHttpRequests[i*2+1].URL.Path).To(Equal(fmt.Sprintf("/_index_template/%s-%s", indexPrefix, name)))
+			}
+		})
+
+		It("should match the indices used by the per-project and shared layouts", func() {
+			occurrencesTemplate := parseJsonBody(transport.receivedHttpRequests[3].Body)
+			Expect(occurrencesTemplate.Path("index_patterns").Data()).To(ContainElements(
+				fmt.Sprintf("%s-*-occurrences", indexPrefix),
+				fmt.Sprintf("%s-occurrences", indexPrefix),
+			))
+
+			notesTemplate := parseJsonBody(transport.receivedHttpRequests[5].Body)
+			Expect(notesTemplate.Path("index_patterns").Data()).To(ContainElements(
+				fmt.Sprintf("%s-*-notes", indexPrefix),
+				fmt.Sprintf("%s-notes", indexPrefix),
+			))
+		})
+
+		It("should match the versioned indices created by migrations", func() {
+			for i, name := range []string{"projects", "occurrences", "notes", "revisions", "audit"} {
+				template := parseJsonBody(transport.receivedHttpRequests[i*2+1].Body)
+
+				Expect(template.Path("index_patterns").Data()).To(ContainElement(HaveSuffix(fmt.Sprintf("%s-v*", name))))
+			}
+		})
+
+		It("should use a different priority for each template", func() {
+			priorities := map[float64]bool{}
+			for i := 0; i < 5; i++ {
+				priorities[parseJsonBody(transport.receivedHttpRequests[i*2+1].Body).Path("priority").Data().(float64)] = true
+			}
+
+			Expect(priorities).To(HaveLen(5))
+		})
+
+		When("installing a template fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusBadRequest
+			})
+
+			It("should return an error without installing the remaining templates", func() {
+				Expect(actualErr).To(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+
+	Context("validating project IDs", func() {
+		// matchingTemplates returns the names of the templates with a pattern that matches the index
+		matchingTemplates := func(index string) []string {
+			var names []string
+			for _, template := range elasticsearchStorage.indexTemplates() {
+				for _, pattern := range template.patterns {
+					if matched, _ := path.Match(pattern, index); matched {
+						names = append(names, template.name)
+						break
+					}
+				}
+			}
+
+			return names
+		}
+
+		DescribeTable("project IDs", func(projectId string, valid bool) {
+			err := elasticsearchStorage.validateProjectId(projectId)
+
+			if !valid {
+				assertErrorHasGrpcStatusCode(err, codes.InvalidArgument)
+				return
+			}
+
+			Expect(err).ToNot(HaveOccurred())
+			for _, alias := range elasticsearchStorage.projectIndices(projectId) {
+				for _, index := range []string{alias, backingIndex(alias), nextRolloverIndex(backingIndex(alias))} {
+					Expect(matchingTemplates(index)).To(HaveLen(1), "expected %s to match a single template", index)
+				}
+			}
+		},
+			Entry("letters", fake.LetterN(10), true),
+			Entry("ending with a type of index", "a-notes", true),
+			Entry("containing a type of index", "footnotes-v1", true),
+			Entry("containing versioned notes", "a-notes-v1", false),
+			Entry("containing versioned occurrences", "a-occurrences-v1-b", false),
+			Entry("starting with versioned notes", "notes-v1", false),
+			Entry("starting with versioned projects", "projects-v1", false),
+			Entry("starting with versioned revisions", "revisions-v1", false),
+			Entry("starting with versioned audit events", "audit-v1", false),
+		)
+
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+			})
+
+			It("should allow any project ID", func() {
+				Expect(elasticsearchStorage.validateProjectId("a-notes-v1")).To(Succeed())
+			})
+		})
+	})
+
+	Context("installing a single index template", func() {
+		var (
+			actualErr error
+			template  indexTemplate
+		)
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK},
+			}
+		})
+
+		JustBeforeEach(func() {
+			template = elasticsearchStorage.indexTemplates()[1]
+
+			actualErr = elasticsearchStorage.installIndexTemplate(context.Background(), logger, template)
+		})
+
+		It("should check if the template is already installed", func() {
+			Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/_index_template/%s", template.name)))
+		})
+
+		When("the template is not installed", func() {
+			It("should install the template", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/_index_template/%s", template.name)))
+			})
+
+			It("should include the version, metadata, and string mapping", func() {
+				body := ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body)
+
+				assertJsonHasValues(bytesToReadCloser(body), map[string]interface{}{
+					"version":                               indexTemplateVersion,
+					"priority":                              template.priority,
+					"template.mappings._meta.schemaVersion": schemaVersion,
+				})
+				assertIndexTemplateBodyHasMetadataAndStringMapping(bytesToReadCloser(body))
+			})
+
+			It("should include the explicit mappings for occurrences", func() {
+				body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+
+				Expect(body.Path("template.mappings.dynamic").Data()).To(Equal(config.DynamicMappingFalse))
+				Expect(body.Path("template.mappings.properties.createTime.type").Data()).To(Equal("date"))
+				Expect(body.Path("template.mappings.properties.project.type").Data()).To(Equal("keyword"))
+			})
+
+			When("dynamic mapping is configured", func() {
+				BeforeEach(func() {
+					esConfig.DynamicMapping = config.DynamicMappingStrict
+				})
+
+				It("should use the configured value", func() {
+					Expect(parseJsonBody(transport.receivedHttpRequests[1].Body).Path("template.mappings.dynamic").Data()).To(Equal(config.DynamicMappingStrict))
+				})
+			})
+
+			It("should not include any settings", func() {
+				Expect(parseJsonBody(transport.receivedHttpRequests[1].Body).ExistsP("template.settings")).To(BeFalse())
+			})
+
+			When("index settings are configured", func() {
+				BeforeEach(func() {
+					replicas := 0
+					esConfig.Indices.Occurrences = config.IndexSettings{
+						NumberOfShards:   fake.Number(1, 5),
+						NumberOfReplicas: &replicas,
+						RefreshInterval:  "30s",
+						Codec:            config.CodecBestCompression,
+					}
+				})
+
+				It("should include the settings in the template", func() {
+					assertJsonHasValues(transport.receivedHttpRequests[1].Body, map[string]interface{}{
+						"template.settings.index.number_of_shards":   fmt.Sprint(esConfig.Indices.Occurrences.NumberOfShards),
+						"template.settings.index.number_of_replicas": "0",
+						"template.settings.index.refresh_interval":   "30s",
+						"template.settings.index.codec":              config.CodecBestCompression,
+					})
+				})
+			})
+
+			When("installing the template fails", func() {
+				BeforeEach(func() {
+					transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+				})
+
+				It("should return an error", func() {
+					assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				})
+			})
+		})
+
+		When("the current version of the template is installed", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0] = &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(fmt.Sprintf("%s-occurrences", indexPrefix), (&ElasticsearchStorage{config: esConfig}).indexTemplates()[1].body()),
+				}
+			})
+
+			It("should not update the template", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+
+			When("the configured index settings have changed", func() {
+				BeforeEach(func() {
+					esConfig.Indices.Occurrences.NumberOfShards = fake.Number(1, 5)
+				})
+
+				It("should update the template", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(transport.receivedHttpRequests).To(HaveLen(2))
+					Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+				})
+			})
+
+			When("the configured dynamic mapping has changed", func() {
+				BeforeEach(func() {
+					esConfig.DynamicMapping = config.DynamicMappingStrict
+				})
+
+				It("should update the template", func() {
+					Expect(actualErr).ToNot(HaveOccurred())
+					Expect(transport.receivedHttpRequests).To(HaveLen(2))
+					Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+				})
+			})
+		})
+
+		When("an older version of the template is installed", func() {
+			BeforeEach(func() {
+				installed := (&ElasticsearchStorage{config: esConfig}).indexTemplates()[1].body()
+				installed.Version = indexTemplateVersion - 1
+
+				transport.preparedHttpResponses[0] = &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(fmt.Sprintf("%s-occurrences", indexPrefix), installed),
+				}
+			})
+
+			It("should update the template", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+				Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodPut))
+			})
+		})
+
+		When("a newer version of the template is installed", func() {
+			BeforeEach(func() {
+				installed := (&ElasticsearchStorage{config: esConfig}).indexTemplates()[1].body()
+				installed.Version = indexTemplateVersion + 1
+
+				transport.preparedHttpResponses[0] = &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       createEsIndexTemplatesResponse(fmt.Sprintf("%s-occurrences", indexPrefix), installed),
+				}
+			})
+
+			It("should not update the template", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("checking for the template fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+})
+
+func createEsIndexTemplatesResponse(name string, template *esIndexTemplate) io.ReadCloser {
+	return structToJsonBody(&esIndexTemplatesResponse{
+		IndexTemplates: []*esIndexTemplatesResponseItem{
+			{
+				Name:          name,
+				IndexTemplate: template,
+			},
+		},
+	})
+}
+
+func bytesToReadCloser(b []byte) io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(b))
+}
@@ -0,0 +1,387 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/rode/grafeas-elasticsearch/go/v1beta1/storage/filtering"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// deleteTimeField is stored alongside notes and occurrences that have been soft deleted. Documents with a deleteTime
+// are tombstones, which are hidden from reads until they're either restored or purged.
+const deleteTimeField = "deleteTime"
+
+// restoreScript removes the deleteTime from a tombstone
+const restoreScript = "ctx._source.remove('" + deleteTimeField + "')"
+
+// tombstoneMetrics are published through expvar. The runs and failures counters track each purge, while the deleted
+// counter tracks the tombstones that were purged.
+var tombstoneMetrics = expvar.NewMap("grafeas_tombstone_purge")
+
+// RestoreNote restores a note that was soft deleted, as long as the grace period hasn't passed
+func (es *ElasticsearchStorage) RestoreNote(ctx context.Context, projectId, noteId string) (*pb.Note, error) {
+	noteName := fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+	log := es.logger.Named("RestoreNote").With(zap.String("note", noteName))
+
+	note := &pb.Note{}
+	if err := es.restore(ctx, log, es.notesIndex(projectId), projectId, noteName, note); err != nil {
+		return nil, err
+	}
+
+	return note, nil
+}
+
+// RestoreOccurrence restores an occurrence that was soft deleted, as long as the grace period hasn't passed
+func (es *ElasticsearchStorage) RestoreOccurrence(ctx context.Context, projectId, occurrenceId string) (*pb.Occurrence, error) {
+	occurrenceName := fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+	log := es.logger.Named("RestoreOccurrence").With(zap.String("occurrence", occurrenceName))
+
+	occurrence := &pb.Occurrence{}
+	if err := es.restore(ctx, log, es.occurrencesIndex(projectId), projectId, occurrenceName, occurrence); err != nil {
+		return nil, err
+	}
+
+	return occurrence, nil
+}
+
+// softDelete turns the document for a resource name into a tombstone by setting its deleteTime. Like a regular delete,
+// it's rejected if the client has sent an etag that doesn't match the current version of the document.
+func (es *ElasticsearchStorage) softDelete(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) error {
+	version, err := es.genericGet(ctx, log, index, projectId, name, protoMessage)
+	if err != nil {
+		return err
+	}
+	if err := checkEtag(ctx, log, name, version); err != nil {
+		return err
+	}
+
+	encodedBody, _ := encodeRequest(map[string]interface{}{
+		"doc": map[string]interface{}{
+			deleteTimeField: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	})
+
+	_, err = es.conditionalUpdate(ctx, log, projectId, name, version, encodedBody)
+
+	return err
+}
+
+// restore removes the deleteTime from a tombstone. Documents that aren't tombstones are returned unchanged.
+func (es *ElasticsearchStorage) restore(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) error {
+	version, err := es.getDocument(ctx, log, index, projectId, name, protoMessage)
+	if err != nil {
+		return err
+	}
+
+	if version.deleteTime == nil {
+		log.Debug("document is not deleted")
+		return nil
+	}
+	if time.Since(*version.deleteTime) > es.config.SoftDelete.Period() {
+		log.Debug("grace period has passed", zap.Time("deleteTime", *version.deleteTime))
+		return status.Errorf(codes.FailedPrecondition, "%s was deleted at %s, and can no longer be restored", name, version.deleteTime.Format(time.RFC3339))
+	}
+
+	encodedBody, _ := encodeRequest(map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": restoreScript,
+			"lang":   "painless",
+		},
+	})
+
+	version, err = es.conditionalUpdate(ctx, log, projectId, name, version, encodedBody)
+	if err != nil {
+		return err
+	}
+
+	log.Info("restored deleted document")
+	es.recordRevision(ctx, log, name, OperationRestore, protoMessage, version)
+	es.recordAuditEvent(ctx, log, "", OperationRestore, name, nil, nil)
+
+	return nil
+}
+
+// replaceTombstone is used when creating a document is rejected because a document with the same ID exists. Tombstones
+// keep their ID until they're purged, but are treated as missing, so a tombstone is overwritten with the new document as
+// long as it hasn't changed since it was read. Any other document still exists, so the create fails.
+func (es *ElasticsearchStorage) replaceTombstone(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}, document []byte) (*documentVersion, error) {
+	existing := proto.Clone(protoMessage.(proto.Message))
+	version, err := es.getDocument(ctx, log, index, projectId, name, existing)
+	if status.Code(err) == codes.NotFound {
+		log.Debug("conflicting document was removed")
+		return nil, status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version.deleteTime == nil {
+		log.Debug("document already exists")
+		return nil, status.Errorf(codes.AlreadyExists, "%s already exists", name)
+	}
+
+	log.Debug("replacing tombstone", zap.Time("deleteTime", *version.deleteTime))
+	res, err := es.client.Index(
+		version.index,
+		bytes.NewReader(document),
+		es.client.Index.WithContext(ctx),
+		es.client.Index.WithDocumentID(documentId(name)),
+		es.client.Index.WithIfSeqNo(version.seqNo),
+		es.client.Index.WithIfPrimaryTerm(version.primaryTerm),
+		es.client.Index.WithRefresh(es.config.Refresh.String()),
+		es.client.Index.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusConflict {
+		log.Debug("tombstone was modified concurrently")
+		return nil, status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error replacing tombstone in elasticsearch", res)
+	}
+
+	esResponse := &esIndexDocResponse{}
+	if err := decodeResponse(res.Body, esResponse); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return &documentVersion{
+		index:       esResponse.Index,
+		seqNo:       esResponse.SeqNo,
+		primaryTerm: esResponse.PrimaryTerm,
+	}, nil
+}
+
+// replaceNoteTombstones retries the creates in a batch of notes that were rejected because a tombstone holds their ID,
+// replacing each tombstone as long as it hasn't changed since it was read. The responses and errors of the retried notes
+// are updated in place, and their positions are returned.
+func (es *ElasticsearchStorage) replaceNoteTombstones(ctx context.Context, log *zap.Logger, projectId string, notes []*pb.Note, items []*bulkItem, responses []*esIndexDocResponse, requestErrs []error) map[int]bool {
+	if !es.config.SoftDelete.Enabled {
+		return nil
+	}
+
+	var (
+		conflicts []int
+		names     []string
+	)
+	for i, response := range responses {
+		if response != nil && response.Status == http.StatusConflict {
+			conflicts = append(conflicts, i)
+			names = append(names, notes[i].Name)
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	stored, err := es.findStoredNotes(ctx, log, projectId, names)
+	if err != nil {
+		for _, i := range conflicts {
+			responses[i], requestErrs[i] = nil, err
+		}
+
+		return nil
+	}
+
+	var (
+		positions []int
+		retries   []*bulkItem
+	)
+	for _, i := range conflicts {
+		existing := stored[notes[i].Name]
+		if existing == nil || existing.exists() {
+			continue
+		}
+
+		action := *items[i].metadata.Create
+		action.Index = existing.version.index
+		action.IfSeqNo = &existing.version.seqNo
+		action.IfPrimaryTerm = &existing.version.primaryTerm
+
+		positions = append(positions, i)
+		retries = append(retries, &bulkItem{
+			metadata: &esBulkQueryFragment{Index: &action},
+			document: items[i].document,
+		})
+	}
+	if len(retries) == 0 {
+		return nil
+	}
+
+	log.Debug("replacing tombstones", zap.Int("notes", len(retries)))
+	retryResponses, retryErrs := es.bulkWrite(ctx, log, retries)
+
+	replaced := map[int]bool{}
+	for j, i := range positions {
+		responses[i], requestErrs[i] = retryResponses[j], retryErrs[j]
+		replaced[i] = true
+	}
+
+	return replaced
+}
+
+// conditionalUpdate applies a partial update to the document for a resource name, but only if it hasn't changed since
+// the given version was read, and returns the new version of the document
+func (es *ElasticsearchStorage) conditionalUpdate(ctx context.Context, log *zap.Logger, projectId, name string, version *documentVersion, body io.Reader) (*documentVersion, error) {
+	res, err := es.client.Update(
+		version.index,
+		documentId(name),
+		body,
+		es.client.Update.WithContext(ctx),
+		es.client.Update.WithIfSeqNo(version.seqNo),
+		es.client.Update.WithIfPrimaryTerm(version.primaryTerm),
+		es.client.Update.WithRefresh(es.config.Refresh.String()),
+		es.client.Update.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("document not found")
+		return nil, status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if res.StatusCode == http.StatusConflict {
+		log.Debug("document was modified concurrently")
+		return nil, status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error updating document in elasticsearch", res)
+	}
+
+	esResponse := &esIndexDocResponse{}
+	if err := decodeResponse(res.Body, esResponse); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return &documentVersion{
+		index:       esResponse.Index,
+		seqNo:       esResponse.SeqNo,
+		primaryTerm: esResponse.PrimaryTerm,
+	}, nil
+}
+
+// withoutTombstones excludes tombstones from a query when soft deletes are enabled
+func (es *ElasticsearchStorage) withoutTombstones(query *filtering.Query) *filtering.Query {
+	if !es.config.SoftDelete.Enabled {
+		return query
+	}
+
+	filter := &filtering.Bool{
+		MustNot: &filtering.MustNot{
+			&filtering.Query{
+				Exists: &filtering.Exists{
+					Field: deleteTimeField,
+				},
+			},
+		},
+	}
+	if query != nil {
+		filter.Must = &filtering.Must{query}
+	}
+
+	return &filtering.Query{Bool: filter}
+}
+
+// documentDeleteTime returns the time a document was soft deleted, or nil if it isn't a tombstone
+func documentDeleteTime(source json.RawMessage) (*time.Time, error) {
+	document := &struct {
+		DeleteTime *time.Time `json:"deleteTime"`
+	}{}
+	if err := json.Unmarshal(source, document); err != nil {
+		return nil, err
+	}
+
+	return document.DeleteTime, nil
+}
+
+// startTombstonePurge periodically deletes tombstones that are older than the grace period until the context is cancelled
+func (es *ElasticsearchStorage) startTombstonePurge(ctx context.Context, log *zap.Logger) {
+	interval := es.config.SoftDelete.Interval()
+	log = log.Named("TombstonePurge")
+	log.Info("starting tombstone purge", zap.Duration("interval", interval), zap.Duration("gracePeriod", es.config.SoftDelete.Period()))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			// errors are logged when they're created, and the next attempt may succeed
+			_ = es.purgeTombstones(ctx, log)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeTombstones permanently deletes the notes and occurrences that were soft deleted before the start of the grace period
+func (es *ElasticsearchStorage) purgeTombstones(ctx context.Context, log *zap.Logger) error {
+	tombstoneMetrics.Add("runs", 1)
+
+	encodedBody, requestJson := encodeRequest(map[string]interface{}{
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				deleteTimeField: map[string]interface{}{
+					"lt": fmt.Sprintf("now-%ds", int64(es.config.SoftDelete.Period().Seconds())),
+				},
+			},
+		},
+	})
+	log.Debug("purging tombstones", zap.String("request", requestJson))
+
+	res, err := es.client.DeleteByQuery(
+		[]string{occurrencesIndexPattern(), notesIndexPattern()},
+		encodedBody,
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
+		es.client.DeleteByQuery.WithRefresh(withRefreshBool(es.config.Refresh)),
+	)
+	if err != nil {
+		tombstoneMetrics.Add("failures", 1)
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		tombstoneMetrics.Add("failures", 1)
+		return createResponseError(log, "error purging tombstones", res)
+	}
+
+	var deletedResults esDeleteResponse
+	if err := decodeResponse(res.Body, &deletedResults); err != nil {
+		tombstoneMetrics.Add("failures", 1)
+		return createError(log, "error decoding elasticsearch response", err)
+	}
+
+	tombstoneMetrics.Add("deleted", int64(deletedResults.Deleted))
+	log.Info("tombstones purged", zap.Int("deleted", deletedResults.Deleted))
+
+	return nil
+}
@@ -0,0 +1,507 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("soft deletes", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+		noteId               string
+		noteName             string
+		version              *documentVersion
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+			SoftDelete: config.SoftDeleteConfig{
+				Enabled:     true,
+				GracePeriod: "7d",
+			},
+		}
+		projectId = fake.LetterN(10)
+		noteId = fake.LetterN(10)
+		noteName = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+		version = &documentVersion{
+			index:       fake.LetterN(10),
+			seqNo:       fake.Number(1, 100),
+			primaryTerm: fake.Number(1, 10),
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("deleting a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(&pb.Note{Name: noteName}, version),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: version.index, SeqNo: version.seqNo + 1, PrimaryTerm: version.primaryTerm}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.DeleteNote(ctx, projectId, noteId)
+		})
+
+		It("should set the delete time on the version of the note that was read", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			updateRequest := transport.receivedHttpRequests[1]
+			Expect(updateRequest.Method).To(Equal(http.MethodPost))
+			Expect(updateRequest.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s/_update", version.index, documentId(noteName))))
+			Expect(updateRequest.URL.Query().Get("if_seq_no")).To(Equal(fmt.Sprintf("%d", version.seqNo)))
+			Expect(updateRequest.URL.Query().Get("if_primary_term")).To(Equal(fmt.Sprintf("%d", version.primaryTerm)))
+
+			body := parseJsonBody(updateRequest.Body)
+			deleteTime, err := time.Parse(time.RFC3339Nano, body.Path("doc.deleteTime").Data().(string))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteTime).To(BeTemporally("~", time.Now(), time.Minute))
+		})
+
+		When("the note has already been deleted", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].Body = createEsTombstoneGetResponse(&pb.Note{Name: noteName}, version, time.Now())
+			})
+
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the note is modified concurrently", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusConflict
+			})
+
+			It("should return an aborted error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+			})
+		})
+
+		When("soft deletes are disabled", func() {
+			BeforeEach(func() {
+				esConfig.SoftDelete.Enabled = false
+				transport.preparedHttpResponses = []*http.Response{
+					{
+						StatusCode: http.StatusOK,
+						Body:       structToJsonBody(&esDeleteResponse{Deleted: 1}),
+					},
+				}
+			})
+
+			It("should delete the document", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(transport.receivedHttpRequests[0].Method).To(Equal(http.MethodDelete))
+			})
+		})
+	})
+
+	Context("getting a deleted note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsTombstoneGetResponse(&pb.Note{Name: noteName}, version, time.Now()),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, actualErr = elasticsearchStorage.GetNote(ctx, projectId, noteId)
+		})
+
+		It("should return a not found error", func() {
+			assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+		})
+
+		When("soft deletes are disabled", func() {
+			BeforeEach(func() {
+				esConfig.SoftDelete.Enabled = false
+			})
+
+			It("should return the note", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+			})
+		})
+	})
+
+	Context("creating a note that was deleted", func() {
+		var (
+			actualNote *pb.Note
+			actualErr  error
+		)
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusConflict,
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsTombstoneGetResponse(&pb.Note{Name: noteName}, version, time.Now()),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: version.index, SeqNo: version.seqNo + 1, PrimaryTerm: version.primaryTerm}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualNote, actualErr = elasticsearchStorage.CreateNote(ctx, projectId, noteId, "", &pb.Note{ShortDescription: fake.Word()})
+		})
+
+		It("should replace the tombstone with the new note, as long as it hasn't changed since it was read", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualNote.Name).To(Equal(noteName))
+			Expect(transport.receivedHttpRequests).To(HaveLen(4))
+
+			indexRequest := transport.receivedHttpRequests[3]
+			Expect(indexRequest.Method).To(Equal(http.MethodPut))
+			Expect(indexRequest.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", version.index, documentId(noteName))))
+			Expect(indexRequest.URL.Query().Get("op_type")).To(BeEmpty())
+			Expect(indexRequest.URL.Query().Get("if_seq_no")).To(Equal(fmt.Sprintf("%d", version.seqNo)))
+			Expect(indexRequest.URL.Query().Get("if_primary_term")).To(Equal(fmt.Sprintf("%d", version.primaryTerm)))
+
+			body := parseJsonBody(indexRequest.Body)
+			Expect(body.Exists(deleteTimeField)).To(BeFalse())
+			Expect(body.Path("shortDescription").Data()).To(Equal(actualNote.ShortDescription))
+		})
+
+		When("the existing note wasn't deleted", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = createEsVersionedGetResponse(&pb.Note{Name: noteName}, version)
+			})
+
+			It("should return an already exists error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			})
+		})
+
+		When("the tombstone is modified concurrently", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[3] = &http.Response{StatusCode: http.StatusConflict}
+			})
+
+			It("should return an aborted error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+			})
+		})
+
+		When("soft deletes are disabled", func() {
+			BeforeEach(func() {
+				esConfig.SoftDelete.Enabled = false
+			})
+
+			It("should return an already exists error without reading the existing note", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.AlreadyExists)
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+	})
+
+	Context("batch creating notes that were deleted", func() {
+		var (
+			deletedNote   *pb.Note
+			actualNotes   []*pb.Note
+			actualErrs    []error
+			deletedNoteId string
+		)
+
+		BeforeEach(func() {
+			deletedNoteId = "z" + fake.LetterN(10)
+			deletedNote = &pb.Note{Name: fmt.Sprintf("projects/%s/notes/%s", projectId, deletedNoteId)}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsProjectGetResponse(projectId, ""),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkNoteCreateResponse([]int{http.StatusCreated, http.StatusConflict}),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsStoredNotesResponse(storedNoteHit(deletedNote, true)),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBulkOccurrenceStatusResponse([]int{http.StatusOK}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualNotes, actualErrs = elasticsearchStorage.BatchCreateNotes(ctx, projectId, "", map[string]*pb.Note{
+				"a" + noteId:  {ShortDescription: fake.Word()},
+				deletedNoteId: {ShortDescription: fake.Word()},
+			})
+		})
+
+		It("should replace the tombstones of the notes that were rejected", func() {
+			Expect(actualErrs).To(BeEmpty())
+			Expect(actualNotes).To(HaveLen(2))
+			Expect(transport.receivedHttpRequests).To(HaveLen(4))
+
+			actions := bulkRequestActions(transport.receivedHttpRequests[3])
+			Expect(actions).To(HaveLen(1))
+			Expect(actions[0].Path("index._id").Data()).To(Equal(documentId(deletedNote.Name)))
+			Expect(actions[0].Path("index._index").Data()).To(Equal(storedNotesIndex))
+			Expect(actions[0].Path("index.if_seq_no").Data()).To(BeEquivalentTo(2))
+			Expect(actions[0].Path("index.if_primary_term").Data()).To(BeEquivalentTo(1))
+		})
+
+		When("the rejected note wasn't deleted", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[2].Body = createEsStoredNotesResponse(storedNoteHit(deletedNote, false))
+			})
+
+			It("should return an already exists error for the note", func() {
+				Expect(actualNotes).To(HaveLen(1))
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.AlreadyExists)
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+			})
+		})
+
+		When("the tombstone is modified concurrently", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[3].Body = createEsBulkOccurrenceStatusResponse([]int{http.StatusConflict})
+			})
+
+			It("should return an aborted error for the note", func() {
+				Expect(actualErrs).To(HaveLen(1))
+				assertErrorHasGrpcStatusCode(actualErrs[0], codes.Aborted)
+			})
+		})
+	})
+
+	Context("listing notes", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createGenericEsSearchResponse(),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			_, _, err := elasticsearchStorage.ListNotes(ctx, projectId, "", "", 0)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should exclude tombstones", func() {
+			body := parseJsonBody(transport.receivedHttpRequests[0].Body)
+			Expect(body.Path("query.bool.must_not.0.exists.field").Data()).To(Equal(deleteTimeField))
+		})
+	})
+
+	Context("restoring a note", func() {
+		var (
+			deleteTime time.Time
+			actualNote *pb.Note
+			actualErr  error
+		)
+
+		BeforeEach(func() {
+			deleteTime = time.Now().Add(-24 * time.Hour)
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsTombstoneGetResponse(&pb.Note{Name: noteName}, version, deleteTime),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Index: version.index, SeqNo: version.seqNo + 1, PrimaryTerm: version.primaryTerm}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualNote, actualErr = elasticsearchStorage.RestoreNote(ctx, projectId, noteId)
+		})
+
+		It("should remove the delete time from the version of the note that was read", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualNote.Name).To(Equal(noteName))
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			updateRequest := transport.receivedHttpRequests[1]
+			Expect(updateRequest.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s/_update", version.index, documentId(noteName))))
+			Expect(updateRequest.URL.Query().Get("if_seq_no")).To(Equal(fmt.Sprintf("%d", version.seqNo)))
+
+			body := parseJsonBody(updateRequest.Body)
+			Expect(body.Path("script.source").Data()).To(Equal(restoreScript))
+		})
+
+		When("the grace period has passed", func() {
+			BeforeEach(func() {
+				deleteTime = time.Now().Add(-8 * 24 * time.Hour)
+				transport.preparedHttpResponses[0].Body = createEsTombstoneGetResponse(&pb.Note{Name: noteName}, version, deleteTime)
+			})
+
+			It("should return a failed precondition error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.FailedPrecondition)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the note was not deleted", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].Body = createEsVersionedGetResponse(&pb.Note{Name: noteName}, version)
+			})
+
+			It("should return the note without updating it", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualNote.Name).To(Equal(noteName))
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the note does not exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0] = &http.Response{StatusCode: http.StatusNotFound}
+			})
+
+			It("should return a not found error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+			})
+		})
+	})
+
+	Context("purging tombstones", func() {
+		var (
+			expectedDeleted int
+			actualErr       error
+		)
+
+		BeforeEach(func() {
+			expectedDeleted = fake.Number(1, 1000)
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esDeleteResponse{Deleted: expectedDeleted}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.purgeTombstones(ctx, logger)
+		})
+
+		It("should delete the notes and occurrences deleted before the grace period", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(1))
+
+			request := transport.receivedHttpRequests[0]
+			Expect(request.URL.Path).To(Equal(fmt.Sprintf("/%s-*occurrences,%s-*notes/_delete_by_query", indexPrefix, indexPrefix)))
+			Expect(request.URL.Query().Get("conflicts")).To(Equal("proceed"))
+
+			body := parseJsonBody(request.Body)
+			Expect(body.Path("query.range.deleteTime.lt").Data()).To(Equal("now-604800s"))
+		})
+
+		It("should record the number of purged tombstones", func() {
+			Expect(tombstoneMetrics.Get("deleted").(*expvar.Int).Value()).To(BeNumerically(">=", expectedDeleted))
+		})
+
+		When("the purge fails", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0].StatusCode = http.StatusInternalServerError
+			})
+
+			It("should return an error", func() {
+				Expect(actualErr).To(HaveOccurred())
+			})
+		})
+	})
+})
+
+func createEsTombstoneGetResponse(message proto.Message, version *documentVersion, deleteTime time.Time) io.ReadCloser {
+	raw, err := protojson.Marshal(proto.MessageV2(message))
+	Expect(err).ToNot(HaveOccurred())
+
+	document := map[string]interface{}{}
+	Expect(json.Unmarshal(raw, &document)).To(Succeed())
+	document[deleteTimeField] = deleteTime.UTC().Format(time.RFC3339Nano)
+	source, err := json.Marshal(document)
+	Expect(err).ToNot(HaveOccurred())
+
+	return structToJsonBody(&esGetResponse{
+		Id:          fake.LetterN(10),
+		Index:       version.index,
+		SeqNo:       version.seqNo,
+		PrimaryTerm: version.primaryTerm,
+		Found:       true,
+		Source:      source,
+	})
+}
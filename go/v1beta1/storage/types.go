@@ -37,17 +37,22 @@ type esSearchResponseTotal struct {
 }
 
 type esSearchResponseHit struct {
-	ID         string          `json:"_id"`
-	Source     json.RawMessage `json:"_source"`
-	Highlights json.RawMessage `json:"highlight"`
-	Sort       []interface{}   `json:"sort"`
+	ID          string          `json:"_id"`
+	Index       string          `json:"_index"`
+	SeqNo       int             `json:"_seq_no"`
+	PrimaryTerm int             `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
+	Highlights  json.RawMessage `json:"highlight"`
+	Sort        []interface{}   `json:"sort"`
 }
 
 // Elasticsearch /_search query
 
 type esSearch struct {
-	Query *filtering.Query       `json:"query,omitempty"`
-	Sort  map[string]esSortOrder `json:"sort,omitempty"`
+	Query            *filtering.Query       `json:"query,omitempty"`
+	Sort             map[string]esSortOrder `json:"sort,omitempty"`
+	SearchAfter      []interface{}          `json:"search_after,omitempty"`
+	SeqNoPrimaryTerm bool                   `json:"seq_no_primary_term,omitempty"`
 }
 
 type esSortOrder string
@@ -57,12 +62,43 @@ const (
 	esSortOrderDecending esSortOrder = "desc"
 )
 
+// Elasticsearch GET /_doc response
+
+type esGetResponse struct {
+	Id          string           `json:"_id"`
+	Index       string           `json:"_index"`
+	SeqNo       int              `json:"_seq_no"`
+	PrimaryTerm int              `json:"_primary_term"`
+	Found       bool             `json:"found"`
+	Source      json.RawMessage  `json:"_source"`
+	Error       *esIndexDocError `json:"error,omitempty"`
+}
+
+// Elasticsearch /_mget request and response
+
+type esMultiGetRequest struct {
+	Docs []*esMultiGetDocument `json:"docs"`
+}
+
+type esMultiGetDocument struct {
+	Index   string `json:"_index"`
+	Id      string `json:"_id"`
+	Routing string `json:"routing,omitempty"`
+}
+
+type esMultiGetResponse struct {
+	Docs []*esGetResponse `json:"docs"`
+}
+
 // Elasticsearch /_doc response
 
 type esIndexDocResponse struct {
-	Id     string           `json:"_id"`
-	Status int              `json:"status"`
-	Error  *esIndexDocError `json:"error,omitempty"`
+	Id          string           `json:"_id"`
+	Index       string           `json:"_index"`
+	SeqNo       int              `json:"_seq_no"`
+	PrimaryTerm int              `json:"_primary_term"`
+	Status      int              `json:"status"`
+	Error       *esIndexDocError `json:"error,omitempty"`
 }
 
 type esIndexDocError struct {
@@ -70,6 +106,13 @@ type esIndexDocError struct {
 	Reason string `json:"reason"`
 }
 
+// Elasticsearch error response
+
+type esErrorResponse struct {
+	Error  *esIndexDocError `json:"error"`
+	Status int              `json:"status"`
+}
+
 // Elasticsearch /_delete_by_query response
 
 type esDeleteResponse struct {
@@ -79,11 +122,17 @@ type esDeleteResponse struct {
 // Elasticsearch /_bulk query fragments
 
 type esBulkQueryFragment struct {
-	Index *esBulkQueryIndexFragment `json:"index"`
+	Index  *esBulkQueryIndexFragment `json:"index,omitempty"`
+	Create *esBulkQueryIndexFragment `json:"create,omitempty"`
 }
 
 type esBulkQueryIndexFragment struct {
-	Index string `json:"_index"`
+	Index   string `json:"_index"`
+	Id      string `json:"_id,omitempty"`
+	Routing string `json:"routing,omitempty"`
+	// IfSeqNo and IfPrimaryTerm only apply the operation if the document hasn't changed since that version was read
+	IfSeqNo       *int `json:"if_seq_no,omitempty"`
+	IfPrimaryTerm *int `json:"if_primary_term,omitempty"`
 }
 
 // Elasticsearch /_bulk response
@@ -94,30 +143,127 @@ type esBulkResponse struct {
 }
 
 type esBulkResponseItem struct {
-	Index *esIndexDocResponse `json:"index,omitempty"`
+	Index  *esIndexDocResponse `json:"index,omitempty"`
+	Create *esIndexDocResponse `json:"create,omitempty"`
 }
 
-// Elasticsearch /_msearch query fragments
+// Elasticsearch /_index_template request and response
+
+type esIndexTemplate struct {
+	IndexPatterns []string             `json:"index_patterns"`
+	Priority      int                  `json:"priority"`
+	Version       int                  `json:"version"`
+	Template      *esIndexTemplateBody `json:"template"`
+}
 
-type esMultiSearchQueryFragment struct {
-	Index string `json:"index"`
+type esIndexTemplateBody struct {
+	Settings map[string]map[string]string `json:"settings,omitempty"`
+	Mappings map[string]interface{}       `json:"mappings,omitempty"`
 }
 
-// Elasticsearch /_msearch response
+type esIndexTemplatesResponse struct {
+	IndexTemplates []*esIndexTemplatesResponseItem `json:"index_templates"`
+}
 
-type esMultiSearchResponse struct {
-	Responses []*esMultiSearchResponseHitsSummary `json:"responses"`
+type esIndexTemplatesResponseItem struct {
+	Name          string           `json:"name"`
+	IndexTemplate *esIndexTemplate `json:"index_template"`
 }
 
-type esMultiSearchResponseHitsSummary struct {
-	Hits *esMultiSearchResponseHits `json:"hits"`
+// Elasticsearch /<index> response
+
+type esIndicesResponse map[string]*esIndex
+
+type esIndex struct {
+	Aliases  map[string]*esIndexAlias `json:"aliases"`
+	Mappings *esIndexMappings         `json:"mappings,omitempty"`
+}
+
+type esIndexMappings struct {
+	Meta *esIndexMeta `json:"_meta,omitempty"`
+}
+
+type esIndexMeta struct {
+	Type          string `json:"type"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+// Elasticsearch /_reindex and /_tasks responses
+
+type esTaskCreatedResponse struct {
+	Task string `json:"task"`
 }
 
-type esMultiSearchResponseHits struct {
-	Total *esSearchResponseTotal      `json:"total"`
-	Hits  []*esMultiSearchResponseHit `json:"hits"`
+type esTaskResponse struct {
+	Completed bool                  `json:"completed"`
+	Task      *esTask               `json:"task"`
+	Error     *esIndexDocError      `json:"error,omitempty"`
+	Response  *esTaskResultResponse `json:"response,omitempty"`
 }
 
-type esMultiSearchResponseHit struct {
-	Source json.RawMessage `json:"_source"`
+type esTask struct {
+	Status *esTaskStatus `json:"status"`
+}
+
+type esTaskStatus struct {
+	Total            int `json:"total"`
+	Created          int `json:"created"`
+	VersionConflicts int `json:"version_conflicts"`
+}
+
+type esTaskResultResponse struct {
+	Failures []json.RawMessage `json:"failures"`
+}
+
+// Elasticsearch index creation request
+
+type esIndexCreateRequest struct {
+	Aliases map[string]*esIndexAlias `json:"aliases,omitempty"`
+}
+
+type esIndexAlias struct {
+	IsWriteIndex bool `json:"is_write_index,omitempty"`
+}
+
+// Elasticsearch /_aliases request
+
+type esAliasActionsRequest struct {
+	Actions []*esAliasAction `json:"actions"`
+}
+
+type esAliasAction struct {
+	Add         *esAliasActionTarget `json:"add,omitempty"`
+	Remove      *esAliasActionTarget `json:"remove,omitempty"`
+	RemoveIndex *esAliasActionTarget `json:"remove_index,omitempty"`
+}
+
+type esAliasActionTarget struct {
+	Index        string   `json:"index"`
+	Alias        string   `json:"alias,omitempty"`
+	Aliases      []string `json:"aliases,omitempty"`
+	IsWriteIndex bool     `json:"is_write_index,omitempty"`
+}
+
+// Elasticsearch /_rollover request and response
+
+type esRolloverRequest struct {
+	Conditions *esRolloverConditions    `json:"conditions"`
+	Aliases    map[string]*esIndexAlias `json:"aliases,omitempty"`
+}
+
+type esRolloverConditions struct {
+	MaxAge  string `json:"max_age,omitempty"`
+	MaxSize string `json:"max_size,omitempty"`
+	MaxDocs int    `json:"max_docs,omitempty"`
+}
+
+type esRolloverResponse struct {
+	RolledOver bool   `json:"rolled_over"`
+	NewIndex   string `json:"new_index"`
+}
+
+// Elasticsearch /_count response
+
+type esCountResponse struct {
+	Count int `json:"count"`
 }
@@ -0,0 +1,216 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/http"
+	"sort"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// NoteUpsertReport counts the notes that were created, updated, or left unchanged by UpsertNotes
+type NoteUpsertReport struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+// storedNote is a note that was read along with the version of its document
+type storedNote struct {
+	note    *pb.Note
+	version *documentVersion
+}
+
+// exists returns true if the note is stored and isn't a tombstone
+func (s *storedNote) exists() bool {
+	return s != nil && s.version.deleteTime == nil
+}
+
+// UpsertNotes creates the notes that don't exist yet and replaces the stored notes that differ from them, which is useful
+// for syncing notes from a feed. Stored notes with the same content are left as they are, so they keep their version and
+// don't record a revision. Replaced notes keep the time they were first created, and are rejected if they change before
+// they're written. Errors are returned in the order of the note IDs, along with the counts of the notes that were written.
+func (es *ElasticsearchStorage) UpsertNotes(ctx context.Context, projectId, uID string, notesWithNoteIds map[string]*pb.Note) (*NoteUpsertReport, []error) {
+	log := es.logger.Named("UpsertNotes").With(zap.String("projectId", projectId))
+	log.Debug("upserting notes")
+
+	if err := es.checkProjectWritable(ctx, log, projectId); err != nil {
+		return nil, []error{err}
+	}
+
+	var (
+		noteIds []string
+		names   []string
+	)
+	for noteId, note := range notesWithNoteIds {
+		note.Name = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+		noteIds = append(noteIds, noteId)
+		names = append(names, note.Name)
+	}
+	sort.Strings(noteIds)
+
+	stored, err := es.findStoredNotes(ctx, log, projectId, names)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	report := &NoteUpsertReport{}
+	var (
+		items     []*bulkItem
+		positions []int
+	)
+	for i, noteId := range noteIds {
+		note := notesWithNoteIds[noteId]
+		existing := stored[note.Name]
+
+		// notes that were already stored are replaced in the backing index that holds them, as long as they haven't
+		// changed since they were read
+		action := &esBulkQueryIndexFragment{
+			Index:   writeAlias(es.notesIndex(projectId)),
+			Id:      documentId(note.Name),
+			Routing: es.routing(projectId),
+		}
+		metadata := &esBulkQueryFragment{Create: action}
+		if existing != nil {
+			action.Index = existing.version.index
+			action.IfSeqNo = &existing.version.seqNo
+			action.IfPrimaryTerm = &existing.version.primaryTerm
+			metadata = &esBulkQueryFragment{Index: action}
+		}
+
+		if existing.exists() {
+			note.CreateTime = existing.note.CreateTime
+
+			changes, err := contentChanges(existing.note, note)
+			if err != nil {
+				return nil, []error{
+					withBatchItemDetails(createError(log, "error comparing notes", err), noteResourceType, note.Name, noteId, i),
+				}
+			}
+			if len(changes) == 0 {
+				report.Unchanged++
+				continue
+			}
+
+			log.Debug("replacing stored note", zap.String("note", note.Name), zap.Strings("fields", changes))
+			note.UpdateTime = ptypes.TimestampNow()
+		} else if note.CreateTime == nil {
+			note.CreateTime = ptypes.TimestampNow()
+		}
+
+		data, err := protojson.Marshal(proto.MessageV2(note))
+		if err == nil {
+			data, err = es.withProjectField(projectId, data)
+		}
+		if err != nil {
+			return nil, []error{
+				withBatchItemDetails(createError(log, "error marshaling note", err), noteResourceType, note.Name, noteId, i),
+			}
+		}
+
+		positions = append(positions, i)
+		items = append(items, &bulkItem{
+			metadata: metadata,
+			document: data,
+		})
+	}
+
+	if len(items) == 0 {
+		log.Debug("all notes are unchanged")
+
+		return report, nil
+	}
+
+	responses, requestErrs := es.bulkWrite(ctx, log, items)
+
+	var (
+		errs        []error
+		revisions   []*esRevision
+		auditEvents []*AuditEvent
+	)
+	for j, item := range responses {
+		i := positions[j]
+		note := notesWithNoteIds[noteIds[i]]
+
+		var err error
+		if item == nil {
+			err = requestErrs[j]
+		} else if item.Status == http.StatusConflict {
+			err = status.Errorf(codes.Aborted, "%s was modified concurrently", note.Name)
+		} else if item.Error != nil {
+			err = createItemError(log, "error upserting note in ES", item, zap.Any("note", note))
+		}
+
+		if err != nil {
+			errs = append(errs, withBatchItemDetails(err, noteResourceType, note.Name, noteIds[i], i))
+			continue
+		}
+
+		operation, before := OperationCreate, interface{}(nil)
+		if existing := stored[note.Name]; existing.exists() {
+			operation, before = OperationUpdate, existing.note
+			report.Updated++
+		} else {
+			report.Created++
+		}
+
+		if es.config.RevisionHistory {
+			revisions = appendRevision(log, revisions, note.Name, operation, note, item)
+		}
+		if es.config.Audit.Enabled {
+			auditEvents = es.appendAuditEvent(ctx, log, auditEvents, uID, operation, note.Name, before, note)
+		}
+	}
+
+	es.recordRevisions(ctx, log, revisions)
+	es.recordAuditEvents(ctx, log, auditEvents)
+
+	log.Debug("upserted notes", zap.Any("report", report))
+	if len(errs) > 0 {
+		log.Info("errors while upserting notes", zap.Any("errors", errs))
+
+		return report, errs
+	}
+
+	return report, nil
+}
+
+// findStoredNotes fetches the notes with the given names, including tombstones, keyed by name.
+// Notes that haven't been stored are left out.
+func (es *ElasticsearchStorage) findStoredNotes(ctx context.Context, log *zap.Logger, projectId string, names []string) (map[string]*storedNote, error) {
+	stored := map[string]*storedNote{}
+	err := es.findStoredDocuments(ctx, log, es.notesIndex(projectId), projectId, names, func(hit *esSearchResponseHit, version *documentVersion) error {
+		note := &pb.Note{}
+		version, err := unmarshalDocument(log, hit.Source, note, version)
+		if err != nil {
+			return err
+		}
+
+		stored[note.Name] = &storedNote{note: note, version: version}
+
+		return nil
+	})
+
+	return stored, err
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("upserting notes", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+
+		notes       map[string]*pb.Note
+		storedNotes map[string]*pb.Note
+		createTime  = ptypes.TimestampNow()
+
+		actualReport *NoteUpsertReport
+		actualErrs   []error
+	)
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		}
+		ctx = context.Background()
+		projectId = fake.LetterN(10)
+
+		notes = map[string]*pb.Note{
+			"a-changed":   createVulnerabilityNote(),
+			"b-new":       createVulnerabilityNote(),
+			"c-unchanged": createVulnerabilityNote(),
+		}
+
+		storedNotes = map[string]*pb.Note{}
+		for _, noteId := range []string{"a-changed", "c-unchanged"} {
+			stored := proto.Clone(notes[noteId]).(*pb.Note)
+			stored.Name = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+			stored.CreateTime = createTime
+			storedNotes[noteId] = stored
+		}
+		storedNotes["a-changed"].ShortDescription = fake.Sentence(3)
+
+		transport.preparedHttpResponses = []*http.Response{
+			{
+				StatusCode: http.StatusOK,
+				Body:       createEsProjectGetResponse(projectId, ""),
+			},
+			{
+				StatusCode: http.StatusOK,
+			},
+			{
+				StatusCode: http.StatusOK,
+				Body:       createEsBulkNoteCreateResponse([]int{http.StatusOK, http.StatusCreated}),
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		if transport.preparedHttpResponses[1].Body == nil {
+			var hits []*esSearchResponseHit
+			for _, note := range storedNotes {
+				hits = append(hits, storedNoteHit(note, false))
+			}
+			transport.preparedHttpResponses[1].Body = createEsStoredNotesResponse(hits...)
+		}
+
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+		actualReport, actualErrs = elasticsearchStorage.UpsertNotes(ctx, projectId, "", notes)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	It("should search for the stored notes", func() {
+		Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", elasticsearchStorage.notesIndex(projectId))))
+
+		body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+		Expect(body.Path("query.ids.values").Data()).To(ConsistOf(
+			documentId(fmt.Sprintf("projects/%s/notes/a-changed", projectId)),
+			documentId(fmt.Sprintf("projects/%s/notes/b-new", projectId)),
+			documentId(fmt.Sprintf("projects/%s/notes/c-unchanged", projectId)),
+		))
+		Expect(body.Path("seq_no_primary_term").Data()).To(BeTrue())
+	})
+
+	It("should only write the notes that are new or changed", func() {
+		Expect(transport.receivedHttpRequests).To(HaveLen(3))
+		Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal("/_bulk"))
+
+		actions := bulkRequestActions(transport.receivedHttpRequests[2])
+		Expect(actions).To(HaveLen(2))
+
+		Expect(actions[0].Path("index._id").Data()).To(Equal(documentId(storedNotes["a-changed"].Name)))
+		Expect(actions[0].Path("index._index").Data()).To(Equal(storedNotesIndex))
+		Expect(actions[0].Path("index.if_seq_no").Data()).To(BeEquivalentTo(2))
+		Expect(actions[0].Path("index.if_primary_term").Data()).To(BeEquivalentTo(1))
+
+		Expect(actions[1].Path("create._id").Data()).To(Equal(documentId(fmt.Sprintf("projects/%s/notes/b-new", projectId))))
+		Expect(actions[1].Path("create._index").Data()).To(Equal(writeAlias(elasticsearchStorage.notesIndex(projectId))))
+	})
+
+	It("should keep the create time of updated notes", func() {
+		Expect(notes["a-changed"].CreateTime).To(Equal(createTime))
+		Expect(notes["a-changed"].UpdateTime).ToNot(BeNil())
+		Expect(notes["b-new"].CreateTime).ToNot(BeNil())
+	})
+
+	It("should count the notes", func() {
+		Expect(actualErrs).To(BeEmpty())
+		Expect(actualReport).To(Equal(&NoteUpsertReport{Created: 1, Updated: 1, Unchanged: 1}))
+	})
+
+	When("every note is unchanged", func() {
+		BeforeEach(func() {
+			notes = map[string]*pb.Note{"c-unchanged": notes["c-unchanged"]}
+		})
+
+		It("should not write any notes", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			Expect(actualErrs).To(BeEmpty())
+			Expect(actualReport).To(Equal(&NoteUpsertReport{Unchanged: 1}))
+		})
+	})
+
+	When("a stored note was deleted", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses[1].Body = createEsStoredNotesResponse(
+				storedNoteHit(storedNotes["a-changed"], false),
+				storedNoteHit(storedNotes["c-unchanged"], true),
+			)
+			transport.preparedHttpResponses[2].Body = createEsBulkNoteCreateResponse([]int{http.StatusOK, http.StatusCreated, http.StatusOK})
+		})
+
+		It("should replace the tombstone", func() {
+			actions := bulkRequestActions(transport.receivedHttpRequests[2])
+			Expect(actions).To(HaveLen(3))
+			Expect(actions[2].Path("index._id").Data()).To(Equal(documentId(storedNotes["c-unchanged"].Name)))
+			Expect(actions[2].Path("index.if_seq_no").Data()).To(BeEquivalentTo(2))
+		})
+
+		It("should count the note as created", func() {
+			Expect(actualReport).To(Equal(&NoteUpsertReport{Created: 2, Updated: 1}))
+		})
+	})
+
+	When("a stored note changes before it's replaced", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses[2].Body = createEsBulkNoteCreateResponse([]int{http.StatusConflict, http.StatusCreated})
+		})
+
+		It("should return an error for the note", func() {
+			Expect(actualErrs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(actualErrs[0], codes.Aborted)
+			Expect(actualReport).To(Equal(&NoteUpsertReport{Created: 1, Unchanged: 1}))
+		})
+	})
+
+	When("the stored notes can't be found", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses[1].StatusCode = http.StatusInternalServerError
+			transport.preparedHttpResponses[1].Body = structToJsonBody(&esIndexDocError{Type: fake.LetterN(10)})
+		})
+
+		It("should return an error without writing any notes", func() {
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			Expect(actualReport).To(BeNil())
+			Expect(actualErrs).To(HaveLen(1))
+			assertErrorHasGrpcStatusCode(actualErrs[0], codes.Internal)
+		})
+	})
+})
+
+func createVulnerabilityNote() *pb.Note {
+	return &pb.Note{
+		ShortDescription: fake.Sentence(5),
+		LongDescription:  fake.Paragraph(1, 2, 5, " "),
+		Kind:             common_go_proto.NoteKind_VULNERABILITY,
+		RelatedUrl: []*common_go_proto.RelatedUrl{
+			{Url: fake.URL(), Label: fake.LetterN(5)},
+		},
+	}
+}
+
+// storedNotesIndex is the backing index that holds the notes returned by storedNoteHit
+const storedNotesIndex = "grafeas-v1beta1-rode-notes-v1"
+
+func storedNoteHit(note *pb.Note, deleted bool) *esSearchResponseHit {
+	source, err := protojson.Marshal(proto.MessageV2(note))
+	Expect(err).ToNot(HaveOccurred())
+
+	if deleted {
+		document, err := gabs.ParseJSON(source)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = document.Set(time.Now().UTC().Format(time.RFC3339Nano), deleteTimeField)
+		Expect(err).ToNot(HaveOccurred())
+		source = document.Bytes()
+	}
+
+	return &esSearchResponseHit{
+		ID:          documentId(note.Name),
+		Index:       storedNotesIndex,
+		SeqNo:       2,
+		PrimaryTerm: 1,
+		Source:      source,
+	}
+}
+
+func createEsStoredNotesResponse(hits ...*esSearchResponseHit) io.ReadCloser {
+	return structToJsonBody(&esSearchResponse{
+		Hits: &esSearchResponseHits{
+			Total: &esSearchResponseTotal{Value: len(hits)},
+			Hits:  hits,
+		},
+	})
+}
+
+// bulkRequestActions returns the metadata line of each item in a bulk request
+func bulkRequestActions(request *http.Request) []*gabs.Container {
+	lines := strings.Split(strings.TrimSuffix(string(ioReadCloserToByteSlice(request.Body)), "\n"), "\n")
+
+	var actions []*gabs.Container
+	for i := 0; i < len(lines); i += 2 {
+		action, err := gabs.ParseJSON([]byte(lines[i]))
+		Expect(err).ToNot(HaveOccurred())
+
+		actions = append(actions, action)
+	}
+
+	return actions
+}
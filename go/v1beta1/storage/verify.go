@@ -0,0 +1,218 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"regexp"
+	"sort"
+	"strings"
+
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+// projectIndexPattern matches the read alias of the notes and occurrences indices created for a project with the
+// per-project layout
+var projectIndexPattern = regexp.MustCompile(fmt.Sprintf(`^%s-(.+)-(occurrences|notes)$`, regexp.QuoteMeta(indexPrefix)))
+
+// IndexReport lists the inconsistencies found between the project documents and the indices that store their notes and occurrences
+type IndexReport struct {
+	// MissingIndices are the read aliases of indices that don't exist, but are needed by a project
+	MissingIndices []string
+	// InvalidIndices are indices needed by a project that weren't created by Grafeas, according to their metadata
+	InvalidIndices []string
+	// OrphanedProjects are the IDs of projects that have indices, but no project document
+	OrphanedProjects []string
+}
+
+// Consistent returns true when no problems were found
+func (r *IndexReport) Consistent() bool {
+	return len(r.MissingIndices) == 0 && len(r.InvalidIndices) == 0 && len(r.OrphanedProjects) == 0
+}
+
+// VerifyIndices checks that the indices for every project exist and were created by Grafeas, and looks for indices that
+// belong to a project without a project document. When repair is set, missing indices are created and project documents
+// are restored for orphaned indices, so that no data is removed. Invalid indices are only reported, since they can't be
+// replaced without losing the documents they contain.
+func (es *ElasticsearchStorage) VerifyIndices(ctx context.Context, repair bool) (*IndexReport, error) {
+	log := es.logger.Named("VerifyIndices")
+
+	return es.verifyIndices(ctx, log, repair)
+}
+
+func (es *ElasticsearchStorage) verifyIndices(ctx context.Context, log *zap.Logger, repair bool) (*IndexReport, error) {
+	projects, err := es.listProjectStates(ctx, log)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, err := es.getIndices(ctx, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// backing indices are grouped by the read alias they are accessed through. Indices created before aliases were
+	// introduced are named after the alias.
+	backingIndices := map[string][]string{}
+	for name := range indices {
+		alias := name
+		if match := versionedIndexPattern.FindStringSubmatch(name); match != nil {
+			alias = match[1]
+		}
+		backingIndices[alias] = append(backingIndices[alias], name)
+	}
+
+	expected := []string{projectsIndex()}
+	if es.config.RevisionHistory {
+		expected = append(expected, revisionsIndex())
+	}
+	if es.config.Audit.Enabled {
+		expected = append(expected, auditIndex())
+	}
+	if es.sharedLayout() {
+		expected = append(expected, es.projectIndices("")...)
+	} else {
+		for projectId, state := range projects {
+			// the indices of a project that is being deleted may have already been removed
+			if state != projectStateDeleting {
+				expected = append(expected, es.projectIndices(projectId)...)
+			}
+		}
+	}
+	sort.Strings(expected)
+
+	report := &IndexReport{}
+	for _, alias := range expected {
+		names, ok := backingIndices[alias]
+		if !ok {
+			log.Warn("index is missing", zap.String("alias", alias))
+			report.MissingIndices = append(report.MissingIndices, alias)
+			continue
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			if !isGrafeasIndex(indices[name]) {
+				log.Warn("index was not created by grafeas", zap.String("index", name), zap.String("alias", alias))
+				report.InvalidIndices = append(report.InvalidIndices, name)
+			}
+		}
+	}
+
+	// indices for every project are shared with the shared layout, so they can't be orphaned
+	if !es.sharedLayout() {
+		orphans := map[string]bool{}
+		for alias, names := range backingIndices {
+			match := projectIndexPattern.FindStringSubmatch(alias)
+			if match == nil || !isGrafeasIndex(indices[names[0]]) {
+				continue
+			}
+			if _, ok := projects[match[1]]; ok {
+				continue
+			}
+			orphans[match[1]] = true
+		}
+
+		for projectId := range orphans {
+			report.OrphanedProjects = append(report.OrphanedProjects, projectId)
+		}
+		sort.Strings(report.OrphanedProjects)
+
+		for _, projectId := range report.OrphanedProjects {
+			log.Warn("found indices without a project", zap.String("project", fmt.Sprintf("projects/%s", projectId)))
+		}
+	}
+
+	if report.Consistent() {
+		log.Info("indices are consistent", zap.Int("projects", len(projects)))
+		return report, nil
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	for _, alias := range report.MissingIndices {
+		if _, err := es.createAliasedIndexIfNotExists(ctx, log, alias); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, projectId := range report.OrphanedProjects {
+		projectName := fmt.Sprintf("projects/%s", projectId)
+		_, err := es.genericCreate(ctx, log.With(zap.String("project", projectName)), projectsIndex(), "", projectName, &prpb.Project{Name: projectName})
+		if err != nil && status.Code(err) != codes.AlreadyExists {
+			return nil, err
+		}
+	}
+
+	log.Info("repaired indices", zap.Int("missing", len(report.MissingIndices)), zap.Int("orphaned", len(report.OrphanedProjects)))
+
+	return report, nil
+}
+
+// listProjectStates returns the state of every project that has a project document, keyed by project ID.
+// The state is only set for projects that are being deleted.
+func (es *ElasticsearchStorage) listProjectStates(ctx context.Context, log *zap.Logger) (map[string]string, error) {
+	projects := map[string]string{}
+	err := es.searchAllProjects(ctx, log, nil, func(hit *esSearchResponseHit) error {
+		project := map[string]interface{}{}
+		if err := json.Unmarshal(hit.Source, &project); err != nil {
+			return createError(log, "error decoding project", err)
+		}
+
+		name, _ := project["name"].(string)
+		state, _ := project[projectStateField].(string)
+		projects[strings.TrimPrefix(name, "projects/")] = state
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
+
+// getIndices returns every index with the Grafeas index prefix, along with its aliases and mappings
+func (es *ElasticsearchStorage) getIndices(ctx context.Context, log *zap.Logger) (esIndicesResponse, error) {
+	res, err := es.client.Indices.Get(
+		[]string{indexPrefix + "-*"},
+		es.client.Indices.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error retrieving indices", res)
+	}
+
+	indices := esIndicesResponse{}
+	if err := decodeResponse(res.Body, &indices); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return indices, nil
+}
+
+// isGrafeasIndex checks the metadata that is added to the mappings of every index created by Grafeas
+func isGrafeasIndex(index *esIndex) bool {
+	return index != nil && index.Mappings != nil && index.Mappings.Meta != nil && index.Mappings.Meta.Type == "grafeas"
+}
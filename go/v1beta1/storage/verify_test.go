@@ -0,0 +1,290 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"net/http"
+	"strings"
+
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+)
+
+var _ = Describe("index verification", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		esConfig             *config.ElasticsearchConfig
+		ctx                  context.Context
+		projectId            string
+		indices              esIndicesResponse
+		projectsResponse     *http.Response
+		nextProjectsPages    []*http.Response
+		indicesStatusCode    int
+		repair               bool
+		actualReport         *IndexReport
+		actualErr            error
+	)
+
+	grafeasIndex := func(version int) *esIndex {
+		return &esIndex{
+			Mappings: &esIndexMappings{
+				Meta: &esIndexMeta{Type: "grafeas", SchemaVersion: version},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		esConfig = &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		}
+		projectId = fake.LetterN(10)
+		indicesStatusCode = http.StatusOK
+		repair = false
+		nextProjectsPages = nil
+		projectsResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       createProjectEsSearchResponse(generateTestProject(projectId)),
+		}
+
+		indices = esIndicesResponse{
+			backingIndex(projectsIndex()):                                          grafeasIndex(schemaVersion),
+			backingIndex(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId)): grafeasIndex(schemaVersion),
+			backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)):       grafeasIndex(schemaVersion),
+		}
+	})
+
+	JustBeforeEach(func() {
+		responses := append([]*http.Response{projectsResponse}, nextProjectsPages...)
+		responses = append(responses, &http.Response{
+			StatusCode: indicesStatusCode,
+			Body:       structToJsonBody(indices),
+		})
+		transport.preparedHttpResponses = append(responses, transport.preparedHttpResponses...)
+
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), esConfig)
+
+		actualReport, actualErr = elasticsearchStorage.VerifyIndices(ctx, repair)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	It("should list the projects and the grafeas indices", func() {
+		Expect(transport.receivedHttpRequests[0].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", projectsIndex())))
+		Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodGet))
+		Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s-*", indexPrefix)))
+	})
+
+	It("should not find any problems", func() {
+		Expect(actualErr).ToNot(HaveOccurred())
+		Expect(actualReport.Consistent()).To(BeTrue())
+		Expect(transport.receivedHttpRequests).To(HaveLen(2))
+	})
+
+	When("an index for a project is missing", func() {
+		BeforeEach(func() {
+			delete(indices, backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)))
+		})
+
+		It("should report the missing index", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualReport.MissingIndices).To(ConsistOf(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)))
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+		})
+
+		When("repairing the indices", func() {
+			BeforeEach(func() {
+				repair = true
+				transport.preparedHttpResponses = []*http.Response{
+					{StatusCode: http.StatusNotFound},
+					{StatusCode: http.StatusOK},
+				}
+			})
+
+			It("should create the missing index", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(4))
+				Expect(transport.receivedHttpRequests[3].Method).To(Equal(http.MethodPut))
+				Expect(transport.receivedHttpRequests[3].URL.Path).To(Equal(fmt.Sprintf("/%s-%s-notes-v%d", indexPrefix, projectId, schemaVersion)))
+			})
+		})
+	})
+
+	When("the indices of a project that is being deleted are missing", func() {
+		BeforeEach(func() {
+			repair = true
+			delete(indices, backingIndex(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId)))
+			delete(indices, backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)))
+			projectsResponse = &http.Response{
+				StatusCode: http.StatusOK,
+				Body: structToJsonBody(&esSearchResponse{
+					Hits: &esSearchResponseHits{
+						Total: &esSearchResponseTotal{Value: 1},
+						Hits: []*esSearchResponseHit{
+							{Source: []byte(fmt.Sprintf(`{"name":"projects/%s","%s":"%s"}`, projectId, projectStateField, projectStateDeleting))},
+						},
+					},
+				}),
+			}
+		})
+
+		It("should not recreate the indices", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualReport.Consistent()).To(BeTrue())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+		})
+	})
+
+	When("an index for a project was not created by grafeas", func() {
+		BeforeEach(func() {
+			repair = true
+			indices[fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)] = &esIndex{}
+			delete(indices, backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)))
+		})
+
+		It("should report the index without changing it", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualReport.InvalidIndices).To(ConsistOf(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId)))
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+		})
+	})
+
+	When("there are indices for a project without a project document", func() {
+		var orphanedProjectId string
+
+		BeforeEach(func() {
+			orphanedProjectId = fake.LetterN(10)
+			indices[fmt.Sprintf("%s-%s-occurrences-v%d-000002", indexPrefix, orphanedProjectId, schemaVersion)] = grafeasIndex(schemaVersion)
+			indices[fmt.Sprintf("%s-%s-occurrences-v%d", indexPrefix, orphanedProjectId, schemaVersion)] = grafeasIndex(schemaVersion)
+			indices[fmt.Sprintf("%s-%s-notes", indexPrefix, orphanedProjectId)] = grafeasIndex(0)
+		})
+
+		It("should report the project once", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualReport.OrphanedProjects).To(Equal([]string{orphanedProjectId}))
+		})
+
+		When("repairing the indices", func() {
+			BeforeEach(func() {
+				repair = true
+				transport.preparedHttpResponses = []*http.Response{
+					{
+						StatusCode: http.StatusCreated,
+						Body:       structToJsonBody(&esIndexDocResponse{Id: fake.LetterN(10)}),
+					},
+				}
+			})
+
+			It("should restore the project document", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(3))
+
+				projectName := fmt.Sprintf("projects/%s", orphanedProjectId)
+				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", writeAlias(projectsIndex()), documentId(projectName))))
+
+				project := &prpb.Project{}
+				Expect(protojson.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[2].Body), proto.MessageV2(project))).To(Succeed())
+				Expect(project.Name).To(Equal(projectName))
+			})
+		})
+
+		When("the shared layout is configured", func() {
+			BeforeEach(func() {
+				esConfig.Layout = config.LayoutShared
+				indices[backingIndex(fmt.Sprintf("%s-occurrences", indexPrefix))] = grafeasIndex(schemaVersion)
+				indices[backingIndex(fmt.Sprintf("%s-notes", indexPrefix))] = grafeasIndex(schemaVersion)
+			})
+
+			It("should only check the shared indices", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualReport.Consistent()).To(BeTrue())
+			})
+		})
+	})
+
+	When("there is more than one page of projects", func() {
+		var lastProjectName string
+
+		BeforeEach(func() {
+			var hits []*esSearchResponseHit
+			for i := 0; i < grafeasMaxPageSize; i++ {
+				project := generateTestProject(fmt.Sprintf("%s-%04d", fake.LetterN(10), i))
+				lastProjectName = project.Name
+
+				source, err := protojson.Marshal(proto.MessageV2(project))
+				Expect(err).ToNot(HaveOccurred())
+				hits = append(hits, &esSearchResponseHit{Source: source, Sort: []interface{}{project.Name}})
+
+				projectId := strings.TrimPrefix(project.Name, "projects/")
+				indices[backingIndex(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId))] = grafeasIndex(schemaVersion)
+				indices[backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId))] = grafeasIndex(schemaVersion)
+			}
+
+			// the second page has the project from the default response
+			nextProjectsPages = []*http.Response{projectsResponse}
+			projectsResponse = &http.Response{
+				StatusCode: http.StatusOK,
+				Body: structToJsonBody(&esSearchResponse{
+					Hits: &esSearchResponseHits{
+						Total: &esSearchResponseTotal{Value: len(hits)},
+						Hits:  hits,
+					},
+				}),
+			}
+		})
+
+		It("should read the next page of projects before listing the indices", func() {
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(Equal(fmt.Sprintf("/%s/_search", projectsIndex())))
+
+			body := parseJsonBody(transport.receivedHttpRequests[1].Body)
+			Expect(body.Path("search_after").Data()).To(ConsistOf(lastProjectName))
+		})
+
+		It("should not report the indices of projects on any page as orphaned", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualReport.Consistent()).To(BeTrue())
+		})
+	})
+
+	When("listing the indices fails", func() {
+		BeforeEach(func() {
+			indicesStatusCode = http.StatusInternalServerError
+		})
+
+		It("should return an error", func() {
+			assertErrorHasGrpcStatusCode(actualErr, codes.Internal)
+			Expect(actualReport).To(BeNil())
+		})
+	})
+})
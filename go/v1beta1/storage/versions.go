@@ -0,0 +1,245 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Grafeas resources don't have a version field, so the version of a note or occurrence is exchanged through gRPC metadata.
+// The etag of the stored document is returned in the etagMetadataKey header when it's read or written, and can be sent
+// back in the ifMatchMetadataKey header of an update or delete, which is rejected if the document has changed since.
+const (
+	etagMetadataKey    = "etag"
+	ifMatchMetadataKey = "if-match"
+)
+
+// immutableFields can't be changed by an update
+var immutableFields = map[protoreflect.Name]bool{
+	"name":        true,
+	"create_time": true,
+}
+
+// documentVersion identifies a single version of a document, using the sequence number and primary term that
+// Elasticsearch assigns to every write. The index is the backing index that holds the document, and deleteTime is set
+// when the document is a tombstone.
+type documentVersion struct {
+	index       string
+	seqNo       int
+	primaryTerm int
+	deleteTime  *time.Time
+}
+
+// etag is an opaque representation of the version, so that clients don't depend on how versions are tracked
+func (v *documentVersion) etag() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", v.primaryTerm, v.seqNo)))
+}
+
+// setEtag returns the etag of a document to the client in the response headers. The headers can only be set when
+// handling a gRPC request, so this has no effect elsewhere, e.g. when running an admin command.
+func setEtag(ctx context.Context, log *zap.Logger, version *documentVersion) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs(etagMetadataKey, version.etag())); err != nil {
+		log.Debug("unable to set etag header", zap.Error(err))
+	}
+}
+
+// requestEtag returns the etag sent by the client in the request headers, if any
+func requestEtag(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	values := md.Get(ifMatchMetadataKey)
+	if len(values) == 0 || values[0] == "" {
+		return "", false
+	}
+
+	return values[0], true
+}
+
+// checkEtag rejects a write when the client has sent an etag that doesn't match the current version of the document
+func checkEtag(ctx context.Context, log *zap.Logger, name string, current *documentVersion) error {
+	etag, ok := requestEtag(ctx)
+	if !ok || etag == current.etag() {
+		return nil
+	}
+
+	log.Debug("etag does not match the current version", zap.String("etag", etag), zap.String("current", current.etag()))
+
+	return status.Errorf(codes.Aborted, "%s has been modified, the etag does not match the current version", name)
+}
+
+// genericUpdate replaces the document for a resource name, but only if it hasn't changed since the given version was read.
+// The document is written to the backing index that it was read from, which isn't necessarily the write index.
+func (es *ElasticsearchStorage) genericUpdate(ctx context.Context, log *zap.Logger, projectId, name string, protoMessage interface{}, version *documentVersion) (*documentVersion, error) {
+	str, err := es.documentBody(projectId, protoMessage)
+	if err != nil {
+		return nil, createError(log, fmt.Sprintf("error marshalling %T to json", protoMessage), err)
+	}
+
+	res, err := es.client.Index(
+		version.index,
+		bytes.NewReader(str),
+		es.client.Index.WithContext(ctx),
+		es.client.Index.WithDocumentID(documentId(name)),
+		es.client.Index.WithIfSeqNo(version.seqNo),
+		es.client.Index.WithIfPrimaryTerm(version.primaryTerm),
+		es.client.Index.WithRefresh(es.config.Refresh.String()),
+		es.client.Index.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return nil, createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusConflict {
+		log.Debug("document was modified concurrently")
+		return nil, status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if res.IsError() {
+		return nil, createResponseError(log, "error updating document in elasticsearch", res)
+	}
+
+	esResponse := &esIndexDocResponse{}
+	if err := decodeResponse(res.Body, esResponse); err != nil {
+		return nil, createError(log, "error decoding elasticsearch response", err)
+	}
+
+	return &documentVersion{
+		index:       esResponse.Index,
+		seqNo:       esResponse.SeqNo,
+		primaryTerm: esResponse.PrimaryTerm,
+	}, nil
+}
+
+// conditionalDelete deletes the document for a resource name when the client has sent an etag, rejecting the delete if
+// the document has changed since. Without an etag, the document is deleted regardless of its version.
+func (es *ElasticsearchStorage) conditionalDelete(ctx context.Context, log *zap.Logger, index, projectId, name string, protoMessage interface{}) error {
+	if _, ok := requestEtag(ctx); !ok {
+		return es.genericDelete(ctx, log, index, projectId, name)
+	}
+
+	version, err := es.genericGet(ctx, log, index, projectId, name, protoMessage)
+	if err != nil {
+		return err
+	}
+	if err := checkEtag(ctx, log, name, version); err != nil {
+		return err
+	}
+
+	res, err := es.client.Delete(
+		version.index,
+		documentId(name),
+		es.client.Delete.WithContext(ctx),
+		es.client.Delete.WithIfSeqNo(version.seqNo),
+		es.client.Delete.WithIfPrimaryTerm(version.primaryTerm),
+		es.client.Delete.WithRefresh(es.config.Refresh.String()),
+		es.client.Delete.WithRouting(es.routing(projectId)),
+	)
+	if err != nil {
+		return createError(log, "error sending request to elasticsearch", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		log.Debug("document not found")
+		return status.Errorf(codes.NotFound, "%s not found", name)
+	}
+	if res.StatusCode == http.StatusConflict {
+		log.Debug("document was modified concurrently")
+		return status.Errorf(codes.Aborted, "%s was modified concurrently", name)
+	}
+	if res.IsError() {
+		return createResponseError(log, "error deleting document from elasticsearch", res)
+	}
+
+	return nil
+}
+
+// applyFieldMask copies the fields in the mask from src to dst, clearing any that aren't set in src. Paths can refer to
+// nested fields, e.g. `vulnerability.severity`, using either the proto or JSON field names. An empty mask replaces
+// every field. Immutable fields are never copied.
+func applyFieldMask(dst, src interface{}, mask *fieldmaskpb.FieldMask) error {
+	dstMessage := proto.MessageV2(dst).ProtoReflect()
+	srcMessage := proto.MessageV2(src).ProtoReflect()
+
+	if len(mask.GetPaths()) == 0 {
+		fields := dstMessage.Descriptor().Fields()
+		for i := 0; i < fields.Len(); i++ {
+			if !immutableFields[fields.Get(i).Name()] {
+				copyField(dstMessage, srcMessage, fields.Get(i))
+			}
+		}
+
+		return nil
+	}
+
+	for _, path := range mask.GetPaths() {
+		dstField, srcField := dstMessage, srcMessage
+		segments := strings.Split(path, ".")
+		for i, segment := range segments {
+			field := findField(dstField.Descriptor(), segment)
+			if field == nil {
+				return status.Errorf(codes.InvalidArgument, "invalid field mask path %q", path)
+			}
+			if i == 0 && immutableFields[field.Name()] {
+				return status.Errorf(codes.InvalidArgument, "field %q can't be updated", path)
+			}
+
+			if i == len(segments)-1 {
+				copyField(dstField, srcField, field)
+				break
+			}
+
+			if field.Message() == nil || field.IsList() || field.IsMap() {
+				return status.Errorf(codes.InvalidArgument, "invalid field mask path %q", path)
+			}
+
+			// the parent of a field that is being set has to exist in dst, but may be missing from src, in which case
+			// the field is read from an empty message and cleared
+			srcField = srcField.Get(field).Message()
+			dstField = dstField.Mutable(field).Message()
+		}
+	}
+
+	return nil
+}
+
+func findField(message protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if field := message.Fields().ByName(protoreflect.Name(name)); field != nil {
+		return field
+	}
+
+	return message.Fields().ByJSONName(name)
+}
+
+func copyField(dst, src protoreflect.Message, field protoreflect.FieldDescriptor) {
+	if src.Has(field) {
+		dst.Set(field, src.Get(field))
+	} else {
+		dst.Clear(field)
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2021 The Rode Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rode/grafeas-elasticsearch/go/config"
+	"github.com/rode/grafeas-elasticsearch/go/mocks"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"io"
+	"net/http"
+	"strconv"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+var _ = Describe("document versions", func() {
+	var (
+		elasticsearchStorage *ElasticsearchStorage
+		transport            *mockEsTransport
+		mockCtrl             *gomock.Controller
+		stream               *fakeServerTransportStream
+		ctx                  context.Context
+		projectId            string
+		noteId               string
+		noteName             string
+		backingNotesIndex    string
+		existingNote         *pb.Note
+		currentVersion       *documentVersion
+	)
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		transport = &mockEsTransport{}
+		stream = &fakeServerTransportStream{}
+		ctx = grpc.NewContextWithServerTransportStream(context.Background(), stream)
+
+		projectId = fake.LetterN(10)
+		noteId = fake.LetterN(10)
+		noteName = fmt.Sprintf("projects/%s/notes/%s", projectId, noteId)
+		backingNotesIndex = backingIndex(fmt.Sprintf("%s-%s-notes", indexPrefix, projectId))
+		existingNote = generateTestNote(noteName)
+		currentVersion = &documentVersion{
+			index:       backingNotesIndex,
+			seqNo:       fake.Number(1, 1000),
+			primaryTerm: fake.Number(1, 10),
+		}
+	})
+
+	JustBeforeEach(func() {
+		mockEsClient := &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}
+
+		elasticsearchStorage = NewElasticsearchStorage(logger, mockEsClient, mocks.NewMockFilterer(mockCtrl), &config.ElasticsearchConfig{
+			URL:     fake.URL(),
+			Refresh: config.RefreshTrue,
+		})
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("getting a note", func() {
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(existingNote, currentVersion),
+				},
+			}
+		})
+
+		It("should return the etag of the note in the response headers", func() {
+			_, err := elasticsearchStorage.GetNote(ctx, projectId, noteId)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stream.header.Get(etagMetadataKey)).To(ConsistOf(currentVersion.etag()))
+		})
+
+		It("should not fail outside of a gRPC request", func() {
+			_, err := elasticsearchStorage.GetNote(context.Background(), projectId, noteId)
+
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("updating a note", func() {
+		var (
+			update      *pb.Note
+			mask        *fieldmaskpb.FieldMask
+			actualNote  *pb.Note
+			actualErr   error
+			nextVersion *documentVersion
+		)
+
+		BeforeEach(func() {
+			update = &pb.Note{
+				Name:             fake.LetterN(10),
+				ShortDescription: fake.Phrase(),
+				LongDescription:  fake.Phrase(),
+			}
+			mask = &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+			nextVersion = &documentVersion{
+				index:       backingNotesIndex,
+				seqNo:       currentVersion.seqNo + 1,
+				primaryTerm: currentVersion.primaryTerm,
+			}
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(existingNote, currentVersion),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body: structToJsonBody(&esIndexDocResponse{
+						Id:          documentId(noteName),
+						Index:       nextVersion.index,
+						SeqNo:       nextVersion.seqNo,
+						PrimaryTerm: nextVersion.primaryTerm,
+					}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualNote, actualErr = elasticsearchStorage.UpdateNote(ctx, projectId, noteId, update, mask)
+		})
+
+		It("should write the note to the index it was read from, if it hasn't changed since", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			request := transport.receivedHttpRequests[1]
+			Expect(request.Method).To(Equal(http.MethodPut))
+			Expect(request.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", backingNotesIndex, documentId(noteName))))
+			Expect(request.URL.Query().Get("if_seq_no")).To(Equal(strconv.Itoa(currentVersion.seqNo)))
+			Expect(request.URL.Query().Get("if_primary_term")).To(Equal(strconv.Itoa(currentVersion.primaryTerm)))
+		})
+
+		It("should only update the fields in the mask", func() {
+			Expect(actualNote.Name).To(Equal(noteName))
+			Expect(actualNote.ShortDescription).To(Equal(update.ShortDescription))
+			Expect(actualNote.LongDescription).To(Equal(existingNote.LongDescription))
+			Expect(actualNote.UpdateTime).ToNot(BeNil())
+
+			written := &pb.Note{}
+			Expect(protojson.Unmarshal(ioReadCloserToByteSlice(transport.receivedHttpRequests[1].Body), proto.MessageV2(written))).To(Succeed())
+			Expect(written.ShortDescription).To(Equal(update.ShortDescription))
+			Expect(written.LongDescription).To(Equal(existingNote.LongDescription))
+		})
+
+		It("should return the etag of the new version", func() {
+			Expect(stream.header.Get(etagMetadataKey)).To(ConsistOf(nextVersion.etag()))
+		})
+
+		When("the mask is empty", func() {
+			BeforeEach(func() {
+				mask = nil
+			})
+
+			It("should replace every field except for the name and creation time", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(actualNote.Name).To(Equal(noteName))
+				Expect(actualNote.CreateTime.AsTime()).To(Equal(existingNote.CreateTime.AsTime()))
+				Expect(actualNote.LongDescription).To(Equal(update.LongDescription))
+			})
+		})
+
+		When("the mask contains an unknown field", func() {
+			BeforeEach(func() {
+				mask.Paths = []string{fake.LetterN(10)}
+			})
+
+			It("should return an error without writing the note", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the mask contains the name", func() {
+			BeforeEach(func() {
+				mask.Paths = []string{"name"}
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.InvalidArgument)
+			})
+		})
+
+		When("the client sends the etag of the current version", func() {
+			BeforeEach(func() {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ifMatchMetadataKey, currentVersion.etag()))
+			})
+
+			It("should update the note", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(2))
+			})
+		})
+
+		When("the client sends a stale etag", func() {
+			BeforeEach(func() {
+				staleVersion := &documentVersion{seqNo: currentVersion.seqNo - 1, primaryTerm: currentVersion.primaryTerm}
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ifMatchMetadataKey, staleVersion.etag()))
+			})
+
+			It("should reject the update without writing the note", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the note is modified before it's written", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1] = &http.Response{
+					StatusCode: http.StatusConflict,
+					Body: structToJsonBody(&esErrorResponse{
+						Error:  &esIndexDocError{Type: "version_conflict_engine_exception", Reason: fake.LetterN(10)},
+						Status: http.StatusConflict,
+					}),
+				}
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+			})
+		})
+
+		When("the note doesn't exist", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[0] = &http.Response{StatusCode: http.StatusNotFound}
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.NotFound)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+	})
+
+	Context("updating an occurrence", func() {
+		var (
+			occurrenceName   string
+			occurrenceId     string
+			actualOccurrence *pb.Occurrence
+			actualErr        error
+			update           *pb.Occurrence
+		)
+
+		BeforeEach(func() {
+			occurrenceId = fake.LetterN(10)
+			occurrenceName = fmt.Sprintf("projects/%s/occurrences/%s", projectId, occurrenceId)
+			existingOccurrence := generateTestOccurrence(occurrenceName)
+			update = &pb.Occurrence{Remediation: fake.Phrase()}
+			currentVersion.index = backingIndex(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId))
+
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsBackingIndicesResponse(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId), 1),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(existingOccurrence, currentVersion),
+				},
+				{
+					StatusCode: http.StatusOK,
+					Body:       structToJsonBody(&esIndexDocResponse{Id: documentId(occurrenceName)}),
+				},
+			}
+		})
+
+		JustBeforeEach(func() {
+			actualOccurrence, actualErr = elasticsearchStorage.UpdateOccurrence(ctx, projectId, occurrenceId, update, &fieldmaskpb.FieldMask{Paths: []string{"remediation"}})
+		})
+
+		It("should read the occurrence by its ID, so that an occurrence is found as soon as it's created", func() {
+			Expect(transport.receivedHttpRequests[1].Method).To(Equal(http.MethodGet))
+			Expect(transport.receivedHttpRequests[1].URL.Path).To(HaveSuffix(fmt.Sprintf("/_doc/%s", documentId(occurrenceName))))
+		})
+
+		It("should update the occurrence in the backing index it was found in", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(actualOccurrence.Name).To(Equal(occurrenceName))
+			Expect(actualOccurrence.Remediation).To(Equal(update.Remediation))
+			Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", currentVersion.index, documentId(occurrenceName))))
+		})
+
+		When("the occurrence is in an older backing index after rollover was disabled", func() {
+			BeforeEach(func() {
+				currentVersion.index = nextRolloverIndex(backingIndex(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId)))
+				transport.preparedHttpResponses[0].Body = createEsBackingIndicesResponse(fmt.Sprintf("%s-%s-occurrences", indexPrefix, projectId), 3)
+				transport.preparedHttpResponses[1].Body = createEsVersionedSearchResponse(generateTestOccurrence(occurrenceName), currentVersion)
+			})
+
+			It("should find and update the occurrence", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests[1].URL.Path).To(HaveSuffix("/_search"))
+				Expect(transport.receivedHttpRequests[2].URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", currentVersion.index, documentId(occurrenceName))))
+			})
+		})
+	})
+
+	Context("deleting a note", func() {
+		var actualErr error
+
+		BeforeEach(func() {
+			transport.preparedHttpResponses = []*http.Response{
+				{
+					StatusCode: http.StatusOK,
+					Body:       createEsVersionedGetResponse(existingNote, currentVersion),
+				},
+				{
+					StatusCode: http.StatusOK,
+				},
+			}
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ifMatchMetadataKey, currentVersion.etag()))
+		})
+
+		JustBeforeEach(func() {
+			actualErr = elasticsearchStorage.DeleteNote(ctx, projectId, noteId)
+		})
+
+		It("should only delete the note if it hasn't changed since it was read", func() {
+			Expect(actualErr).ToNot(HaveOccurred())
+			Expect(transport.receivedHttpRequests).To(HaveLen(2))
+
+			request := transport.receivedHttpRequests[1]
+			Expect(request.Method).To(Equal(http.MethodDelete))
+			Expect(request.URL.Path).To(Equal(fmt.Sprintf("/%s/_doc/%s", backingNotesIndex, documentId(noteName))))
+			Expect(request.URL.Query().Get("if_seq_no")).To(Equal(strconv.Itoa(currentVersion.seqNo)))
+			Expect(request.URL.Query().Get("if_primary_term")).To(Equal(strconv.Itoa(currentVersion.primaryTerm)))
+		})
+
+		When("the client sends a stale etag", func() {
+			BeforeEach(func() {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ifMatchMetadataKey, fake.LetterN(10)))
+			})
+
+			It("should reject the delete", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+			})
+		})
+
+		When("the note is modified before it's deleted", func() {
+			BeforeEach(func() {
+				transport.preparedHttpResponses[1].StatusCode = http.StatusConflict
+			})
+
+			It("should return an error", func() {
+				assertErrorHasGrpcStatusCode(actualErr, codes.Aborted)
+			})
+		})
+
+		When("the client doesn't send an etag", func() {
+			BeforeEach(func() {
+				ctx = context.Background()
+				transport.preparedHttpResponses = transport.preparedHttpResponses[1:]
+			})
+
+			It("should delete the note without reading it first", func() {
+				Expect(actualErr).ToNot(HaveOccurred())
+				Expect(transport.receivedHttpRequests).To(HaveLen(1))
+				Expect(transport.receivedHttpRequests[0].URL.Query().Get("if_seq_no")).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("applying a field mask", func() {
+		var dst, src *pb.Note
+
+		BeforeEach(func() {
+			dst = generateTestNote(noteName)
+			dst.Type = &pb.Note_Vulnerability{
+				Vulnerability: &vulnerability_go_proto.Vulnerability{
+					CvssScore: 5,
+					Severity:  vulnerability_go_proto.Severity_HIGH,
+				},
+			}
+			src = &pb.Note{
+				Type: &pb.Note_Vulnerability{
+					Vulnerability: &vulnerability_go_proto.Vulnerability{
+						Severity: vulnerability_go_proto.Severity_LOW,
+					},
+				},
+			}
+		})
+
+		It("should update nested fields", func() {
+			Expect(applyFieldMask(dst, src, &fieldmaskpb.FieldMask{Paths: []string{"vulnerability.severity"}})).To(Succeed())
+
+			Expect(dst.GetVulnerability().Severity).To(Equal(vulnerability_go_proto.Severity_LOW))
+			Expect(dst.GetVulnerability().CvssScore).To(BeEquivalentTo(5))
+		})
+
+		It("should accept JSON field names", func() {
+			Expect(applyFieldMask(dst, src, &fieldmaskpb.FieldMask{Paths: []string{"vulnerability.cvssScore"}})).To(Succeed())
+
+			Expect(dst.GetVulnerability().CvssScore).To(BeZero())
+			Expect(dst.GetVulnerability().Severity).To(Equal(vulnerability_go_proto.Severity_HIGH))
+		})
+
+		It("should clear fields that aren't set", func() {
+			Expect(applyFieldMask(dst, src, &fieldmaskpb.FieldMask{Paths: []string{"short_description"}})).To(Succeed())
+
+			Expect(dst.ShortDescription).To(BeEmpty())
+		})
+
+		It("should reject paths through fields that aren't messages", func() {
+			err := applyFieldMask(dst, src, &fieldmaskpb.FieldMask{Paths: []string{"short_description.value"}})
+
+			assertErrorHasGrpcStatusCode(err, codes.InvalidArgument)
+		})
+	})
+})
+
+// fakeServerTransportStream captures the headers set while handling a gRPC request
+type fakeServerTransportStream struct {
+	header metadata.MD
+}
+
+func (s *fakeServerTransportStream) Method() string {
+	return ""
+}
+
+func (s *fakeServerTransportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *fakeServerTransportStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *fakeServerTransportStream) SetTrailer(_ metadata.MD) error {
+	return nil
+}
+
+func createEsVersionedGetResponse(message proto.Message, version *documentVersion) io.ReadCloser {
+	raw, err := protojson.Marshal(proto.MessageV2(message))
+	Expect(err).ToNot(HaveOccurred())
+
+	return structToJsonBody(&esGetResponse{
+		Id:          fake.LetterN(10),
+		Index:       version.index,
+		SeqNo:       version.seqNo,
+		PrimaryTerm: version.primaryTerm,
+		Found:       true,
+		Source:      raw,
+	})
+}
+
+func createEsVersionedSearchResponse(message proto.Message, version *documentVersion) io.ReadCloser {
+	raw, err := protojson.Marshal(proto.MessageV2(message))
+	Expect(err).ToNot(HaveOccurred())
+
+	return structToJsonBody(&esSearchResponse{
+		Hits: &esSearchResponseHits{
+			Total: &esSearchResponseTotal{Value: 1},
+			Hits: []*esSearchResponseHit{
+				{
+					ID:          fake.LetterN(10),
+					Index:       version.index,
+					SeqNo:       version.seqNo,
+					PrimaryTerm: version.primaryTerm,
+					Source:      raw,
+				},
+			},
+		},
+	})
+}